@@ -0,0 +1,313 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminPathPrefix is the path prefix under which the admin API is served
+const adminPathPrefix = "/.totp/admin/"
+
+// isAdminRequest reports whether the request targets the admin API
+func (ta *TOTPAuth) isAdminRequest(req *http.Request) bool {
+	return ta.config.AdminToken != "" && strings.HasPrefix(req.URL.Path, adminPathPrefix)
+}
+
+// handleAdmin authenticates and dispatches admin API requests
+func (ta *TOTPAuth) handleAdmin(rw http.ResponseWriter, req *http.Request) {
+	if !ta.isAdminAuthorized(req) {
+		log.Printf("[%s] Unauthorized admin request to %s from %s", ta.name, req.URL.Path, ta.getClientIP(req))
+		ta.audit(req, auditAdminAction, "unauthorized", req.URL.Path)
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="totp-admin"`)
+		writeJSONError(rw, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, adminPathPrefix)
+	if path == adminSessionDumpPath {
+		ta.handleAdminSessionDump(rw, req)
+		return
+	}
+	if strings.HasPrefix(path, "sessions/") {
+		ta.handleAdminSession(rw, req, strings.TrimPrefix(path, "sessions/"))
+		return
+	}
+
+	switch path {
+	case "sessions":
+		ta.handleAdminSessions(rw, req)
+	case "drift":
+		ta.handleAdminDrift(rw, req)
+	case "status":
+		ta.handleAdminStatus(rw, req)
+	case "config":
+		ta.handleAdminConfig(rw, req)
+	case "lockdown":
+		ta.handleAdminLockdown(rw, req)
+	case "lockouts":
+		ta.handleAdminLockouts(rw, req)
+	case "approvals":
+		ta.handleAdminApprovals(rw, req)
+	default:
+		writeJSONError(rw, http.StatusNotFound, "not found")
+	}
+}
+
+// isAdminAuthorized checks the bearer token against the configured admin token.
+// The session cookie is never accepted for admin access.
+func (ta *TOTPAuth) isAdminAuthorized(req *http.Request) bool {
+	auth := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return false
+	}
+	token := strings.TrimSpace(auth[len(prefix):])
+	return subtle.ConstantTimeCompare([]byte(token), []byte(ta.config.AdminToken)) == 1
+}
+
+// Page sizes of the admin session listing
+const (
+	adminSessionsDefaultLimit = 100
+	adminSessionsMaxLimit     = 1000
+)
+
+// adminSession is a session as listed by the admin API. Sessions are
+// identified by a prefix of their token hash, which can't be used as a cookie.
+type adminSession struct {
+	ID            string     `json:"id"`
+	CreatedAt     time.Time  `json:"createdAt"`
+	ExpiresAt     time.Time  `json:"expiresAt"`
+	IdleExpiresAt *time.Time `json:"idleExpiresAt,omitempty"`
+	IP            string     `json:"ip"`
+	UserAgent     string     `json:"userAgent"`
+	ReadOnly      bool       `json:"readOnly"`
+	Areas         []string   `json:"areas,omitempty"`
+	Method        string     `json:"method,omitempty"`
+}
+
+// handleAdminSessions handles the /.totp/admin/sessions endpoint
+func (ta *TOTPAuth) handleAdminSessions(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		ta.handleAdminListSessions(rw, req)
+	case http.MethodDelete:
+		ta.handleAdminRevokeByIP(rw, req)
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAdminListSessions lists the active sessions, newest first, a page of
+// limit sessions starting at offset at a time
+func (ta *TOTPAuth) handleAdminListSessions(rw http.ResponseWriter, req *http.Request) {
+	if _, canList := ta.sessions.(SessionLister); !canList || ta.statelessSessions() {
+		writeJSONError(rw, http.StatusNotImplemented, "the session store cannot list sessions")
+		return
+	}
+
+	query := req.URL.Query()
+	limit, err := queryInt(query.Get("limit"), adminSessionsDefaultLimit)
+	if err != nil || limit < 1 || limit > adminSessionsMaxLimit {
+		writeJSONError(rw, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", adminSessionsMaxLimit))
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeJSONError(rw, http.StatusBadRequest, "offset must not be negative")
+		return
+	}
+
+	now := ta.clock.Now()
+	var active []*Session
+	for _, session := range ta.listSessions() {
+		if now.Before(session.deadline()) {
+			active = append(active, session)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool {
+		if !active[i].CreatedAt.Equal(active[j].CreatedAt) {
+			return active[i].CreatedAt.After(active[j].CreatedAt)
+		}
+		return active[i].TokenHash < active[j].TokenHash
+	})
+
+	page := []adminSession{}
+	for i := offset; i < len(active) && i < offset+limit; i++ {
+		session := active[i]
+		listed := adminSession{
+			ID:        session.id(),
+			CreatedAt: session.CreatedAt.UTC(),
+			ExpiresAt: session.ExpiresAt.UTC(),
+			IP:        session.IP,
+			UserAgent: session.UserAgent,
+			ReadOnly:  session.ReadOnly,
+			Areas:     session.Areas,
+			Method:    session.Method,
+		}
+		if !session.IdleExpiresAt.IsZero() {
+			idleExpiresAt := session.IdleExpiresAt.UTC()
+			listed.IdleExpiresAt = &idleExpiresAt
+		}
+		page = append(page, listed)
+	}
+
+	response := map[string]interface{}{
+		"sessions": page,
+		"total":    len(active),
+		"offset":   offset,
+		"limit":    limit,
+	}
+	if offset+limit < len(active) {
+		response["nextOffset"] = offset + limit
+	}
+	log.Printf("[%s] Admin listed %d of %d session(s) (admin request from %s)", ta.name, len(page), len(active), ta.getClientIP(req))
+	ta.audit(req, auditAdminAction, "list_sessions", fmt.Sprintf("offset=%d listed=%d total=%d", offset, len(page), len(active)))
+	writeJSON(rw, http.StatusOK, response)
+}
+
+// handleAdminSession handles /.totp/admin/sessions/{id}, where id is the
+// session ID shown in the listing
+func (ta *TOTPAuth) handleAdminSession(rw http.ResponseWriter, req *http.Request, id string) {
+	if req.Method != http.MethodDelete {
+		rw.Header().Set("Allow", http.MethodDelete)
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if _, canList := ta.sessions.(SessionLister); !canList || ta.statelessSessions() {
+		writeJSONError(rw, http.StatusNotImplemented, "the session store cannot list sessions")
+		return
+	}
+	if !validSessionID(id) {
+		writeJSONError(rw, http.StatusBadRequest, "invalid session id")
+		return
+	}
+
+	var revoked []*Session
+	for _, session := range ta.listSessions() {
+		if session.id() == id {
+			ta.sessions.Delete(session.TokenHash)
+			revoked = append(revoked, session)
+		}
+	}
+	if len(revoked) == 0 {
+		writeJSONError(rw, http.StatusNotFound, "session not found")
+		return
+	}
+
+	for _, session := range revoked {
+		log.Printf("[%s] Admin revoked session %s created at %s from %s (admin request from %s)",
+			ta.name, id, session.CreatedAt.UTC().Format(time.RFC3339), session.IP, ta.getClientIP(req))
+	}
+	ta.audit(req, auditAdminAction, "revoke_session", fmt.Sprintf("id=%s ip=%s", id, revoked[0].IP))
+
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"id":      id,
+		"revoked": len(revoked),
+	})
+}
+
+// validSessionID reports whether id looks like a session ID: the first 16
+// hex characters of a token hash
+func validSessionID(id string) bool {
+	if len(id) != 16 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// queryInt parses an integer query parameter, def when it is empty
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// handleAdminRevokeByIP removes every session whose recorded client IP matches
+// the ip query parameter (a single address or a CIDR range)
+func (ta *TOTPAuth) handleAdminRevokeByIP(rw http.ResponseWriter, req *http.Request) {
+	param := strings.TrimSpace(req.URL.Query().Get("ip"))
+	if param == "" {
+		writeJSONError(rw, http.StatusBadRequest, "ip parameter is required")
+		return
+	}
+
+	network, err := parseIPNetwork(param)
+	if err != nil {
+		writeJSONError(rw, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var revoked int
+	_, canList := ta.sessions.(SessionLister)
+	revoker, canRevoke := ta.sessions.(SessionIPRevoker)
+	switch {
+	case ta.statelessSessions() || (!canList && !canRevoke):
+		writeJSONError(rw, http.StatusNotImplemented, "the session store cannot revoke sessions by IP")
+		return
+	case canList:
+		revoked = ta.deleteSessions(func(session *Session) bool {
+			return session.inNetwork(network)
+		})
+	default:
+		revoked, err = revoker.DeleteByIP(network)
+		if err != nil {
+			log.Printf("[%s] Failed to revoke sessions for ip=%s in the session store: %v", ta.name, param, err)
+			writeJSONError(rw, http.StatusBadGateway, "the session store failed to revoke the sessions")
+			return
+		}
+	}
+
+	log.Printf("[%s] Admin revoked %d session(s) for ip=%s (admin request from %s)", ta.name, revoked, param, ta.getClientIP(req))
+	ta.audit(req, auditAdminAction, "revoke_by_ip", fmt.Sprintf("ip=%s revoked=%d", param, revoked))
+
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"ip":      param,
+		"revoked": revoked,
+	})
+}
+
+// parseIPNetwork parses a single IP address or a CIDR range into a network;
+// a single address becomes a /32 or /128
+func parseIPNetwork(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", value)
+		}
+		return network, nil
+	}
+
+	target := net.ParseIP(value)
+	if target == nil {
+		return nil, fmt.Errorf("invalid IP address: %s", value)
+	}
+	if ip4 := target.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: target, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(rw http.ResponseWriter, status int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(v)
+}
+
+// writeJSONError writes a JSON error response
+func writeJSONError(rw http.ResponseWriter, status int, message string) {
+	writeJSON(rw, status, map[string]string{"error": message})
+}
@@ -0,0 +1,89 @@
+package traefik_totp_plugin
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// networkObservation records when a session was first seen from a network
+type networkObservation struct {
+	network string
+	seenAt  time.Time
+}
+
+// sourceNetwork returns the client's network at the configured granularity
+func (ta *TOTPAuth) sourceNetwork(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return clientIP
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(ta.config.IPChangePrefixV4, 32)), Mask: net.CIDRMask(ta.config.IPChangePrefixV4, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(ta.config.IPChangePrefixV6, 128)), Mask: net.CIDRMask(ta.config.IPChangePrefixV6, 128)}).String()
+}
+
+// observeNetwork records the network the session with tokenHash is used
+// from. The store is only written when the network differs from the last one
+// seen. It returns the distinct networks seen within window when the number
+// of changes exceeds maxChanges, or nil otherwise.
+func (s *memorySessionStore) observeNetwork(tokenHash, network string, now time.Time, window time.Duration, maxChanges int) []string {
+	s.mu.RLock()
+	session, exists := s.sessions[tokenHash]
+	unchanged := !exists || len(session.networks) > 0 && session.networks[len(session.networks)-1].network == network
+	s.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists = s.sessions[tokenHash]
+	if !exists {
+		return nil
+	}
+
+	// Keep a small ring: enough entries to detect maxChanges+1 changes
+	session.networks = append(session.networks, networkObservation{network: network, seenAt: now})
+	if limit := maxChanges + 2; len(session.networks) > limit {
+		session.networks = append([]networkObservation(nil), session.networks[len(session.networks)-limit:]...)
+	}
+
+	var recent []string
+	for _, observation := range session.networks {
+		if now.Sub(observation.seenAt) <= window {
+			recent = append(recent, observation.network)
+		}
+	}
+
+	// The first network in the window is where the session was; each
+	// further entry is a change
+	if len(recent)-1 > maxChanges {
+		return recent
+	}
+	return nil
+}
+
+// isAnomalousNetworkChange tracks the session's source networks and reports
+// whether it changed networks too often and must be invalidated
+func (ta *TOTPAuth) isAnomalousNetworkChange(req *http.Request, session *Session) bool {
+	if ta.config.MaxIPChanges <= 0 {
+		return false
+	}
+
+	clientIP := ta.getClientIP(req)
+	window := time.Duration(ta.config.IPChangeWindow) * time.Second
+	networks := ta.memorySessions().observeNetwork(session.TokenHash, ta.sourceNetwork(clientIP), ta.clock.Now(), window, ta.config.MaxIPChanges)
+	if networks == nil {
+		return false
+	}
+
+	log.Printf("[%s] Session %s invalidated after %d network changes within %s: %s (last from %s)",
+		ta.name, session.id(), len(networks)-1, window, strings.Join(networks, ", "), clientIP)
+	ta.audit(req, auditSessionRevoked, "ip_changes", strings.Join(networks, ","))
+	return true
+}
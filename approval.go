@@ -0,0 +1,635 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// approvePath is the link sent to the approver
+	approvePath = "/.totp/approve"
+	// approvalPollPath is polled by the browser waiting for approval
+	approvalPollPath = "/.totp/approval"
+
+	// approvalMaxPerIP limits pending approvals per client IP. There is no
+	// limit overall: one client could otherwise use it up and keep every
+	// other device from being approved. Each approval needs a valid code
+	// and expires after approvalTimeout, which bounds how many can pile up.
+	approvalMaxPerIP = 3
+
+	// deviceCookieMaxAge is how long an approved device is remembered
+	deviceCookieMaxAge = 365 * 24 * 60 * 60
+
+	// webhookApprovalRequested is sent when a login waits for approval
+	webhookApprovalRequested = "approval_requested"
+)
+
+// Approval states
+const (
+	approvalPending  = "pending"
+	approvalApproved = "approved"
+	approvalDenied   = "denied"
+	approvalExpired  = "expired"
+)
+
+// approval is a verified login from an unknown device waiting for an
+// out-of-band decision
+type approval struct {
+	ref       string // Shown in the admin API and the webhook
+	approveID string // Carried in the approval link
+	browserID string // Known only to the waiting browser, carried in its cookie
+	ip        string
+	userAgent string
+	readOnly  bool
+	areas     []string
+	reason    string // Audit reason of the code check that started the login
+	method    string // Validator that accepted the code
+	createdAt time.Time
+	expiresAt time.Time
+	state     string
+}
+
+// approvalInfo is the admin API view of a pending approval
+type approvalInfo struct {
+	Ref       string    `json:"ref"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	ReadOnly  bool      `json:"readOnly,omitempty"`
+	Status    string    `json:"status"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// approvalStore keeps logins waiting for approval
+type approvalStore struct {
+	mu        sync.Mutex
+	byBrowser map[string]*approval
+	byApprove map[string]*approval
+}
+
+// newApprovalStore creates an empty approval store
+func newApprovalStore() *approvalStore {
+	return &approvalStore{
+		byBrowser: make(map[string]*approval),
+		byApprove: make(map[string]*approval),
+	}
+}
+
+// randomHex returns n random bytes, hex encoded
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// create adds a pending approval. It returns nil when ip has too many
+// pending approvals.
+func (s *approvalStore) create(a *approval, ttl time.Duration, now time.Time) (*approval, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := 0
+	for _, existing := range s.byBrowser {
+		if existing.ip == a.ip && existing.state == approvalPending && now.Before(existing.expiresAt) {
+			pending++
+		}
+	}
+	if pending >= approvalMaxPerIP {
+		return nil, nil
+	}
+
+	var err error
+	if a.ref, err = randomHex(6); err != nil {
+		return nil, err
+	}
+	if a.approveID, err = randomHex(32); err != nil {
+		return nil, err
+	}
+	if a.browserID, err = randomHex(32); err != nil {
+		return nil, err
+	}
+	a.createdAt = now
+	a.expiresAt = now.Add(ttl)
+	a.state = approvalPending
+
+	s.byBrowser[a.browserID] = a
+	s.byApprove[a.approveID] = a
+	return a, nil
+}
+
+// status returns the state of the approval identified by the browser secret
+func (s *approvalStore) status(browserID string, now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.byBrowser[browserID]
+	if a == nil || now.After(a.expiresAt) {
+		return approvalExpired
+	}
+	return a.state
+}
+
+// forApproval returns a copy of the unexpired approval for an approval link
+func (s *approvalStore) forApproval(approveID string, now time.Time) (approval, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.byApprove[approveID]
+	if a == nil || now.After(a.expiresAt) {
+		return approval{}, false
+	}
+	return *a, true
+}
+
+// decide approves or denies a pending approval. It returns false when there
+// is no such unexpired, undecided approval.
+func (s *approvalStore) decide(approveID string, approved bool, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.byApprove[approveID]
+	if a == nil || a.state != approvalPending || now.After(a.expiresAt) {
+		return false
+	}
+	a.state = approvalDenied
+	if approved {
+		a.state = approvalApproved
+	}
+	return true
+}
+
+// cancel denies the pending approval with ref
+func (s *approvalStore) cancel(ref string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.byBrowser {
+		if a.ref == ref && a.state == approvalPending && now.Before(a.expiresAt) {
+			a.state = approvalDenied
+			return true
+		}
+	}
+	return false
+}
+
+// claim removes an approved approval so that it grants exactly one session
+func (s *approvalStore) claim(browserID string, now time.Time) (approval, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a := s.byBrowser[browserID]
+	if a == nil || a.state != approvalApproved || now.After(a.expiresAt) {
+		return approval{}, false
+	}
+	delete(s.byBrowser, a.browserID)
+	delete(s.byApprove, a.approveID)
+	return *a, true
+}
+
+// list returns the unexpired approvals, oldest first
+func (s *approvalStore) list(now time.Time) []approvalInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infos := make([]approvalInfo, 0, len(s.byBrowser))
+	for _, a := range s.byBrowser {
+		if now.After(a.expiresAt) {
+			continue
+		}
+		infos = append(infos, approvalInfo{
+			Ref:       a.ref,
+			IP:        a.ip,
+			UserAgent: a.userAgent,
+			ReadOnly:  a.readOnly,
+			Status:    a.state,
+			CreatedAt: a.createdAt,
+			ExpiresAt: a.expiresAt,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+	return infos
+}
+
+// cleanup removes expired approvals
+func (s *approvalStore) cleanup(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for browserID, a := range s.byBrowser {
+		if now.After(a.expiresAt) {
+			delete(s.byBrowser, browserID)
+			delete(s.byApprove, a.approveID)
+		}
+	}
+}
+
+// approvalCookieName is the cookie holding the waiting browser's secret
+func (ta *TOTPAuth) approvalCookieName() string {
+	return ta.config.CookieName + "_approval"
+}
+
+// deviceCookieName is the cookie marking a browser as an approved device
+func (ta *TOTPAuth) deviceCookieName() string {
+	return ta.config.CookieName + "_device"
+}
+
+// signDevice signs a device ID with a key derived from formKey for this
+// purpose alone, so the TOTP secret is never used for anything but codes and
+// rotating it keeps approved devices
+func (ta *TOTPAuth) signDevice(deviceID string) string {
+	mac := hmac.New(sha256.New, deriveSigningKey(ta.formKey, "device:"))
+	mac.Write([]byte(deviceID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isKnownDevice reports whether the request carries a valid device cookie
+func (ta *TOTPAuth) isKnownDevice(req *http.Request) bool {
+	cookie, err := req.Cookie(ta.deviceCookieName())
+	if err != nil {
+		return false
+	}
+	idx := strings.LastIndex(cookie.Value, ".")
+	if idx == -1 {
+		return false
+	}
+	expected := ta.signDevice(cookie.Value[:idx])
+	return hmac.Equal([]byte(expected), []byte(cookie.Value[idx+1:]))
+}
+
+// rememberDevice sets the cookie that lets this browser skip the approval gate
+func (ta *TOTPAuth) rememberDevice(rw http.ResponseWriter) error {
+	deviceID, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	cookie := ta.sessionCookie(deviceID+"."+ta.signDevice(deviceID), deviceCookieMaxAge)
+	cookie.Name = ta.deviceCookieName()
+	http.SetCookie(rw, cookie)
+	return nil
+}
+
+// requestApproval holds a verified login from an unknown device, notifies the
+// webhook with an approval link and shows the waiting page
+func (ta *TOTPAuth) requestApproval(rw http.ResponseWriter, req *http.Request, result validationResult, areas []string) {
+	clientIP := ta.getClientIP(req)
+	now := ta.clock.Now()
+
+	// A browser that is already waiting keeps its approval
+	if cookie, err := req.Cookie(ta.approvalCookieName()); err == nil && ta.approvals.status(cookie.Value, now) == approvalPending {
+		ta.showApprovalWait(rw, req)
+		return
+	}
+
+	timeout := time.Duration(ta.config.ApprovalTimeout) * time.Second
+	a, err := ta.approvals.create(&approval{
+		ip:        clientIP,
+		userAgent: truncate(req.UserAgent(), 256),
+		readOnly:  result.ReadOnly,
+		areas:     areas,
+		reason:    result.Reason,
+		method:    result.Method,
+	}, timeout, now)
+	if err != nil {
+		log.Printf("[%s] Failed to create approval: %v", ta.name, err)
+		ta.showTOTPPage(rw, req, "Authentication failed. Please try again.")
+		return
+	}
+	if a == nil {
+		log.Printf("[%s] Too many pending approvals, rejecting login from %s", ta.name, clientIP)
+		ta.showTOTPPage(rw, req, "Too many sign-ins are waiting for approval. Please try again later.")
+		return
+	}
+
+	cookie := ta.sessionCookie(a.browserID, ta.config.ApprovalTimeout)
+	cookie.Name = ta.approvalCookieName()
+	http.SetCookie(rw, cookie)
+
+	approveURL := ta.requestScheme(req) + "://" + ta.requestHost(req) + approvePath + "?token=" + ta.signFormValue("approve", a.approveID)
+	ta.notifyWebhook(webhookApprovalRequested, map[string]interface{}{
+		"ref":        a.ref,
+		"approveURL": approveURL,
+		"ip":         a.ip,
+		"userAgent":  a.userAgent,
+		"readOnly":   a.readOnly,
+		"expiresAt":  a.expiresAt.UTC(),
+	})
+
+	log.Printf("[%s] Login from unknown device at %s is waiting for approval (ref=%s)", ta.name, clientIP, a.ref)
+	ta.audit(req, auditAccessDenied, "approval_required", "ref="+a.ref)
+	ta.showApprovalWait(rw, req)
+}
+
+// handleApprovalPoll answers the waiting browser's polling requests and
+// grants it a session once the login has been approved
+func (ta *TOTPAuth) handleApprovalPoll(rw http.ResponseWriter, req *http.Request) {
+	cookie, err := req.Cookie(ta.approvalCookieName())
+	if err != nil {
+		writeJSON(rw, http.StatusOK, map[string]string{"status": approvalExpired})
+		return
+	}
+
+	now := ta.clock.Now()
+	a, ok := ta.approvals.claim(cookie.Value, now)
+	if !ok {
+		status := ta.approvals.status(cookie.Value, now)
+		if status != approvalPending {
+			http.SetCookie(rw, ta.expiredCookie(ta.approvalCookieName()))
+		}
+		writeJSON(rw, http.StatusOK, map[string]string{"status": status})
+		return
+	}
+
+	ta.discardIncomingSessions(rw, req)
+	sessionToken, err := ta.createScopedSession(req, a.readOnly, a.areas, a.method)
+	if err != nil {
+		log.Printf("[%s] Failed to create session: %v", ta.name, err)
+		writeJSONError(rw, http.StatusInternalServerError, "failed to create session")
+		return
+	}
+	http.SetCookie(rw, ta.sessionCookie(sessionToken, ta.sessionCookieMaxAge()))
+	http.SetCookie(rw, ta.expiredCookie(ta.approvalCookieName()))
+	if err := ta.rememberDevice(rw); err != nil {
+		log.Printf("[%s] Failed to remember approved device: %v", ta.name, err)
+	}
+	ta.markVerified(rw, req)
+
+	log.Printf("[%s] Successful TOTP authentication from %s after approval (ref=%s)", ta.name, ta.getClientIP(req), a.ref)
+	ta.incrMetric(metricAuthSuccess)
+	ta.audit(req, auditAuthSuccess, "approved_login", "ref="+a.ref+" code="+a.reason)
+	if a.reason == "valid_code" {
+		ta.enrollment.confirm(now)
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]string{"status": approvalApproved})
+}
+
+// handleApprove shows the approval link's page and records the decision. The
+// decision is only taken on POST so that link previews cannot approve logins.
+func (ta *TOTPAuth) handleApprove(rw http.ResponseWriter, req *http.Request) {
+	if req.Method == http.MethodPost {
+		if err := req.ParseForm(); err != nil {
+			ta.showMessagePage(rw, http.StatusBadRequest, "Invalid Request", "The request could not be read.")
+			return
+		}
+	}
+
+	approveID, ok := ta.verifyFormValue("approve", req.FormValue("token"))
+	now := ta.clock.Now()
+	a, found := ta.approvals.forApproval(approveID, now)
+	if !ok || !found {
+		ta.showMessagePage(rw, http.StatusNotFound, "Link Expired", "This sign-in request does not exist or has expired.")
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		ta.showApprovePage(rw, req.FormValue("token"), a)
+		return
+	}
+
+	approved := req.PostFormValue("decision") == "approve"
+	if !ta.approvals.decide(approveID, approved, now) {
+		ta.showMessagePage(rw, http.StatusConflict, "Already Decided", "This sign-in request has already been approved or denied.")
+		return
+	}
+
+	if approved {
+		log.Printf("[%s] Login from %s approved (ref=%s, approver %s)", ta.name, a.ip, a.ref, ta.getClientIP(req))
+		ta.audit(req, auditAuthSuccess, "approval_granted", "ref="+a.ref+" ip="+a.ip)
+		ta.showMessagePage(rw, http.StatusOK, "Sign-In Approved", "The waiting browser will be signed in within a few seconds.")
+		return
+	}
+
+	log.Printf("[%s] Login from %s denied (ref=%s, approver %s)", ta.name, a.ip, a.ref, ta.getClientIP(req))
+	ta.audit(req, auditAuthFailure, "approval_denied", "ref="+a.ref+" ip="+a.ip)
+	ta.showMessagePage(rw, http.StatusOK, "Sign-In Denied", "The sign-in request has been denied.")
+}
+
+// handleAdminApprovals handles the /.totp/admin/approvals endpoint
+func (ta *TOTPAuth) handleAdminApprovals(rw http.ResponseWriter, req *http.Request) {
+	if ta.approvals == nil {
+		writeJSONError(rw, http.StatusNotFound, "approvals are not enabled")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, map[string]interface{}{
+			"approvals": ta.approvals.list(ta.clock.Now()),
+		})
+	case http.MethodDelete:
+		ref := strings.TrimSpace(req.URL.Query().Get("ref"))
+		if ref == "" {
+			writeJSONError(rw, http.StatusBadRequest, "ref parameter is required")
+			return
+		}
+		if !ta.approvals.cancel(ref, ta.clock.Now()) {
+			writeJSONError(rw, http.StatusNotFound, "no pending approval with this ref")
+			return
+		}
+		log.Printf("[%s] Admin cancelled approval %s (admin request from %s)", ta.name, ref, ta.getClientIP(req))
+		ta.audit(req, auditAdminAction, "cancel_approval", fmt.Sprintf("ref=%s", ref))
+		writeJSON(rw, http.StatusOK, map[string]interface{}{
+			"ref":       ref,
+			"cancelled": true,
+		})
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// showApprovalWait renders the page a browser sees while its login waits
+func (ta *TOTPAuth) showApprovalWait(rw http.ResponseWriter, req *http.Request) {
+	data := map[string]interface{}{
+		"Title":   "Waiting for Approval",
+		"PollURL": approvalPollPath,
+		"Next":    req.URL.String(),
+	}
+	if ta.isEmbedded(req) {
+		ta.setEmbedHeaders(rw)
+		data["TargetOrigin"] = ta.embedTargetOrigin()
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	ta.renderPage(rw, http.StatusAccepted, ta.pages.approvalWait, data)
+}
+
+// showApprovePage renders the approver's page for a pending login
+func (ta *TOTPAuth) showApprovePage(rw http.ResponseWriter, token string, a approval) {
+	scope := "full access"
+	if a.readOnly {
+		scope = "read-only access"
+	}
+	data := map[string]interface{}{
+		"Title":     "Approve Sign-In?",
+		"Action":    approvePath,
+		"Token":     token,
+		"IP":        a.ip,
+		"UserAgent": a.userAgent,
+		"Scope":     scope,
+		"Requested": a.createdAt.UTC().Format("2006-01-02 15:04:05 MST"),
+		"Ref":       a.ref,
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Referrer-Policy", "no-referrer")
+	ta.renderPage(rw, http.StatusOK, ta.pages.approve, data)
+}
+
+// approvalPageStyle is shared by the approval pages
+const approvalPageStyle = `
+        * {
+            margin: 0;
+            padding: 0;
+            box-sizing: border-box;
+        }
+
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            padding: 20px;
+        }
+
+        .container {
+            background: white;
+            border-radius: 16px;
+            box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
+            max-width: 420px;
+            width: 100%;
+            padding: 40px;
+            text-align: center;
+        }
+
+        h1 {
+            color: #2d3748;
+            font-size: 24px;
+            font-weight: 700;
+            margin-bottom: 12px;
+        }
+
+        p {
+            color: #718096;
+            font-size: 15px;
+            line-height: 1.6;
+        }
+
+        dl {
+            text-align: left;
+            margin: 24px 0;
+            font-size: 14px;
+        }
+
+        dt {
+            color: #4a5568;
+            font-weight: 600;
+        }
+
+        dd {
+            color: #718096;
+            margin-bottom: 10px;
+            word-break: break-word;
+        }
+
+        button {
+            width: 100%;
+            padding: 14px 24px;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            color: white;
+            border: none;
+            border-radius: 8px;
+            font-size: 16px;
+            font-weight: 600;
+            cursor: pointer;
+            margin-top: 10px;
+        }
+
+        button.deny {
+            background: #e53e3e;
+        }
+`
+
+// HTML template for the page shown while a login waits for approval
+const approvalWaitTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Title}}</title>
+    <style>` + approvalPageStyle + `    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Title}}</h1>
+        <p id="status">Your code was accepted. This device has not been used before, so the sign-in has to be approved. This page continues automatically once it is.</p>
+    </div>
+    <script>
+        (function() {
+            var status = document.getElementById('status');
+            var poll = function() {
+                fetch('{{.PollURL}}', {credentials: 'same-origin', cache: 'no-store'})
+                    .then(function(response) { return response.json(); })
+                    .then(function(result) {
+                        if (result.status === 'approved') {
+                            {{if .TargetOrigin}}window.parent.postMessage({totp: 'success'}, {{.TargetOrigin}});{{else}}window.location.replace({{.Next}});{{end}}
+                        } else if (result.status === 'denied') {
+                            status.textContent = 'The sign-in was denied.';
+                        } else if (result.status === 'expired') {
+                            status.textContent = 'The approval request has expired. Please reload the page to sign in again.';
+                        } else {
+                            setTimeout(poll, 2000);
+                        }
+                    })
+                    .catch(function() { setTimeout(poll, 5000); });
+            };
+            setTimeout(poll, 2000);
+        })();
+    </script>
+</body>
+</html>`
+
+// HTML template for the approver's page
+const approvePageTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Title}}</title>
+    <style>` + approvalPageStyle + `    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Title}}</h1>
+        <p>A valid code was entered on a device that has not been used before.</p>
+        <dl>
+            <dt>IP address</dt>
+            <dd>{{.IP}}</dd>
+            <dt>Browser</dt>
+            <dd>{{if .UserAgent}}{{.UserAgent}}{{else}}unknown{{end}}</dd>
+            <dt>Access</dt>
+            <dd>{{.Scope}}</dd>
+            <dt>Requested</dt>
+            <dd>{{.Requested}} (ref {{.Ref}})</dd>
+        </dl>
+        <form method="POST" action="{{.Action}}">
+            <input type="hidden" name="token" value="{{.Token}}">
+            <button type="submit" name="decision" value="approve">Approve</button>
+            <button type="submit" name="decision" value="deny" class="deny">Deny</button>
+        </form>
+    </div>
+</body>
+</html>`
@@ -0,0 +1,68 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestDeviceCookieSurvivesRotation checks that approved-device cookies are
+// not signed with the TOTP secret, so rotating it keeps them valid
+func TestDeviceCookieSurvivesRotation(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.SecretFile = filepath.Join(t.TempDir(), "secret.json")
+		config.SecretRotationDays = 30
+	})
+
+	rec := httptest.NewRecorder()
+	if err := ta.rememberDevice(rec); err != nil {
+		t.Fatal(err)
+	}
+	device := responseCookie(rec, ta.deviceCookieName())
+	if device == nil {
+		t.Fatal("no device cookie set")
+	}
+
+	ta.rotateSecretIfDue(ta.clock.Now().Add(31 * 24 * time.Hour))
+	if ta.currentSecret() == testSecret {
+		t.Fatal("secret not rotated")
+	}
+	req := newTestRequest("GET", "/app")
+	req.AddCookie(device)
+	if !ta.isKnownDevice(req) {
+		t.Error("device cookie rejected after a secret rotation")
+	}
+
+	other := newTestAuth(t, nil)
+	if other.isKnownDevice(req) {
+		t.Error("device cookie accepted by an instance with another form key")
+	}
+}
+
+// TestApprovalLimitPerIP checks that pending approvals are limited per client
+// IP only, so other clients can still ask for approval
+func TestApprovalLimitPerIP(t *testing.T) {
+	store := newApprovalStore()
+	now := time.Date(2026, 9, 10, 11, 12, 13, 0, time.UTC)
+
+	for i := 0; i < approvalMaxPerIP; i++ {
+		a, err := store.create(&approval{ip: "192.0.2.1"}, time.Minute, now)
+		if err != nil || a == nil {
+			t.Fatalf("approval %d refused: %v", i, err)
+		}
+	}
+	if a, _ := store.create(&approval{ip: "192.0.2.1"}, time.Minute, now); a != nil {
+		t.Error("approval over the per-IP limit accepted")
+	}
+	for i := 0; i < 50; i++ {
+		ip := fmt.Sprintf("198.51.100.%d", i)
+		if a, err := store.create(&approval{ip: ip}, time.Minute, now); err != nil || a == nil {
+			t.Fatalf("approval from %s refused: %v", ip, err)
+		}
+	}
+	if a, _ := store.create(&approval{ip: "192.0.2.1"}, time.Minute, now.Add(2*time.Minute)); a == nil {
+		t.Error("approval refused after the pending ones expired")
+	}
+}
@@ -0,0 +1,64 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validatePathSecrets checks the per-prefix secrets
+func validatePathSecrets(config *Config) error {
+	for prefix, secret := range config.PathSecrets {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("pathSecrets prefix must start with /: %s", prefix)
+		}
+		if secret == "" {
+			return fmt.Errorf("pathSecrets secret for %s is empty", prefix)
+		}
+		if _, err := decodeSecret(secret); err != nil {
+			return fmt.Errorf("invalid pathSecrets secret for %s (must be base32 encoded): %w", prefix, err)
+		}
+	}
+	return nil
+}
+
+// validateAdditionalSecrets checks additionalSecretKeys. A secret shared
+// with readOnlySecretKey would turn read-only codes into full logins.
+func validateAdditionalSecrets(config *Config) error {
+	for i, secret := range config.AdditionalSecretKeys {
+		if _, err := decodeSecret(secret); err != nil || secret == "" {
+			return fmt.Errorf("invalid additionalSecretKeys[%d] (must be base32 encoded)", i)
+		}
+		if config.ReadOnlySecretKey != "" && strings.EqualFold(secret, config.ReadOnlySecretKey) {
+			return fmt.Errorf("additionalSecretKeys[%d] must differ from readOnlySecretKey", i)
+		}
+	}
+	return nil
+}
+
+// areaFor returns the longest pathSecrets prefix covering path together with
+// its secret. Paths outside every prefix belong to the default area ("") and
+// use secretKey. Prefixes match whole path segments, so "/app" covers
+// "/app/x" but not "/application".
+func (ta *TOTPAuth) areaFor(path string) (string, string) {
+	area, secret := "", ta.currentSecret()
+	for prefix, prefixSecret := range ta.config.PathSecrets {
+		trimmed := strings.TrimSuffix(prefix, "/")
+		if path != trimmed && !strings.HasPrefix(path, trimmed+"/") {
+			continue
+		}
+		if len(prefix) > len(area) {
+			area, secret = prefix, prefixSecret
+		}
+	}
+	return area, secret
+}
+
+// coversArea reports whether the session has been unlocked for area
+func (s *Session) coversArea(area string) bool {
+	for _, unlocked := range s.Areas {
+		if unlocked == area {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,84 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// assertionHeaderSegment is the fixed JOSE header of application assertions
+var assertionHeaderSegment = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// assertionOptionalClaims are the claims that can be selected with
+// assertionClaims; iat and exp are always included
+var assertionOptionalClaims = map[string]bool{
+	"sub":   true,
+	"scope": true,
+	"sid":   true,
+	"ip":    true,
+	"iss":   true,
+}
+
+// validateAssertionConfig checks the application assertion settings
+func validateAssertionConfig(config *Config) error {
+	if config.AssertionHeader == "" {
+		return nil
+	}
+	if len(config.AssertionSigningKey) < 32 {
+		return fmt.Errorf("assertionSigningKey must be at least 32 characters when assertionHeader is set")
+	}
+	for _, claim := range config.AssertionClaims {
+		if !assertionOptionalClaims[claim] {
+			return fmt.Errorf("unsupported assertion claim %q (supported: sub, scope, sid, ip, iss)", claim)
+		}
+	}
+	return nil
+}
+
+// setAppAssertion attaches a freshly signed HS256 JWT for the backend's own
+// session system. It is minted per request so its expiry is always recent.
+func (ta *TOTPAuth) setAppAssertion(req *http.Request, subject, scope, sid string) {
+	if ta.config.AssertionHeader == "" {
+		return
+	}
+
+	now := ta.clock.Now()
+	claims := map[string]interface{}{
+		"iat": now.Unix(),
+		"exp": now.Add(time.Duration(ta.config.AssertionTTL) * time.Second).Unix(),
+	}
+	for _, claim := range ta.config.AssertionClaims {
+		var value string
+		switch claim {
+		case "sub":
+			value = subject
+		case "scope":
+			value = scope
+		case "sid":
+			value = sid
+		case "ip":
+			value = ta.getClientIP(req)
+		case "iss":
+			value = ta.config.Issuer
+		}
+		if value != "" {
+			claims[claim] = value
+		}
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		log.Printf("[%s] Failed to encode application assertion: %v", ta.name, err)
+		return
+	}
+
+	signingInput := assertionHeaderSegment + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(ta.config.AssertionSigningKey))
+	mac.Write([]byte(signingInput))
+	req.Header.Set(ta.config.AssertionHeader, signingInput+"."+base64.RawURLEncoding.EncodeToString(mac.Sum(nil)))
+}
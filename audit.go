@@ -0,0 +1,261 @@
+package traefik_totp_plugin
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit event names
+const (
+	auditAuthSuccess    = "auth_success"
+	auditAuthFailure    = "auth_failure"
+	auditAccessDenied   = "access_denied"
+	auditSessionRevoked = "session_revoked"
+	auditAdminAction    = "admin_action"
+)
+
+// auditIPMode values
+const (
+	auditIPFull      = "full"
+	auditIPTruncated = "truncated"
+	auditIPHashed    = "hashed"
+)
+
+// auditAdminUser is the user admin actions are recorded for, since the admin
+// API authenticates with adminToken rather than a session
+const auditAdminUser = "admin"
+
+// auditEvent is a single line in the audit file
+type auditEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Event     string    `json:"event"`
+	User      string    `json:"user,omitempty"`
+	Area      string    `json:"area,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Reason    string    `json:"reason"`
+	Detail    string    `json:"detail,omitempty"`
+}
+
+// auditLogger appends audit events as JSON lines to a file, rotating it by
+// size. Writes are buffered and flushed periodically; errors are logged and
+// never affect request handling.
+type auditLogger struct {
+	name     string
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	mu     sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+}
+
+// validateAuditIPMode checks auditIPMode
+func validateAuditIPMode(config *Config) error {
+	config.AuditIPMode = strings.ToLower(config.AuditIPMode)
+	switch config.AuditIPMode {
+	case "":
+		config.AuditIPMode = auditIPFull
+	case auditIPFull, auditIPTruncated, auditIPHashed:
+	default:
+		return fmt.Errorf("invalid auditIPMode (must be %q, %q or %q): %s", auditIPFull, auditIPTruncated, auditIPHashed, config.AuditIPMode)
+	}
+	return nil
+}
+
+// newAuditLogger creates an audit logger for the configured file
+func newAuditLogger(config *Config, name string) *auditLogger {
+	return &auditLogger{
+		name:     name,
+		path:     config.AuditFile,
+		maxSize:  int64(config.AuditMaxSizeMB) * 1024 * 1024,
+		maxFiles: config.AuditMaxFiles,
+	}
+}
+
+// record appends an event
+func (al *auditLogger) record(event auditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.file != nil && al.size+int64(len(line)) > al.maxSize {
+		al.rotateLocked()
+	}
+	if !al.openLocked() {
+		return
+	}
+
+	n, err := al.writer.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		log.Printf("[%s] Failed to write audit event: %v", al.name, err)
+	}
+}
+
+// openLocked opens the audit file if needed; al.mu must be held
+func (al *auditLogger) openLocked() bool {
+	if al.file != nil {
+		return true
+	}
+
+	file, err := os.OpenFile(al.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		log.Printf("[%s] Failed to open audit file %s: %v", al.name, al.path, err)
+		return false
+	}
+
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	al.file = file
+	al.writer = bufio.NewWriter(file)
+	al.size = size
+	return true
+}
+
+// closeLocked flushes and closes the audit file; al.mu must be held
+func (al *auditLogger) closeLocked() {
+	if al.file == nil {
+		return
+	}
+	if err := al.writer.Flush(); err != nil {
+		log.Printf("[%s] Failed to flush audit file: %v", al.name, err)
+	}
+	al.file.Close()
+	al.file = nil
+	al.writer = nil
+}
+
+// rotateLocked renames the current file with a timestamp suffix and removes
+// the oldest rotated files beyond maxFiles; al.mu must be held
+func (al *auditLogger) rotateLocked() {
+	al.closeLocked()
+
+	rotated := al.path + "." + time.Now().UTC().Format("20060102T150405.000Z")
+	if err := os.Rename(al.path, rotated); err != nil {
+		log.Printf("[%s] Failed to rotate audit file: %v", al.name, err)
+		return
+	}
+
+	matches, err := filepath.Glob(al.path + ".*")
+	if err != nil {
+		return
+	}
+	sort.Strings(matches)
+	for len(matches) > al.maxFiles {
+		if err := os.Remove(matches[0]); err != nil {
+			log.Printf("[%s] Failed to remove old audit file %s: %v", al.name, matches[0], err)
+		}
+		matches = matches[1:]
+	}
+}
+
+// flush writes buffered events to disk
+func (al *auditLogger) flush() {
+	al.mu.Lock()
+	defer al.mu.Unlock()
+
+	if al.writer != nil {
+		if err := al.writer.Flush(); err != nil {
+			log.Printf("[%s] Failed to flush audit file: %v", al.name, err)
+		}
+	}
+}
+
+// run flushes periodically and closes the file when ctx is done
+func (al *auditLogger) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			al.mu.Lock()
+			al.closeLocked()
+			al.mu.Unlock()
+			return
+		case <-ticker.C:
+			al.flush()
+		}
+	}
+}
+
+// audit records an authentication decision or administrative action
+func (ta *TOTPAuth) audit(req *http.Request, event, reason string, detail ...string) {
+	if ta.auditLog == nil {
+		return
+	}
+
+	user, area := ta.auditUser(req, event)
+	ta.auditLog.record(auditEvent{
+		Timestamp: time.Now().UTC(),
+		Event:     event,
+		User:      user,
+		Area:      area,
+		IP:        ta.auditIP(ta.getClientIP(req)),
+		Reason:    reason,
+		Detail:    strings.Join(detail, " "),
+	})
+}
+
+// auditUser returns who an event is recorded for: the subject of a JWT
+// login, otherwise accountName, together with the pathSecrets area of the
+// request, since each area is unlocked with its own secret
+func (ta *TOTPAuth) auditUser(req *http.Request, event string) (string, string) {
+	if event == auditAdminAction {
+		return auditAdminUser, ""
+	}
+	area, _ := ta.areaFor(req.URL.Path)
+	// Incoming values of the header are stripped, so only jwt.go sets it
+	if ta.config.IdentityHeader != "" {
+		if subject := req.Header.Get(ta.config.IdentityHeader); subject != "" {
+			return subject, area
+		}
+	}
+	return ta.config.AccountName, area
+}
+
+// auditIP returns the client IP as auditIPMode records it: unchanged, with
+// the host part cleared, or as a keyed hash that still correlates the events
+// of one client but can't be reversed without formKey
+func (ta *TOTPAuth) auditIP(clientIP string) string {
+	switch ta.config.AuditIPMode {
+	case auditIPTruncated:
+		ip := net.ParseIP(clientIP)
+		if ip == nil {
+			return ""
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	case auditIPHashed:
+		mac := hmac.New(sha256.New, ta.formKey)
+		mac.Write([]byte("audit-ip:" + clientIP))
+		return hex.EncodeToString(mac.Sum(nil)[:16])
+	}
+	return clientIP
+}
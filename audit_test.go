@@ -0,0 +1,113 @@
+package traefik_totp_plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readAuditEvents flushes the audit log and returns its events
+func readAuditEvents(t *testing.T, ta *TOTPAuth) []auditEvent {
+	t.Helper()
+	ta.auditLog.flush()
+	file, err := os.Open(ta.config.AuditFile)
+	if err != nil {
+		t.Fatalf("open audit file: %v", err)
+	}
+	defer file.Close()
+
+	var events []auditEvent
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("audit line %q: %v", scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// TestAuditUser checks who events are recorded for
+func TestAuditUser(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.AuditFile = filepath.Join(t.TempDir(), "audit.log")
+		config.AccountName = "alice@example.com"
+		config.PathSecrets = map[string]string{"/admin": "GEZDGNBVGY3TQOJQ"}
+	})
+
+	ta.audit(newTestRequest(http.MethodGet, "/app"), auditAuthFailure, "invalid_code")
+	ta.audit(newTestRequest(http.MethodGet, "/admin/users"), auditAuthSuccess, "valid_code")
+	jwtLogin := newTestRequest(http.MethodGet, "/app")
+	jwtLogin.Header.Set(ta.config.IdentityHeader, "bob")
+	ta.audit(jwtLogin, auditAuthSuccess, "jwt")
+	ta.audit(newTestRequest(http.MethodGet, "/.totp/admin/sessions"), auditAdminAction, "list_sessions")
+
+	want := []struct{ user, area string }{
+		{"alice@example.com", ""},
+		{"alice@example.com", "/admin"},
+		{"bob", ""},
+		{"admin", ""},
+	}
+	events := readAuditEvents(t, ta)
+	if len(events) != len(want) {
+		t.Fatalf("%d audit events, want %d", len(events), len(want))
+	}
+	for i, event := range events {
+		if event.User != want[i].user || event.Area != want[i].area {
+			t.Errorf("%s/%s: user %q area %q, want %q %q", event.Event, event.Reason, event.User, event.Area, want[i].user, want[i].area)
+		}
+	}
+}
+
+// TestAuditIPMode checks how much of the client IP each auditIPMode keeps
+func TestAuditIPMode(t *testing.T) {
+	tests := []struct {
+		mode, ip, want string
+	}{
+		{auditIPFull, "203.0.113.9", "203.0.113.9"},
+		{auditIPFull, "2001:db8:1:2:3::9", "2001:db8:1:2:3::9"},
+		{auditIPTruncated, "203.0.113.9", "203.0.113.0/24"},
+		{auditIPTruncated, "2001:db8:1:2:3::9", "2001:db8:1::/48"},
+		{auditIPTruncated, "not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		ta := newTestAuth(t, func(config *Config) { config.AuditIPMode = tt.mode })
+		if got := ta.auditIP(tt.ip); got != tt.want {
+			t.Errorf("%s %s: recorded %q, want %q", tt.mode, tt.ip, got, tt.want)
+		}
+	}
+
+	ta := newTestAuth(t, func(config *Config) {
+		config.AuditIPMode = "Hashed"
+		config.FormSigningKey = "0123456789abcdef0123456789abcdef"
+	})
+	hashed := ta.auditIP("203.0.113.9")
+	if len(hashed) != 32 || hashed == "203.0.113.9" {
+		t.Fatalf("hashed IP %q, want 32 hex digits", hashed)
+	}
+	if ta.auditIP("203.0.113.9") != hashed {
+		t.Error("the same IP hashed differently")
+	}
+	if ta.auditIP("203.0.113.10") == hashed {
+		t.Error("different IPs hashed alike")
+	}
+	other := newTestAuth(t, func(config *Config) {
+		config.AuditIPMode = auditIPHashed
+		config.FormSigningKey = "fedcba9876543210fedcba9876543210"
+	})
+	if other.auditIP("203.0.113.9") == hashed {
+		t.Error("the hash doesn't depend on the key")
+	}
+
+	config := CreateConfig()
+	config.SecretKey = testSecret
+	config.AuditIPMode = "anonymized"
+	if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+		t.Error("invalid auditIPMode accepted")
+	}
+}
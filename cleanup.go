@@ -0,0 +1,178 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultCleanupInterval is how often expired sessions and caches are swept
+// unless cleanupInterval says otherwise
+const defaultCleanupInterval = 5 * time.Minute
+
+// Cleanup modes
+const (
+	cleanupModeBackground = "background"
+	cleanupModeLazy       = "lazy"
+)
+
+// lazyCleanupBatch is how many expired sessions a request removes at most
+// in lazy cleanup mode
+const lazyCleanupBatch = 16
+
+// validateCleanupMode checks cleanupMode
+func validateCleanupMode(config *Config) error {
+	config.CleanupMode = strings.ToLower(config.CleanupMode)
+	switch config.CleanupMode {
+	case "":
+		config.CleanupMode = cleanupModeBackground
+	case cleanupModeBackground, cleanupModeLazy:
+	default:
+		return fmt.Errorf("invalid cleanupMode (must be %q or %q): %s", cleanupModeBackground, cleanupModeLazy, config.CleanupMode)
+	}
+	return nil
+}
+
+// cleanupTask is a task registered with the cleanup scheduler
+type cleanupTask struct {
+	run      func(time.Time)
+	interval time.Duration
+	due      time.Time
+}
+
+// cleanupScheduler runs the periodic cleanup of all middleware instances from
+// a single goroutine and timer, instead of one per instance
+type cleanupScheduler struct {
+	mu     sync.Mutex
+	tasks  map[uint64]*cleanupTask
+	nextID uint64
+	stop   chan struct{}
+	wake   chan struct{} // Signals run that the tasks changed
+}
+
+// sharedCleanup is the scheduler used by every instance in this process
+var sharedCleanup = &cleanupScheduler{
+	tasks: make(map[uint64]*cleanupTask),
+	wake:  make(chan struct{}, 1),
+}
+
+// register runs task every interval until ctx is cancelled and returns its
+// ID. The goroutine is started with the first task and stopped again once
+// the last one is gone, so nothing keeps running across configuration reloads
+func (s *cleanupScheduler) register(ctx context.Context, interval time.Duration, task func(time.Time)) uint64 {
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.tasks[id] = &cleanupTask{run: task, interval: interval, due: time.Now().Add(interval)}
+	if s.stop == nil {
+		s.stop = make(chan struct{})
+		go s.run(s.stop)
+	}
+	s.mu.Unlock()
+	s.notify()
+
+	context.AfterFunc(ctx, func() { s.unregister(id) })
+	return id
+}
+
+// registered reports whether the task with the given ID is scheduled and the
+// goroutine running it is up
+func (s *cleanupScheduler) registered(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.tasks[id]
+	return exists && s.stop != nil
+}
+
+// unregister removes a task and stops the goroutine when none are left
+func (s *cleanupScheduler) unregister(id uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tasks, id)
+	if len(s.tasks) == 0 && s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+}
+
+// notify wakes run up to recompute when the next task is due
+func (s *cleanupScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run calls every registered task once per its interval
+func (s *cleanupScheduler) run(stop chan struct{}) {
+	for {
+		timer := time.NewTimer(time.Until(s.nextDue()))
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-s.wake:
+			timer.Stop()
+		case <-timer.C:
+			now := time.Now()
+			for _, task := range s.dueTasks(now) {
+				task(now)
+			}
+		}
+	}
+}
+
+// nextDue returns when the next task is due
+func (s *cleanupScheduler) nextDue() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := time.Now().Add(defaultCleanupInterval)
+	for _, task := range s.tasks {
+		if task.due.Before(next) {
+			next = task.due
+		}
+	}
+	return next
+}
+
+// dueTasks returns the tasks due at now and schedules their next run, so
+// they run without holding the lock
+func (s *cleanupScheduler) dueTasks(now time.Time) []func(time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var tasks []func(time.Time)
+	for _, task := range s.tasks {
+		if !task.due.After(now) {
+			tasks = append(tasks, task.run)
+			task.due = now.Add(task.interval)
+		}
+	}
+	return tasks
+}
+
+// cleanupOnRequest does the cleanup work of lazy cleanup mode while handling
+// a request: it removes a small batch of expired sessions and queued
+// invalidated sessions, and once per cleanupInterval sweeps the remaining
+// caches on a short-lived goroutine, so nothing runs between requests.
+func (ta *TOTPAuth) cleanupOnRequest() {
+	now := ta.clock.Now()
+	if memory, ok := ta.sessions.(*memorySessionStore); ok {
+		memory.deleteExpiredBatch(now, lazyCleanupBatch)
+	}
+	ta.drainSessionDeletions(lazyCleanupBatch)
+
+	last := atomic.LoadInt64(&ta.lastCleanup)
+	if now.UnixNano()-last < int64(ta.cleanupInterval)*int64(time.Second) {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&ta.lastCleanup, last, now.UnixNano()) {
+		go ta.cleanupExpiredSessions(now)
+	}
+}
@@ -0,0 +1,105 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newCleanupTest creates a plugin in the given cleanup mode on a fake clock
+// with expired sessions already expired and live sessions still valid, and
+// returns their tokens
+func newCleanupTest(t *testing.T, mode string, expired, live int) (*TOTPAuth, *fakeClock, []string, []string) {
+	t.Helper()
+	ta := newTestAuth(t, func(config *Config) {
+		config.CleanupMode = mode
+		config.CleanupInterval = "1h"
+		config.SessionExpiry = "10m"
+		config.MaxSessionsPerIP = expired + live
+	})
+	clock := newFakeClock(time.Date(2026, 9, 10, 11, 12, 13, 0, time.UTC))
+	ta.SetClock(clock)
+	ta.lastCleanup = clock.Now().UnixNano()
+
+	expiredTokens := make([]string, expired)
+	for i := range expiredTokens {
+		expiredTokens[i] = newTestSession(t, ta)
+	}
+	clock.advance(5 * time.Minute)
+	liveTokens := make([]string, live)
+	for i := range liveTokens {
+		liveTokens[i] = newTestSession(t, ta)
+	}
+	clock.advance(6 * time.Minute)
+	return ta, clock, expiredTokens, liveTokens
+}
+
+// checkCleanedUp checks that the expired sessions are gone from the store and
+// the live ones are left
+func checkCleanedUp(t *testing.T, ta *TOTPAuth, expired, live []string) {
+	t.Helper()
+	for _, token := range expired {
+		if _, ok := ta.sessions.Get(hashSessionToken(token)); ok {
+			t.Fatal("expired session left in the store")
+		}
+	}
+	for _, token := range live {
+		if _, ok := ta.sessions.Get(hashSessionToken(token)); !ok {
+			t.Fatal("live session removed")
+		}
+	}
+	if count := ta.sessions.Count(); count != len(live) {
+		t.Errorf("%d sessions in the store, want %d", count, len(live))
+	}
+}
+
+// TestBackgroundCleanupRemovesExpired runs the task registered with the
+// shared scheduler and checks that it removes every expired session
+func TestBackgroundCleanupRemovesExpired(t *testing.T) {
+	ta, _, expired, live := newCleanupTest(t, cleanupModeBackground, 40, 5)
+
+	sharedCleanup.mu.Lock()
+	task := sharedCleanup.tasks[ta.cleanupTask]
+	sharedCleanup.mu.Unlock()
+	if task == nil {
+		t.Fatal("no cleanup task registered")
+	}
+	if task.interval != time.Hour {
+		t.Errorf("cleanup interval %s, want 1h", task.interval)
+	}
+
+	task.run(time.Now())
+	checkCleanedUp(t, ta, expired, live)
+}
+
+// TestLazyCleanupRemovesExpired checks that in lazy mode nothing is
+// registered with the scheduler and requests remove the expired sessions a
+// batch at a time
+func TestLazyCleanupRemovesExpired(t *testing.T) {
+	const expired = 3*lazyCleanupBatch + 5
+	ta, _, expiredTokens, live := newCleanupTest(t, cleanupModeLazy, expired, 5)
+	if ta.cleanupTask != 0 {
+		t.Fatal("lazy mode registered a cleanup task")
+	}
+
+	requests := 0
+	for ta.sessions.Count() > len(live) {
+		if requests++; requests > expired {
+			t.Fatalf("%d sessions left after %d requests", ta.sessions.Count(), requests-1)
+		}
+		before := ta.sessions.Count()
+		rec := httptest.NewRecorder()
+		ta.ServeHTTP(rec, withSession(ta, newTestRequest(http.MethodGet, "/app"), live[0]))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request with a live session: status %d", rec.Code)
+		}
+		if removed := before - ta.sessions.Count(); removed > lazyCleanupBatch {
+			t.Fatalf("a request removed %d sessions, at most %d expected", removed, lazyCleanupBatch)
+		}
+	}
+	if want := (expired + lazyCleanupBatch - 1) / lazyCleanupBatch; requests != want {
+		t.Errorf("cleanup took %d requests, want %d", requests, want)
+	}
+	checkCleanedUp(t, ta, expiredTokens, live)
+}
@@ -0,0 +1,61 @@
+package traefik_totp_plugin
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is the wall clock
+type systemClock struct{}
+
+// Now returns the current wall-clock time
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// pluginClock is the time source of a plugin and its session stores. It
+// delegates to the Clock given to SetClock, which may be replaced while the
+// shared cleanup task and requests read it.
+type pluginClock struct {
+	mu    sync.RWMutex
+	clock Clock
+}
+
+// newPluginClock creates a clock following the system clock
+func newPluginClock() *pluginClock {
+	return &pluginClock{clock: systemClock{}}
+}
+
+// Now returns the current time of the configured clock
+func (c *pluginClock) Now() time.Time {
+	c.mu.RLock()
+	clock := c.clock
+	c.mu.RUnlock()
+	return clock.Now()
+}
+
+// set replaces the configured clock
+func (c *pluginClock) set(clock Clock) {
+	c.mu.Lock()
+	c.clock = clock
+	c.mu.Unlock()
+}
+
+// SetClock replaces the clock sessions, cleanup and time steps are computed
+// with, so tests can freeze and advance time. Sessions stored in memory,
+// including those restored from sessionFile, are kept and re-bucketed for
+// the new clock. nil restores the system clock.
+func (ta *TOTPAuth) SetClock(clock Clock) {
+	if clock == nil {
+		clock = systemClock{}
+	}
+	ta.clock.set(clock)
+	if memory, isMemory := ta.sessions.(*memorySessionStore); isMemory {
+		memory.rebase(ta.clock.Now())
+	}
+}
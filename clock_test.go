@@ -0,0 +1,117 @@
+package traefik_totp_plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a Clock tests move by hand
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// newFakeClock creates a clock frozen at now
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+// Now returns the frozen time
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// advance moves the clock forward by d
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func TestSetClockKeepsRestoredSessions(t *testing.T) {
+	// Not t.TempDir: the plugins flush the file once more when their context
+	// is cancelled, which may race the directory's removal
+	dir, err := os.MkdirTemp("", "totp-clock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	path := filepath.Join(dir, "sessions.json")
+	configure := func(config *Config) {
+		config.SessionFile = path
+	}
+	first := newTestAuth(t, configure)
+	token := newTestSession(t, first)
+
+	second := newTestAuth(t, configure)
+	second.SetClock(newFakeClock(time.Now().Add(time.Minute)))
+	if second.validSession(newTestRequest(http.MethodGet, "/"), token) == nil {
+		t.Fatal("session restored from sessionFile was dropped by SetClock")
+	}
+
+	// The next write keeps the restored session in the file
+	newTestSession(t, second)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contents sessionFileContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		t.Fatal(err)
+	}
+	if len(contents.Sessions) != 2 {
+		t.Fatalf("sessionFile holds %d sessions, want 2", len(contents.Sessions))
+	}
+}
+
+func TestSetClockRebasesExpiry(t *testing.T) {
+	ta := newTestAuth(t, nil)
+	clock := newFakeClock(time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC))
+	ta.SetClock(clock)
+	token := newTestSession(t, ta)
+	req := newTestRequest(http.MethodGet, "/")
+
+	clock.advance(30 * time.Minute)
+	if ta.validSession(req, token) == nil {
+		t.Fatal("session expired early")
+	}
+
+	// A jump of years is swept in one pass, without visiting every minute
+	clock.advance(5 * 365 * 24 * time.Hour)
+	ta.SetClock(clock)
+	clock.advance(2 * time.Minute)
+	if removed := ta.sessions.DeleteExpired(clock.Now()); removed != 1 {
+		t.Fatalf("DeleteExpired removed %d sessions, want 1", removed)
+	}
+	if ta.sessions.Count() != 0 {
+		t.Fatalf("%d sessions left after the sweep", ta.sessions.Count())
+	}
+}
+
+// TestSetClockConcurrent replaces the clock while the cleanup reads it; run
+// with -race
+func TestSetClockConcurrent(t *testing.T) {
+	ta := newTestAuth(t, nil)
+	clock := newFakeClock(time.Now())
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			ta.cleanupExpiredSessions(ta.clock.Now())
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		ta.SetClock(clock)
+		ta.SetClock(nil)
+	}
+	wg.Wait()
+}
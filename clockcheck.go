@@ -0,0 +1,82 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// metricClockDrift counts clock checks that found excessive drift
+const metricClockDrift = "clock.drift"
+
+// runClockCheck compares the local clock with the Date header of the
+// configured endpoint at startup and then periodically, warning when the
+// difference would make codes fail. It is best-effort and never blocks
+// request handling.
+func (ta *TOTPAuth) runClockCheck(ctx context.Context) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	interval := time.Duration(ta.config.ClockCheckInterval) * time.Second
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ta.checkClock(ctx, client)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkClock performs a single clock comparison
+func (ta *TOTPAuth) checkClock(ctx context.Context, client *http.Client) {
+	drift, err := measureClockDrift(ctx, client, ta.config.ClockCheckURL)
+	if err != nil {
+		log.Printf("[%s] Clock check against %s failed: %v", ta.name, ta.config.ClockCheckURL, err)
+		return
+	}
+
+	// Codes are computed with the configured offset applied
+	drift += time.Duration(ta.config.TimeOffsetSeconds) * time.Second
+
+	threshold := time.Duration(ta.timeStep) * time.Second / 2
+	if drift > threshold || drift < -threshold {
+		log.Printf("[%s] WARNING: local clock is off by %s compared to %s (more than half a time step); TOTP codes will fail. Check NTP on this host.",
+			ta.name, drift.Round(time.Second), ta.config.ClockCheckURL)
+		ta.incrMetric(metricClockDrift)
+	}
+}
+
+// measureClockDrift returns how far the local clock is ahead of the remote
+// clock, using the midpoint of the request to compensate for latency
+func measureClockDrift(ctx context.Context, client *http.Client, endpoint string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	end := time.Now()
+
+	date := resp.Header.Get("Date")
+	if date == "" {
+		return 0, fmt.Errorf("response has no Date header")
+	}
+	remote, err := http.ParseTime(date)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Date header %q: %w", date, err)
+	}
+
+	local := start.Add(end.Sub(start) / 2)
+	return local.Sub(remote), nil
+}
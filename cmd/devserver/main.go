@@ -0,0 +1,178 @@
+// Command devserver runs the TOTP middleware in front of a trivial echo
+// backend so the challenge page, cookies and configuration combinations can
+// be tried locally without a Traefik installation:
+//
+//	go run ./cmd/devserver -config dev.json
+//	go run ./cmd/devserver -addr 127.0.0.1:8080 -digits 8
+//
+// The config file holds the plugin configuration as JSON, using the same keys
+// as the Traefik dynamic configuration. YAML is not read; convert the plugin
+// block of a YAML configuration to JSON first. Flags override values from the
+// file.
+// When no secret is configured a random one is generated and its
+// provisioning URI is printed at startup.
+package main
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	totp "github.com/CangioUni/traefik-totp-auth"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8080", "listen address")
+	configFile := flag.String("config", "", "JSON file with the plugin configuration (YAML is not supported)")
+	secret := flag.String("secret", "", "base32 TOTP secret (generated when empty)")
+	expiry := flag.String("expiry", "", "session expiry in seconds or as a duration, e.g. 12h")
+	digits := flag.Int("digits", 0, "number of digits in codes")
+	step := flag.String("step", "", "time step in seconds or as a duration, e.g. 30s")
+	skew := flag.Int("skew", 0, "allowed clock skew in time steps")
+	cookieSecure := flag.Bool("cookie-secure", false, "set the Secure flag on cookies (needs HTTPS)")
+	flag.Parse()
+
+	config := totp.CreateConfig()
+	config.CookieSecure = false // plain HTTP on localhost
+	if *configFile != "" {
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			log.Fatalf("Failed to read config: %v", err)
+		}
+		data, err = quoteDurations(data)
+		if err != nil {
+			log.Fatalf("Failed to parse config (it must be JSON, not YAML): %v", err)
+		}
+		if err := json.Unmarshal(data, config); err != nil {
+			log.Fatalf("Failed to parse config (it must be JSON, not YAML): %v", err)
+		}
+	}
+
+	// Flags given on the command line override the config file
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "secret":
+			config.SecretKey = *secret
+		case "expiry":
+			config.SessionExpiry = *expiry
+		case "digits":
+			config.CodeDigits = *digits
+		case "step":
+			config.TimeStep = *step
+		case "skew":
+			config.AllowedSkew = *skew
+		case "cookie-secure":
+			config.CookieSecure = *cookieSecure
+		}
+	})
+
+	generated := config.SecretKey == ""
+	if generated {
+		key, err := totp.GenerateSecret(20)
+		if err != nil {
+			log.Fatalf("Failed to generate secret: %v", err)
+		}
+		if strings.EqualFold(config.SecretEncoding, "hex") {
+			raw, _ := base32.StdEncoding.DecodeString(key)
+			key = hex.EncodeToString(raw)
+		}
+		config.SecretKey = key
+	}
+
+	handler, err := totp.New(context.Background(), http.HandlerFunc(echo), config, "devserver")
+	if err != nil {
+		log.Fatalf("Failed to create middleware: %v", err)
+	}
+
+	// New has rewritten the secrets as canonical base32, whatever their
+	// secretEncoding, which is what authenticator apps expect
+	if generated {
+		uri, err := provisioningURI(config, config.SecretKey, "")
+		if err != nil {
+			log.Fatalf("Failed to build provisioning URI: %v", err)
+		}
+		fmt.Printf("Generated secret: %s\n", config.SecretKey)
+		fmt.Printf("Provisioning URI: %s\n", uri)
+	}
+
+	// Every path prefix has its own authenticator entry
+	prefixes := make([]string, 0, len(config.PathSecrets))
+	for prefix := range config.PathSecrets {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		uri, err := provisioningURI(config, config.PathSecrets[prefix], prefix)
+		if err != nil {
+			log.Fatalf("Failed to build provisioning URI for %s: %v", prefix, err)
+		}
+		fmt.Printf("Provisioning URI for %s: %s\n", prefix, uri)
+	}
+
+	log.Printf("Serving on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, handler))
+}
+
+// echo is the protected backend: it reports the request it received
+func echo(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(rw, "%s %s %s\n\n", req.Method, req.URL.RequestURI(), req.Proto)
+
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Header[name] {
+			fmt.Fprintf(rw, "%s: %s\n", name, value)
+		}
+	}
+}
+
+// quoteDurations turns numeric sessionExpiry and timeStep values, written as
+// plain seconds in older config files, into the strings the config expects
+func quoteDurations(data []byte) ([]byte, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"sessionExpiry", "timeStep"} {
+		if seconds, ok := raw[key].(float64); ok {
+			raw[key] = strconv.FormatFloat(seconds, 'f', -1, 64)
+		}
+	}
+	return json.Marshal(raw)
+}
+
+// provisioningURI returns the otpauth:// URI of secret for the code
+// parameters of prefix. The path prefix, if any, is added to the account
+// name to tell entries apart.
+func provisioningURI(config *totp.Config, secret, prefix string) (string, error) {
+	issuer := config.Issuer
+	if issuer == "" {
+		issuer = "devserver"
+	}
+	account := config.AccountName
+	if account == "" {
+		account = "dev@localhost"
+	}
+	if prefix != "" {
+		account += " " + prefix
+	}
+
+	opts, err := totp.ProvisioningOptionsFor(config, prefix)
+	if err != nil {
+		return "", err
+	}
+	return totp.ProvisioningURIWithOptions(secret, issuer, account, opts), nil
+}
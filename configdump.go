@@ -0,0 +1,155 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// redactedConfigFields are the JSON names of the config fields holding
+// secrets, which the config dump replaces by their length and fingerprint.
+// Every new secret option must be added here.
+var redactedConfigFields = map[string]bool{
+	"secretKey":             true,
+	"readOnlySecretKey":     true,
+	"additionalSecretKeys":  true,
+	"pathSecrets":           true,
+	"secretKeyEncrypted":    true,
+	"staticTestCode":        true,
+	"adminToken":            true,
+	"jwtSecret":             true,
+	"signingSecret":         true,
+	"portalSigningKey":      true,
+	"assertionSigningKey":   true,
+	"verifierToken":         true,
+	"sessionSigningKey":     true,
+	"sessionSigningKeys":    true,
+	"sessionEncryptionKey":  true,
+	"sessionEncryptionKeys": true,
+	"formSigningKey":        true,
+	"sessionStoreToken":     true,
+	"redisPassword":         true,
+	"webhookURL":            true, // Webhook URLs of chat services carry their token in the path
+}
+
+// redactSecret describes a secret by its length and fingerprint, enough to
+// tell whether two instances use the same value
+func redactSecret(secret string) string {
+	return fmt.Sprintf("redacted (length %d, sha256 %s)", len(secret), secretFingerprint(secret))
+}
+
+// secretFingerprint returns the start of the SHA-256 of a secret, which
+// identifies it in logs without revealing it
+func secretFingerprint(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:4])
+}
+
+// redactConfigValue redacts every string in a decoded config value
+func redactConfigValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return redactSecret(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = redactConfigValue(v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = redactConfigValue(v[key])
+		}
+	}
+	return value
+}
+
+// redactURL removes the password and query parameters of URLs in the
+// config, which may carry credentials
+func redactURL(value string) string {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return redactSecret(value)
+	}
+	if parsed.RawQuery != "" {
+		query := parsed.Query()
+		for key := range query {
+			query.Set(key, "xxxxx")
+		}
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.Redacted()
+}
+
+// redactedConfig returns the effective config as JSON fields, with secrets
+// replaced by redactSecret and credentials removed from URLs
+func (ta *TOTPAuth) redactedConfig() (map[string]interface{}, error) {
+	data, err := json.Marshal(ta.config)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	for key, value := range fields {
+		switch {
+		case redactedConfigFields[key]:
+			fields[key] = redactConfigValue(value)
+		case strings.HasSuffix(key, "URL"):
+			if s, ok := value.(string); ok {
+				fields[key] = redactURL(s)
+			}
+		}
+	}
+	return fields, nil
+}
+
+// handleAdminConfig dumps the effective configuration, after defaults were
+// applied, together with values derived from it, for debugging
+func (ta *TOTPAuth) handleAdminConfig(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	config, err := ta.redactedConfig()
+	if err != nil {
+		writeJSONError(rw, http.StatusInternalServerError, "failed to encode the configuration")
+		return
+	}
+
+	_, canList := ta.sessions.(SessionLister)
+	derived := map[string]interface{}{
+		"sessionExpirySeconds":   ta.sessionExpiry,
+		"idleTimeoutSeconds":     ta.idleTimeout,
+		"timeStepSeconds":        ta.timeStep,
+		"cleanupIntervalSeconds": ta.cleanupInterval,
+		"cleanupRunning":         sharedCleanup.registered(ta.cleanupTask),
+		"trustedNetworks":        networkStrings(ta.trustedProxies.list()),
+		"lockoutExemptNetworks":  networkStrings(ta.exemptNetworks),
+		"statelessSessions":      ta.statelessSessions(),
+		"sessionStoreType":       fmt.Sprintf("%T", ta.sessions),
+		"sessionsListable":       canList && !ta.statelessSessions(),
+	}
+
+	ta.audit(req, auditAdminAction, "show_config")
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"config":  config,
+		"derived": derived,
+	})
+}
+
+// networkStrings returns networks in CIDR notation
+func networkStrings(networks []*net.IPNet) []string {
+	list := make([]string, 0, len(networks))
+	for _, network := range networks {
+		list = append(list, network.String())
+	}
+	return list
+}
@@ -0,0 +1,81 @@
+package traefik_totp_plugin
+
+import (
+	"log"
+	"net/http"
+)
+
+// sessionCookie builds the session cookie carrying token
+func (ta *TOTPAuth) sessionCookie(token string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     ta.config.CookieName,
+		Value:    token,
+		Path:     "/",
+		Domain:   ta.config.CookieDomain,
+		MaxAge:   maxAge,
+		Secure:   ta.config.CookieSecure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// expiredCookie returns a cookie that deletes the named cookie, matching the
+// attributes the session cookie is set with
+func (ta *TOTPAuth) expiredCookie(name string) *http.Cookie {
+	cookie := ta.sessionCookie("", -1)
+	cookie.Name = name
+	return cookie
+}
+
+// sessionToken returns the session token carried by the request, looking at
+// the current cookie name first and then at legacy names
+func (ta *TOTPAuth) sessionToken(req *http.Request) string {
+	if cookie, err := req.Cookie(ta.config.CookieName); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	for _, name := range ta.config.LegacyCookieNames {
+		if cookie, err := req.Cookie(name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	return ""
+}
+
+// expireLegacyCookies sends deletion cookies for every legacy session cookie
+// present on the request
+func (ta *TOTPAuth) expireLegacyCookies(rw http.ResponseWriter, req *http.Request) {
+	for _, name := range ta.config.LegacyCookieNames {
+		if _, err := req.Cookie(name); err == nil {
+			http.SetCookie(rw, ta.expiredCookie(name))
+		}
+	}
+}
+
+// discardIncomingSessions deletes every session referenced by the request's
+// session cookies, valid or not, before a new session is issued, so a token
+// the browser brought along (possibly planted by someone else) never
+// survives a login. Legacy cookies are expired; the current cookie is
+// overwritten by the new session.
+func (ta *TOTPAuth) discardIncomingSessions(rw http.ResponseWriter, req *http.Request) {
+	names := map[string]bool{ta.config.CookieName: true}
+	for _, name := range ta.config.LegacyCookieNames {
+		names[name] = true
+	}
+
+	removed := 0
+	for _, cookie := range req.Cookies() {
+		if cookie.Value == "" || !names[cookie.Name] {
+			continue
+		}
+		hash := hashSessionToken(cookie.Value)
+		if _, exists := ta.sessions.Get(hash); exists {
+			ta.sessions.Delete(hash)
+			removed++
+		}
+	}
+	ta.expireLegacyCookies(rw, req)
+
+	if removed > 0 {
+		log.Printf("[%s] Replaced %d previous session(s) at login from %s", ta.name, removed, ta.getClientIP(req))
+	}
+}
@@ -0,0 +1,173 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestLoginDiscardsIncomingSessions checks that a login never keeps a
+// session the browser brought along, whatever state it is in
+func TestLoginDiscardsIncomingSessions(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		cookie    func(*TOTPAuth) (name, token string)
+	}{
+		{
+			name: "planted read-only session",
+			cookie: func(ta *TOTPAuth) (string, string) {
+				token, _ := ta.createScopedSession(newTestRequest(http.MethodGet, "/"), true, []string{""}, methodReadOnly)
+				return ta.config.CookieName, token
+			},
+		},
+		{
+			name:      "session of another client",
+			configure: func(config *Config) { config.ValidateIP = true },
+			cookie: func(ta *TOTPAuth) (string, string) {
+				req := newTestRequest(http.MethodGet, "/")
+				req.RemoteAddr = "198.51.100.7:1234"
+				token, _ := ta.createSession(req, methodTOTP)
+				return ta.config.CookieName, token
+			},
+		},
+		{
+			name: "unknown token",
+			cookie: func(ta *TOTPAuth) (string, string) {
+				return ta.config.CookieName, "stale-token-from-an-old-deployment"
+			},
+		},
+		{
+			name:      "read-only session under a legacy name",
+			configure: func(config *Config) { config.LegacyCookieNames = []string{"old_session"} },
+			cookie: func(ta *TOTPAuth) (string, string) {
+				token, _ := ta.createScopedSession(newTestRequest(http.MethodGet, "/"), true, []string{""}, methodReadOnly)
+				return "old_session", token
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestAuth(t, func(config *Config) {
+				config.MaxSessionsPerIP = 100
+				if tt.configure != nil {
+					tt.configure(config)
+				}
+			})
+			name, incoming := tt.cookie(ta)
+
+			form, csrf := loginForm(ta, currentCode(ta))
+			req := newTestLogin(ta, "/app", form, csrf)
+			req.AddCookie(&http.Cookie{Name: name, Value: incoming})
+			rec := httptest.NewRecorder()
+			ta.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusSeeOther {
+				t.Fatalf("status %d, want %d", rec.Code, http.StatusSeeOther)
+			}
+			issued := responseCookie(rec, ta.config.CookieName)
+			if issued == nil || issued.Value == "" || issued.Value == incoming {
+				t.Fatalf("session cookie = %v, want a new session", issued)
+			}
+			if _, ok := ta.sessions.Get(hashSessionToken(incoming)); ok {
+				t.Error("incoming session survived the login")
+			}
+			if _, ok := ta.sessions.Get(hashSessionToken(issued.Value)); !ok {
+				t.Error("new session not stored")
+			}
+			if name != ta.config.CookieName {
+				if deleted := responseCookie(rec, name); deleted == nil || deleted.MaxAge >= 0 {
+					t.Errorf("%s cookie = %v, want a deletion", name, deleted)
+				}
+			}
+		})
+	}
+}
+
+// TestLegacyCookieNextToCurrent sends the current and a legacy session cookie
+// together and checks which session is used and which cookies are set or
+// deleted
+func TestLegacyCookieNextToCurrent(t *testing.T) {
+	const legacy = "old_session"
+	tests := []struct {
+		name           string
+		currentValid   bool
+		legacyValid    bool
+		wantStatus     int
+		wantCurrent    string // "legacy" when the legacy token moves to the current name, "deleted", or "" for untouched
+		wantLegacyGone bool
+	}{
+		{"both valid", true, true, http.StatusOK, "", true},
+		{"only current valid", true, false, http.StatusOK, "", true},
+		{"only legacy valid", false, true, http.StatusOK, "legacy", true},
+		{"neither valid", false, false, http.StatusUnauthorized, "deleted", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestAuth(t, func(config *Config) {
+				config.LegacyCookieNames = []string{legacy}
+			})
+			token := func(valid bool) string {
+				if valid {
+					return newTestSession(t, ta)
+				}
+				return "unknown-token"
+			}
+			currentToken, legacyToken := token(tt.currentValid), token(tt.legacyValid)
+
+			req := withSession(ta, newTestRequest(http.MethodGet, "/app"), currentToken)
+			req.AddCookie(&http.Cookie{Name: legacy, Value: legacyToken})
+			rec := httptest.NewRecorder()
+			ta.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if deleted := responseCookie(rec, legacy); tt.wantLegacyGone != (deleted != nil && deleted.MaxAge < 0) {
+				t.Errorf("%s cookie = %v, want deleted = %v", legacy, deleted, tt.wantLegacyGone)
+			}
+			current := responseCookie(rec, ta.config.CookieName)
+			switch tt.wantCurrent {
+			case "":
+				if current != nil {
+					t.Errorf("current cookie = %v, want it untouched", current)
+				}
+			case "legacy":
+				if current == nil || current.Value != legacyToken || current.MaxAge <= 0 {
+					t.Errorf("current cookie = %v, want the legacy session", current)
+				}
+			case "deleted":
+				if current == nil || current.MaxAge >= 0 {
+					t.Errorf("current cookie = %v, want a deletion", current)
+				}
+			}
+		})
+	}
+}
+
+// TestExpireLegacyCookies checks that only the legacy cookies the request
+// carries are deleted, never the current one
+func TestExpireLegacyCookies(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.LegacyCookieNames = []string{"old_session", "older_session"}
+		config.CookieDomain = "example"
+	})
+	req := withSession(ta, newTestRequest(http.MethodGet, "/"), "current-token")
+	req.AddCookie(&http.Cookie{Name: "old_session", Value: "legacy-token"})
+	rec := httptest.NewRecorder()
+	ta.expireLegacyCookies(rec, req)
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("%d cookies set, want 1: %v", len(cookies), cookies)
+	}
+	deleted := cookies[0]
+	if deleted.Name != "old_session" || deleted.MaxAge >= 0 || deleted.Value != "" {
+		t.Errorf("cookie = %v, want a deletion of old_session", deleted)
+	}
+	if deleted.Path != "/" || deleted.Domain != "example" {
+		t.Errorf("deletion path %q domain %q, want the session cookie's", deleted.Path, deleted.Domain)
+	}
+}
@@ -0,0 +1,249 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+)
+
+// devicesPath is the self-service page listing the user's sessions
+const devicesPath = "/.totp/devices"
+
+// sessionID returns a short, non-reversible identifier for a session token
+// that is safe to show in pages and API responses
+func sessionID(token string) string {
+	return hashSessionToken(token)[:16]
+}
+
+// id returns the sessionID of a stored session
+func (s *Session) id() string {
+	if len(s.TokenHash) < 16 {
+		return s.TokenHash
+	}
+	return s.TokenHash[:16]
+}
+
+// csrfToken derives a CSRF token bound to the given session token and purpose
+func (ta *TOTPAuth) csrfToken(sessionToken, purpose string) string {
+	mac := hmac.New(sha256.New, ta.formKey)
+	mac.Write([]byte(purpose + ":" + sessionToken))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRFToken checks a submitted CSRF token in constant time
+func (ta *TOTPAuth) validCSRFToken(sessionToken, purpose, submitted string) bool {
+	expected := ta.csrfToken(sessionToken, purpose)
+	return hmac.Equal([]byte(expected), []byte(submitted))
+}
+
+// roughIP hides the host part of an address (/24 for IPv4, /48 for IPv6)
+func roughIP(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// handleDevices serves the self-service session list for an authenticated
+// user. In single-secret mode every session belongs to the same user, which is
+// why the page must be enabled explicitly.
+func (ta *TOTPAuth) handleDevices(rw http.ResponseWriter, req *http.Request) {
+	current := ta.sessionToken(req)
+
+	if req.Method == http.MethodPost {
+		ta.handleDevicesAction(rw, req, current)
+		return
+	}
+
+	currentHash := hashSessionToken(current)
+	sessions := ta.listSessions()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.After(sessions[j].CreatedAt)
+	})
+
+	now := ta.clock.Now()
+	var rows []map[string]interface{}
+	for _, session := range sessions {
+		if now.After(session.deadline()) {
+			continue
+		}
+		rows = append(rows, map[string]interface{}{
+			"ID":        session.id(),
+			"CreatedAt": session.CreatedAt.UTC().Format("2006-01-02 15:04 MST"),
+			"IP":        roughIP(session.IP),
+			"UserAgent": session.UserAgent,
+			"Current":   session.TokenHash == currentHash,
+			"ReadOnly":  session.ReadOnly,
+		})
+	}
+
+	data := map[string]interface{}{
+		"Title":    "Your Sessions",
+		"Sessions": rows,
+		"CSRF":     ta.csrfToken(current, "devices"),
+		"Action":   devicesPath,
+	}
+
+	rw.Header().Set("Cache-Control", "no-store")
+	ta.renderPage(rw, http.StatusOK, ta.pages.devices, data)
+}
+
+// handleDevicesAction revokes a single session or all other sessions
+func (ta *TOTPAuth) handleDevicesAction(rw http.ResponseWriter, req *http.Request, current string) {
+	if err := req.ParseForm(); err != nil || !ta.validCSRFToken(current, "devices", req.PostFormValue("csrf")) {
+		ta.showMessagePage(rw, http.StatusForbidden, "Request Rejected", "The form has expired. Please reload the page and try again.")
+		return
+	}
+
+	clientIP := ta.getClientIP(req)
+
+	switch req.PostFormValue("action") {
+	case "revoke":
+		id := req.PostFormValue("id")
+		if id == sessionID(current) {
+			// Revoking the current session is a logout
+			ta.logout(rw, req)
+			return
+		}
+		revoked := ta.deleteSessions(func(session *Session) bool {
+			return session.id() == id
+		})
+		log.Printf("[%s] User revoked %d session(s) with id %s from %s", ta.name, revoked, id, clientIP)
+		ta.audit(req, auditSessionRevoked, "user_revoked", "id="+id)
+	case "revoke_others":
+		revoked := ta.deleteSessions(func(session *Session) bool {
+			return session.TokenHash != hashSessionToken(current)
+		})
+		log.Printf("[%s] User signed out %d other session(s) from %s", ta.name, revoked, clientIP)
+		ta.audit(req, auditSessionRevoked, "user_revoked_others", fmt.Sprintf("revoked=%d", revoked))
+	default:
+		ta.showMessagePage(rw, http.StatusBadRequest, "Request Rejected", "Unknown action.")
+		return
+	}
+
+	http.Redirect(rw, req, devicesPath, http.StatusSeeOther)
+}
+
+// HTML template for the self-service session list
+const devicesPageTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Title}}</title>
+    <style>
+        * {
+            margin: 0;
+            padding: 0;
+            box-sizing: border-box;
+        }
+
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            padding: 40px 20px;
+        }
+
+        .container {
+            background: white;
+            border-radius: 16px;
+            box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
+            max-width: 720px;
+            margin: 0 auto;
+            padding: 40px;
+        }
+
+        h1 {
+            color: #2d3748;
+            font-size: 24px;
+            font-weight: 700;
+            margin-bottom: 24px;
+        }
+
+        .session {
+            display: flex;
+            align-items: center;
+            justify-content: space-between;
+            gap: 16px;
+            padding: 16px 0;
+            border-bottom: 1px solid #e2e8f0;
+        }
+
+        .details {
+            color: #4a5568;
+            font-size: 14px;
+            line-height: 1.6;
+            overflow-wrap: anywhere;
+        }
+
+        .agent {
+            color: #718096;
+            font-size: 13px;
+        }
+
+        .current {
+            color: #38a169;
+            font-weight: 600;
+        }
+
+        button {
+            padding: 8px 16px;
+            background: white;
+            color: #c53030;
+            border: 1px solid #fc8181;
+            border-radius: 8px;
+            font-size: 14px;
+            cursor: pointer;
+            white-space: nowrap;
+        }
+
+        .others {
+            margin-top: 24px;
+        }
+
+        .others button {
+            width: 100%;
+            padding: 14px 24px;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            color: white;
+            border: none;
+            font-size: 16px;
+            font-weight: 600;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Title}}</h1>
+        {{range .Sessions}}
+        <div class="session">
+            <div class="details">
+                <div>{{.CreatedAt}} &middot; {{.IP}}{{if .ReadOnly}} &middot; read-only{{end}}{{if .Current}} &middot; <span class="current">this device</span>{{end}}</div>
+                <div class="agent">{{.UserAgent}}</div>
+            </div>
+            <form method="POST" action="{{$.Action}}">
+                <input type="hidden" name="csrf" value="{{$.CSRF}}">
+                <input type="hidden" name="action" value="revoke">
+                <input type="hidden" name="id" value="{{.ID}}">
+                <button type="submit">{{if .Current}}Sign out{{else}}Revoke{{end}}</button>
+            </form>
+        </div>
+        {{end}}
+        <form class="others" method="POST" action="{{.Action}}">
+            <input type="hidden" name="csrf" value="{{.CSRF}}">
+            <input type="hidden" name="action" value="revoke_others">
+            <button type="submit">Sign out everywhere else</button>
+        </form>
+    </div>
+</body>
+</html>`
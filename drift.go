@@ -0,0 +1,215 @@
+package traefik_totp_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// driftState holds the measured offset, in time steps, between the
+// authenticator's clock and ours
+type driftState struct {
+	mu           sync.RWMutex
+	path         string
+	steps        int64
+	calibratedAt time.Time
+}
+
+// driftFileContents is the JSON persisted in driftFile
+type driftFileContents struct {
+	Steps        int64     `json:"steps"`
+	CalibratedAt time.Time `json:"calibratedAt"`
+}
+
+// loadDriftState reads the persisted drift. A missing file means no drift.
+func loadDriftState(path string) (*driftState, error) {
+	state := &driftState{path: path}
+	if path == "" {
+		return state, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read drift file: %w", err)
+	}
+
+	var contents driftFileContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("invalid drift file %s: %w", path, err)
+	}
+	state.steps = contents.Steps
+	state.calibratedAt = contents.CalibratedAt
+	return state, nil
+}
+
+// get returns the current drift in time steps
+func (d *driftState) get() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.steps
+}
+
+// snapshot returns the drift and when it was calibrated
+func (d *driftState) snapshot() (int64, time.Time) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.steps, d.calibratedAt
+}
+
+// set stores a new drift and persists it when a drift file is configured
+func (d *driftState) set(steps int64, calibratedAt time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.path != "" {
+		data, err := json.Marshal(driftFileContents{Steps: steps, CalibratedAt: calibratedAt})
+		if err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".tmp")
+		if err != nil {
+			return err
+		}
+		_, writeErr := tmp.Write(data)
+		closeErr := tmp.Close()
+		if writeErr == nil {
+			writeErr = closeErr
+		}
+		if writeErr == nil {
+			writeErr = os.Rename(tmp.Name(), d.path)
+		}
+		if writeErr != nil {
+			os.Remove(tmp.Name())
+			return writeErr
+		}
+	}
+
+	d.steps = steps
+	d.calibratedAt = calibratedAt
+	return nil
+}
+
+// maxTimeOffset bounds timeOffsetSeconds; larger differences mean the host
+// clock is broken, not drifting
+const maxTimeOffset = 300
+
+// codeTime returns the time codes are computed for: the host clock corrected
+// by timeOffsetSeconds
+func (ta *TOTPAuth) codeTime() time.Time {
+	return ta.clock.Now().Add(time.Duration(ta.config.TimeOffsetSeconds) * time.Second)
+}
+
+// calibrateDrift finds the drift from two consecutive codes: the first must
+// match some step within ±calibrationWindow of now and the second the step
+// right after it. The wide window is only ever searched here, when enrollment
+// is confirmed, never during normal logins.
+func (ta *TOTPAuth) calibrateDrift(first, second string, now time.Time) (int64, error) {
+	current := now.Unix() / int64(ta.timeStep)
+	window := int64(ta.config.CalibrationWindow)
+
+	// Search outwards from the current step so the smallest drift wins
+	for distance := int64(0); distance < window; distance++ {
+		offsets := []int64{distance}
+		if distance > 0 {
+			offsets = append(offsets, -distance)
+		}
+		for _, offset := range offsets {
+			if ta.generateTOTP(current+offset) == first && ta.generateTOTP(current+offset+1) == second {
+				return offset + 1, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("codes are not two consecutive codes within %d time steps of the current time", window)
+}
+
+// validateConfirmEnrollment checks that confirmEnrollment has local
+// time-based codes to calibrate against
+func validateConfirmEnrollment(config *Config) error {
+	if config.ConfirmEnrollment && (config.Mode == modeHOTP || config.VerifierURL != "") {
+		return fmt.Errorf("confirmEnrollment cannot be combined with mode hotp or verifierURL")
+	}
+	return nil
+}
+
+// awaitingEnrollment reports whether the next login to area must confirm
+// enrollment with two consecutive codes. pathSecrets areas have their own
+// authenticators, which the drift doesn't apply to.
+func (ta *TOTPAuth) awaitingEnrollment(area string) bool {
+	return ta.config.ConfirmEnrollment && area == "" && ta.enrollment.confirmed().IsZero()
+}
+
+// confirmEnrollment validates a login that confirms enrollment: code and
+// the totp_next_code field must be two consecutive codes of the primary
+// authenticator. Their offset from the current step is stored as the drift.
+func (ta *TOTPAuth) confirmEnrollment(req *http.Request, code string) (validationResult, bool) {
+	next := ta.normalizeCode(strings.TrimSpace(req.PostFormValue("totp_next_code")))
+	if next == "" {
+		return validationResult{}, false
+	}
+	steps, err := ta.calibrateDrift(ta.normalizeCode(code), next, ta.codeTime())
+	if err != nil {
+		return validationResult{}, false
+	}
+
+	now := ta.clock.Now()
+	if err := ta.drift.set(steps, now.UTC()); err != nil {
+		log.Printf("[%s] Failed to persist drift: %v", ta.name, err)
+	}
+	ta.enrollment.confirm(now)
+	log.Printf("[%s] Enrollment confirmed from %s, clock drift calibrated to %d time step(s)", ta.name, ta.getClientIP(req), steps)
+	ta.incrMetric(metricAuthMethodPrefix + methodTOTP)
+	return validationResult{Valid: true, Method: methodTOTP, Reason: "enrollment_confirmed", Skew: int(steps), Secret: "secretKey"}, true
+}
+
+// handleAdminDrift handles the /.totp/admin/drift endpoint. The drift is
+// calibrated when enrollment is confirmed; admins can only view and reset it.
+func (ta *TOTPAuth) handleAdminDrift(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		ta.writeDrift(rw)
+	case http.MethodDelete:
+		ta.resetDrift(rw, req)
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// resetDrift clears the drift and responds with it. With confirmEnrollment
+// the next login calibrates it again.
+func (ta *TOTPAuth) resetDrift(rw http.ResponseWriter, req *http.Request) {
+	if err := ta.drift.set(0, time.Time{}); err != nil {
+		log.Printf("[%s] Failed to persist drift: %v", ta.name, err)
+		writeJSONError(rw, http.StatusInternalServerError, "failed to persist drift")
+		return
+	}
+	if ta.config.ConfirmEnrollment {
+		ta.enrollment.reset()
+	}
+
+	log.Printf("[%s] Admin reset the drift (admin request from %s)", ta.name, ta.getClientIP(req))
+	ta.audit(req, auditAdminAction, "reset_drift")
+	ta.writeDrift(rw)
+}
+
+// writeDrift responds with the current drift
+func (ta *TOTPAuth) writeDrift(rw http.ResponseWriter) {
+	steps, calibratedAt := ta.drift.snapshot()
+	response := map[string]interface{}{
+		"steps":   steps,
+		"seconds": steps * int64(ta.timeStep),
+	}
+	if !calibratedAt.IsZero() {
+		response["calibratedAt"] = calibratedAt
+	}
+	writeJSON(rw, http.StatusOK, response)
+}
@@ -0,0 +1,130 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConfirmEnrollmentCalibratesDrift enrolls a token whose clock runs
+// three steps ahead and checks that the first login asks for two codes,
+// stores the drift from them and that later logins only need one
+func TestConfirmEnrollmentCalibratesDrift(t *testing.T) {
+	driftFile := filepath.Join(t.TempDir(), "drift.json")
+	configure := func(config *Config) {
+		config.ConfirmEnrollment = true
+		config.DriftFile = driftFile
+		config.AdminToken = "admin-token"
+	}
+	ta := newTestAuth(t, configure)
+	ta.maxFailureDelay = 0 // Answer the rejected logins right away
+	clock := newFakeClock(time.Date(2026, 10, 11, 12, 13, 0, 0, time.UTC))
+	ta.SetClock(clock)
+	step := func() int64 { return ta.codeTime().Unix() / int64(ta.timeStep) }
+
+	login := func(codes ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		form, csrf := loginForm(ta, codes[0])
+		if len(codes) > 1 {
+			form.Set("totp_next_code", codes[1])
+		}
+		rec := httptest.NewRecorder()
+		ta.ServeHTTP(rec, newTestLogin(ta, "/app", form, csrf))
+		return rec
+	}
+	challenge := func() string {
+		rec := httptest.NewRecorder()
+		ta.ServeHTTP(rec, newTestRequest(http.MethodGet, "/app"))
+		return rec.Body.String()
+	}
+
+	if !strings.Contains(challenge(), `name="totp_next_code"`) {
+		t.Fatal("challenge before enrollment doesn't ask for the next code")
+	}
+	if rec := login(ta.generateTOTP(step())); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("single code before enrollment: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if rec := login(ta.generateTOTP(step()+3), ta.generateTOTP(step()+5)); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("codes that aren't consecutive: status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if !ta.enrollment.confirmed().IsZero() {
+		t.Fatal("enrollment confirmed by rejected codes")
+	}
+
+	// The token showed step+3 a moment ago and shows step+4 now
+	rec := login(ta.generateTOTP(step()+3), ta.generateTOTP(step()+4))
+	if rec.Code != http.StatusSeeOther || responseCookie(rec, ta.config.CookieName) == nil {
+		t.Fatalf("enrollment: status %d, want %d with a session", rec.Code, http.StatusSeeOther)
+	}
+	if steps := ta.drift.get(); steps != 4 {
+		t.Errorf("drift %d step(s), want 4", steps)
+	}
+	if ta.enrollment.confirmed().IsZero() {
+		t.Error("enrollment not confirmed")
+	}
+
+	clock.advance(time.Duration(ta.timeStep) * time.Second)
+	if strings.Contains(challenge(), `name="totp_next_code"`) {
+		t.Error("challenge after enrollment still asks for the next code")
+	}
+	if rec := login(ta.generateTOTP(step() + 4)); rec.Code != http.StatusSeeOther {
+		t.Errorf("drifted code after enrollment: status %d, want %d", rec.Code, http.StatusSeeOther)
+	}
+
+	// The calibration in driftFile keeps enrollment confirmed after a restart
+	restarted := newTestAuth(t, configure)
+	if steps := restarted.drift.get(); steps != 4 || restarted.enrollment.confirmed().IsZero() {
+		t.Errorf("after a restart: drift %d, enrollment confirmed %v", steps, !restarted.enrollment.confirmed().IsZero())
+	}
+
+	// Admins can only view and reset the drift; a reset asks for two codes again
+	admin := func(method string) int {
+		req := newTestRequest(method, "/.totp/admin/drift")
+		req.Header.Set("Authorization", "Bearer admin-token")
+		rec := httptest.NewRecorder()
+		ta.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if status := admin(http.MethodPost); status != http.StatusMethodNotAllowed {
+		t.Errorf("POST drift: status %d, want %d", status, http.StatusMethodNotAllowed)
+	}
+	if status := admin(http.MethodDelete); status != http.StatusOK {
+		t.Fatalf("DELETE drift: status %d", status)
+	}
+	if ta.drift.get() != 0 || !ta.enrollment.confirmed().IsZero() {
+		t.Error("reset kept the drift or the enrollment")
+	}
+	if !strings.Contains(challenge(), `name="totp_next_code"`) {
+		t.Error("challenge after a reset doesn't ask for the next code")
+	}
+	if restarted := newTestAuth(t, configure); !restarted.enrollment.confirmed().IsZero() {
+		t.Error("reset enrollment confirmed again after a restart")
+	}
+}
+
+// TestConfirmEnrollmentValidation checks the modes confirmEnrollment can't
+// calibrate
+func TestConfirmEnrollmentValidation(t *testing.T) {
+	for name, configure := range map[string]func(*Config){
+		"hotp": func(config *Config) {
+			config.Mode = modeHOTP
+			config.HOTPCounterFile = filepath.Join(t.TempDir(), "counter.json")
+		},
+		"verifier": func(config *Config) { config.VerifierURL = "https://verifier.example" },
+	} {
+		config := CreateConfig()
+		config.SecretKey = testSecret
+		config.SkipSelfTest = true
+		config.ConfirmEnrollment = true
+		configure(config)
+		if err := validateModeConfig(config); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := validateConfirmEnrollment(config); err == nil {
+			t.Errorf("%s: confirmEnrollment accepted", name)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSeconds parses a setting given either as whole seconds ("3600", as
+// before) or as a Go duration ("12h", "30s"). Empty values and zero select
+// def; negative and invalid values are reported with the field name.
+func parseSeconds(field, value string, def int) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return def, nil
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, fmt.Errorf("invalid %s %q (must not be negative)", field, value)
+		}
+		if seconds == 0 {
+			return def, nil
+		}
+		return seconds, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 || duration%time.Second != 0 {
+		return 0, fmt.Errorf("invalid %s %q (must be whole seconds or a duration like \"12h\" or \"30s\")", field, value)
+	}
+	return int(duration / time.Second), nil
+}
@@ -0,0 +1,74 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// validateEmbedConfig checks that embedding origins are plain origins
+func validateEmbedConfig(config *Config) error {
+	origins := config.EmbedAllowedOrigins
+	if config.EmbedTargetOrigin != "" {
+		origins = append(append([]string(nil), origins...), config.EmbedTargetOrigin)
+	}
+	for _, origin := range origins {
+		parsed, err := url.Parse(origin)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" ||
+			parsed.User != nil || strings.TrimSuffix(parsed.Path, "/") != "" || parsed.RawQuery != "" || parsed.Fragment != "" {
+			return fmt.Errorf("invalid embedding origin (must be scheme://host[:port]): %s", origin)
+		}
+	}
+	if config.EmbedTargetOrigin != "" && len(config.EmbedAllowedOrigins) == 0 {
+		return fmt.Errorf("embedTargetOrigin requires embedAllowedOrigins")
+	}
+	return nil
+}
+
+// isEmbedded reports whether the challenge is requested in embedded (iframe)
+// mode. Without configured origins the parameter is ignored.
+func (ta *TOTPAuth) isEmbedded(req *http.Request) bool {
+	return len(ta.config.EmbedAllowedOrigins) > 0 && req.URL.Query().Get("embedded") == "1"
+}
+
+// setEmbedHeaders allows the configured origins to frame the response
+func (ta *TOTPAuth) setEmbedHeaders(rw http.ResponseWriter) {
+	ancestors := make([]string, len(ta.config.EmbedAllowedOrigins))
+	for i, origin := range ta.config.EmbedAllowedOrigins {
+		ancestors[i] = strings.TrimSuffix(origin, "/")
+	}
+	rw.Header().Set("Content-Security-Policy", "frame-ancestors "+strings.Join(ancestors, " "))
+}
+
+// embedTargetOrigin is the origin the completion message is posted to
+func (ta *TOTPAuth) embedTargetOrigin() string {
+	if ta.config.EmbedTargetOrigin != "" {
+		return strings.TrimSuffix(ta.config.EmbedTargetOrigin, "/")
+	}
+	return strings.TrimSuffix(ta.config.EmbedAllowedOrigins[0], "/")
+}
+
+// showEmbeddedSuccess tells the parent window that verification succeeded
+// instead of redirecting the frame
+func (ta *TOTPAuth) showEmbeddedSuccess(rw http.ResponseWriter) {
+	ta.setEmbedHeaders(rw)
+	rw.Header().Set("Cache-Control", "no-store")
+	ta.renderPage(rw, http.StatusOK, ta.pages.embedded, map[string]interface{}{
+		"TargetOrigin": ta.embedTargetOrigin(),
+	})
+}
+
+// HTML template posting the completion message to the embedding page
+const embeddedSuccessTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <title>Verified</title>
+</head>
+<body>
+    <script>
+        window.parent.postMessage({"totp": "success"}, {{.TargetOrigin}});
+    </script>
+</body>
+</html>`
@@ -0,0 +1,509 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricLockout counts clients locked out after too many failed codes
+const metricLockout = "auth.lockout"
+
+// maxTrackedClients bounds the clients whose failed codes are tracked
+const maxTrackedClients = 100000
+
+// Lockout scopes
+const (
+	lockoutScopeIP       = "ip"
+	lockoutScopeIdentity = "identity"
+)
+
+// validateLockoutScope checks lockoutScope
+func validateLockoutScope(config *Config) error {
+	config.LockoutScope = strings.ToLower(config.LockoutScope)
+	switch config.LockoutScope {
+	case "":
+		config.LockoutScope = lockoutScopeIP
+	case lockoutScopeIP, lockoutScopeIdentity:
+	default:
+		return fmt.Errorf("invalid lockoutScope (must be %q or %q): %s", lockoutScopeIP, lockoutScopeIdentity, config.LockoutScope)
+	}
+	return nil
+}
+
+// failureRecord holds the recent failed codes of one client
+type failureRecord struct {
+	failures    []time.Time // Times of the failed codes within the window, oldest first
+	lockedUntil time.Time   // End of the lockout, zero when not locked out
+	consecutive int         // Failed submissions since the last valid code, for the delay
+	lastFailure time.Time   // Time of the latest failed submission
+	inFlight    int         // Attempts reserved and still being checked
+}
+
+// failureTracker counts failed codes per client over a sliding window.
+// Failures older than the window no longer count, and max failures within
+// it lock the client out for the lockout duration. At most max times are
+// kept per client.
+type failureTracker struct {
+	mu      sync.Mutex
+	clients map[string]*failureRecord
+	max     int
+	window  time.Duration
+	lockout time.Duration
+}
+
+// newFailureTracker creates a tracker locking clients out after max failed
+// codes within window
+func newFailureTracker(max int, window, lockout time.Duration) *failureTracker {
+	return &failureTracker{
+		clients: make(map[string]*failureRecord),
+		max:     max,
+		window:  window,
+		lockout: lockout,
+	}
+}
+
+// failureKey returns the key failed codes from clientIP are counted under.
+// IPv6 clients usually hold a whole /64, so they are counted per /64.
+func failureKey(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil || ip.To4() != nil {
+		return clientIP
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// lockoutKey returns the key failed codes submitted with req count towards
+// for lockouts: the client, or with lockoutScope identity, the secret of
+// the area the code is checked against
+func (ta *TOTPAuth) lockoutKey(req *http.Request, clientIP string) string {
+	if ta.config.LockoutScope == lockoutScopeIdentity {
+		return "identity:" + ta.validationIdentityFor(req).area
+	}
+	return failureKey(clientIP)
+}
+
+// expireLocked drops the failures of a record that are older than the
+// window at now; t.mu must be held
+func (t *failureTracker) expireLocked(record *failureRecord, now time.Time) {
+	kept := record.failures[:0]
+	for _, failedAt := range record.failures {
+		if now.Sub(failedAt) < t.window {
+			kept = append(kept, failedAt)
+		}
+	}
+	record.failures = kept
+}
+
+// lockedUntil returns the end of the lockout of key, and false when it isn't
+// locked out at now
+func (t *failureTracker) lockedUntil(key string, now time.Time) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record, exists := t.clients[key]
+	if !exists || !now.Before(record.lockedUntil) {
+		return time.Time{}, false
+	}
+	return record.lockedUntil, true
+}
+
+// reserve starts an attempt of key unless key is locked out, or its failures
+// within the window together with the attempts still being checked already
+// reach max. It returns the end of the lockout when key is locked out and
+// whether the attempt may go ahead. Counting attempts before they are
+// checked keeps parallel submissions from all passing a check that only
+// failures recorded afterwards would close. A reserved attempt is ended with
+// release.
+func (t *failureTracker) reserve(key string, now time.Time) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if record, exists := t.clients[key]; exists && now.Before(record.lockedUntil) {
+		return record.lockedUntil, false
+	}
+	record := t.recordLocked(key, now)
+	if record == nil {
+		return time.Time{}, true
+	}
+	t.expireLocked(record, now)
+	if len(record.failures)+record.inFlight >= t.max {
+		return time.Time{}, false
+	}
+	record.inFlight++
+	return time.Time{}, true
+}
+
+// release ends an attempt reserved with reserve
+func (t *failureTracker) release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if record, exists := t.clients[key]; exists && record.inFlight > 0 {
+		record.inFlight--
+	}
+}
+
+// fail counts a failed code from key and returns the end of the lockout when
+// this failure locked it out
+func (t *failureTracker) fail(key string, now time.Time) (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record := t.recordLocked(key, now)
+	if record == nil {
+		return time.Time{}, false
+	}
+
+	t.expireLocked(record, now)
+	record.failures = append(record.failures, now)
+	if len(record.failures) < t.max {
+		return time.Time{}, false
+	}
+	record.failures = record.failures[:0]
+	record.lockedUntil = now.Add(t.lockout)
+	return record.lockedUntil, true
+}
+
+// streak counts a failed submission from key towards its consecutive
+// failures and returns their number. A streak is forgotten after a window
+// without failures.
+func (t *failureTracker) streak(key string, now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	record := t.recordLocked(key, now)
+	if record == nil {
+		return 0
+	}
+	if now.Sub(record.lastFailure) >= t.window {
+		record.consecutive = 0
+	}
+	record.consecutive++
+	record.lastFailure = now
+	return record.consecutive
+}
+
+// recordLocked returns the record of key, creating it if there is room, or
+// nil; t.mu must be held
+func (t *failureTracker) recordLocked(key string, now time.Time) *failureRecord {
+	record, exists := t.clients[key]
+	if !exists {
+		if len(t.clients) >= maxTrackedClients && !t.makeRoomLocked(now) {
+			return nil
+		}
+		record = &failureRecord{}
+		t.clients[key] = record
+	}
+	return record
+}
+
+// reset forgets the failed codes of key after a successful one. Attempts
+// still being checked keep counting until they are released.
+func (t *failureTracker) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if record, exists := t.clients[key]; exists && record.inFlight > 0 {
+		t.clients[key] = &failureRecord{inFlight: record.inFlight}
+		return
+	}
+	delete(t.clients, key)
+}
+
+// resetAll forgets the failed codes of every key and returns how many were
+// locked out at now
+func (t *failureTracker) resetAll(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	locked := 0
+	for _, record := range t.clients {
+		if now.Before(record.lockedUntil) {
+			locked++
+		}
+	}
+	t.clients = make(map[string]*failureRecord)
+	return locked
+}
+
+// lockoutEntry describes the failed codes of one key for the admin API
+type lockoutEntry struct {
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`              // Failed codes within the window
+	Consecutive int        `json:"consecutive,omitempty"` // Failed submissions since the last valid code
+	LastFailure *time.Time `json:"lastFailure,omitempty"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"` // End of the lockout, omitted when not locked out
+}
+
+// list returns the keys with failed codes or a lockout at now, sorted
+// by key
+func (t *failureTracker) list(now time.Time) []lockoutEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := make([]lockoutEntry, 0, len(t.clients))
+	for key, record := range t.clients {
+		t.expireLocked(record, now)
+		entry := lockoutEntry{Key: key, Failures: len(record.failures)}
+		if now.Sub(record.lastFailure) < t.window {
+			lastFailure := record.lastFailure.UTC()
+			entry.Consecutive = record.consecutive
+			entry.LastFailure = &lastFailure
+		}
+		if now.Before(record.lockedUntil) {
+			lockedUntil := record.lockedUntil.UTC()
+			entry.LockedUntil = &lockedUntil
+		}
+		if entry.Failures > 0 || entry.LastFailure != nil || entry.LockedUntil != nil {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// makeRoomLocked removes records that don't matter anymore or, failing that,
+// one that isn't locked out, and reports whether there is room for another;
+// t.mu must be held
+func (t *failureTracker) makeRoomLocked(now time.Time) bool {
+	t.cleanupLocked(now)
+	if len(t.clients) < maxTrackedClients {
+		return true
+	}
+	for key, record := range t.clients {
+		if !now.Before(record.lockedUntil) && record.inFlight == 0 {
+			delete(t.clients, key)
+			return true
+		}
+	}
+	return false
+}
+
+// cleanup removes the records of clients that aren't locked out and have
+// no failures within the window
+func (t *failureTracker) cleanup(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cleanupLocked(now)
+}
+
+// cleanupLocked is cleanup with t.mu held
+func (t *failureTracker) cleanupLocked(now time.Time) {
+	for key, record := range t.clients {
+		t.expireLocked(record, now)
+		if !now.Before(record.lockedUntil) && len(record.failures) == 0 && now.Sub(record.lastFailure) >= t.window && record.inFlight == 0 {
+			delete(t.clients, key)
+		}
+	}
+}
+
+// lockedOutUntil returns the end of the lockout that applies to req and its
+// audit reason: "locked_out" for maxFailedAttempts, "global_limit" for
+// globalFailureRate, or "" when there is none. Clients in
+// lockoutExemptNetworks are never locked out.
+func (ta *TOTPAuth) lockedOutUntil(req *http.Request) (time.Time, string) {
+	clientIP := ta.getClientIP(req)
+	if ta.isLockoutExempt(clientIP) {
+		return time.Time{}, ""
+	}
+	now := ta.clock.Now()
+	if until, locked := ta.failures.lockedUntil(ta.lockoutKey(req, clientIP), now); locked {
+		return until, "locked_out"
+	}
+	if until, engaged := ta.globalLimitUntil(now); engaged {
+		return until, "global_limit"
+	}
+	return time.Time{}, ""
+}
+
+// reserveAttempt lets a code submission be checked: it answers and returns
+// false when the client is locked out, the global failure limit is engaged,
+// or maxFailedAttempts codes of the client are already failed or still
+// being checked. Otherwise call the returned func once the code was checked.
+// Submissions refused by the global limit or while others are checked aren't
+// logged one by one, as they come from an attack under way.
+func (ta *TOTPAuth) reserveAttempt(rw http.ResponseWriter, req *http.Request) (func(), bool) {
+	until, reason := ta.lockedOutUntil(req)
+	if reason == "" {
+		clientIP := ta.getClientIP(req)
+		if ta.isLockoutExempt(clientIP) {
+			return func() {}, true
+		}
+		key := ta.lockoutKey(req, clientIP)
+		lockedUntil, ok := ta.failures.reserve(key, ta.clock.Now())
+		if ok {
+			return func() { ta.failures.release(key) }, true
+		}
+		until, reason = lockedUntil, "locked_out"
+		if until.IsZero() {
+			// The attempts being checked end within moments
+			until, reason = ta.clock.Now().Add(time.Second), "attempts_in_flight"
+		}
+	}
+	if reason == "locked_out" {
+		log.Printf("[%s] Rejected code submission from locked out client %s", ta.name, ta.getClientIP(req))
+	}
+	ta.audit(req, auditAuthFailure, reason)
+	ta.showLockout(rw, req, until)
+	return nil, false
+}
+
+// recordFailedCode counts an invalid code from the client, and against
+// globalFailureRate. When that locks the client out, it answers the request
+// and returns true.
+func (ta *TOTPAuth) recordFailedCode(rw http.ResponseWriter, req *http.Request) bool {
+	clientIP := ta.getClientIP(req)
+	if ta.isLockoutExempt(clientIP) {
+		return false
+	}
+	now := ta.clock.Now()
+	if until, engaged := ta.failGlobally(now); engaged {
+		ta.audit(req, auditAuthFailure, "global_limit_engaged", fmt.Sprintf("until=%s", until.UTC().Format(time.RFC3339)))
+	}
+	key := ta.lockoutKey(req, clientIP)
+	until, locked := ta.failures.fail(key, now)
+	if !locked {
+		return false
+	}
+	log.Printf("[%s] Locked out %s until %s after %d failed code(s), the last from %s", ta.name, key, until.UTC().Format(time.RFC3339), ta.config.MaxFailedAttempts, clientIP)
+	ta.incrMetric(metricLockout)
+	ta.audit(req, auditAuthFailure, "lockout", fmt.Sprintf("until=%s", until.UTC().Format(time.RFC3339)))
+	ta.showLockout(rw, req, until)
+	return true
+}
+
+// failureDelay returns how long to hold back the answer to the n-th
+// consecutive failed submission: nothing for the first, then 2^(n-1)
+// seconds, at most max
+func failureDelay(n int, max time.Duration) time.Duration {
+	if n < 2 {
+		return 0
+	}
+	if n > 31 {
+		return max
+	}
+	delay := time.Duration(1<<uint(n-1)) * time.Second
+	if delay > max {
+		return max
+	}
+	return delay
+}
+
+// delayFailedSubmission holds back the answer to a wrong or malformed code,
+// twice as long with every consecutive failure of the client, up to
+// maxFailureDelay. The wait ends early when the client goes away or the
+// plugin shuts down.
+func (ta *TOTPAuth) delayFailedSubmission(req *http.Request) {
+	if ta.maxFailureDelay == 0 {
+		return
+	}
+	clientIP := ta.getClientIP(req)
+	if ta.isLockoutExempt(clientIP) {
+		return
+	}
+	n := ta.failures.streak(failureKey(clientIP), ta.clock.Now())
+	delay := failureDelay(n, time.Duration(ta.maxFailureDelay)*time.Second)
+	if delay == 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-req.Context().Done():
+	case <-ta.done:
+	}
+}
+
+// recordSuccessfulCode forgets the failed codes of the client, ending its
+// streak of delayed answers, and with lockoutScope identity those of the
+// identity
+func (ta *TOTPAuth) recordSuccessfulCode(req *http.Request) {
+	clientIP := ta.getClientIP(req)
+	ta.failures.reset(failureKey(clientIP))
+	if key := ta.lockoutKey(req, clientIP); key != failureKey(clientIP) {
+		ta.failures.reset(key)
+	}
+}
+
+// showLockout tells a locked out client when to try again: API clients
+// get a 429 with the cooldown in Retry-After and the body, browsers the
+// login page with the wait instead of the invalid code message. Neither
+// says which limit applies.
+func (ta *TOTPAuth) showLockout(rw http.ResponseWriter, req *http.Request, until time.Time) {
+	seconds := retryAfterSeconds(until.Sub(ta.clock.Now()))
+	rw.Header().Set("Retry-After", strconv.Itoa(seconds))
+	if !acceptsHTML(req) {
+		writeJSON(rw, http.StatusTooManyRequests, map[string]interface{}{
+			"error":      "temporarily locked",
+			"retryAfter": seconds,
+		})
+		return
+	}
+	ta.renderTOTPPage(rw, req, http.StatusTooManyRequests,
+		fmt.Sprintf("Sign-in is temporarily locked. Please try again in %s.", formatWait(seconds)))
+}
+
+// retryAfterSeconds rounds a cooldown up to whole seconds for Retry-After,
+// at least 1
+func retryAfterSeconds(wait time.Duration) int {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// formatWait describes a wait of seconds for the login page, in minutes
+// once it is longer than one
+func formatWait(seconds int) string {
+	if seconds <= 60 {
+		return fmt.Sprintf("%d second(s)", seconds)
+	}
+	return fmt.Sprintf("%d minute(s)", (seconds+59)/60)
+}
+
+// handleAdminLockouts handles /.totp/admin/lockouts: GET lists the clients,
+// or identities, with failed codes or a lockout, DELETE clears the one given
+// by ?key= (a key from the list or a client IP), or all of them
+func (ta *TOTPAuth) handleAdminLockouts(rw http.ResponseWriter, req *http.Request) {
+	now := ta.clock.Now()
+	switch req.Method {
+	case http.MethodGet:
+		writeJSON(rw, http.StatusOK, map[string]interface{}{
+			"scope":    ta.config.LockoutScope,
+			"lockouts": ta.failures.list(now),
+		})
+	case http.MethodDelete:
+		key := strings.TrimSpace(req.URL.Query().Get("key"))
+		if key == "" {
+			locked := ta.failures.resetAll(now)
+			log.Printf("[%s] Admin cleared all failed codes, lifting %d lockout(s) (admin request from %s)", ta.name, locked, ta.getClientIP(req))
+			ta.audit(req, auditAdminAction, "clear_lockouts", fmt.Sprintf("locked=%d", locked))
+			writeJSON(rw, http.StatusOK, map[string]interface{}{"cleared": locked})
+			return
+		}
+
+		key = failureKey(key)
+		_, locked := ta.failures.lockedUntil(key, now)
+		ta.failures.reset(key)
+		log.Printf("[%s] Admin cleared the failed codes of %s (admin request from %s)", ta.name, key, ta.getClientIP(req))
+		ta.audit(req, auditAdminAction, "clear_lockout", key)
+		cleared := 0
+		if locked {
+			cleared = 1
+		}
+		writeJSON(rw, http.StatusOK, map[string]interface{}{"key": key, "cleared": cleared})
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
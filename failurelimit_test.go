@@ -0,0 +1,108 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestParallelFailuresCapped fires more concurrent wrong codes than
+// maxFailedAttempts and checks that no more than that many are validated
+// before the client is locked out
+func TestParallelFailuresCapped(t *testing.T) {
+	const max, submissions = 5, 20
+	ta := newTestAuth(t, func(config *Config) {
+		config.MaxFailedAttempts = max
+	})
+	ta.maxFailureDelay = 0
+
+	// Every validation waits until all submissions got an answer or a validator
+	var validating int32
+	release := make(chan struct{})
+	ta.validators = []validator{validatorFunc(func(ctx context.Context, identity validationIdentity, code string) (validationResult, error) {
+		atomic.AddInt32(&validating, 1)
+		<-release
+		return validationResult{}, nil
+	})}
+
+	var answered int32
+	statuses := make(chan int, submissions)
+	var wg sync.WaitGroup
+	for i := 0; i < submissions; i++ {
+		form, csrf := loginForm(ta, "000000")
+		req := newTestLogin(ta, "/app", form, csrf)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			ta.ServeHTTP(rec, req)
+			atomic.AddInt32(&answered, 1)
+			statuses <- rec.Code
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&validating)+atomic.LoadInt32(&answered) < submissions {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d validating and %d answered of %d submissions", atomic.LoadInt32(&validating), atomic.LoadInt32(&answered), submissions)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&validating); n != max {
+		t.Errorf("%d codes validated at once, want %d", n, max)
+	}
+	close(release)
+	wg.Wait()
+	close(statuses)
+
+	refused := 0
+	for status := range statuses {
+		if status == http.StatusTooManyRequests {
+			refused++
+		}
+	}
+	if refused < submissions-max {
+		t.Errorf("%d submissions refused, want at least %d", refused, submissions-max)
+	}
+	if n := atomic.LoadInt32(&validating); n != max {
+		t.Errorf("%d codes validated in total, want %d", n, max)
+	}
+	if _, locked := ta.failures.lockedUntil(failureKey("192.0.2.1"), ta.clock.Now()); !locked {
+		t.Error("client not locked out after the failed codes")
+	}
+}
+
+// TestReservationSurvivesSuccess checks that a valid code doesn't drop the
+// reservations of attempts still being checked
+func TestReservationSurvivesSuccess(t *testing.T) {
+	now := time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+	tracker := newFailureTracker(2, time.Minute, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if _, ok := tracker.reserve("client", now); !ok {
+			t.Fatalf("attempt %d refused", i+1)
+		}
+	}
+	if _, ok := tracker.reserve("client", now); ok {
+		t.Fatal("third parallel attempt allowed")
+	}
+
+	tracker.release("client")
+	tracker.reset("client")
+	if _, ok := tracker.reserve("client", now); !ok {
+		t.Fatal("attempt after a valid code refused")
+	}
+	if _, ok := tracker.reserve("client", now); ok {
+		t.Error("reset dropped the attempt still being checked")
+	}
+	tracker.release("client")
+	tracker.release("client")
+	tracker.cleanup(now.Add(2 * time.Minute))
+	if len(tracker.clients) != 0 {
+		t.Errorf("%d records left after all attempts ended", len(tracker.clients))
+	}
+}
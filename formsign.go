@@ -0,0 +1,80 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// signFormValue returns value with an HMAC signature appended, for hidden
+// form fields the server must be able to trust when they come back
+func (ta *TOTPAuth) signFormValue(purpose, value string) string {
+	mac := hmac.New(sha256.New, ta.formKey)
+	mac.Write([]byte(purpose + ":" + value))
+	return value + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyFormValue checks a value produced by signFormValue and returns the
+// original value
+func (ta *TOTPAuth) verifyFormValue(purpose, signed string) (string, bool) {
+	idx := strings.LastIndex(signed, ".")
+	if idx == -1 {
+		return "", false
+	}
+
+	value := signed[:idx]
+	expected := ta.signFormValue(purpose, value)
+	if !hmac.Equal([]byte(expected), []byte(signed)) {
+		return "", false
+	}
+	return value, true
+}
+
+// renderTimestamp returns a signed timestamp of when the challenge page was rendered
+func (ta *TOTPAuth) renderTimestamp(now time.Time) string {
+	return ta.signFormValue("rendered", strconv.FormatInt(now.UnixMilli(), 10))
+}
+
+// renderedAt extracts the time from a signed render timestamp
+func (ta *TOTPAuth) renderedAt(signed string) (time.Time, bool) {
+	value, ok := ta.verifyFormValue("rendered", signed)
+	if !ok {
+		return time.Time{}, false
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(millis), true
+}
+
+// submissionTimingProblem checks the render timestamp of a submitted form
+// against submitMinDelayMs and submitMaxAge and describes the problem for the
+// log, or returns "" when the timing is acceptable or not checked. Bots post
+// the form instantly; stale forms are replays.
+func (ta *TOTPAuth) submissionTimingProblem(req *http.Request, now time.Time) string {
+	if ta.config.SubmitMinDelayMs == 0 && ta.config.SubmitMaxAge == 0 {
+		return ""
+	}
+
+	renderedAt, ok := ta.renderedAt(req.PostFormValue("rendered"))
+	if !ok {
+		return "missing or invalid render timestamp"
+	}
+	elapsed := now.Sub(renderedAt)
+	if elapsed < 0 {
+		return fmt.Sprintf("form rendered %s in the future", (-elapsed).Round(time.Millisecond))
+	}
+	if elapsed < time.Duration(ta.config.SubmitMinDelayMs)*time.Millisecond {
+		return fmt.Sprintf("submitted %s after rendering", elapsed.Round(time.Millisecond))
+	}
+	if ta.config.SubmitMaxAge > 0 && elapsed > time.Duration(ta.config.SubmitMaxAge)*time.Second {
+		return fmt.Sprintf("form is %s old", elapsed.Round(time.Second))
+	}
+	return ""
+}
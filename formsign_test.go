@@ -0,0 +1,82 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubmissionTimingProblem(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.SubmitMinDelayMs = 800
+		config.SubmitMaxAge = 600
+	})
+	clock := newFakeClock(time.Date(2026, 5, 6, 7, 8, 9, 0, time.UTC))
+	ta.SetClock(clock)
+	now := clock.Now()
+	signed := ta.renderTimestamp(now.Add(-time.Minute))
+	backdated := strconv.FormatInt(now.Add(-time.Second).UnixMilli(), 10) + signed[strings.LastIndex(signed, "."):]
+
+	tests := []struct {
+		name     string
+		rendered string
+		problem  string // Prefix of the expected problem, "" when accepted
+	}{
+		{"missing", "", "missing or invalid render timestamp"},
+		{"unsigned", strconv.FormatInt(now.UnixMilli(), 10), "missing or invalid render timestamp"},
+		{"timestamp changed under the signature", backdated, "missing or invalid render timestamp"},
+		{"signed for another purpose", ta.signFormValue("other", strconv.FormatInt(now.Add(-time.Minute).UnixMilli(), 10)), "missing or invalid render timestamp"},
+		{"not a number", ta.signFormValue("rendered", "soon"), "missing or invalid render timestamp"},
+		{"rendered in the future", ta.renderTimestamp(now.Add(time.Millisecond)), "form rendered 1ms in the future"},
+		{"instant", ta.renderTimestamp(now), "submitted 0s after rendering"},
+		{"just under the minimum delay", ta.renderTimestamp(now.Add(-799 * time.Millisecond)), "submitted 799ms after rendering"},
+		{"exactly the minimum delay", ta.renderTimestamp(now.Add(-800 * time.Millisecond)), ""},
+		{"exactly the maximum age", ta.renderTimestamp(now.Add(-600 * time.Second)), ""},
+		{"just over the maximum age", ta.renderTimestamp(now.Add(-600*time.Second - time.Millisecond)), "form is 10m0s old"},
+		{"replayed a day later", ta.renderTimestamp(now.Add(-24 * time.Hour)), "form is 24h0m0s old"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newTestForm("/", url.Values{"rendered": {tt.rendered}})
+			problem := ta.submissionTimingProblem(req, clock.Now())
+			if (tt.problem == "") != (problem == "") || !strings.HasPrefix(problem, tt.problem) {
+				t.Errorf("problem = %q, want %q", problem, tt.problem)
+			}
+		})
+	}
+}
+
+// TestStaleFormReplayedAfterClockAdvance checks that a form accepted when
+// submitted in time is refused once the clock has moved past submitMaxAge
+func TestStaleFormReplayedAfterClockAdvance(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.SubmitMaxAge = 60
+	})
+	clock := newFakeClock(time.Date(2026, 5, 6, 7, 8, 9, 0, time.UTC))
+	ta.SetClock(clock)
+
+	form, csrf := loginForm(ta, "000000")
+	form.Set("rendered", ta.renderTimestamp(clock.Now()))
+	clock.advance(61 * time.Second)
+	form.Set("totp_code", currentCode(ta))
+
+	rec := httptest.NewRecorder()
+	ta.ServeHTTP(rec, newTestLogin(ta, "/app", form, csrf))
+	if rec.Code == http.StatusSeeOther || responseCookie(rec, ta.config.CookieName) != nil {
+		t.Fatalf("stale form accepted: status %d", rec.Code)
+	}
+
+	// The same form, rendered again, goes through
+	form.Set("rendered", ta.renderTimestamp(clock.Now().Add(-time.Second)))
+	form.Set("submission", newFormNonce())
+	rec = httptest.NewRecorder()
+	ta.ServeHTTP(rec, newTestLogin(ta, "/app", form, csrf))
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("fresh form refused: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,114 @@
+package traefik_totp_plugin
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// metricGlobalLimit counts how often the global failure limit engaged
+const metricGlobalLimit = "auth.global_limit"
+
+// globalLimiter is a token bucket of failed codes across all clients. Every
+// failed code takes a token and rate tokens per second flow back, up to
+// burst. Once the bucket is empty the limiter engages, and code submissions
+// are refused until it has refilled completely.
+type globalLimiter struct {
+	mu           sync.Mutex
+	rate         float64 // Tokens per second
+	burst        float64
+	tokens       float64
+	updated      time.Time // Time tokens was last refilled
+	engagedUntil time.Time // End of the current engagement, zero when not engaged
+}
+
+// newGlobalLimiter creates a full bucket allowing perMinute failed codes a
+// minute and burst at once
+func newGlobalLimiter(perMinute, burst int, now time.Time) *globalLimiter {
+	return &globalLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		updated: now,
+	}
+}
+
+// refillLocked adds the tokens that flowed back since the last refill;
+// l.mu must be held
+func (l *globalLimiter) refillLocked(now time.Time) {
+	if elapsed := now.Sub(l.updated).Seconds(); elapsed > 0 {
+		l.tokens += elapsed * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.updated = now
+}
+
+// fail takes a token for a failed code and returns the end of the
+// engagement when this emptied the bucket
+func (l *globalLimiter) fail(now time.Time) (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Before(l.engagedUntil) {
+		return time.Time{}, false
+	}
+	l.refillLocked(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		if l.tokens >= 1 {
+			return time.Time{}, false
+		}
+	}
+	refill := time.Duration((l.burst - l.tokens) / l.rate * float64(time.Second))
+	l.engagedUntil = now.Add(refill)
+	return l.engagedUntil, true
+}
+
+// state returns the end of the engagement, and false when the limiter isn't
+// engaged at now. disengaged is true exactly once after an engagement ended.
+func (l *globalLimiter) state(now time.Time) (until time.Time, engaged, disengaged bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.engagedUntil.IsZero() {
+		return time.Time{}, false, false
+	}
+	if now.Before(l.engagedUntil) {
+		return l.engagedUntil, true, false
+	}
+	l.engagedUntil = time.Time{}
+	l.refillLocked(now)
+	return time.Time{}, false, true
+}
+
+// globalLimitUntil returns the end of the global failure limit, and false
+// when it isn't engaged. The end of an engagement is logged by the first
+// request or cleanup that notices it.
+func (ta *TOTPAuth) globalLimitUntil(now time.Time) (time.Time, bool) {
+	if ta.globalFailures == nil {
+		return time.Time{}, false
+	}
+	until, engaged, disengaged := ta.globalFailures.state(now)
+	if disengaged {
+		log.Printf("[%s] Global failure limit disengaged, accepting codes again", ta.name)
+	}
+	return until, engaged
+}
+
+// failGlobally counts a failed code against globalFailureRate and reports
+// whether that engaged the global failure limit
+func (ta *TOTPAuth) failGlobally(now time.Time) (time.Time, bool) {
+	if ta.globalFailures == nil {
+		return time.Time{}, false
+	}
+	until, engaged := ta.globalFailures.fail(now)
+	if !engaged {
+		return time.Time{}, false
+	}
+	log.Printf("[%s] Global failure limit engaged: the budget of %d failed code(s), refilled at %d/min, is used up across all clients; refusing codes until %s",
+		ta.name, ta.config.GlobalFailureBurst, ta.config.GlobalFailureRate, until.UTC().Format(time.RFC3339))
+	ta.incrMetric(metricGlobalLimit)
+	return until, true
+}
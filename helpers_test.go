@@ -0,0 +1,105 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// testSecret is the base32 secret of the test plugins
+const testSecret = "JBSWY3DPEHPK3PXP"
+
+// newTestAuth creates a plugin with testSecret whose backend answers 200
+// "ok", after configure adjusted the default config
+func newTestAuth(t testing.TB, configure func(*Config)) *TOTPAuth {
+	t.Helper()
+	config := CreateConfig()
+	config.SecretKey = testSecret
+	config.SkipSelfTest = true
+	if configure != nil {
+		configure(config)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("ok"))
+	})
+	handler, err := New(ctx, next, config, "test")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return handler.(*TOTPAuth)
+}
+
+// newTestRequest creates an HTTPS request from 192.0.2.1
+func newTestRequest(method, target string) *http.Request {
+	req := httptest.NewRequest(method, "https://app.example"+target, nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Accept", "text/html")
+	return req
+}
+
+// newTestForm creates an HTTPS form submission from 192.0.2.1
+func newTestForm(target string, form url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "https://app.example"+target, strings.NewReader(form.Encode()))
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("Accept", "text/html")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+// currentCode returns the code of testSecret for the plugin's current time step
+func currentCode(ta *TOTPAuth) string {
+	return ta.generateTOTP(ta.codeTime().Unix() / int64(ta.timeStep))
+}
+
+// loginForm returns a challenge form filled in with code, and the login CSRF
+// cookie the browser received with it
+func loginForm(ta *TOTPAuth, code string) (url.Values, *http.Cookie) {
+	nonce := newFormNonce()
+	form := url.Values{
+		"totp_code":  {code},
+		"csrf":       {ta.csrfToken(nonce, "login")},
+		"submission": {newFormNonce()},
+	}
+	return form, &http.Cookie{Name: ta.loginCSRFCookieName(), Value: nonce}
+}
+
+// newTestLogin creates the submission of a login form returning to next
+func newTestLogin(ta *TOTPAuth, next string, form url.Values, csrf *http.Cookie) *http.Request {
+	req := newTestForm(ta.config.LoginPath+"?"+url.Values{loginReturnParam: {next}}.Encode(), form)
+	req.AddCookie(csrf)
+	return req
+}
+
+// responseCookie returns the cookie named name set by a response
+func responseCookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+// newTestSession creates a session for requests from newTestRequest and
+// returns its token
+func newTestSession(t testing.TB, ta *TOTPAuth) string {
+	t.Helper()
+	token, err := ta.createSession(newTestRequest(http.MethodGet, "/"), methodTOTP)
+	if err != nil {
+		t.Fatalf("createSession: %v", err)
+	}
+	return token
+}
+
+// withSession adds the session cookie of token to req
+func withSession(ta *TOTPAuth, req *http.Request, token string) *http.Request {
+	req.AddCookie(&http.Cookie{Name: ta.config.CookieName, Value: token})
+	return req
+}
@@ -0,0 +1,152 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Code generation modes
+const (
+	modeTOTP = "totp"
+	modeHOTP = "hotp"
+)
+
+// methodHOTP is the validation method of counter-based codes
+const methodHOTP = "hotp"
+
+// hotpState holds the next counter value a HOTP token may use. Accepted
+// counters are persisted before a code is accepted, so codes can't be
+// replayed across restarts.
+type hotpState struct {
+	mu      sync.Mutex
+	path    string
+	counter int64
+}
+
+// hotpFileContents is the JSON persisted in hotpCounterFile
+type hotpFileContents struct {
+	Counter int64 `json:"counter"`
+}
+
+// validateModeConfig checks the code generation mode and its options
+func validateModeConfig(config *Config) error {
+	config.Mode = strings.ToLower(config.Mode)
+	if config.Mode == "" {
+		config.Mode = modeTOTP
+	}
+
+	switch config.Mode {
+	case modeTOTP:
+		return nil
+	case modeHOTP:
+	default:
+		return fmt.Errorf("invalid mode (must be %q or %q): %s", modeTOTP, modeHOTP, config.Mode)
+	}
+
+	if config.HOTPCounterFile == "" {
+		return fmt.Errorf("mode hotp requires hotpCounterFile to persist the counter")
+	}
+	if config.InitialCounter < 0 {
+		return fmt.Errorf("initialCounter must not be negative")
+	}
+	if config.HOTPLookAhead <= 0 {
+		config.HOTPLookAhead = 10
+	}
+	// Each of these keys its own secret or schedule to the clock
+	if len(config.PathSecrets) > 0 || len(config.AdditionalSecretKeys) > 0 || config.VerifierURL != "" || config.SecretRotationDays > 0 {
+		return fmt.Errorf("mode hotp cannot be combined with pathSecrets, additionalSecretKeys, verifierURL or secretRotationDays")
+	}
+	return nil
+}
+
+// loadHOTPState reads the persisted counter. A missing file starts at
+// initialCounter.
+func loadHOTPState(path string, initial int64) (*hotpState, error) {
+	state := &hotpState{path: path, counter: initial}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hotp counter file: %w", err)
+	}
+
+	var contents hotpFileContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("invalid hotp counter file %s: %w", path, err)
+	}
+	state.counter = contents.Counter
+	return state, nil
+}
+
+// next returns the next counter value a code is expected for
+func (h *hotpState) next() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.counter
+}
+
+// persist stores counter as the next expected value, replacing the file
+// atomically. Callers hold the lock.
+func (h *hotpState) persist(counter int64) error {
+	data, err := json.Marshal(hotpFileContents{Counter: counter})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(h.path), filepath.Base(h.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, writeErr := tmp.Write(data)
+	closeErr := tmp.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tmp.Name(), h.path)
+	}
+	if writeErr != nil {
+		os.Remove(tmp.Name())
+		return writeErr
+	}
+
+	h.counter = counter
+	return nil
+}
+
+// validateHOTPCode validates a counter-based code against the current counter
+// and the following hotpLookAhead values. The accepted counter is persisted
+// before the code is accepted, and only later counters are valid afterwards.
+func (ta *TOTPAuth) validateHOTPCode(ctx context.Context, identity validationIdentity, code string) (validationResult, error) {
+	secret := ta.currentSecret()
+	code = ta.normalizeCode(code)
+
+	h := ta.hotp
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Like matchCode, compare every counter in the window in constant time
+	matched, found := 0, 0
+	submitted := []byte(code)
+	for ahead := 0; ahead <= ta.config.HOTPLookAhead; ahead++ {
+		equal := subtle.ConstantTimeCompare(submitted, []byte(ta.generateCode(secret, h.counter+int64(ahead))))
+		matched = subtle.ConstantTimeSelect(equal&^found, ahead, matched)
+		found |= equal
+	}
+	if found != 1 {
+		return validationResult{}, nil
+	}
+
+	if err := h.persist(h.counter + int64(matched) + 1); err != nil {
+		return validationResult{}, fmt.Errorf("failed to persist hotp counter, rejecting code: %w", err)
+	}
+	return validationResult{Valid: true, Method: methodHOTP, Reason: "valid_code", Skew: matched}, nil
+}
@@ -0,0 +1,101 @@
+package traefik_totp_plugin
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// deadline returns when the session stops being valid: at its absolute
+// expiry or, with idleTimeout, when it has been unused for too long
+func (s *Session) deadline() time.Time {
+	if !s.IdleExpiresAt.IsZero() && s.IdleExpiresAt.Before(s.ExpiresAt) {
+		return s.IdleExpiresAt
+	}
+	return s.ExpiresAt
+}
+
+// idleDeadline returns the idle deadline of a session used at now, capped by
+// its absolute expiry, or the zero time without idleTimeout
+func (ta *TOTPAuth) idleDeadline(now, expiresAt time.Time) time.Time {
+	if ta.idleTimeout <= 0 {
+		return time.Time{}
+	}
+	idleExpiresAt := now.Add(time.Duration(ta.idleTimeout) * time.Second)
+	if idleExpiresAt.After(expiresAt) {
+		return expiresAt
+	}
+	return idleExpiresAt
+}
+
+// sessionCookieMaxAge returns the Max-Age of the cookie of a new session
+func (ta *TOTPAuth) sessionCookieMaxAge() int {
+	if ta.idleTimeout > 0 && ta.idleTimeout < ta.sessionExpiry {
+		return ta.idleTimeout
+	}
+	return ta.sessionExpiry
+}
+
+// touchSession slides the idle deadline of a session that was just used and
+// re-issues its cookie with a matching Max-Age. So that a burst of requests
+// doesn't cause a store write and a Set-Cookie each, the session is only
+// renewed once less than idleRenewThreshold percent of idleTimeout remains.
+func (ta *TOTPAuth) touchSession(rw http.ResponseWriter, token string, session *Session) {
+	if ta.idleTimeout <= 0 {
+		return
+	}
+
+	now := ta.clock.Now()
+	threshold := time.Duration(ta.idleTimeout) * time.Second * time.Duration(ta.config.IdleRenewThreshold) / 100
+	if session.IdleExpiresAt.Sub(now) >= threshold {
+		return
+	}
+	ta.renewSession(rw, token, session, now)
+}
+
+// renewSession pushes the idle deadline of a session back to a full
+// idleTimeout from now, capped by its absolute expiry, and re-issues its
+// cookie. It returns the token of the cookie, which changes in the stateless
+// session modes, and the new idle deadline, or false when it couldn't be
+// moved.
+func (ta *TOTPAuth) renewSession(rw http.ResponseWriter, token string, session *Session, now time.Time) (string, time.Time, bool) {
+	// Close to the absolute expiry there is nothing left to extend
+	idleExpiresAt := ta.idleDeadline(now, session.ExpiresAt)
+	if !idleExpiresAt.After(session.IdleExpiresAt) {
+		return token, time.Time{}, false
+	}
+
+	if ta.statelessSessions() {
+		// The cookie carries the deadline, so it is re-issued
+		updated := *session
+		updated.IdleExpiresAt = idleExpiresAt
+		encoded, err := ta.encodeSession(&updated)
+		if err != nil {
+			log.Printf("[%s] Failed to refresh session cookie: %v", ta.name, err)
+			return token, time.Time{}, false
+		}
+		token = encoded
+	} else if memory, ok := ta.sessions.(*memorySessionStore); ok {
+		// Of a burst of requests that all read the old deadline, only the
+		// first renews the session and sends a cookie
+		if !memory.update(session.TokenHash, func(stored *Session) bool {
+			if !stored.IdleExpiresAt.Equal(session.IdleExpiresAt) {
+				return false
+			}
+			stored.IdleExpiresAt = idleExpiresAt
+			return true
+		}) {
+			return token, time.Time{}, false
+		}
+	} else {
+		updated := *session
+		updated.IdleExpiresAt = idleExpiresAt
+		if err := ta.sessions.Put(&updated); err != nil {
+			log.Printf("[%s] Failed to refresh session idle timeout: %v", ta.name, err)
+			return token, time.Time{}, false
+		}
+	}
+
+	http.SetCookie(rw, ta.sessionCookie(token, int(idleExpiresAt.Sub(now).Seconds())))
+	return token, idleExpiresAt, true
+}
@@ -0,0 +1,92 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestTouchSessionConcurrent renews one session from many requests at once;
+// run with -race to check the idle deadline isn't read while it is written
+func TestTouchSessionConcurrent(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.IdleTimeout = "10m"
+		config.IdleRenewThreshold = 100
+	})
+	token := newTestSession(t, ta)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				rw := httptest.NewRecorder()
+				ta.ServeHTTP(rw, withSession(ta, newTestRequest(http.MethodGet, "/app"), token))
+				if rw.Code != http.StatusOK {
+					t.Errorf("status = %d, want %d", rw.Code, http.StatusOK)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// TestTouchSessionRenewsOnce has a burst of requests read the session while
+// it is due for renewal, then touch it, and checks that exactly one renews it
+func TestTouchSessionRenewsOnce(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.IdleTimeout = "10m"
+		config.IdleRenewThreshold = 50
+	})
+	clock := newFakeClock(time.Date(2026, 8, 9, 10, 11, 12, 0, time.UTC))
+	ta.SetClock(clock)
+	token := newTestSession(t, ta)
+	clock.advance(6 * time.Minute) // 4 of 10 minutes left, below 50%
+
+	// Every request of the burst looked the session up before any renewed it
+	const burst = 16
+	snapshots := make([]*Session, burst)
+	for i := range snapshots {
+		req := withSession(ta, newTestRequest(http.MethodGet, "/app"), token)
+		if snapshots[i] = ta.validSession(req, token); snapshots[i] == nil {
+			t.Fatal("session rejected")
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	renewals := 0
+	for _, snapshot := range snapshots {
+		wg.Add(1)
+		go func(snapshot *Session) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			ta.touchSession(rec, token, snapshot)
+			if responseCookie(rec, ta.config.CookieName) != nil {
+				mu.Lock()
+				renewals++
+				mu.Unlock()
+			}
+		}(snapshot)
+	}
+	wg.Wait()
+
+	if renewals != 1 {
+		t.Errorf("%d of %d requests renewed the session, want 1", renewals, burst)
+	}
+	session, _ := ta.sessions.Get(hashSessionToken(token))
+	if want := clock.Now().Add(10 * time.Minute); !session.IdleExpiresAt.Equal(want) {
+		t.Errorf("idle deadline %s, want %s", session.IdleExpiresAt, want)
+	}
+
+	// Requests after the renewal find the new deadline and leave it alone
+	rec := httptest.NewRecorder()
+	ta.ServeHTTP(rec, withSession(ta, newTestRequest(http.MethodGet, "/app"), token))
+	if rec.Code != http.StatusOK || responseCookie(rec, ta.config.CookieName) != nil {
+		t.Errorf("request after the renewal: status %d, cookie %v", rec.Code, responseCookie(rec, ta.config.CookieName))
+	}
+}
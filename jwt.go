@@ -0,0 +1,258 @@
+package traefik_totp_plugin
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// jwtLeeway is the clock skew tolerated when checking exp and nbf
+const jwtLeeway = 30 * time.Second
+
+// jwtVerifier verifies JWTs issued by an external identity provider
+type jwtVerifier struct {
+	hmacKey   []byte
+	publicKey crypto.PublicKey
+	issuer    string
+	audience  string
+}
+
+// jwtClaims holds the registered claims the plugin checks
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"`
+	ExpiresAt *int64          `json:"exp"`
+	NotBefore *int64          `json:"nbf"`
+}
+
+// newJWTVerifier creates a verifier from either an HMAC secret or a PEM
+// encoded RSA/ECDSA public key (or certificate)
+func newJWTVerifier(config *Config) (*jwtVerifier, error) {
+	verifier := &jwtVerifier{
+		issuer:   config.JWTIssuer,
+		audience: config.JWTAudience,
+	}
+
+	switch {
+	case config.JWTSecret != "" && config.JWTPublicKey != "":
+		return nil, fmt.Errorf("only one of jwtSecret and jwtPublicKey may be set")
+	case config.JWTSecret != "":
+		verifier.hmacKey = []byte(config.JWTSecret)
+	default:
+		block, _ := pem.Decode([]byte(config.JWTPublicKey))
+		if block == nil {
+			return nil, fmt.Errorf("invalid jwtPublicKey: no PEM block found")
+		}
+
+		var key interface{}
+		var err error
+		if block.Type == "CERTIFICATE" {
+			var cert *x509.Certificate
+			cert, err = x509.ParseCertificate(block.Bytes)
+			if err == nil {
+				key = cert.PublicKey
+			}
+		} else {
+			key, err = x509.ParsePKIXPublicKey(block.Bytes)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwtPublicKey: %w", err)
+		}
+
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			verifier.publicKey = key
+		default:
+			return nil, fmt.Errorf("invalid jwtPublicKey: unsupported key type %T", key)
+		}
+	}
+
+	return verifier, nil
+}
+
+// verify checks the token's signature and claims and returns the claims
+func (jv *jwtVerifier) verify(token string, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed header")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed header")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+
+	if err := jv.verifySignature(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed payload")
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed payload")
+	}
+
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("missing exp claim")
+	}
+	if now.After(time.Unix(*claims.ExpiresAt, 0).Add(jwtLeeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(*claims.NotBefore, 0)) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if jv.issuer != "" && claims.Issuer != jv.issuer {
+		return nil, fmt.Errorf("unexpected issuer %q", claims.Issuer)
+	}
+	if jv.audience != "" && !audienceContains(claims.Audience, jv.audience) {
+		return nil, fmt.Errorf("unexpected audience")
+	}
+
+	return &claims, nil
+}
+
+// verifySignature checks the signature for the given algorithm. The
+// algorithm must match the configured key type, and for ECDSA its curve,
+// which rules out "none" and HMAC/public-key confusion.
+func (jv *jwtVerifier) verifySignature(alg, signingInput string, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+	switch alg[2:] {
+	case "256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+	case "384":
+		newHash, cryptoHash = sha512.New384, crypto.SHA384
+	case "512":
+		newHash, cryptoHash = sha512.New, crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	switch key := jv.publicKey.(type) {
+	case nil:
+		if !strings.HasPrefix(alg, "HS") {
+			return fmt.Errorf("unexpected algorithm %q", alg)
+		}
+		mac := hmac.New(newHash, jv.hmacKey)
+		mac.Write([]byte(signingInput))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("unexpected algorithm %q", alg)
+		}
+		h := newHash()
+		h.Write([]byte(signingInput))
+		if err := rsa.VerifyPKCS1v15(key, cryptoHash, h.Sum(nil), signature); err != nil {
+			return fmt.Errorf("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("unexpected algorithm %q", alg)
+		}
+		// Each ES algorithm has its own curve: ES256 is P-256, ES384 P-384
+		// and ES512 P-521
+		if curveBits := map[string]int{"256": 256, "384": 384, "512": 521}[alg[2:]]; key.Curve.Params().BitSize != curveBits {
+			return fmt.Errorf("algorithm %q doesn't match the key's curve %s", alg, key.Curve.Params().Name)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("invalid signature")
+		}
+		h := newHash()
+		h.Write([]byte(signingInput))
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return fmt.Errorf("invalid signature")
+		}
+	}
+
+	return nil
+}
+
+// audienceContains checks the aud claim, which may be a string or an array
+func audienceContains(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, aud := range list {
+			if aud == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// bearerJWT extracts the JWT from the configured header
+func (ta *TOTPAuth) bearerJWT(req *http.Request) string {
+	value := strings.TrimSpace(req.Header.Get(ta.config.JWTHeader))
+	if len(value) > 7 && strings.EqualFold(value[:7], "Bearer ") {
+		value = strings.TrimSpace(value[7:])
+	}
+	return value
+}
+
+// hasValidJWT reports whether the request carries a valid JWT and, if so,
+// forwards its subject in the identity header. Failures are logged and the
+// request falls back to the normal TOTP flow.
+func (ta *TOTPAuth) hasValidJWT(req *http.Request) bool {
+	if ta.jwt == nil {
+		return false
+	}
+
+	token := ta.bearerJWT(req)
+	if token == "" {
+		return false
+	}
+
+	claims, err := ta.jwt.verify(token, ta.clock.Now())
+	if err != nil {
+		log.Printf("[%s] JWT from %s rejected, falling back to TOTP: %v", ta.name, ta.getClientIP(req), err)
+		return false
+	}
+
+	if ta.config.IdentityHeader != "" && claims.Subject != "" {
+		req.Header.Set(ta.config.IdentityHeader, claims.Subject)
+	}
+	ta.setAppAssertion(req, claims.Subject, "full", "")
+	return true
+}
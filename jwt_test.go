@@ -0,0 +1,221 @@
+package traefik_totp_plugin
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"hash"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jwtTestNow is the time the test tokens are verified at
+var jwtTestNow = time.Date(2026, 9, 10, 11, 12, 13, 0, time.UTC)
+
+// jwtSigner signs a JWT signing input
+type jwtSigner func(t *testing.T, signingInput string) []byte
+
+// hmacSigner signs with HMAC over newHash
+func hmacSigner(key []byte, newHash func() hash.Hash) jwtSigner {
+	return func(t *testing.T, signingInput string) []byte {
+		mac := hmac.New(newHash, key)
+		mac.Write([]byte(signingInput))
+		return mac.Sum(nil)
+	}
+}
+
+// rsaSigner signs with RSASSA-PKCS1-v1_5 and SHA-256
+func rsaSigner(key *rsa.PrivateKey) jwtSigner {
+	return func(t *testing.T, signingInput string) []byte {
+		digest := sha256.Sum256([]byte(signingInput))
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+}
+
+// ecdsaSigner signs the digest of newHash with key and encodes r and s with
+// the key's coordinate size, as JWS does
+func ecdsaSigner(key *ecdsa.PrivateKey, newHash func() hash.Hash) jwtSigner {
+	return func(t *testing.T, signingInput string) []byte {
+		h := newHash()
+		h.Write([]byte(signingInput))
+		r, s, err := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return signature
+	}
+}
+
+// newTestJWT returns a JWT with alg in its header and claims as payload,
+// signed by sign (no signature when sign is nil)
+func newTestJWT(t *testing.T, alg string, claims map[string]interface{}, sign jwtSigner) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	if sign != nil {
+		signature = sign(t, signingInput)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// validClaims returns claims that pass every check of the test verifiers
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"sub": "user@example.com",
+		"iss": "https://idp.example",
+		"aud": "totp",
+		"exp": jwtTestNow.Add(time.Hour).Unix(),
+	}
+}
+
+// withClaim returns validClaims with name set to value, or removed for nil
+func withClaim(name string, value interface{}) map[string]interface{} {
+	claims := validClaims()
+	if value == nil {
+		delete(claims, name)
+	} else {
+		claims[name] = value
+	}
+	return claims
+}
+
+func TestJWTVerify(t *testing.T) {
+	hmacKey := []byte("jwt-secret-0123456789abcdef0123456789")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaPublicDER})
+
+	verifiers := map[string]*jwtVerifier{
+		"hmac": {hmacKey: hmacKey},
+		"rsa":  {publicKey: &rsaKey.PublicKey},
+		"p256": {publicKey: &p256.PublicKey},
+		"p384": {publicKey: &p384.PublicKey},
+	}
+	for _, v := range verifiers {
+		v.issuer, v.audience = "https://idp.example", "totp"
+	}
+
+	// truncated cuts the last byte off the signature of sign
+	truncated := func(sign jwtSigner) jwtSigner {
+		return func(t *testing.T, signingInput string) []byte {
+			signature := sign(t, signingInput)
+			return signature[:len(signature)-1]
+		}
+	}
+
+	tests := []struct {
+		name     string
+		verifier string
+		alg      string
+		claims   map[string]interface{}
+		sign     jwtSigner
+		wantErr  string // "" for a valid token
+	}{
+		{"HS256", "hmac", "HS256", validClaims(), hmacSigner(hmacKey, sha256.New), ""},
+		{"HS512", "hmac", "HS512", validClaims(), hmacSigner(hmacKey, sha512.New), ""},
+		{"RS256", "rsa", "RS256", validClaims(), rsaSigner(rsaKey), ""},
+		{"ES256", "p256", "ES256", validClaims(), ecdsaSigner(p256, sha256.New), ""},
+		{"ES384", "p384", "ES384", validClaims(), ecdsaSigner(p384, sha512.New384), ""},
+
+		{"alg none with an HMAC key", "hmac", "none", validClaims(), nil, "unsupported algorithm"},
+		{"alg none with an RSA key", "rsa", "none", validClaims(), nil, "unsupported algorithm"},
+		{"alg NONE", "hmac", "NONE", validClaims(), nil, "unsupported algorithm"},
+		{"unsigned HS256", "hmac", "HS256", validClaims(), nil, "invalid signature"},
+
+		{"HS256 signed with the RSA public key", "rsa", "HS256", validClaims(), hmacSigner(rsaPublicPEM, sha256.New), "unexpected algorithm"},
+		{"HS256 for an EC key", "p256", "HS256", validClaims(), hmacSigner(hmacKey, sha256.New), "unexpected algorithm"},
+		{"RS256 for an HMAC key", "hmac", "RS256", validClaims(), rsaSigner(rsaKey), "unexpected algorithm"},
+		{"ES256 for an RSA key", "rsa", "ES256", validClaims(), ecdsaSigner(p256, sha256.New), "unexpected algorithm"},
+		{"HS256 with the wrong secret", "hmac", "HS256", validClaims(), hmacSigner([]byte("wrong"), sha256.New), "invalid signature"},
+		{"HS512 signature for HS256", "hmac", "HS256", validClaims(), hmacSigner(hmacKey, sha512.New), "invalid signature"},
+
+		{"ES256 with a P-384 key", "p384", "ES256", validClaims(), ecdsaSigner(p384, sha256.New), "doesn't match the key's curve"},
+		{"ES384 with a P-256 key", "p256", "ES384", validClaims(), ecdsaSigner(p256, sha512.New384), "doesn't match the key's curve"},
+		{"ES256 signed on P-384", "p256", "ES256", validClaims(), ecdsaSigner(p384, sha256.New), "invalid signature"},
+		{"ES256 signature one byte short", "p256", "ES256", validClaims(), truncated(ecdsaSigner(p256, sha256.New)), "invalid signature"},
+		{"ES256 signature of another key", "p256", "ES256", validClaims(), ecdsaSigner(mustECDSAKey(t), sha256.New), "invalid signature"},
+
+		{"expired", "hmac", "HS256", withClaim("exp", jwtTestNow.Add(-jwtLeeway-time.Second).Unix()), hmacSigner(hmacKey, sha256.New), "token expired"},
+		{"expired within the leeway", "hmac", "HS256", withClaim("exp", jwtTestNow.Add(-jwtLeeway+time.Second).Unix()), hmacSigner(hmacKey, sha256.New), ""},
+		{"without exp", "hmac", "HS256", withClaim("exp", nil), hmacSigner(hmacKey, sha256.New), "missing exp claim"},
+		{"nbf in the future", "hmac", "HS256", withClaim("nbf", jwtTestNow.Add(jwtLeeway+time.Second).Unix()), hmacSigner(hmacKey, sha256.New), "token not yet valid"},
+		{"nbf within the leeway", "hmac", "HS256", withClaim("nbf", jwtTestNow.Add(jwtLeeway-time.Second).Unix()), hmacSigner(hmacKey, sha256.New), ""},
+		{"nbf in the past", "hmac", "HS256", withClaim("nbf", jwtTestNow.Add(-time.Hour).Unix()), hmacSigner(hmacKey, sha256.New), ""},
+
+		{"other issuer", "hmac", "HS256", withClaim("iss", "https://evil.example"), hmacSigner(hmacKey, sha256.New), "unexpected issuer"},
+		{"without issuer", "hmac", "HS256", withClaim("iss", nil), hmacSigner(hmacKey, sha256.New), "unexpected issuer"},
+		{"other audience", "hmac", "HS256", withClaim("aud", "other"), hmacSigner(hmacKey, sha256.New), "unexpected audience"},
+		{"audience list without ours", "hmac", "HS256", withClaim("aud", []string{"other", "more"}), hmacSigner(hmacKey, sha256.New), "unexpected audience"},
+		{"audience list with ours", "hmac", "HS256", withClaim("aud", []string{"other", "totp"}), hmacSigner(hmacKey, sha256.New), ""},
+		{"without audience", "hmac", "HS256", withClaim("aud", nil), hmacSigner(hmacKey, sha256.New), "unexpected audience"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := newTestJWT(t, tt.alg, tt.claims, tt.sign)
+			claims, err := verifiers[tt.verifier].verify(token, jwtTestNow)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("valid token rejected: %v", err)
+				}
+				if claims.Subject != "user@example.com" {
+					t.Errorf("subject %q", claims.Subject)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// mustECDSAKey generates a P-256 key
+func mustECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
@@ -0,0 +1,48 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"time"
+)
+
+// challengeDurationBuckets are the upper bounds of the challenge-to-success
+// latency histogram
+var challengeDurationBuckets = []struct {
+	limit time.Duration
+	name  string
+}{
+	{5 * time.Second, "challenge.duration.le_5s"},
+	{15 * time.Second, "challenge.duration.le_15s"},
+	{30 * time.Second, "challenge.duration.le_30s"},
+	{60 * time.Second, "challenge.duration.le_60s"},
+	{120 * time.Second, "challenge.duration.le_120s"},
+}
+
+// Histogram buckets for slow and unknown challenge durations
+const (
+	metricChallengeDurationInf     = "challenge.duration.le_inf"
+	metricChallengeDurationUnknown = "challenge.duration.unknown"
+)
+
+// recordChallengeDuration records how long the user spent on the challenge
+// page, based on the signed render timestamp in the form. It returns the
+// value for the login log line.
+func (ta *TOTPAuth) recordChallengeDuration(req *http.Request) string {
+	renderedAt, ok := ta.renderedAt(req.PostFormValue("rendered"))
+	elapsed := ta.clock.Now().Sub(renderedAt)
+	if !ok || elapsed < 0 {
+		ta.incrMetric(metricChallengeDurationUnknown)
+		return "unknown"
+	}
+
+	metric := metricChallengeDurationInf
+	for _, bucket := range challengeDurationBuckets {
+		if elapsed <= bucket.limit {
+			metric = bucket.name
+			break
+		}
+	}
+	ta.incrMetric(metric)
+
+	return elapsed.Round(100 * time.Millisecond).String()
+}
@@ -0,0 +1,31 @@
+package traefik_totp_plugin
+
+import "strings"
+
+// splitList flattens comma-separated entries, so that a single string such
+// as "10.0.0.0/8, 172.16.0.0/12" (convenient in Docker labels) parses like
+// the equivalent list. Entries are trimmed and empty ones dropped.
+func splitList(values []string) []string {
+	var split []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				split = append(split, part)
+			}
+		}
+	}
+	return split
+}
+
+// splitListFields applies splitList to every list-valued setting
+func splitListFields(config *Config) {
+	config.TrustedProxies = splitList(config.TrustedProxies)
+	config.LegacyCookieNames = splitList(config.LegacyCookieNames)
+	config.LockoutExemptNetworks = splitList(config.LockoutExemptNetworks)
+	config.AllowedRedirectHosts = splitList(config.AllowedRedirectHosts)
+	config.AssertionClaims = splitList(config.AssertionClaims)
+	config.EmbedAllowedOrigins = splitList(config.EmbedAllowedOrigins)
+	config.AdditionalSecretKeys = splitList(config.AdditionalSecretKeys)
+	config.SessionSigningKeys = splitList(config.SessionSigningKeys)
+	config.SessionEncryptionKeys = splitList(config.SessionEncryptionKeys)
+}
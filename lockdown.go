@@ -0,0 +1,135 @@
+package traefik_totp_plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultLockdownMessage is shown to every request during a lockdown unless
+// lockdownMessage says otherwise
+const defaultLockdownMessage = "This service is temporarily unavailable. Please try again later."
+
+// lockdownEnd returns when the current lockdown ends, and false when there
+// is none at now
+func (ta *TOTPAuth) lockdownEnd(now time.Time) (time.Time, bool) {
+	until := atomic.LoadInt64(&ta.lockdownUntil)
+	if until == 0 || now.UnixNano() >= until {
+		return time.Time{}, false
+	}
+	return time.Unix(0, until).UTC(), true
+}
+
+// setLockdown starts a lockdown that ends at until, or lifts it with the
+// zero time, and persists the end to sessionFile
+func (ta *TOTPAuth) setLockdown(until time.Time) {
+	if until.IsZero() {
+		atomic.StoreInt64(&ta.lockdownUntil, 0)
+	} else {
+		atomic.StoreInt64(&ta.lockdownUntil, until.UnixNano())
+	}
+	if memory, ok := ta.sessions.(*memorySessionStore); ok {
+		memory.setLockdown(until)
+	}
+}
+
+// serveLockdown answers a request during a lockdown with lockdownMessage.
+// The requests aren't logged one by one, as a lockdown usually means an
+// attack is under way.
+func (ta *TOTPAuth) serveLockdown(rw http.ResponseWriter, until time.Time) {
+	rw.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(until.Sub(ta.clock.Now()))))
+	ta.showMessagePage(rw, http.StatusServiceUnavailable, "Temporarily Unavailable", ta.config.LockdownMessage)
+}
+
+// revokeAllSessions removes every session the store holds. Stores that can't
+// list their sessions are asked to remove those from any IP. The stateless
+// session modes keep nothing that could be removed.
+func (ta *TOTPAuth) revokeAllSessions() (int, error) {
+	if ta.statelessSessions() {
+		return 0, nil
+	}
+	if _, canList := ta.sessions.(SessionLister); canList {
+		return ta.deleteSessions(func(*Session) bool { return true }), nil
+	}
+	revoker, ok := ta.sessions.(SessionIPRevoker)
+	if !ok {
+		return 0, errors.New("the session store cannot revoke all sessions")
+	}
+	revoked := 0
+	for _, cidr := range []string{"0.0.0.0/0", "::/0"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		n, err := revoker.DeleteByIP(network)
+		revoked += n
+		if err != nil {
+			return revoked, err
+		}
+	}
+	return revoked, nil
+}
+
+// handleAdminLockdown handles the /.totp/admin/lockdown endpoint: POST
+// revokes every session and refuses all requests for lockdownDuration, or
+// the duration in the body, DELETE lifts the lockdown early
+func (ta *TOTPAuth) handleAdminLockdown(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		ta.writeLockdown(rw, nil)
+	case http.MethodPost:
+		var body struct {
+			Duration string `json:"duration"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, 4096)).Decode(&body); err != nil && err != io.EOF {
+			writeJSONError(rw, http.StatusBadRequest, `body must be empty or {"duration": "<duration>"}`)
+			return
+		}
+		seconds, err := parseSeconds("duration", body.Duration, ta.lockdownDuration)
+		if err != nil {
+			writeJSONError(rw, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		until := ta.clock.Now().Add(time.Duration(seconds) * time.Second).UTC()
+		ta.setLockdown(until)
+		revoked, err := ta.revokeAllSessions()
+		if err != nil {
+			log.Printf("[%s] Lockdown: failed to revoke sessions in the session store: %v", ta.name, err)
+		}
+
+		log.Printf("[%s] Admin started a lockdown until %s and revoked %d session(s) (admin request from %s)",
+			ta.name, until.Format(time.RFC3339), revoked, ta.getClientIP(req))
+		ta.audit(req, auditAdminAction, "lockdown_start", fmt.Sprintf("until=%s revoked=%d", until.Format(time.RFC3339), revoked))
+		response := map[string]interface{}{"revoked": revoked}
+		if err != nil {
+			response["error"] = "the session store failed to revoke all sessions"
+		}
+		ta.writeLockdown(rw, response)
+	case http.MethodDelete:
+		ta.setLockdown(time.Time{})
+		log.Printf("[%s] Admin lifted the lockdown (admin request from %s)", ta.name, ta.getClientIP(req))
+		ta.audit(req, auditAdminAction, "lockdown_lift")
+		ta.writeLockdown(rw, nil)
+	default:
+		rw.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// writeLockdown responds with the lockdown state, adding the given fields
+func (ta *TOTPAuth) writeLockdown(rw http.ResponseWriter, response map[string]interface{}) {
+	if response == nil {
+		response = make(map[string]interface{})
+	}
+	until, locked := ta.lockdownEnd(ta.clock.Now())
+	response["locked"] = locked
+	if locked {
+		response["until"] = until
+	}
+	writeJSON(rw, http.StatusOK, response)
+}
@@ -0,0 +1,197 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultLoginPath is the path the challenge form submits codes to
+const defaultLoginPath = "/.totp/login"
+
+// loginReturnParam carries the URL the user asked for through the login path
+const loginReturnParam = "totp_next"
+
+// Handling of requests with a body from unauthenticated clients
+const (
+	unauthenticatedWritesChallenge = "challenge"
+	unauthenticatedWritesReject    = "reject"
+)
+
+// loginCSRFMaxAge is how long the pre-auth cookie behind the login form's
+// CSRF token lives, in seconds
+const loginCSRFMaxAge = 1800
+
+// writeDiscardedMessage tells the user that the request body was not passed on
+const writeDiscardedMessage = "The data you submitted was not saved. Sign in, then submit it again."
+
+// validateLoginPath checks loginPath, which must be a plain absolute path
+// that doesn't shadow one of the plugin's other endpoints
+func validateLoginPath(config *Config) error {
+	if config.LoginPath == "" {
+		config.LoginPath = defaultLoginPath
+	}
+
+	path := config.LoginPath
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.ContainsAny(path, "?#\\ ") {
+		return fmt.Errorf("loginPath must be an absolute path like %s, got %q", defaultLoginPath, path)
+	}
+	switch path {
+	case "/", config.LogoutPath, sessionStatusPath, sessionExtendPath, devicesPath, pairPath, pairPollPath, approvePath, approvalPollPath:
+		return fmt.Errorf("loginPath %s conflicts with another endpoint", path)
+	}
+	if strings.HasPrefix(path, adminPathPrefix) {
+		return fmt.Errorf("loginPath %s conflicts with the admin API", path)
+	}
+	return nil
+}
+
+// loginAction returns the form action for a challenge shown on req: the
+// login path, carrying the URL to return to after a successful submission
+func (ta *TOTPAuth) loginAction(req *http.Request) string {
+	return ta.config.LoginPath + "?" + url.Values{loginReturnParam: {req.URL.RequestURI()}}.Encode()
+}
+
+// loginTarget returns the URL a login submission returns to: a same-origin
+// path or an absolute URL on one of allowedRedirectHosts. Anything else falls
+// back to the site root.
+func (ta *TOTPAuth) loginTarget(req *http.Request) *url.URL {
+	next := req.URL.Query().Get(loginReturnParam)
+	if next == "" {
+		return &url.URL{Path: "/"}
+	}
+
+	safe := sanitizeRedirect(next, ta.config.AllowedRedirectHosts)
+	if safe != next {
+		log.Printf("[%s] Ignoring unsafe login return URL %q from %s", ta.name, next, ta.getClientIP(req))
+	}
+	target, err := url.Parse(safe)
+	if err != nil {
+		return &url.URL{Path: "/"}
+	}
+	return target
+}
+
+// handleLogin handles requests to the login path. Codes are only accepted
+// here; the submission is processed as if it had been made on the URL the
+// user asked for, so areas, the portal return and the final redirect all
+// refer to that URL.
+func (ta *TOTPAuth) handleLogin(rw http.ResponseWriter, req *http.Request) {
+	target := ta.loginTarget(req)
+	if req.Method != http.MethodPost {
+		http.Redirect(rw, req, target.String(), http.StatusSeeOther)
+		return
+	}
+
+	original := req.Clone(req.Context())
+	original.URL = target
+	original.RequestURI = target.RequestURI()
+
+	// A session that must re-verify submits its fresh code here. Any other
+	// submission creates a new session, replacing the one the browser has.
+	if ta.config.StepUpHeader != "" {
+		area, _ := ta.areaFor(target.Path)
+		if session := ta.sessionFromCookies(rw, original); session != nil && session.coversArea(area) {
+			if required, _ := ta.memorySessions().stepUpState(session.TokenHash); required {
+				ta.handleStepUp(rw, original, session)
+				return
+			}
+		}
+	}
+
+	if ta.isDeniedByReputation(original) {
+		ta.audit(original, auditAccessDenied, "reputation")
+		ta.showMessagePage(rw, http.StatusForbidden, "Access Denied", "Access from your network is not permitted.")
+		return
+	}
+
+	// In portal mode codes are only entered on the login portal
+	if ta.config.PortalURL != "" {
+		ta.redirectToPortal(rw, original)
+		return
+	}
+
+	if ta.enforceTLS(rw, original) {
+		return
+	}
+
+	ta.handleTOTPSubmission(rw, original)
+}
+
+// validateUnauthenticatedWrites checks unauthenticatedWrites
+func validateUnauthenticatedWrites(config *Config) error {
+	config.UnauthenticatedWrites = strings.ToLower(config.UnauthenticatedWrites)
+	switch config.UnauthenticatedWrites {
+	case "":
+		config.UnauthenticatedWrites = unauthenticatedWritesChallenge
+	case unauthenticatedWritesChallenge, unauthenticatedWritesReject:
+	default:
+		return fmt.Errorf("unauthenticatedWrites must be %q or %q, got %q", unauthenticatedWritesChallenge, unauthenticatedWritesReject, config.UnauthenticatedWrites)
+	}
+	return nil
+}
+
+// isWriteMethod reports whether requests with method usually carry data
+func isWriteMethod(method string) bool {
+	return method == http.MethodPost || method == http.MethodPut || method == http.MethodPatch
+}
+
+// handleUnauthenticatedWrite answers a POST, PUT or PATCH from a client
+// without a session. The body is never passed on: API clients get a 401 they
+// can retry after authenticating, browsers get the challenge with a warning
+// or, with unauthenticatedWrites reject, a 401 page.
+func (ta *TOTPAuth) handleUnauthenticatedWrite(rw http.ResponseWriter, req *http.Request) {
+	log.Printf("[%s] Discarded %s %s from unauthenticated client %s", ta.name, req.Method, req.URL.Path, ta.getClientIP(req))
+
+	if !acceptsHTML(req) {
+		writeJSONError(rw, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	if ta.config.UnauthenticatedWrites == unauthenticatedWritesReject {
+		ta.showMessagePage(rw, http.StatusUnauthorized, "Sign-in Required", "You need to sign in before submitting data. "+writeDiscardedMessage)
+		return
+	}
+	ta.showTOTPPage(rw, req, writeDiscardedMessage)
+}
+
+// loginCSRFCookieName is the pre-auth cookie holding the nonce the login
+// form's CSRF token is derived from
+func (ta *TOTPAuth) loginCSRFCookieName() string {
+	return ta.config.CookieName + "_csrf"
+}
+
+// loginCSRFToken returns the CSRF token for a login form rendered for req.
+// The nonce of the browser's pre-auth cookie is reused so that several open
+// tabs keep working; a new one is issued when there is none.
+func (ta *TOTPAuth) loginCSRFToken(rw http.ResponseWriter, req *http.Request) string {
+	nonce := ""
+	if cookie, err := req.Cookie(ta.loginCSRFCookieName()); err == nil && len(cookie.Value) == 32 {
+		nonce = cookie.Value
+	} else {
+		nonce = newFormNonce()
+	}
+
+	cookie := ta.sessionCookie(nonce, loginCSRFMaxAge)
+	cookie.Name = ta.loginCSRFCookieName()
+	http.SetCookie(rw, cookie)
+	return ta.csrfToken(nonce, "login")
+}
+
+// validLoginCSRF checks the CSRF token of a submitted login form against the
+// browser's pre-auth cookie. A page on another site can make the browser
+// submit the form, but can neither read the cookie nor compute the token.
+func (ta *TOTPAuth) validLoginCSRF(req *http.Request) bool {
+	cookie, err := req.Cookie(ta.loginCSRFCookieName())
+	if err != nil || len(cookie.Value) != 32 {
+		return false
+	}
+	return ta.validCSRFToken(cookie.Value, "login", req.PostFormValue("csrf"))
+}
+
+// acceptsHTML reports whether the client is a browser that can be shown the
+// challenge page
+func acceptsHTML(req *http.Request) bool {
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,128 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultLogoutPath is the path that ends the current session
+const defaultLogoutPath = "/.totp/logout"
+
+// validateLogoutPath checks logoutPath, which must be a plain absolute path
+// that doesn't shadow one of the plugin's other endpoints
+func validateLogoutPath(config *Config) error {
+	if config.LogoutPath == "" {
+		config.LogoutPath = defaultLogoutPath
+	}
+
+	path := config.LogoutPath
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.ContainsAny(path, "?#\\ ") {
+		return fmt.Errorf("logoutPath must be an absolute path like %s, got %q", defaultLogoutPath, path)
+	}
+	switch path {
+	case "/", sessionStatusPath, sessionExtendPath, devicesPath, pairPath, pairPollPath, approvePath, approvalPollPath:
+		return fmt.Errorf("logoutPath %s conflicts with another endpoint", path)
+	}
+	if strings.HasPrefix(path, adminPathPrefix) {
+		return fmt.Errorf("logoutPath %s conflicts with the admin API", path)
+	}
+	return nil
+}
+
+// logoutEverywhereScope is the value of the scope field of the logout form
+// that ends every session instead of the current one
+const logoutEverywhereScope = "all"
+
+// handleLogout ends the current session, or every session. GET renders a
+// confirmation button so that link prefetching cannot log users out; POST
+// performs the logout. The form carries a CSRF token bound to the session,
+// so other sites can't sign users out either.
+func (ta *TOTPAuth) handleLogout(rw http.ResponseWriter, req *http.Request) {
+	token := ta.sessionToken(req)
+	if req.Method != http.MethodPost {
+		ta.showLogoutPage(rw, req, token, "Do you want to end your session?")
+		return
+	}
+
+	// Without a session there is nothing to protect; the cookie is still cleared
+	if token != "" {
+		if err := req.ParseForm(); err != nil || !ta.validCSRFToken(token, "logout", req.PostFormValue("csrf")) {
+			log.Printf("[%s] Rejected logout with a missing or invalid CSRF token from %s", ta.name, ta.getClientIP(req))
+			ta.showLogoutPage(rw, req, token, "Your sign-out request has expired. Do you want to end your session?")
+			return
+		}
+	}
+
+	if req.PostFormValue("scope") == logoutEverywhereScope && ta.canLogoutEverywhere(req, token) {
+		ta.logoutEverywhere(rw, req)
+		return
+	}
+	ta.logout(rw, req)
+}
+
+// showLogoutPage renders the logout confirmation, offering to end every
+// session when the current one may do so
+func (ta *TOTPAuth) showLogoutPage(rw http.ResponseWriter, req *http.Request, token, message string) {
+	data := map[string]interface{}{
+		"Title":   "Sign Out",
+		"Message": message,
+		"Action":  ta.config.LogoutPath,
+		"Button":  "Sign Out",
+		"CSRF":    ta.csrfToken(token, "logout"),
+	}
+	if ta.canLogoutEverywhere(req, token) {
+		data["Secondary"] = map[string]string{"Name": "scope", "Value": logoutEverywhereScope, "Label": "Sign Out Everywhere"}
+	}
+	ta.renderMessagePage(rw, http.StatusOK, data)
+}
+
+// canLogoutEverywhere reports whether the request holds a valid session and
+// the store can enumerate the sessions to end. Sessions kept in the cookie
+// can't be revoked at all.
+func (ta *TOTPAuth) canLogoutEverywhere(req *http.Request, token string) bool {
+	if token == "" || ta.statelessSessions() {
+		return false
+	}
+	if _, canList := ta.sessions.(SessionLister); !canList {
+		return false
+	}
+	return ta.validSession(req, token) != nil
+}
+
+// logoutEverywhere ends every session, e.g. after a device was lost. With a
+// single shared secret every session belongs to the caller's identity.
+func (ta *TOTPAuth) logoutEverywhere(rw http.ResponseWriter, req *http.Request) {
+	revoked := ta.deleteSessions(func(*Session) bool { return true })
+	log.Printf("[%s] Signed out everywhere from %s: revoked %d session(s)", ta.name, ta.getClientIP(req), revoked)
+	ta.audit(req, auditSessionRevoked, "logout_all", strconv.Itoa(revoked))
+	ta.finishLogout(rw, req)
+}
+
+// logout deletes the current session, clears the cookie and sends the user
+// to the post-logout destination
+func (ta *TOTPAuth) logout(rw http.ResponseWriter, req *http.Request) {
+	if token := ta.sessionToken(req); token != "" {
+		ta.sessions.Delete(hashSessionToken(token))
+		log.Printf("[%s] Session logged out from %s", ta.name, ta.getClientIP(req))
+		ta.audit(req, auditSessionRevoked, "logout")
+	}
+	ta.finishLogout(rw, req)
+}
+
+// finishLogout clears the session cookies and sends the user to the
+// post-logout destination
+func (ta *TOTPAuth) finishLogout(rw http.ResponseWriter, req *http.Request) {
+	// Always clear the cookie, whatever the destination
+	http.SetCookie(rw, ta.expiredCookie(ta.config.CookieName))
+	ta.expireLegacyCookies(rw, req)
+
+	if ta.config.PostLogoutRedirectURL != "" {
+		http.Redirect(rw, req, ta.config.PostLogoutRedirectURL, http.StatusSeeOther)
+		return
+	}
+
+	ta.showMessagePage(rw, http.StatusOK, "Signed Out", "You have been signed out.")
+}
@@ -0,0 +1,135 @@
+package traefik_totp_plugin
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// loopMarkerWindow is how soon after a successful verification a new
+// challenge counts as a redirect loop iteration
+const loopMarkerWindow = 15 * time.Second
+
+// loopMarkerName is the cookie tracking challenges shown right after a
+// successful verification
+func (ta *TOTPAuth) loopMarkerName() string {
+	return ta.config.CookieName + "_loop"
+}
+
+// loopMarker builds the marker cookie. It is deliberately host-only and not
+// Secure so that it survives the misconfigurations it helps diagnose.
+func (ta *TOTPAuth) loopMarker(count int, verifiedAt time.Time, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     ta.loopMarkerName(),
+		Value:    strconv.Itoa(count) + "." + strconv.FormatInt(verifiedAt.Unix(), 10),
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// readLoopMarker returns the loop count and verification time carried by the
+// marker cookie
+func (ta *TOTPAuth) readLoopMarker(req *http.Request) (int, time.Time, bool) {
+	cookie, err := req.Cookie(ta.loopMarkerName())
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	countText, unixText, found := strings.Cut(cookie.Value, ".")
+	if !found {
+		return 0, time.Time{}, false
+	}
+	count, err := strconv.Atoi(countText)
+	if err != nil || count < 0 {
+		return 0, time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(unixText, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return count, time.Unix(unix, 0), true
+}
+
+// markVerified records a successful verification in the marker cookie,
+// keeping the count of a loop that is still in progress
+func (ta *TOTPAuth) markVerified(rw http.ResponseWriter, req *http.Request) {
+	now := ta.clock.Now()
+	count, verifiedAt, ok := ta.readLoopMarker(req)
+	if !ok || now.Sub(verifiedAt) > loopMarkerWindow {
+		count = 0
+	}
+	http.SetCookie(rw, ta.loopMarker(count, now, 60))
+}
+
+// clearLoopMarker removes the marker once the session cookie works
+func (ta *TOTPAuth) clearLoopMarker(rw http.ResponseWriter, req *http.Request) {
+	if _, err := req.Cookie(ta.loopMarkerName()); err == nil {
+		http.SetCookie(rw, ta.loopMarker(0, time.Unix(0, 0), -1))
+	}
+}
+
+// detectRedirectLoop counts challenges shown right after a successful
+// verification and, once redirectLoopThreshold is reached, shows a page
+// explaining why the session is not being accepted. It returns true when
+// the diagnostic page was shown.
+func (ta *TOTPAuth) detectRedirectLoop(rw http.ResponseWriter, req *http.Request) bool {
+	count, verifiedAt, ok := ta.readLoopMarker(req)
+	if !ok {
+		return false
+	}
+	if ta.clock.Now().Sub(verifiedAt) > loopMarkerWindow {
+		ta.clearLoopMarker(rw, req)
+		return false
+	}
+
+	count++
+	if count < ta.config.RedirectLoopThreshold {
+		http.SetCookie(rw, ta.loopMarker(count, verifiedAt, 60))
+		return false
+	}
+
+	causes := ta.redirectLoopCauses(req)
+	log.Printf("[%s] Redirect loop detected for %s after %d verifications: %s", ta.name, ta.getClientIP(req), count, strings.Join(causes, " | "))
+	ta.clearLoopMarker(rw, req)
+	ta.renderMessagePage(rw, http.StatusUnauthorized, map[string]interface{}{
+		"Title":   "Sign-in Is Not Sticking",
+		"Message": "Your code was accepted, but your browser keeps returning without a valid session. Likely causes:",
+		"Details": causes,
+	})
+	return true
+}
+
+// redirectLoopCauses lists the misconfigurations detectable from the request
+func (ta *TOTPAuth) redirectLoopCauses(req *http.Request) []string {
+	var causes []string
+
+	if _, err := req.Cookie(ta.config.CookieName); err != nil {
+		if ta.config.CookieSecure && ta.requestScheme(req) == "http" {
+			causes = append(causes, "The session cookie is marked Secure (cookieSecure: true) but this page appears to be served over plain HTTP, so the browser discards it. Use HTTPS, or add a TLS-terminating proxy to trustedProxies so X-Forwarded-Proto is honoured.")
+		}
+
+		if ta.config.CookieDomain != "" {
+			host := strings.ToLower(ta.requestHost(req))
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			domain := strings.TrimPrefix(strings.ToLower(ta.config.CookieDomain), ".")
+			if host != domain && !strings.HasSuffix(host, "."+domain) {
+				causes = append(causes, "cookieDomain is "+ta.config.CookieDomain+" but this site is served from "+host+", so the browser rejects the session cookie.")
+			}
+		}
+
+		causes = append(causes, "The browser did not send the session cookie ("+ta.config.CookieName+") back. A proxy may be stripping Set-Cookie headers, or the browser is blocking cookies for this site.")
+	} else {
+		causes = append(causes, "The browser sent the session cookie but it was not recognised. Sessions are kept in memory, so this happens when requests are balanced across several instances or the plugin was reloaded.")
+		if ta.config.ValidateIP {
+			causes = append(causes, "validateIP is enabled and your IP address appears to change between requests. Configure trustedProxies or disable validateIP.")
+		}
+	}
+
+	return causes
+}
@@ -0,0 +1,88 @@
+package traefik_totp_plugin
+
+import (
+	"html/template"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// noticeCheckInterval is how often the notice file is stat'ed at most
+const noticeCheckInterval = 5 * time.Second
+
+// noticeMaxSize caps how much of the notice file is shown
+const noticeMaxSize = 4096
+
+// noticeBanner serves the contents of noticeFile, re-reading it only when its
+// size or modification time changes
+type noticeBanner struct {
+	path      string
+	allowHTML bool
+	name      string
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	modTime   time.Time
+	size      int64
+	notice    template.HTML
+}
+
+// newNoticeBanner creates a banner backed by path
+func newNoticeBanner(config *Config, name string) *noticeBanner {
+	return &noticeBanner{
+		path:      config.NoticeFile,
+		allowHTML: config.NoticeHTML,
+		name:      name,
+	}
+}
+
+// current returns the notice to render, or "" when there is none
+func (n *noticeBanner) current(now time.Time) template.HTML {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if now.Sub(n.checkedAt) < noticeCheckInterval {
+		return n.notice
+	}
+	n.checkedAt = now
+
+	info, err := os.Stat(n.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[%s] Failed to stat notice file: %v", n.name, err)
+		}
+		n.modTime, n.size, n.notice = time.Time{}, 0, ""
+		return ""
+	}
+	if info.ModTime().Equal(n.modTime) && info.Size() == n.size {
+		return n.notice
+	}
+
+	data, err := os.ReadFile(n.path)
+	if err != nil {
+		log.Printf("[%s] Failed to read notice file: %v", n.name, err)
+		return n.notice
+	}
+	if len(data) > noticeMaxSize {
+		data = data[:noticeMaxSize]
+	}
+
+	n.modTime, n.size = info.ModTime(), info.Size()
+	text := strings.TrimSpace(string(data))
+	if n.allowHTML {
+		n.notice = template.HTML(text)
+	} else {
+		n.notice = template.HTML(template.HTMLEscapeString(text))
+	}
+	return n.notice
+}
+
+// noticeHTML returns the banner contents for the challenge page
+func (ta *TOTPAuth) noticeHTML() template.HTML {
+	if ta.notice == nil {
+		return ""
+	}
+	return ta.notice.current(ta.clock.Now())
+}
@@ -0,0 +1,70 @@
+package traefik_totp_plugin
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Modes for StrictOriginCheck
+const (
+	originCheckOff     = "off"
+	originCheckLog     = "log"
+	originCheckEnforce = "enforce"
+)
+
+// metricOriginViolation counts submissions failing the origin check
+const metricOriginViolation = "origin.violation"
+
+// checkSubmissionOrigin validates the Origin and Sec-Fetch-Site headers of a
+// code submission. Missing headers are accepted so that old clients and
+// non-browser tools are not penalized. It returns false only when the
+// submission must be rejected.
+func (ta *TOTPAuth) checkSubmissionOrigin(req *http.Request) bool {
+	if ta.config.StrictOriginCheck == originCheckOff {
+		return true
+	}
+
+	reason := ta.originViolation(req)
+	if reason == "" {
+		return true
+	}
+
+	ta.incrMetric(metricOriginViolation)
+	if ta.config.StrictOriginCheck == originCheckLog {
+		log.Printf("[%s] Origin check failed for submission from %s: %s (not enforced)", ta.name, ta.getClientIP(req), reason)
+		return true
+	}
+
+	log.Printf("[%s] Rejected submission from %s: %s", ta.name, ta.getClientIP(req), reason)
+	return false
+}
+
+// originViolation returns a description of the violation, or "" if the
+// submission's headers are acceptable
+func (ta *TOTPAuth) originViolation(req *http.Request) string {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Host == "" {
+			return "invalid Origin " + origin
+		}
+		host := ta.requestHost(req)
+		if !strings.EqualFold(stripDefaultPort(parsed.Host), stripDefaultPort(host)) {
+			return "Origin " + origin + " does not match host " + host
+		}
+	}
+
+	if site := req.Header.Get("Sec-Fetch-Site"); site != "" {
+		if site != "same-origin" && site != "none" {
+			return "Sec-Fetch-Site is " + site
+		}
+	}
+
+	return ""
+}
+
+// stripDefaultPort removes an explicit :80 or :443 from a host
+func stripDefaultPort(host string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(host, ":443"), ":80")
+}
@@ -0,0 +1,224 @@
+package traefik_totp_plugin
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// renderBuffers holds reusable buffers for rendering pages before they are sent
+var renderBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// renderFailedPage is sent instead of a partially rendered page
+const renderFailedPage = `<!DOCTYPE html>
+<html lang="en"><head><meta charset="UTF-8"><title>Error</title></head>
+<body><p>Something went wrong while loading this page. Please try again.</p></body></html>
+`
+
+// pageTemplates holds the page templates, parsed once in New
+type pageTemplates struct {
+	totp         *template.Template
+	message      *template.Template
+	pair         *template.Template
+	devices      *template.Template
+	approvalWait *template.Template
+	approve      *template.Template
+	embedded     *template.Template
+}
+
+// parsePageTemplates parses the templates of every page the plugin serves
+func parsePageTemplates() (*pageTemplates, error) {
+	sources := map[string]string{
+		"totp":     totpPageTemplate,
+		"message":  messagePageTemplate,
+		"pair":     pairPageTemplate,
+		"devices":  devicesPageTemplate,
+		"approval": approvalWaitTemplate,
+		"approve":  approvePageTemplate,
+		"embedded": embeddedSuccessTemplate,
+	}
+	parsed := make(map[string]*template.Template, len(sources))
+	for name, text := range sources {
+		tmpl, err := template.New(name).Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s page template: %w", name, err)
+		}
+		parsed[name] = tmpl
+	}
+	return &pageTemplates{
+		totp:         parsed["totp"],
+		message:      parsed["message"],
+		pair:         parsed["pair"],
+		devices:      parsed["devices"],
+		approvalWait: parsed["approval"],
+		approve:      parsed["approve"],
+		embedded:     parsed["embedded"],
+	}, nil
+}
+
+// renderPage executes tmpl into a pooled buffer and only writes the response
+// once rendering succeeded, so a failing template never sends half a page
+func (ta *TOTPAuth) renderPage(rw http.ResponseWriter, status int, tmpl *template.Template, data interface{}) {
+	buf := renderBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer renderBuffers.Put(buf)
+
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := tmpl.Execute(buf, data); err != nil {
+		log.Printf("[%s] Failed to render %s page: %v", ta.name, tmpl.Name(), err)
+		rw.Header().Set("Cache-Control", "no-store")
+		rw.Header().Set("Content-Length", strconv.Itoa(len(renderFailedPage)))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte(renderFailedPage))
+		return
+	}
+
+	rw.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	rw.WriteHeader(status)
+	rw.Write(buf.Bytes())
+}
+
+// showMessagePage renders a simple informational page (denials, notices, ...)
+// using the same look as the TOTP page
+func (ta *TOTPAuth) showMessagePage(rw http.ResponseWriter, status int, title, message string) {
+	ta.renderMessagePage(rw, status, map[string]interface{}{
+		"Title":   title,
+		"Message": message,
+	})
+}
+
+// showLinkPage renders a message page with a single button that links to href
+func (ta *TOTPAuth) showLinkPage(rw http.ResponseWriter, status int, title, message, href, button string) {
+	ta.renderMessagePage(rw, status, map[string]interface{}{
+		"Title":   title,
+		"Message": message,
+		"Link":    href,
+		"Button":  button,
+	})
+}
+
+// renderMessagePage executes the message page template
+func (ta *TOTPAuth) renderMessagePage(rw http.ResponseWriter, status int, data map[string]interface{}) {
+	rw.Header().Set("Cache-Control", "no-store")
+	ta.renderPage(rw, status, ta.pages.message, data)
+}
+
+// HTML template for informational pages
+const messagePageTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Title}}</title>
+    <style>
+        * {
+            margin: 0;
+            padding: 0;
+            box-sizing: border-box;
+        }
+
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            padding: 20px;
+        }
+
+        .container {
+            background: white;
+            border-radius: 16px;
+            box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
+            max-width: 420px;
+            width: 100%;
+            padding: 40px;
+            text-align: center;
+        }
+
+        h1 {
+            color: #2d3748;
+            font-size: 24px;
+            font-weight: 700;
+            margin-bottom: 12px;
+        }
+
+        .message {
+            color: #718096;
+            font-size: 15px;
+            line-height: 1.6;
+        }
+
+        .details {
+            color: #4a5568;
+            font-size: 14px;
+            line-height: 1.5;
+            margin-top: 16px;
+            padding-left: 20px;
+            text-align: left;
+        }
+
+        .details li {
+            margin-bottom: 8px;
+        }
+
+        form {
+            margin-top: 24px;
+        }
+
+        button, .link {
+            display: block;
+            width: 100%;
+            padding: 14px 24px;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            color: white;
+            border: none;
+            border-radius: 8px;
+            font-size: 16px;
+            font-weight: 600;
+            cursor: pointer;
+        }
+
+        .link {
+            margin-top: 24px;
+            text-decoration: none;
+        }
+
+        button.secondary {
+            margin-top: 12px;
+            background: white;
+            color: #667eea;
+            border: 2px solid #667eea;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Title}}</h1>
+        <p class="message">{{.Message}}</p>
+        {{if .Details}}
+        <ul class="details">
+            {{range .Details}}<li>{{.}}</li>
+            {{end}}
+        </ul>
+        {{end}}
+        {{if .Link}}
+        <a class="link" href="{{.Link}}">{{.Button}}</a>
+        {{end}}
+        {{if .Action}}
+        <form method="POST" action="{{.Action}}">
+            {{if .CSRF}}<input type="hidden" name="csrf" value="{{.CSRF}}">{{end}}
+            <button type="submit">{{.Button}}</button>
+            {{with .Secondary}}<button type="submit" class="secondary" name="{{.Name}}" value="{{.Value}}">{{.Label}}</button>{{end}}
+        </form>
+        {{end}}
+    </div>
+</body>
+</html>`
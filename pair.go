@@ -0,0 +1,558 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pairPath is where an authenticated user approves a waiting device
+	pairPath = "/.totp/pair"
+	// pairPollPath is polled by the waiting device
+	pairPollPath = "/.totp/pair/poll"
+
+	// pairingCodeAlphabet avoids characters that are easily confused (0/O, 1/I)
+	pairingCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+	// pairingMaxPerIP limits pending pairings per client IP
+	pairingMaxPerIP = 5
+	// pairingMaxPending limits pending pairings overall
+	pairingMaxPending = 1000
+	// pairingMaxAttempts limits approval attempts per session within pairingTTL
+	pairingMaxAttempts = 5
+	// pairingQRBorder is the quiet zone around the pairing QR code in modules
+	pairingQRBorder = 4
+)
+
+// pairing is a device waiting to be approved from an authenticated session
+type pairing struct {
+	code      string
+	secret    string // Known only to the waiting device, carried in its cookie
+	ip        string
+	userAgent string
+	createdAt time.Time
+	expiresAt time.Time
+	approved  bool
+	readOnly  bool     // Scope of the approving session, set on approval
+	areas     []string // Areas of the approving session, set on approval
+}
+
+// pairingStore keeps pending pairings and approval attempts
+type pairingStore struct {
+	mu       sync.Mutex
+	byCode   map[string]*pairing
+	bySecret map[string]*pairing
+	attempts map[string][]time.Time
+}
+
+// newPairingStore creates an empty pairing store
+func newPairingStore() *pairingStore {
+	return &pairingStore{
+		byCode:   make(map[string]*pairing),
+		bySecret: make(map[string]*pairing),
+		attempts: make(map[string][]time.Time),
+	}
+}
+
+// create starts a new pairing for the device at ip. It returns nil when ip or
+// the store as a whole has too many pending pairings.
+func (s *pairingStore) create(ip, userAgent string, ttl time.Duration, now time.Time) (*pairing, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := 0
+	for _, p := range s.byCode {
+		if p.ip == ip && now.Before(p.expiresAt) {
+			pending++
+		}
+	}
+	if pending >= pairingMaxPerIP || len(s.byCode) >= pairingMaxPending {
+		return nil, nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	code, err := newPairingCode()
+	if err != nil {
+		return nil, err
+	}
+	if _, taken := s.byCode[code]; taken {
+		return nil, nil
+	}
+
+	p := &pairing{
+		code:      code,
+		secret:    hex.EncodeToString(secret),
+		ip:        ip,
+		userAgent: userAgent,
+		createdAt: now,
+		expiresAt: now.Add(ttl),
+	}
+	s.byCode[p.code] = p
+	s.bySecret[p.secret] = p
+	return p, nil
+}
+
+// pending returns the unexpired pairing identified by the device secret
+func (s *pairingStore) pending(secret string, now time.Time) *pairing {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.bySecret[secret]
+	if p == nil || now.After(p.expiresAt) {
+		return nil
+	}
+	return p
+}
+
+// waiting returns a copy of the unexpired, unapproved pairing with code, so
+// that the approver can see which device it belongs to
+func (s *pairingStore) waiting(code string, now time.Time) (pairing, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.byCode[code]
+	if p == nil || p.approved || now.After(p.expiresAt) {
+		return pairing{}, false
+	}
+	return *p, true
+}
+
+// approve marks the pairing with code as approved with the approving
+// session's scope. It returns false when there is no such unexpired,
+// unapproved pairing.
+func (s *pairingStore) approve(code string, readOnly bool, areas []string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.byCode[code]
+	if p == nil || p.approved || now.After(p.expiresAt) {
+		return false
+	}
+	p.approved = true
+	p.readOnly = readOnly
+	p.areas = append([]string(nil), areas...)
+	return true
+}
+
+// claim removes an approved pairing so that it grants exactly one session,
+// and returns it
+func (s *pairingStore) claim(secret string, now time.Time) (pairing, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.bySecret[secret]
+	if p == nil || !p.approved || now.After(p.expiresAt) {
+		return pairing{}, false
+	}
+	delete(s.byCode, p.code)
+	delete(s.bySecret, p.secret)
+	return *p, true
+}
+
+// allowAttempt records an approval attempt for key and reports whether it is
+// within the limit
+func (s *pairingStore) allowAttempt(key string, window time.Duration, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var recent []time.Time
+	for _, at := range s.attempts[key] {
+		if now.Sub(at) < window {
+			recent = append(recent, at)
+		}
+	}
+	if len(recent) >= pairingMaxAttempts {
+		s.attempts[key] = recent
+		return false
+	}
+	s.attempts[key] = append(recent, now)
+	return true
+}
+
+// cleanup removes expired pairings and old approval attempts
+func (s *pairingStore) cleanup(window time.Duration, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for code, p := range s.byCode {
+		if now.After(p.expiresAt) {
+			delete(s.byCode, code)
+			delete(s.bySecret, p.secret)
+		}
+	}
+	for key, attempts := range s.attempts {
+		if len(attempts) == 0 || now.Sub(attempts[len(attempts)-1]) >= window {
+			delete(s.attempts, key)
+		}
+	}
+}
+
+// newPairingCode returns a random 8 character code
+func newPairingCode() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := make([]byte, len(buf))
+	for i, b := range buf {
+		code[i] = pairingCodeAlphabet[int(b)%len(pairingCodeAlphabet)]
+	}
+	return string(code), nil
+}
+
+// normalizePairingCode accepts codes typed in lower case or with separators
+func normalizePairingCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// formatPairingCode groups a code for display ("ABCD-EFGH")
+func formatPairingCode(code string) string {
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// pairingCookieName is the cookie holding the waiting device's secret
+func (ta *TOTPAuth) pairingCookieName() string {
+	return ta.config.CookieName + "_pair"
+}
+
+// pairingForPage returns the pairing code to show on the challenge page,
+// starting a new pairing when the device has none. It returns "" when pairing
+// is disabled or rate-limited.
+func (ta *TOTPAuth) pairingForPage(rw http.ResponseWriter, req *http.Request) string {
+	if !ta.config.EnablePairing {
+		return ""
+	}
+
+	now := ta.clock.Now()
+	if cookie, err := req.Cookie(ta.pairingCookieName()); err == nil {
+		if p := ta.pairings.pending(cookie.Value, now); p != nil && !p.approved {
+			return p.code
+		}
+	}
+
+	ttl := time.Duration(ta.config.PairingTTL) * time.Second
+	p, err := ta.pairings.create(ta.getClientIP(req), truncate(req.UserAgent(), 256), ttl, now)
+	if err != nil {
+		log.Printf("[%s] Failed to create pairing: %v", ta.name, err)
+		return ""
+	}
+	if p == nil {
+		return ""
+	}
+
+	cookie := ta.sessionCookie(p.secret, ta.config.PairingTTL)
+	cookie.Name = ta.pairingCookieName()
+	http.SetCookie(rw, cookie)
+	return p.code
+}
+
+// pairingQR returns the SVG path data and size of a QR code linking to the
+// approval page with code filled in, or "" when the URL is too long for one
+func (ta *TOTPAuth) pairingQR(req *http.Request, code string) (string, int) {
+	q, err := encodeQR([]byte(ta.requestScheme(req) + "://" + ta.requestHost(req) + pairPath + "?code=" + code))
+	if err != nil {
+		return "", 0
+	}
+	return q.svgPath(pairingQRBorder), q.size + 2*pairingQRBorder
+}
+
+// handlePairPoll answers the waiting device's polling requests and grants it
+// a session once the pairing has been approved
+func (ta *TOTPAuth) handlePairPoll(rw http.ResponseWriter, req *http.Request) {
+	cookie, err := req.Cookie(ta.pairingCookieName())
+	if err != nil {
+		writeJSON(rw, http.StatusOK, map[string]string{"status": "expired"})
+		return
+	}
+
+	now := ta.clock.Now()
+	p := ta.pairings.pending(cookie.Value, now)
+	if p == nil {
+		writeJSON(rw, http.StatusOK, map[string]string{"status": "expired"})
+		return
+	}
+	approved, ok := ta.pairings.claim(cookie.Value, now)
+	if !ok {
+		writeJSON(rw, http.StatusOK, map[string]string{"status": "pending"})
+		return
+	}
+
+	// The device gets the approving session's scope, not the default area
+	ta.discardIncomingSessions(rw, req)
+	sessionToken, err := ta.createScopedSession(req, approved.readOnly, approved.areas, "pairing")
+	if err != nil {
+		log.Printf("[%s] Failed to create session: %v", ta.name, err)
+		writeJSONError(rw, http.StatusInternalServerError, "failed to create session")
+		return
+	}
+	http.SetCookie(rw, ta.sessionCookie(sessionToken, ta.sessionCookieMaxAge()))
+	http.SetCookie(rw, ta.expiredCookie(ta.pairingCookieName()))
+
+	log.Printf("[%s] Successful pairing of device at %s", ta.name, ta.getClientIP(req))
+	ta.incrMetric(metricAuthSuccess)
+	ta.audit(req, auditAuthSuccess, "pairing")
+
+	writeJSON(rw, http.StatusOK, map[string]string{"status": "approved"})
+}
+
+// handlePair lets an authenticated user approve a waiting device. The device
+// is shown before the approval, and a fresh TOTP code is required so that a
+// stolen session alone cannot add devices.
+func (ta *TOTPAuth) handlePair(rw http.ResponseWriter, req *http.Request, session *Session) {
+	current := ta.sessionToken(req)
+
+	if req.Method != http.MethodPost {
+		code := normalizePairingCode(strings.TrimSpace(req.URL.Query().Get("code")))
+		if _, found := ta.pairings.waiting(code, ta.clock.Now()); code != "" && !found {
+			ta.showPairPage(rw, current, code, "Unknown or expired pairing code.")
+			return
+		}
+		ta.showPairPage(rw, current, code, "")
+		return
+	}
+
+	if err := req.ParseForm(); err != nil || !ta.validCSRFToken(current, "pair", req.PostFormValue("csrf")) {
+		ta.showMessagePage(rw, http.StatusForbidden, "Request Rejected", "The form has expired. Please reload the page and try again.")
+		return
+	}
+
+	// Approvals check a code like a login, so they share its failure limits
+	release, ok := ta.reserveAttempt(rw, req)
+	if !ok {
+		return
+	}
+	defer release()
+
+	code := normalizePairingCode(strings.TrimSpace(req.PostFormValue("pairing_code")))
+	clientIP := ta.getClientIP(req)
+
+	window := time.Duration(ta.config.PairingTTL) * time.Second
+	if !ta.pairings.allowAttempt(sessionID(current), window, ta.clock.Now()) {
+		log.Printf("[%s] Too many pairing attempts from %s", ta.name, clientIP)
+		ta.showPairPage(rw, current, code, "Too many attempts. Please wait a few minutes and try again.")
+		return
+	}
+
+	// Only the primary validator may approve devices, not read-only or test codes
+	if _, valid := ta.runValidators(req, strings.TrimSpace(req.PostFormValue("totp_code")), ta.validators[:1]); !valid {
+		log.Printf("[%s] Invalid TOTP code for pairing approval from %s", ta.name, clientIP)
+		ta.incrMetric(metricAuthFailure)
+		ta.audit(req, auditAuthFailure, "pairing_invalid_code")
+		if ta.recordFailedCode(rw, req) {
+			return
+		}
+		ta.delayFailedSubmission(req)
+		ta.showPairPage(rw, current, code, "Invalid TOTP code. Please try again.")
+		return
+	}
+	ta.recordSuccessfulCode(req)
+
+	if !ta.pairings.approve(code, session.ReadOnly, session.Areas, ta.clock.Now()) {
+		log.Printf("[%s] Unknown or expired pairing code from %s", ta.name, clientIP)
+		ta.audit(req, auditAuthFailure, "pairing_unknown_code")
+		ta.showPairPage(rw, current, code, "Unknown or expired pairing code.")
+		return
+	}
+
+	log.Printf("[%s] Pairing approved from %s", ta.name, clientIP)
+	ta.audit(req, auditAuthSuccess, "pairing_approved")
+	ta.showMessagePage(rw, http.StatusOK, "Device Approved", "The other device will be signed in within a few seconds.")
+}
+
+// showPairPage renders the pairing approval form. While code belongs to a
+// waiting device, the page shows that device and asks for a TOTP code;
+// otherwise it asks for the pairing code.
+func (ta *TOTPAuth) showPairPage(rw http.ResponseWriter, current, code, errorMsg string) {
+	data := map[string]interface{}{
+		"Title":  "Pair a Device",
+		"Error":  errorMsg,
+		"Code":   formatPairingCode(code),
+		"Digits": ta.config.CodeDigits,
+		"Steam":  ta.config.CodeFormat == codeFormatSteam,
+		"CSRF":   ta.csrfToken(current, "pair"),
+		"Action": pairPath,
+	}
+	if p, found := ta.pairings.waiting(code, ta.clock.Now()); found {
+		data["Device"] = map[string]string{
+			"IP":        p.ip,
+			"UserAgent": p.userAgent,
+			"Requested": p.createdAt.UTC().Format("2006-01-02 15:04:05 MST"),
+		}
+	}
+
+	status := http.StatusOK
+	if errorMsg != "" {
+		status = http.StatusBadRequest
+	}
+	rw.Header().Set("Cache-Control", "no-store")
+	ta.renderPage(rw, status, ta.pages.pair, data)
+}
+
+// HTML template for approving a device pairing
+const pairPageTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>{{.Title}}</title>
+    <style>
+        * {
+            margin: 0;
+            padding: 0;
+            box-sizing: border-box;
+        }
+
+        body {
+            font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            min-height: 100vh;
+            display: flex;
+            align-items: center;
+            justify-content: center;
+            padding: 20px;
+        }
+
+        .container {
+            background: white;
+            border-radius: 16px;
+            box-shadow: 0 20px 60px rgba(0, 0, 0, 0.3);
+            max-width: 420px;
+            width: 100%;
+            padding: 40px;
+        }
+
+        h1 {
+            color: #2d3748;
+            font-size: 24px;
+            font-weight: 700;
+            margin-bottom: 12px;
+            text-align: center;
+        }
+
+        .description {
+            color: #718096;
+            font-size: 15px;
+            line-height: 1.6;
+            margin-bottom: 24px;
+            text-align: center;
+        }
+
+        .error {
+            background: #fed7d7;
+            color: #c53030;
+            padding: 12px 16px;
+            border-radius: 8px;
+            margin-bottom: 20px;
+            font-size: 14px;
+        }
+
+        label {
+            display: block;
+            color: #4a5568;
+            font-size: 14px;
+            font-weight: 600;
+            margin-bottom: 8px;
+        }
+
+        input {
+            width: 100%;
+            padding: 14px 16px;
+            font-size: 20px;
+            letter-spacing: 4px;
+            text-align: center;
+            border: 2px solid #e2e8f0;
+            border-radius: 8px;
+            margin-bottom: 20px;
+            font-family: 'Courier New', monospace;
+        }
+
+        dl {
+            margin-bottom: 24px;
+            font-size: 14px;
+        }
+
+        dt {
+            color: #4a5568;
+            font-weight: 600;
+        }
+
+        dd {
+            color: #718096;
+            margin-bottom: 10px;
+            word-break: break-word;
+        }
+
+        button {
+            width: 100%;
+            padding: 14px 24px;
+            background: linear-gradient(135deg, #667eea 0%, #764ba2 100%);
+            color: white;
+            border: none;
+            border-radius: 8px;
+            font-size: 16px;
+            font-weight: 600;
+            cursor: pointer;
+        }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h1>{{.Title}}</h1>
+        {{if .Device}}
+        <p class="description">Only approve the device if you recognise it. It will be signed in with the same access as this one.</p>
+
+        {{if .Error}}
+        <div class="error">{{.Error}}</div>
+        {{end}}
+
+        <dl>
+            <dt>Pairing code</dt>
+            <dd>{{.Code}}</dd>
+            <dt>IP address</dt>
+            <dd>{{.Device.IP}}</dd>
+            <dt>Browser</dt>
+            <dd>{{if .Device.UserAgent}}{{.Device.UserAgent}}{{else}}unknown{{end}}</dd>
+            <dt>Requested</dt>
+            <dd>{{.Device.Requested}}</dd>
+        </dl>
+
+        <form method="POST" action="{{.Action}}">
+            <input type="hidden" name="csrf" value="{{.CSRF}}">
+            <input type="hidden" name="pairing_code" value="{{.Code}}">
+            <label for="totp_code">Authentication Code</label>
+            <input type="text" id="totp_code" name="totp_code" maxlength="{{.Digits}}" {{if .Steam}}pattern="[2-9BCDFGHJKMNPQRTVWXYbcdfghjkmnpqrtvwxy]*" autocapitalize="characters"{{else}}pattern="[0-9]*" inputmode="numeric"{{end}} autocomplete="one-time-code" required>
+            <button type="submit">Approve Device</button>
+        </form>
+        {{else}}
+        <p class="description">Enter the pairing code shown on the other device, or scan its QR code.</p>
+
+        {{if .Error}}
+        <div class="error">{{.Error}}</div>
+        {{end}}
+
+        <form method="GET" action="{{.Action}}">
+            <label for="code">Pairing Code</label>
+            <input type="text" id="code" name="code" value="{{.Code}}" maxlength="9" autocomplete="off" autocapitalize="characters" required>
+            <button type="submit">Continue</button>
+        </form>
+        {{end}}
+    </div>
+</body>
+</html>`
@@ -0,0 +1,140 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// postPairApproval submits the pairing approval form with totpCode and
+// returns the status
+func postPairApproval(ta *TOTPAuth, token, totpCode string) int {
+	form := url.Values{
+		"csrf":         {ta.csrfToken(token, "pair")},
+		"pairing_code": {"ABCD1234"},
+		"totp_code":    {totpCode},
+	}
+	req := withSession(ta, newTestForm(pairPath, form), token)
+
+	rec := httptest.NewRecorder()
+	ta.ServeHTTP(rec, req)
+	return rec.Code
+}
+
+func TestPairApprovalCountsFailedCodes(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.EnablePairing = true
+		config.MaxFailedAttempts = 3
+		config.DisableFailureDelay = true
+	})
+	token := newTestSession(t, ta)
+
+	for i := 1; i <= 2; i++ {
+		if status := postPairApproval(ta, token, "000000"); status != http.StatusBadRequest {
+			t.Fatalf("failed code %d: status %d, want %d", i, status, http.StatusBadRequest)
+		}
+	}
+	if status := postPairApproval(ta, token, "000000"); status != http.StatusTooManyRequests {
+		t.Fatalf("failed code 3: status %d, want %d (locked out)", status, http.StatusTooManyRequests)
+	}
+
+	// A locked out client can't approve devices, even with a valid code
+	valid := currentCode(ta)
+	if status := postPairApproval(ta, token, valid); status != http.StatusTooManyRequests {
+		t.Errorf("valid code while locked out: status %d, want %d", status, http.StatusTooManyRequests)
+	}
+}
+
+func TestPairApprovalSuccessResetsFailures(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.EnablePairing = true
+		config.MaxFailedAttempts = 3
+		config.DisableFailureDelay = true
+	})
+	token := newTestSession(t, ta)
+
+	postPairApproval(ta, token, "000000")
+	postPairApproval(ta, token, "000000")
+	// The pairing code is unknown, but the TOTP code was right
+	postPairApproval(ta, token, currentCode(ta))
+
+	if status := postPairApproval(ta, token, "000000"); status != http.StatusBadRequest {
+		t.Errorf("failed code after a valid one: status %d, want %d", status, http.StatusBadRequest)
+	}
+}
+
+// TestPairingShowsDeviceAndCopiesScope pairs a device end to end: the waiting
+// device gets a QR code, the approver sees its IP and browser before
+// confirming, and the paired session has the approver's areas
+func TestPairingShowsDeviceAndCopiesScope(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.EnablePairing = true
+		config.DisableFailureDelay = true
+	})
+
+	waiting := newTestRequest(http.MethodGet, "/app")
+	waiting.RemoteAddr = "198.51.100.7:4321"
+	waiting.Header.Set("User-Agent", "SmartTV/1.0")
+	rec := httptest.NewRecorder()
+	ta.ServeHTTP(rec, waiting)
+	if !strings.Contains(rec.Body.String(), `class="pairing-qr"`) {
+		t.Error("challenge page lacks the pairing QR code")
+	}
+	pairCookie := responseCookie(rec, ta.pairingCookieName())
+	if pairCookie == nil {
+		t.Fatal("no pairing cookie set")
+	}
+	code := ta.pairings.pending(pairCookie.Value, ta.clock.Now()).code
+
+	approver, err := ta.createScopedSession(newTestRequest(http.MethodGet, "/"), false, []string{"", "/admin"}, methodTOTP)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = httptest.NewRecorder()
+	ta.ServeHTTP(rec, withSession(ta, newTestRequest(http.MethodGet, pairPath+"?code="+strings.ToLower(formatPairingCode(code))), approver))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("approval page: status %d", rec.Code)
+	}
+	for _, want := range []string{"198.51.100.7", "SmartTV/1.0"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("approval page doesn't show %q", want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	ta.ServeHTTP(rec, withSession(ta, newTestRequest(http.MethodGet, pairPath+"?code=ZZZZZZZZ"), approver))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "Unknown or expired") {
+		t.Errorf("unknown pairing code: status %d", rec.Code)
+	}
+
+	form := url.Values{
+		"csrf":         {ta.csrfToken(approver, "pair")},
+		"pairing_code": {code},
+		"totp_code":    {currentCode(ta)},
+	}
+	rec = httptest.NewRecorder()
+	ta.ServeHTTP(rec, withSession(ta, newTestForm(pairPath, form), approver))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("approval: status %d", rec.Code)
+	}
+
+	poll := newTestRequest(http.MethodGet, pairPollPath)
+	poll.AddCookie(pairCookie)
+	rec = httptest.NewRecorder()
+	ta.ServeHTTP(rec, poll)
+	cookie := responseCookie(rec, ta.config.CookieName)
+	if cookie == nil {
+		t.Fatalf("no session after approval: %s", rec.Body.String())
+	}
+	session, ok := ta.lookupSession(cookie.Value)
+	if !ok {
+		t.Fatal("paired session not found")
+	}
+	if session.Method != "pairing" || session.ReadOnly || !reflect.DeepEqual(session.Areas, []string{"", "/admin"}) {
+		t.Errorf("paired session method %q, read-only %v, areas %q; want the approver's scope", session.Method, session.ReadOnly, session.Areas)
+	}
+}
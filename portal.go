@@ -0,0 +1,215 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// portalReturnParam carries the original URL to the login portal
+	portalReturnParam = "totp_return"
+	// portalAssertionParam carries the signed assertion back from the portal
+	portalAssertionParam = "totp_assertion"
+)
+
+// replayCache remembers nonces until they expire so that each one is
+// accepted only once
+type replayCache struct {
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// use records nonce and reports whether it had not been used before
+func (c *replayCache) use(nonce string, expires time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, used := c.seen[nonce]; used {
+		return false
+	}
+	c.seen[nonce] = expires
+	return true
+}
+
+// cleanup removes expired nonces
+func (c *replayCache) cleanup(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for nonce, expires := range c.seen {
+		if now.After(expires) {
+			delete(c.seen, nonce)
+		}
+	}
+}
+
+// signPortalAssertion computes the assertion signature, bound to the host the
+// assertion is issued for
+func signPortalAssertion(key []byte, expires, nonce, scope, host string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("portal\n" + expires + "\n" + nonce + "\n" + scope + "\n" + strings.ToLower(stripDefaultPort(host))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// issuePortalAssertion creates a "<expires>.<nonce>.<scope>.<signature>"
+// assertion for host
+func (ta *TOTPAuth) issuePortalAssertion(host string, readOnly bool, now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(now.Add(time.Duration(ta.config.PortalTokenMaxAge)*time.Second).Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	scope := "full"
+	if readOnly {
+		scope = "readonly"
+	}
+	return expires + "." + nonceHex + "." + scope + "." + signPortalAssertion([]byte(ta.config.PortalSigningKey), expires, nonceHex, scope, host), nil
+}
+
+// verifyPortalAssertion checks an assertion's signature, expiry and that it
+// has not been used before, and reports whether it grants read-only access
+func (ta *TOTPAuth) verifyPortalAssertion(assertion, host string, now time.Time) (bool, error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 4 || (parts[2] != "full" && parts[2] != "readonly") {
+		return false, fmt.Errorf("malformed assertion")
+	}
+
+	expected := signPortalAssertion([]byte(ta.config.PortalSigningKey), parts[0], parts[1], parts[2], host)
+	if !hmac.Equal([]byte(expected), []byte(parts[3])) {
+		return false, fmt.Errorf("bad signature")
+	}
+
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false, fmt.Errorf("malformed expiry")
+	}
+	expires := time.Unix(unix, 0)
+	if now.After(expires) {
+		return false, fmt.Errorf("expired %s ago", now.Sub(expires).Round(time.Second))
+	}
+	if expires.Sub(now) > time.Duration(ta.config.PortalTokenMaxAge)*time.Second+30*time.Second {
+		return false, fmt.Errorf("expiry too far in the future")
+	}
+
+	if !ta.portalReplay.use(parts[1], expires) {
+		return false, fmt.Errorf("assertion already used")
+	}
+	return parts[2] == "readonly", nil
+}
+
+// requestScheme returns the scheme the client used, honouring
+// X-Forwarded-Proto from trusted proxies
+func (ta *TOTPAuth) requestScheme(req *http.Request) string {
+	if ip := net.ParseIP(remoteHost(req)); ip != nil && ta.isTrustedProxyIP(ip) {
+		if proto := strings.ToLower(strings.TrimSpace(strings.Split(req.Header.Get("X-Forwarded-Proto"), ",")[0])); proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// redirectToPortal sends an unauthenticated client to the login portal,
+// passing the URL it asked for
+func (ta *TOTPAuth) redirectToPortal(rw http.ResponseWriter, req *http.Request) {
+	original := ta.requestScheme(req) + "://" + ta.requestHost(req) + req.URL.RequestURI()
+
+	target, _ := url.Parse(ta.config.PortalURL)
+	query := target.Query()
+	query.Set(portalReturnParam, original)
+	target.RawQuery = query.Encode()
+
+	http.Redirect(rw, req, target.String(), http.StatusSeeOther)
+}
+
+// redirectToPortalReturn is used on the portal: when the request carries an
+// allowed return URL, the client is sent back to it with a signed assertion.
+// The assertion carries the scope of the portal session. It returns false
+// when there is nothing to return to.
+func (ta *TOTPAuth) redirectToPortalReturn(rw http.ResponseWriter, req *http.Request, readOnly bool) bool {
+	if ta.config.PortalSigningKey == "" {
+		return false
+	}
+
+	returnURL := req.URL.Query().Get(portalReturnParam)
+	if returnURL == "" {
+		return false
+	}
+
+	target, err := url.Parse(returnURL)
+	if err != nil || target.Host == "" || !isAllowedRedirect(returnURL, ta.config.AllowedRedirectHosts) {
+		log.Printf("[%s] Refusing portal return to %q from %s", ta.name, returnURL, ta.getClientIP(req))
+		return false
+	}
+
+	assertion, err := ta.issuePortalAssertion(target.Host, readOnly, ta.clock.Now())
+	if err != nil {
+		log.Printf("[%s] Failed to issue portal assertion: %v", ta.name, err)
+		return false
+	}
+
+	query := target.Query()
+	query.Set(portalAssertionParam, assertion)
+	target.RawQuery = query.Encode()
+
+	log.Printf("[%s] Issued portal assertion for %s to %s", ta.name, target.Host, ta.getClientIP(req))
+	http.Redirect(rw, req, target.String(), http.StatusSeeOther)
+	return true
+}
+
+// handlePortalAssertion converts an assertion from the login portal into a
+// local session. It returns false when the request carries no assertion.
+func (ta *TOTPAuth) handlePortalAssertion(rw http.ResponseWriter, req *http.Request) bool {
+	if ta.config.PortalURL == "" {
+		return false
+	}
+
+	query := req.URL.Query()
+	assertion := query.Get(portalAssertionParam)
+	if assertion == "" {
+		return false
+	}
+
+	readOnly, err := ta.verifyPortalAssertion(assertion, ta.requestHost(req), ta.clock.Now())
+	if err != nil {
+		log.Printf("[%s] Rejected portal assertion from %s: %v", ta.name, ta.getClientIP(req), err)
+		ta.audit(req, auditAuthFailure, "portal_assertion", err.Error())
+		ta.showMessagePage(rw, http.StatusUnauthorized, "Sign-in Failed", "The sign-in link is invalid or has expired. Please try again.")
+		return true
+	}
+
+	area, _ := ta.areaFor(req.URL.Path)
+	ta.discardIncomingSessions(rw, req)
+	sessionToken, err := ta.createScopedSession(req, readOnly, []string{area}, "portal")
+	if err != nil {
+		log.Printf("[%s] Failed to create session: %v", ta.name, err)
+		ta.showMessagePage(rw, http.StatusInternalServerError, "Sign-in Failed", "Authentication failed. Please try again.")
+		return true
+	}
+	http.SetCookie(rw, ta.sessionCookie(sessionToken, ta.sessionCookieMaxAge()))
+	ta.markVerified(rw, req)
+
+	log.Printf("[%s] Successful portal authentication from %s", ta.name, ta.getClientIP(req))
+	ta.audit(req, auditAuthSuccess, "portal_assertion")
+
+	// Continue to the original URL without the assertion
+	query.Del(portalAssertionParam)
+	stripped := *req.URL
+	stripped.RawQuery = query.Encode()
+	http.Redirect(rw, req, stripped.RequestURI(), http.StatusSeeOther)
+	return true
+}
@@ -0,0 +1,169 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// portalTestKey is the key the test portal and apps share
+const portalTestKey = "portal-signing-key-0123456789abcdef"
+
+// newPortalApp creates an app that sends unauthenticated users to the portal
+func newPortalApp(t *testing.T) (*TOTPAuth, *fakeClock) {
+	t.Helper()
+	ta := newTestAuth(t, func(config *Config) {
+		config.PortalURL = "https://login.example/"
+		config.PortalSigningKey = portalTestKey
+		config.PortalTokenMaxAge = 60
+	})
+	clock := newFakeClock(time.Date(2026, 9, 10, 11, 12, 13, 0, time.UTC))
+	ta.SetClock(clock)
+	return ta, clock
+}
+
+// forgeAssertion returns an assertion for host expiring at expires, signed
+// with the shared key
+func forgeAssertion(expires time.Time, nonce, scope, host string) string {
+	unix := strconv.FormatInt(expires.Unix(), 10)
+	return unix + "." + nonce + "." + scope + "." + signPortalAssertion([]byte(portalTestKey), unix, nonce, scope, host)
+}
+
+func TestVerifyPortalAssertion(t *testing.T) {
+	ta, clock := newPortalApp(t)
+	now := clock.Now()
+	maxAge := 60 * time.Second
+
+	tests := []struct {
+		name      string
+		assertion string
+		host      string
+		readOnly  bool
+		wantErr   string // "" for a valid assertion
+	}{
+		{"valid", forgeAssertion(now.Add(maxAge), "n1", "full", "app.example"), "app.example", false, ""},
+		{"read-only", forgeAssertion(now.Add(maxAge), "n2", "readonly", "app.example"), "app.example", true, ""},
+		{"host in other case with default port", forgeAssertion(now.Add(maxAge), "n3", "full", "app.example"), "APP.example:443", false, ""},
+		{"wrong host", forgeAssertion(now.Add(maxAge), "n4", "full", "app.example"), "other.example", false, "bad signature"},
+		{"issued for another port", forgeAssertion(now.Add(maxAge), "n5", "full", "app.example:8443"), "app.example", false, "bad signature"},
+		{"expired", forgeAssertion(now.Add(-time.Second), "n6", "full", "app.example"), "app.example", false, "expired"},
+		{"expiring now", forgeAssertion(now, "n7", "full", "app.example"), "app.example", false, ""},
+		{"expiry within the slack", forgeAssertion(now.Add(maxAge+30*time.Second), "n8", "full", "app.example"), "app.example", false, ""},
+		{"expiry too far in the future", forgeAssertion(now.Add(maxAge+31*time.Second), "n9", "full", "app.example"), "app.example", false, "too far in the future"},
+		{"scope raised", strings.Replace(forgeAssertion(now.Add(maxAge), "n10", "readonly", "app.example"), ".readonly.", ".full.", 1), "app.example", false, "bad signature"},
+		{"unknown scope", forgeAssertion(now.Add(maxAge), "n11", "admin", "app.example"), "app.example", false, "malformed"},
+		{"signature missing", "123.n12.full", "app.example", false, "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			readOnly, err := ta.verifyPortalAssertion(tt.assertion, tt.host, now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("valid assertion rejected: %v", err)
+				}
+				if readOnly != tt.readOnly {
+					t.Errorf("read-only %v, want %v", readOnly, tt.readOnly)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Each assertion is accepted once
+	assertion := forgeAssertion(now.Add(maxAge), "single", "full", "app.example")
+	if _, err := ta.verifyPortalAssertion(assertion, "app.example", now); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if _, err := ta.verifyPortalAssertion(assertion, "app.example", now); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("second use: error %v, want it rejected as already used", err)
+	}
+}
+
+// TestPortalAssertionFlow signs in through the portal: the portal returns
+// the user with an assertion, the app turns it into a session, redirects to
+// the original URL without the assertion and refuses the link a second time
+func TestPortalAssertionFlow(t *testing.T) {
+	portal := newTestAuth(t, func(config *Config) {
+		config.PortalSigningKey = portalTestKey
+		config.AllowedRedirectHosts = []string{"app.example"}
+	})
+	app, clock := newPortalApp(t)
+	portal.SetClock(clock)
+
+	original := "https://app.example/reports?year=2026&tab=q3"
+
+	// Unauthenticated requests go to the portal
+	rec := httptest.NewRecorder()
+	app.ServeHTTP(rec, newTestRequest(http.MethodGet, "/reports?year=2026&tab=q3"))
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if rec.Code != http.StatusSeeOther || err != nil || location.Host != "login.example" {
+		t.Fatalf("unauthenticated request: status %d, Location %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if got := location.Query().Get(portalReturnParam); got != original {
+		t.Fatalf("return URL %q, want %q", got, original)
+	}
+
+	// A signed-in portal user is sent back with an assertion
+	portalSession := newTestSession(t, portal)
+	req := withSession(portal, newTestRequest(http.MethodGet, "/?"+portalReturnParam+"="+url.QueryEscape(original)), portalSession)
+	rec = httptest.NewRecorder()
+	portal.ServeHTTP(rec, req)
+	back := rec.Header().Get("Location")
+	if rec.Code != http.StatusSeeOther || !strings.HasPrefix(back, "https://app.example/reports?") || !strings.Contains(back, portalAssertionParam+"=") {
+		t.Fatalf("portal: status %d, Location %q", rec.Code, back)
+	}
+
+	backURL, err := url.Parse(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	app.ServeHTTP(rec, newTestRequest(http.MethodGet, backURL.RequestURI()))
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("assertion: status %d", rec.Code)
+	}
+	stripped, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stripped.Path != "/reports" || stripped.Query().Has(portalAssertionParam) ||
+		stripped.Query().Get("year") != "2026" || stripped.Query().Get("tab") != "q3" {
+		t.Errorf("redirect after the assertion to %q, want the original URL without %s", stripped, portalAssertionParam)
+	}
+	cookie := responseCookie(rec, app.config.CookieName)
+	if cookie == nil {
+		t.Fatal("no session cookie after a valid assertion")
+	}
+	session, ok := app.lookupSession(cookie.Value)
+	if !ok || session.Method != "portal" {
+		t.Fatalf("portal session not found")
+	}
+
+	// The same link can't be used again, e.g. from the browser history
+	rec = httptest.NewRecorder()
+	app.ServeHTTP(rec, newTestRequest(http.MethodGet, backURL.RequestURI()))
+	if rec.Code != http.StatusUnauthorized || responseCookie(rec, app.config.CookieName) != nil {
+		t.Errorf("reused assertion: status %d", rec.Code)
+	}
+
+	// Nor can a fresh one once it has expired
+	rec = httptest.NewRecorder()
+	portal.ServeHTTP(rec, withSession(portal, newTestRequest(http.MethodGet, "/?"+portalReturnParam+"="+url.QueryEscape(original)), portalSession))
+	fresh, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(61 * time.Second)
+	rec = httptest.NewRecorder()
+	app.ServeHTTP(rec, newTestRequest(http.MethodGet, fresh.RequestURI()))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expired assertion: status %d", rec.Code)
+	}
+}
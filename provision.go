@@ -0,0 +1,109 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// minSecretBytes is the shortest secret RFC 4226 allows (128 bits)
+const minSecretBytes = 16
+
+// GenerateSecret returns a random secret of the given number of bytes as a
+// padded base32 string, ready for secretKey. 20 bytes (160 bits) is the
+// length RFC 4226 recommends; 0 selects it.
+func GenerateSecret(bytes int) (string, error) {
+	if bytes == 0 {
+		bytes = 20
+	}
+	if bytes < minSecretBytes {
+		return "", fmt.Errorf("secrets must have at least %d bytes, got %d", minSecretBytes, bytes)
+	}
+
+	buf := make([]byte, bytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.EncodeToString(buf), nil
+}
+
+// ProvisioningOptions are the code parameters a provisioning URI enrolls.
+// Zero values select the plugin's defaults.
+type ProvisioningOptions struct {
+	Digits    int    // Number of digits in codes (default: 6)
+	Period    int    // Time step in seconds (default: 30)
+	Algorithm string // HMAC algorithm: SHA1, SHA256 or SHA512 (default: SHA1)
+	Steam     bool   // Steam Guard codes, as with codeFormat steam
+}
+
+// ProvisioningURI returns the otpauth:// URI that enrolls secret in an
+// authenticator app, for codes of the given digits and period (in seconds)
+// as the plugin validates them with the default SHA1 algorithm
+func ProvisioningURI(secret, issuer, account string, digits, period int) string {
+	return ProvisioningURIWithOptions(secret, issuer, account, ProvisioningOptions{Digits: digits, Period: period})
+}
+
+// ProvisioningURIWithOptions returns the otpauth:// URI that enrolls secret
+// for codes with opts, including other algorithms and Steam Guard codes
+func ProvisioningURIWithOptions(secret, issuer, account string, opts ProvisioningOptions) string {
+	if opts.Digits <= 0 {
+		opts.Digits = 6
+	}
+	if opts.Period <= 0 {
+		opts.Period = 30
+	}
+
+	query := url.Values{}
+	// Authenticator apps expect the secret without padding
+	query.Set("secret", strings.TrimRight(normalizeSecret(secret), "="))
+	if issuer != "" {
+		query.Set("issuer", issuer)
+	}
+	query.Set("digits", strconv.Itoa(opts.Digits))
+	query.Set("period", strconv.Itoa(opts.Period))
+	// SHA1 is what apps assume when the parameter is missing
+	if algorithm := strings.ToUpper(opts.Algorithm); algorithm != "" && algorithm != "SHA1" {
+		query.Set("algorithm", algorithm)
+	}
+	if opts.Steam {
+		query.Set("encoder", "steam")
+	}
+
+	label := account
+	if issuer != "" {
+		label = issuer + ":" + label
+	}
+	return "otpauth://totp/" + url.PathEscape(label) + "?" + query.Encode()
+}
+
+// ProvisioningOptionsFor returns the code parameters config validates codes
+// of prefix with: the pathTokenSettings of a pathSecrets prefix, or the
+// plugin-level ones for "". Empty settings get the plugin's defaults.
+func ProvisioningOptionsFor(config *Config, prefix string) (ProvisioningOptions, error) {
+	period, err := parseSeconds("timeStep", config.TimeStep, 30)
+	if err != nil {
+		return ProvisioningOptions{}, err
+	}
+	opts := ProvisioningOptions{
+		Digits:    config.CodeDigits,
+		Period:    period,
+		Algorithm: config.Algorithm,
+		Steam:     strings.EqualFold(config.CodeFormat, codeFormatSteam),
+	}
+
+	if settings, ok := config.PathTokenSettings[prefix]; ok {
+		if settings.Digits > 0 {
+			opts.Digits = settings.Digits
+		}
+		if settings.Period > 0 {
+			opts.Period = settings.Period
+		}
+		if settings.Algorithm != "" {
+			opts.Algorithm = settings.Algorithm
+		}
+	}
+	return opts, nil
+}
@@ -0,0 +1,65 @@
+package traefik_totp_plugin
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestProvisioningURIWithOptions(t *testing.T) {
+	config := CreateConfig()
+	config.TimeStep = "1m"
+	config.CodeDigits = 8
+	config.Algorithm = "SHA256"
+	config.PathSecrets = map[string]string{"/admin": testSecret}
+	config.PathTokenSettings = map[string]TokenSettings{"/admin": {Digits: 6, Algorithm: "SHA512"}}
+
+	tests := []struct {
+		name   string
+		prefix string
+		steam  bool
+		want   url.Values
+	}{
+		{"plugin-level settings", "", false, url.Values{"digits": {"8"}, "period": {"60"}, "algorithm": {"SHA256"}}},
+		{"pathTokenSettings", "/admin", false, url.Values{"digits": {"6"}, "period": {"60"}, "algorithm": {"SHA512"}}},
+		{"Steam Guard codes", "", true, url.Values{"digits": {"8"}, "period": {"60"}, "algorithm": {"SHA256"}, "encoder": {"steam"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.CodeFormat = ""
+			if tt.steam {
+				config.CodeFormat = codeFormatSteam
+			}
+			opts, err := ProvisioningOptionsFor(config, tt.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			uri, err := url.Parse(ProvisioningURIWithOptions(testSecret, "MyApp", "user@example.com", opts))
+			if err != nil {
+				t.Fatal(err)
+			}
+			query := uri.Query()
+			if query.Get("secret") != testSecret || query.Get("issuer") != "MyApp" {
+				t.Errorf("URI %s lacks the secret or issuer", uri)
+			}
+			for _, key := range []string{"digits", "period", "algorithm", "encoder"} {
+				if got, want := query.Get(key), tt.want.Get(key); got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+		})
+	}
+
+	// ProvisioningURI keeps describing SHA1 codes, which apps assume by default
+	uri, err := url.Parse(ProvisioningURI(testSecret, "MyApp", "user@example.com", 6, 30))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Query().Has("algorithm") || uri.Query().Get("digits") != "6" || uri.Query().Get("period") != "30" {
+		t.Errorf("ProvisioningURI = %s", uri)
+	}
+
+	config.TimeStep = "soon"
+	if _, err := ProvisioningOptionsFor(config, ""); err == nil {
+		t.Error("invalid timeStep accepted")
+	}
+}
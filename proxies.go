@@ -0,0 +1,146 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// trustedProxySet holds the trusted proxy networks. Entries may be CIDR
+// ranges, single IPs or hostnames; hostnames are resolved at startup and
+// re-resolved periodically, and the resulting set is swapped atomically.
+type trustedProxySet struct {
+	static []*net.IPNet
+	hosts  []string
+
+	mu       sync.RWMutex
+	resolved map[string][]*net.IPNet // Last known addresses per hostname
+	networks []*net.IPNet            // static plus all resolved addresses
+}
+
+// newTrustedProxySet parses the trustedProxies entries, resolving hostnames.
+// Resolution failures at startup are fatal.
+func newTrustedProxySet(ctx context.Context, entries []string) (*trustedProxySet, error) {
+	tp := &trustedProxySet{resolved: make(map[string][]*net.IPNet)}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case strings.Contains(entry, "/"):
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR in trustedProxies (%s): %w", entry, err)
+			}
+			tp.static = append(tp.static, network)
+		case net.ParseIP(entry) != nil:
+			tp.static = append(tp.static, hostNetwork(net.ParseIP(entry)))
+		default:
+			networks, err := resolveHostNetworks(ctx, entry)
+			if err != nil {
+				return nil, fmt.Errorf("failed to resolve trustedProxies host %s: %w", entry, err)
+			}
+			tp.hosts = append(tp.hosts, entry)
+			tp.resolved[entry] = networks
+		}
+	}
+
+	tp.rebuild()
+	return tp, nil
+}
+
+// contains reports whether ip belongs to a trusted proxy
+func (tp *trustedProxySet) contains(ip net.IP) bool {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+
+	for _, network := range tp.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// list returns the trusted networks, including the resolved hostnames
+func (tp *trustedProxySet) list() []*net.IPNet {
+	tp.mu.RLock()
+	defer tp.mu.RUnlock()
+	return tp.networks
+}
+
+// refresh re-resolves all hostnames. Hosts that fail to resolve keep their
+// last known addresses.
+func (tp *trustedProxySet) refresh(ctx context.Context, name string) {
+	for _, host := range tp.hosts {
+		networks, err := resolveHostNetworks(ctx, host)
+		if err != nil {
+			log.Printf("[%s] WARNING: failed to re-resolve trusted proxy %s, keeping last known addresses: %v", name, host, err)
+			continue
+		}
+
+		tp.mu.Lock()
+		tp.resolved[host] = networks
+		tp.mu.Unlock()
+	}
+
+	tp.rebuild()
+}
+
+// rebuild recomputes the combined network list and swaps it in
+func (tp *trustedProxySet) rebuild() {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+
+	networks := append([]*net.IPNet(nil), tp.static...)
+	for _, host := range tp.hosts {
+		networks = append(networks, tp.resolved[host]...)
+	}
+	tp.networks = networks
+}
+
+// runRefresh periodically re-resolves hostnames until ctx is done
+func (tp *trustedProxySet) runRefresh(ctx context.Context, name string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			tp.refresh(ctx, name)
+		}
+	}
+}
+
+// resolveHostNetworks resolves a hostname to single-address networks
+func resolveHostNetworks(ctx context.Context, host string) ([]*net.IPNet, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses found")
+	}
+
+	networks := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		networks = append(networks, hostNetwork(addr.IP))
+	}
+	return networks, nil
+}
+
+// hostNetwork returns the network containing exactly ip
+func hostNetwork(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,466 @@
+package traefik_totp_plugin
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// qrVersion describes a QR code version at error correction level M
+type qrVersion struct {
+	ecPerBlock int   // Error correction codewords per block
+	blocks     []int // Data codewords of each block
+	alignment  []int // Alignment pattern centres
+}
+
+// qrVersions lists versions 1 to 10, which hold up to 213 bytes; that is
+// plenty for a pairing URL
+var qrVersions = []qrVersion{
+	{10, []int{16}, nil},
+	{16, []int{28}, []int{6, 18}},
+	{26, []int{44}, []int{6, 22}},
+	{18, []int{32, 32}, []int{6, 26}},
+	{24, []int{43, 43}, []int{6, 30}},
+	{16, []int{27, 27, 27, 27}, []int{6, 34}},
+	{18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	{22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	{22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	{26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+// errQRTooLong is returned for data that doesn't fit in a version 10 code
+var errQRTooLong = errors.New("data too long for a QR code")
+
+// qrField holds the exponent and logarithm tables of GF(256) with the QR code
+// polynomial x^8 + x^4 + x^3 + x^2 + 1
+type qrField struct {
+	exp [512]byte
+	log [256]byte
+}
+
+var qrGF = newQRField()
+
+// newQRField builds the GF(256) tables
+func newQRField() *qrField {
+	f := &qrField{}
+	x := 1
+	for i := 0; i < 255; i++ {
+		f.exp[i] = byte(x)
+		f.log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		f.exp[i] = f.exp[i-255]
+	}
+	return f
+}
+
+// mul multiplies a and b in GF(256)
+func (f *qrField) mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return f.exp[int(f.log[a])+int(f.log[b])]
+}
+
+// qrECC returns the Reed-Solomon error correction codewords for data
+func qrECC(data []byte, degree int) []byte {
+	// Generator polynomial (x - a^0)(x - a^1)...(x - a^(degree-1)), highest
+	// coefficient first
+	gen := []byte{1}
+	for i := 0; i < degree; i++ {
+		next := make([]byte, len(gen)+1)
+		for j, c := range gen {
+			next[j] ^= c
+			next[j+1] ^= qrGF.mul(c, qrGF.exp[i])
+		}
+		gen = next
+	}
+
+	rem := make([]byte, degree)
+	for _, d := range data {
+		factor := d ^ rem[0]
+		copy(rem, rem[1:])
+		rem[degree-1] = 0
+		for i := range rem {
+			rem[i] ^= qrGF.mul(gen[i+1], factor)
+		}
+	}
+	return rem
+}
+
+// qrCode is a QR code symbol; modules[y][x] is true for dark modules
+type qrCode struct {
+	version  int
+	size     int
+	modules  [][]bool
+	function [][]bool // Finder, timing, alignment, format and version modules
+}
+
+// encodeQR encodes data in byte mode at error correction level M, using the
+// smallest version it fits in
+func encodeQR(data []byte) (*qrCode, error) {
+	for i, v := range qrVersions {
+		version := i + 1
+		countBits := 8
+		if version >= 10 {
+			countBits = 16
+		}
+		capacity := 0
+		for _, n := range v.blocks {
+			capacity += n
+		}
+		if 4+countBits+8*len(data) > 8*capacity {
+			continue
+		}
+
+		q := newQRCode(version)
+		q.drawFunctionPatterns(v)
+		q.placeData(qrCodewords(v, qrDataCodewords(data, countBits, capacity)))
+		q.applyBestMask()
+		return q, nil
+	}
+	return nil, errQRTooLong
+}
+
+// qrDataCodewords encodes data as a byte mode segment padded to capacity
+// codewords
+func qrDataCodewords(data []byte, countBits, capacity int) []byte {
+	var bits []bool
+	appendBits := func(value, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, value>>i&1 == 1)
+		}
+	}
+	appendBits(0x4, 4)
+	appendBits(len(data), countBits)
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	for i := 0; i < 4 && len(bits) < 8*capacity; i++ {
+		bits = append(bits, false)
+	}
+	for len(bits)%8 != 0 {
+		bits = append(bits, false)
+	}
+
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b <<= 1
+			if bit {
+				b |= 1
+			}
+		}
+		codewords = append(codewords, b)
+	}
+	for pad := byte(0xec); len(codewords) < capacity; pad ^= 0xec ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+	return codewords
+}
+
+// qrCodewords splits data into blocks, adds their error correction codewords
+// and interleaves them
+func qrCodewords(v qrVersion, data []byte) []byte {
+	var blocks, eccs [][]byte
+	longest := 0
+	for _, n := range v.blocks {
+		blocks = append(blocks, data[:n])
+		eccs = append(eccs, qrECC(data[:n], v.ecPerBlock))
+		data = data[n:]
+		if n > longest {
+			longest = n
+		}
+	}
+
+	var out []byte
+	for i := 0; i < longest; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, ecc := range eccs {
+			out = append(out, ecc[i])
+		}
+	}
+	return out
+}
+
+// newQRCode creates an empty symbol of the given version
+func newQRCode(version int) *qrCode {
+	size := 17 + 4*version
+	q := &qrCode{
+		version:  version,
+		size:     size,
+		modules:  make([][]bool, size),
+		function: make([][]bool, size),
+	}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.function[i] = make([]bool, size)
+	}
+	return q
+}
+
+// set sets a function module
+func (q *qrCode) set(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.function[y][x] = true
+}
+
+// drawFunctionPatterns draws everything but the data and reserves the format
+// and version areas
+func (q *qrCode) drawFunctionPatterns(v qrVersion) {
+	for i := 0; i < q.size; i++ {
+		q.set(6, i, i%2 == 0)
+		q.set(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns with their separators
+	for _, centre := range [][2]int{{3, 3}, {q.size - 4, 3}, {3, q.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := centre[0]+dx, centre[1]+dy
+				if x < 0 || x >= q.size || y < 0 || y >= q.size {
+					continue
+				}
+				dist := qrDistance(dx, dy)
+				q.set(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+
+	// Alignment patterns, except where they would overlap a finder pattern
+	last := len(v.alignment) - 1
+	for i, cy := range v.alignment {
+		for j, cx := range v.alignment {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.set(cx+dx, cy+dy, qrDistance(dx, dy) != 1)
+				}
+			}
+		}
+	}
+
+	q.drawFormat(0)
+
+	if q.version >= 7 {
+		rem := q.version
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1f25
+		}
+		bits := q.version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := q.size-11+i%3, i/3
+			q.set(a, b, dark)
+			q.set(b, a, dark)
+		}
+	}
+}
+
+// qrDistance returns the distance of dx, dy from a pattern's centre in rings
+func qrDistance(dx, dy int) int {
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	if dx > dy {
+		return dx
+	}
+	return dy
+}
+
+// drawFormat draws both copies of the format information for level M and mask
+func (q *qrCode) drawFormat(mask int) {
+	rem := mask
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (mask<<10 | rem) ^ 0x5412
+	bit := func(i int) bool {
+		return bits>>i&1 == 1
+	}
+
+	for i := 0; i <= 5; i++ {
+		q.set(8, i, bit(i))
+	}
+	q.set(8, 7, bit(6))
+	q.set(8, 8, bit(7))
+	q.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.set(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.set(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.set(8, q.size-15+i, bit(i))
+	}
+	q.set(8, q.size-8, true)
+}
+
+// placeData fills the data modules in the zigzag order, two columns at a
+// time from the bottom right
+func (q *qrCode) placeData(codewords []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if upward {
+				y = q.size - 1 - vert
+			}
+			for x := right; x >= right-1; x-- {
+				if q.function[y][x] || i >= 8*len(codewords) {
+					continue
+				}
+				q.modules[y][x] = codewords[i/8]>>(7-i%8)&1 == 1
+				i++
+			}
+		}
+	}
+}
+
+// qrMasked reports whether mask inverts the module at x, y
+func qrMasked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (x+y)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (x+y)%3 == 0
+	case 4:
+		return (x/3+y/2)%2 == 0
+	case 5:
+		return x*y%2+x*y%3 == 0
+	case 6:
+		return (x*y%2+x*y%3)%2 == 0
+	default:
+		return ((x+y)%2+x*y%3)%2 == 0
+	}
+}
+
+// applyMask inverts the data modules selected by mask; applying it twice
+// undoes it
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if !q.function[y][x] && qrMasked(mask, x, y) {
+				q.modules[y][x] = !q.modules[y][x]
+			}
+		}
+	}
+}
+
+// applyBestMask applies the mask with the lowest penalty
+func (q *qrCode) applyBestMask() {
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormat(mask)
+		if penalty := q.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			best, bestPenalty = mask, penalty
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormat(best)
+}
+
+// penalty scores the symbol by the rules that pick the mask: long runs, 2x2
+// blocks, patterns that look like finders and an unbalanced dark ratio
+func (q *qrCode) penalty() int {
+	lines := make([][]bool, 0, 2*q.size)
+	lines = append(lines, q.modules...)
+	for x := 0; x < q.size; x++ {
+		column := make([]bool, q.size)
+		for y := range column {
+			column[y] = q.modules[y][x]
+		}
+		lines = append(lines, column)
+	}
+
+	score := 0
+	for _, line := range lines {
+		run := 1
+		for i := 1; i <= len(line); i++ {
+			if i < len(line) && line[i] == line[i-1] {
+				run++
+				continue
+			}
+			if run >= 5 {
+				score += run - 2
+			}
+			run = 1
+		}
+		for i := 0; i+11 <= len(line); i++ {
+			if qrMatches(line[i:], "10111010000") || qrMatches(line[i:], "00001011101") {
+				score += 40
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				c := q.modules[y][x]
+				if q.modules[y-1][x] == c && q.modules[y][x-1] == c && q.modules[y-1][x-1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+	deviation := dark*100/(q.size*q.size) - 50
+	if deviation < 0 {
+		deviation = -deviation
+	}
+	return score + deviation/5*10
+}
+
+// qrMatches reports whether line starts with pattern ('1' for dark modules)
+func qrMatches(line []bool, pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		if line[i] != (pattern[i] == '1') {
+			return false
+		}
+	}
+	return true
+}
+
+// svgPath returns SVG path data drawing the dark modules, shifted by border
+// modules of quiet zone
+func (q *qrCode) svgPath(border int) string {
+	var b strings.Builder
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.modules[y][x] {
+				b.WriteString("M" + strconv.Itoa(x+border) + " " + strconv.Itoa(y+border) + "h1v1h-1z")
+			}
+		}
+	}
+	return b.String()
+}
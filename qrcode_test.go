@@ -0,0 +1,154 @@
+package traefik_totp_plugin
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestQRErrorCorrection checks the Reed-Solomon codewords against the
+// "HELLO WORLD" 1-M example of the specification
+func TestQRErrorCorrection(t *testing.T) {
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := qrECC(data, 10); !bytes.Equal(got, want) {
+		t.Errorf("error correction codewords %v, want %v", got, want)
+	}
+}
+
+// readFormat reads the first copy of the format information
+func readFormat(q *qrCode) int {
+	var positions [15][2]int
+	for i := 0; i <= 5; i++ {
+		positions[i] = [2]int{8, i}
+	}
+	positions[6] = [2]int{8, 7}
+	positions[7] = [2]int{8, 8}
+	positions[8] = [2]int{7, 8}
+	for i := 9; i < 15; i++ {
+		positions[i] = [2]int{14 - i, 8}
+	}
+	bits := 0
+	for i, p := range positions {
+		if q.modules[p[1]][p[0]] {
+			bits |= 1 << i
+		}
+	}
+	return bits
+}
+
+func TestQRFormatInformation(t *testing.T) {
+	q := newQRCode(1)
+	q.drawFormat(0)
+	if got, want := readFormat(q), 0x5412; got != want {
+		t.Errorf("format bits for M and mask 0: %015b, want %015b", got, want)
+	}
+}
+
+// decodeQR reads a symbol back: it unmasks the data modules, checks the error
+// correction codewords of every block and returns the byte mode data
+func decodeQR(t *testing.T, q *qrCode) []byte {
+	t.Helper()
+	v := qrVersions[q.version-1]
+
+	mask := -1
+	for m := 0; m < 8; m++ {
+		probe := newQRCode(q.version)
+		probe.drawFormat(m)
+		if readFormat(probe) == readFormat(q) {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("unknown format information %015b", readFormat(q))
+	}
+
+	// A fresh symbol has the same function modules; fill its data modules
+	// with the unmasked modules of q and read them in placement order
+	plain := newQRCode(q.version)
+	plain.drawFunctionPatterns(v)
+	var codewords []byte
+	var current byte
+	count := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			y := vert
+			if (right+1)&2 == 0 {
+				y = q.size - 1 - vert
+			}
+			for x := right; x >= right-1; x-- {
+				if plain.function[y][x] {
+					continue
+				}
+				current <<= 1
+				if q.modules[y][x] != qrMasked(mask, x, y) {
+					current |= 1
+				}
+				if count++; count%8 == 0 {
+					codewords = append(codewords, current)
+				}
+			}
+		}
+	}
+
+	blocks := make([][]byte, len(v.blocks))
+	eccs := make([][]byte, len(v.blocks))
+	longest := v.blocks[len(v.blocks)-1]
+	next := 0
+	for i := 0; i < longest; i++ {
+		for b, n := range v.blocks {
+			if i < n {
+				blocks[b] = append(blocks[b], codewords[next])
+				next++
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for b := range v.blocks {
+			eccs[b] = append(eccs[b], codewords[next])
+			next++
+		}
+	}
+
+	var data []byte
+	for b, block := range blocks {
+		if !bytes.Equal(qrECC(block, v.ecPerBlock), eccs[b]) {
+			t.Fatalf("block %d has wrong error correction codewords", b)
+		}
+		data = append(data, block...)
+	}
+
+	if data[0]>>4 != 0x4 {
+		t.Fatalf("mode %x, want byte mode", data[0]>>4)
+	}
+	var length, offset int
+	if q.version < 10 {
+		length, offset = int(data[0]&0xf)<<4|int(data[1]>>4), 1
+	} else {
+		length, offset = int(data[0]&0xf)<<12|int(data[1])<<4|int(data[2]>>4), 2
+	}
+	out := make([]byte, length)
+	for i := range out {
+		out[i] = data[offset+i]<<4 | data[offset+i+1]>>4
+	}
+	return out
+}
+
+func TestQRRoundTrip(t *testing.T) {
+	for _, n := range []int{0, 14, 26, 42, 62, 84, 106, 122, 152, 180, 213} {
+		data := []byte(strings.Repeat("https://tv.example.com/.totp/pair?code=ABCD2345", 5)[:n])
+		q, err := encodeQR(data)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if got := decodeQR(t, q); !bytes.Equal(got, data) {
+			t.Errorf("version %d decoded to %q, want %q", q.version, got, data)
+		}
+	}
+	if _, err := encodeQR(make([]byte, 214)); err != errQRTooLong {
+		t.Errorf("214 bytes: error %v, want %v", err, errQRTooLong)
+	}
+}
@@ -0,0 +1,57 @@
+package traefik_totp_plugin
+
+import (
+	"net/url"
+	"strings"
+)
+
+// isAllowedRedirect reports whether target is a safe redirect destination:
+// a same-origin relative path, or an absolute http(s) URL whose host, or host
+// and port, is in allowedHosts. Protocol-relative URLs, backslash tricks and
+// other schemes are rejected, also when they only appear once the path is
+// percent-decoded.
+func isAllowedRedirect(target string, allowedHosts []string) bool {
+	if target == "" || strings.ContainsAny(target, "\\\r\n\t") {
+		return false
+	}
+
+	// Relative paths must start with a single slash ("//host" is protocol-relative)
+	if strings.HasPrefix(target, "/") {
+		path := target
+		if i := strings.IndexAny(path, "?#"); i >= 0 {
+			path = path[:i]
+		}
+		decoded, err := url.PathUnescape(path)
+		if err != nil || strings.ContainsAny(decoded, "\\\r\n\t") {
+			return false
+		}
+		return !strings.HasPrefix(target, "//") && !strings.HasPrefix(decoded, "//")
+	}
+
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" || parsed.User != nil {
+		return false
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return false
+	}
+
+	// An allowed host without a port allows any port, "host:port" only that one
+	host, hostPort := strings.ToLower(parsed.Hostname()), strings.ToLower(parsed.Host)
+	for _, allowed := range allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if allowed == host || allowed == hostPort {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeRedirect returns target when it is a safe redirect destination
+// (see isAllowedRedirect) and the site root otherwise
+func sanitizeRedirect(target string, allowedHosts []string) string {
+	if !isAllowedRedirect(target, allowedHosts) {
+		return "/"
+	}
+	return target
+}
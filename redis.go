@@ -0,0 +1,338 @@
+package traefik_totp_plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisMaxIdleConns is how many idle connections the redis store keeps open
+const redisMaxIdleConns = 8
+
+// redisMaxBulkSize bounds the replies read from redis
+const redisMaxBulkSize = 1 << 20
+
+// redisError is an error reply sent by the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a connection speaking the redis protocol (RESP)
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// redisSessionStore keeps sessions in redis, so replicas share them. Keys
+// are keyPrefix followed by the token hash, and each key expires with its
+// session.
+type redisSessionStore struct {
+	address     string
+	password    string
+	db          int
+	prefix      string
+	dialTimeout time.Duration
+	readTimeout time.Duration
+	name        string
+	clock       Clock // Time source of the key TTLs
+
+	idle chan *redisConn
+}
+
+// validateRedisConfig checks the options of sessionStore redis
+func validateRedisConfig(config *Config) error {
+	if config.RedisAddress == "" {
+		return fmt.Errorf("sessionStore redis requires redisAddress")
+	}
+	if _, _, err := net.SplitHostPort(config.RedisAddress); err != nil {
+		return fmt.Errorf("invalid redisAddress (must be host:port): %s", config.RedisAddress)
+	}
+	if config.RedisDB < 0 {
+		return fmt.Errorf("redisDB must not be negative")
+	}
+	if config.RedisKeyPrefix == "" {
+		config.RedisKeyPrefix = "totp:session:"
+	}
+	if config.RedisDialTimeoutMs <= 0 {
+		config.RedisDialTimeoutMs = 500
+	}
+	if config.RedisReadTimeoutMs <= 0 {
+		config.RedisReadTimeoutMs = 500
+	}
+	return nil
+}
+
+// newRedisSessionStore creates a store for the server at redisAddress.
+// Connections are opened on first use.
+func newRedisSessionStore(config *Config, name string, clock Clock) *redisSessionStore {
+	return &redisSessionStore{
+		address:     config.RedisAddress,
+		password:    config.RedisPassword,
+		db:          config.RedisDB,
+		prefix:      config.RedisKeyPrefix,
+		dialTimeout: time.Duration(config.RedisDialTimeoutMs) * time.Millisecond,
+		readTimeout: time.Duration(config.RedisReadTimeoutMs) * time.Millisecond,
+		name:        name,
+		idle:        make(chan *redisConn, redisMaxIdleConns),
+		clock:       clock,
+	}
+}
+
+// dial opens a connection, authenticates and selects the database
+func (s *redisSessionStore) dial() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", s.address, s.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	if s.password != "" {
+		if _, err := rc.do(s.readTimeout, "AUTH", s.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis authentication failed: %w", err)
+		}
+	}
+	if s.db != 0 {
+		if _, err := rc.do(s.readTimeout, "SELECT", strconv.Itoa(s.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to select redis database %d: %w", s.db, err)
+		}
+	}
+	return rc, nil
+}
+
+// do runs a command on an idle or new connection. Connections are reused
+// unless the command failed on the network; error replies leave the
+// connection usable.
+func (s *redisSessionStore) do(args ...string) (interface{}, error) {
+	var rc *redisConn
+	select {
+	case rc = <-s.idle:
+	default:
+		var err error
+		if rc, err = s.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := rc.do(s.readTimeout, args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		rc.conn.Close()
+		return nil, err
+	}
+
+	select {
+	case s.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+	return reply, err
+}
+
+// do sends a command and reads its reply within timeout
+func (rc *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if err := rc.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var cmd strings.Builder
+	fmt.Fprintf(&cmd, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&cmd, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(rc.conn, cmd.String()); err != nil {
+		return nil, err
+	}
+	return rc.readReply()
+}
+
+// readReply reads one reply: a string for simple strings and bulk strings,
+// nil for null bulk strings, int64 for integers, []interface{} for arrays and
+// redisError for error replies
+func (rc *redisConn) readReply() (interface{}, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(body)
+		if err != nil || size > redisMaxBulkSize {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", body)
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length %q", body)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, count)
+		for i := 0; i < count; i++ {
+			item, err := rc.readReply()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
+
+// key returns the redis key of the session for tokenHash
+func (s *redisSessionStore) key(tokenHash string) string {
+	return s.prefix + tokenHash
+}
+
+// Get returns the session for tokenHash. Redis errors are logged and the
+// session is treated as unknown.
+func (s *redisSessionStore) Get(tokenHash string) (*Session, bool) {
+	reply, err := s.do("GET", s.key(tokenHash))
+	if err != nil {
+		log.Printf("[%s] Redis session lookup failed, treating the session as unknown: %v", s.name, err)
+		return nil, false
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return nil, false
+	}
+
+	var record sessionFileEntry
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		log.Printf("[%s] Invalid session record in redis: %v", s.name, err)
+		return nil, false
+	}
+	record.TokenHash = tokenHash
+	return record.session(), true
+}
+
+// Put stores session under a key that expires with it
+func (s *redisSessionStore) Put(session *Session) error {
+	record := newSessionFileEntry(session)
+	record.TokenHash = "" // It is the key
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	ttl := int64(session.deadline().Sub(s.clock.Now()).Seconds()) + 1
+	if ttl < 1 {
+		ttl = 1
+	}
+	if _, err := s.do("SET", s.key(session.TokenHash), string(data), "EX", strconv.FormatInt(ttl, 10)); err != nil {
+		return fmt.Errorf("redis SET failed: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the session for tokenHash
+func (s *redisSessionStore) Delete(tokenHash string) {
+	if _, err := s.do("DEL", s.key(tokenHash)); err != nil {
+		log.Printf("[%s] Failed to delete session from redis: %v", s.name, err)
+	}
+}
+
+// scan calls visit with every key under the prefix, in batches, until visit
+// returns an error
+func (s *redisSessionStore) scan(visit func(keys []string) error) error {
+	cursor := "0"
+	for {
+		reply, err := s.do("SCAN", cursor, "MATCH", s.prefix+"*", "COUNT", "100")
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply")
+		}
+		next, _ := parts[0].(string)
+		items, _ := parts[1].([]interface{})
+
+		keys := make([]string, 0, len(items))
+		for _, item := range items {
+			if key, ok := item.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if err := visit(keys); err != nil {
+			return err
+		}
+
+		if next == "" || next == "0" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// DeleteByIP removes the sessions created from an IP in network, found with
+// SCAN under the prefix
+func (s *redisSessionStore) DeleteByIP(network *net.IPNet) (int, error) {
+	removed := 0
+	err := s.scan(func(keys []string) error {
+		for _, key := range keys {
+			reply, err := s.do("GET", key)
+			if err != nil {
+				return err
+			}
+			data, ok := reply.(string)
+			if !ok {
+				continue
+			}
+			var record sessionFileEntry
+			if json.Unmarshal([]byte(data), &record) != nil || !record.session().inNetwork(network) {
+				continue
+			}
+			if _, err := s.do("DEL", key); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// DeleteExpired does nothing: every key expires on its own with its session,
+// and scanning the keyspace on each cleanup would cost more than it finds
+func (s *redisSessionStore) DeleteExpired(now time.Time) int {
+	return 0
+}
+
+// Count returns 0: counting the keys takes a SCAN of the whole keyspace, so
+// sessions.active isn't reported with this store
+func (s *redisSessionStore) Count() int {
+	return 0
+}
@@ -0,0 +1,399 @@
+package traefik_totp_plugin
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a minimal RESP server keeping string keys per database
+type fakeRedis struct {
+	listener net.Listener
+	password string
+
+	mu       sync.Mutex
+	data     map[int]map[string]string
+	ttls     map[string]int64
+	commands []string          // Command names in the order received
+	failures map[string]string // Error replies by command name
+	cursors  map[string]string // Last key returned by SCAN cursor
+	conns    int
+}
+
+// newFakeRedis starts a server on a local port, stopped when the test ends
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	fr := &fakeRedis{
+		listener: listener,
+		password: password,
+		data:     map[int]map[string]string{},
+		ttls:     map[string]int64{},
+		failures: map[string]string{},
+		cursors:  map[string]string{},
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			fr.mu.Lock()
+			fr.conns++
+			fr.mu.Unlock()
+			go fr.serve(conn)
+		}
+	}()
+	return fr
+}
+
+// serve answers the commands of one connection
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed, db := fr.password == "", 0
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		name := strings.ToUpper(args[0])
+
+		fr.mu.Lock()
+		fr.commands = append(fr.commands, name)
+		failure := fr.failures[name]
+		keys := fr.data[db]
+		if keys == nil {
+			keys = map[string]string{}
+			fr.data[db] = keys
+		}
+
+		var reply string
+		switch {
+		case failure != "":
+			reply = "-" + failure + "\r\n"
+		case name == "AUTH":
+			if args[1] == fr.password {
+				authed = true
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid username-password pair\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case name == "SELECT":
+			db, _ = strconv.Atoi(args[1])
+			reply = "+OK\r\n"
+		case name == "GET":
+			if value, ok := keys[args[1]]; ok {
+				reply = bulk(value)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case name == "SET":
+			keys[args[1]] = args[2]
+			if len(args) == 5 && strings.ToUpper(args[3]) == "EX" {
+				fr.ttls[args[1]], _ = strconv.ParseInt(args[4], 10, 64)
+			}
+			reply = "+OK\r\n"
+		case name == "DEL":
+			removed := 0
+			for _, key := range args[1:] {
+				if _, ok := keys[key]; ok {
+					delete(keys, key)
+					removed++
+				}
+			}
+			reply = ":" + strconv.Itoa(removed) + "\r\n"
+		case name == "SCAN":
+			reply = fr.scanReply(keys, args)
+		default:
+			reply = "-ERR unknown command '" + args[0] + "'\r\n"
+		}
+		fr.mu.Unlock()
+
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand reads an array of bulk strings
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("malformed command %q", line)
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, fmt.Errorf("malformed argument %q", line)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+// bulk encodes a bulk string
+func bulk(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+// scanReply pages through the sorted keys matching a "prefix*" pattern two at
+// a time, so that every scan takes several round trips. Cursors remember the
+// last key returned, so keys deleted during the scan don't shift the pages;
+// fr.mu must be held.
+func (fr *fakeRedis) scanReply(keys map[string]string, args []string) string {
+	after := fr.cursors[args[1]]
+	prefix := ""
+	for i := 2; i+1 < len(args); i += 2 {
+		if strings.ToUpper(args[i]) == "MATCH" {
+			prefix = strings.TrimSuffix(args[i+1], "*")
+		}
+	}
+
+	var matching []string
+	for key := range keys {
+		if strings.HasPrefix(key, prefix) && key > after {
+			matching = append(matching, key)
+		}
+	}
+	sort.Strings(matching)
+
+	next := "0"
+	if len(matching) > 2 {
+		matching = matching[:2]
+		next = strconv.Itoa(len(fr.cursors) + 1)
+		fr.cursors[next] = matching[1]
+	}
+
+	reply := "*2\r\n" + bulk(next) + "*" + strconv.Itoa(len(matching)) + "\r\n"
+	for _, key := range matching {
+		reply += bulk(key)
+	}
+	return reply
+}
+
+// count returns how often the named command was received
+func (fr *fakeRedis) count(name string) int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	n := 0
+	for _, command := range fr.commands {
+		if command == name {
+			n++
+		}
+	}
+	return n
+}
+
+// connections returns how many connections were accepted
+func (fr *fakeRedis) connections() int {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.conns
+}
+
+// newFakeRedisStore creates a store for fr with password and database db
+func newFakeRedisStore(t *testing.T, fr *fakeRedis, password string, db int, clock Clock) *redisSessionStore {
+	t.Helper()
+	config := CreateConfig()
+	config.RedisAddress = fr.listener.Addr().String()
+	config.RedisPassword = password
+	config.RedisDB = db
+	if err := validateRedisConfig(config); err != nil {
+		t.Fatalf("validateRedisConfig: %v", err)
+	}
+	return newRedisSessionStore(config, "test", clock)
+}
+
+func TestRedisSessionStore(t *testing.T) {
+	fr := newFakeRedis(t, "redis-password")
+	clock := newFakeClock(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	store := newFakeRedisStore(t, fr, "redis-password", 3, clock)
+
+	session := &Session{
+		TokenHash: "abc123",
+		CreatedAt: clock.Now(),
+		ExpiresAt: clock.Now().Add(time.Hour),
+		IP:        "192.0.2.1",
+		Areas:     []string{""},
+		Method:    methodTOTP,
+	}
+	if err := store.Put(session); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	// The key lives in the selected database and expires with the session
+	key := "totp:session:abc123"
+	fr.mu.Lock()
+	_, stored := fr.data[3][key]
+	ttl := fr.ttls[key]
+	fr.mu.Unlock()
+	if !stored {
+		t.Fatalf("session not stored under %s in database 3", key)
+	}
+	if ttl != 3601 {
+		t.Errorf("TTL = %d, want 3601", ttl)
+	}
+
+	got, ok := store.Get("abc123")
+	if !ok {
+		t.Fatal("Get: session not found")
+	}
+	if got.TokenHash != "abc123" || got.IP != session.IP || !got.ExpiresAt.Equal(session.ExpiresAt) || got.Method != methodTOTP {
+		t.Errorf("Get = %+v, want %+v", got, session)
+	}
+
+	// A null bulk reply is an unknown session
+	if _, ok := store.Get("missing"); ok {
+		t.Error("Get found a session that was never stored")
+	}
+
+	store.Delete("abc123")
+	if _, ok := store.Get("abc123"); ok {
+		t.Error("Get found a deleted session")
+	}
+
+	// Every command went over the single connection, authenticated and
+	// switched to the database once
+	if fr.connections() != 1 || fr.count("AUTH") != 1 || fr.count("SELECT") != 1 {
+		t.Errorf("connections = %d, AUTH = %d, SELECT = %d, want 1 each", fr.connections(), fr.count("AUTH"), fr.count("SELECT"))
+	}
+}
+
+func TestRedisSessionStoreAuthFailure(t *testing.T) {
+	fr := newFakeRedis(t, "redis-password")
+	store := newFakeRedisStore(t, fr, "wrong-password", 0, newPluginClock())
+
+	if err := store.Put(&Session{TokenHash: "abc123", ExpiresAt: time.Now().Add(time.Hour)}); err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("Put error = %v, want an authentication failure", err)
+	}
+	if _, ok := store.Get("abc123"); ok {
+		t.Error("Get found a session without authenticating")
+	}
+	if fr.count("SET") != 0 || fr.count("GET") != 0 {
+		t.Error("commands were sent after AUTH failed")
+	}
+}
+
+func TestRedisSessionStoreErrorReply(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	store := newFakeRedisStore(t, fr, "", 0, newPluginClock())
+	if err := store.Put(&Session{TokenHash: "abc123", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+
+	fr.mu.Lock()
+	fr.failures["GET"] = "ERR something broke"
+	fr.mu.Unlock()
+	if _, ok := store.Get("abc123"); ok {
+		t.Error("Get found a session despite an error reply")
+	}
+
+	fr.mu.Lock()
+	delete(fr.failures, "GET")
+	fr.failures["SET"] = "OOM command not allowed when used memory > 'maxmemory'"
+	fr.mu.Unlock()
+	if err := store.Put(&Session{TokenHash: "def456", ExpiresAt: time.Now().Add(time.Hour)}); err == nil || !strings.Contains(err.Error(), "OOM") {
+		t.Errorf("Put error = %v, want the error reply", err)
+	}
+
+	// Error replies leave the connection usable
+	if _, ok := store.Get("abc123"); !ok {
+		t.Error("Get failed after the error reply was lifted")
+	}
+	if fr.connections() != 1 {
+		t.Errorf("connections = %d, want 1", fr.connections())
+	}
+}
+
+func TestRedisSessionStoreDeleteByIP(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	store := newFakeRedisStore(t, fr, "", 0, newPluginClock())
+
+	ips := []string{"192.0.2.1", "198.51.100.7", "192.0.2.2", "198.51.100.8", "192.0.2.3"}
+	for i, ip := range ips {
+		session := &Session{TokenHash: fmt.Sprintf("session%d", i), ExpiresAt: time.Now().Add(time.Hour), IP: ip}
+		if err := store.Put(session); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+	}
+	// Keys outside the prefix are never touched
+	fr.mu.Lock()
+	fr.data[0]["other:192.0.2.9"] = `{"ip":"192.0.2.9"}`
+	fr.mu.Unlock()
+
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	removed, err := store.DeleteByIP(network)
+	if err != nil {
+		t.Fatalf("DeleteByIP: %v", err)
+	}
+	if removed != 3 {
+		t.Errorf("removed = %d, want 3", removed)
+	}
+	if scans := fr.count("SCAN"); scans < 3 {
+		t.Errorf("SCAN sent %d times, want every page of 2 keys", scans)
+	}
+
+	fr.mu.Lock()
+	var left []string
+	for key := range fr.data[0] {
+		left = append(left, key)
+	}
+	fr.mu.Unlock()
+	sort.Strings(left)
+	want := []string{"other:192.0.2.9", "totp:session:session1", "totp:session:session3"}
+	if strings.Join(left, ",") != strings.Join(want, ",") {
+		t.Errorf("keys left = %v, want %v", left, want)
+	}
+
+	fr.mu.Lock()
+	fr.failures["SCAN"] = "ERR scan disabled"
+	fr.mu.Unlock()
+	if _, err := store.DeleteByIP(network); err == nil {
+		t.Error("DeleteByIP succeeded despite a SCAN error reply")
+	}
+}
+
+func TestRedisSessionStoreMaintenanceIsFree(t *testing.T) {
+	fr := newFakeRedis(t, "")
+	store := newFakeRedisStore(t, fr, "", 0, newPluginClock())
+
+	if removed := store.DeleteExpired(time.Now()); removed != 0 {
+		t.Errorf("DeleteExpired = %d, want 0", removed)
+	}
+	if count := store.Count(); count != 0 {
+		t.Errorf("Count = %d, want 0", count)
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.conns != 0 || len(fr.commands) != 0 {
+		t.Errorf("cleanup and counting reached redis: %v", fr.commands)
+	}
+}
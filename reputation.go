@@ -0,0 +1,184 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reputation verdicts returned by the external reputation service
+const (
+	verdictChallenge = "challenge"
+	verdictDeny      = "deny"
+)
+
+// reputationChecker consults an external IP reputation service and caches
+// its verdicts per client IP
+type reputationChecker struct {
+	endpoint       string
+	client         *http.Client
+	defaultVerdict string
+	ttl            time.Duration
+	maxEntries     int
+
+	mu    sync.Mutex
+	cache map[string]reputationEntry
+}
+
+// reputationEntry is a cached verdict for a single IP
+type reputationEntry struct {
+	verdict   string
+	expiresAt time.Time
+}
+
+// newReputationChecker creates a reputation checker from the plugin configuration
+func newReputationChecker(config *Config) (*reputationChecker, error) {
+	endpoint, err := url.Parse(config.ReputationURL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid reputationURL: %s", config.ReputationURL)
+	}
+
+	defaultVerdict := strings.ToLower(config.ReputationDefaultVerdict)
+	if defaultVerdict != verdictChallenge && defaultVerdict != verdictDeny {
+		return nil, fmt.Errorf("invalid reputationDefaultVerdict (must be %q or %q): %s", verdictChallenge, verdictDeny, config.ReputationDefaultVerdict)
+	}
+
+	return &reputationChecker{
+		endpoint:       config.ReputationURL,
+		client:         &http.Client{Timeout: time.Duration(config.ReputationTimeoutMs) * time.Millisecond},
+		defaultVerdict: defaultVerdict,
+		ttl:            time.Duration(config.ReputationCacheTTL) * time.Second,
+		maxEntries:     config.ReputationCacheSize,
+		cache:          make(map[string]reputationEntry),
+	}, nil
+}
+
+// verdict returns the (possibly cached) reputation verdict for an IP.
+// The second return value is an error from the lookup, in which case the
+// verdict is the configured default.
+func (rc *reputationChecker) verdict(ctx context.Context, ip string) (string, error) {
+	now := time.Now()
+
+	rc.mu.Lock()
+	entry, ok := rc.cache[ip]
+	rc.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.verdict, nil
+	}
+
+	verdict, err := rc.lookup(ctx, ip)
+	if err != nil {
+		verdict = rc.defaultVerdict
+	}
+
+	rc.store(ip, verdict, now)
+	return verdict, err
+}
+
+// lookup queries the reputation service for an IP
+func (rc *reputationChecker) lookup(ctx context.Context, ip string) (string, error) {
+	endpoint, err := url.Parse(rc.endpoint)
+	if err != nil {
+		return "", err
+	}
+	query := endpoint.Query()
+	query.Set("ip", ip)
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/json, text/plain")
+
+	resp, err := rc.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return "", err
+	}
+
+	// Accept either {"verdict": "deny"} or a plain-text verdict
+	verdict := strings.TrimSpace(string(body))
+	var payload struct {
+		Verdict string `json:"verdict"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Verdict != "" {
+		verdict = payload.Verdict
+	}
+
+	verdict = strings.ToLower(verdict)
+	if verdict != verdictChallenge && verdict != verdictDeny {
+		return "", fmt.Errorf("unknown verdict %q", verdict)
+	}
+	return verdict, nil
+}
+
+// store caches a verdict, making room by dropping expired entries (and, if
+// still full, an arbitrary entry) when the cache is at capacity
+func (rc *reputationChecker) store(ip, verdict string, now time.Time) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if _, exists := rc.cache[ip]; !exists && len(rc.cache) >= rc.maxEntries {
+		rc.pruneLocked(now)
+		for key := range rc.cache {
+			if len(rc.cache) < rc.maxEntries {
+				break
+			}
+			delete(rc.cache, key)
+		}
+	}
+
+	rc.cache[ip] = reputationEntry{verdict: verdict, expiresAt: now.Add(rc.ttl)}
+}
+
+// cleanup removes expired cache entries
+func (rc *reputationChecker) cleanup(now time.Time) {
+	rc.mu.Lock()
+	rc.pruneLocked(now)
+	rc.mu.Unlock()
+}
+
+// pruneLocked removes expired entries; rc.mu must be held
+func (rc *reputationChecker) pruneLocked(now time.Time) {
+	for ip, entry := range rc.cache {
+		if now.After(entry.expiresAt) {
+			delete(rc.cache, ip)
+		}
+	}
+}
+
+// isDeniedByReputation reports whether the reputation service denies the client
+func (ta *TOTPAuth) isDeniedByReputation(req *http.Request) bool {
+	if ta.reputation == nil {
+		return false
+	}
+
+	clientIP := ta.getClientIP(req)
+	verdict, err := ta.reputation.verdict(req.Context(), clientIP)
+	if err != nil {
+		log.Printf("[%s] Reputation lookup for %s failed, using default verdict %q: %v", ta.name, clientIP, verdict, err)
+	}
+
+	if verdict == verdictDeny {
+		log.Printf("[%s] Reputation service denied access for %s", ta.name, clientIP)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,167 @@
+package traefik_totp_plugin
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// headerInterceptor wraps a ResponseWriter and calls intercept with the
+// backend's response headers right before they are written to the client,
+// giving the plugin a chance to inspect and rewrite them. When intercept
+// returns true the backend's response is discarded so that the plugin can
+// send its own.
+type headerInterceptor struct {
+	http.ResponseWriter
+	intercept   func(header http.Header) bool
+	wroteHeader bool
+	hijacked    bool
+	discarded   bool
+}
+
+// WriteHeader runs the interceptor before sending the final status code
+func (hi *headerInterceptor) WriteHeader(code int) {
+	// Informational responses (except 101 Switching Protocols) are followed
+	// by the final response, so defer interception until then
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		hi.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	if !hi.wroteHeader {
+		hi.wroteHeader = true
+		hi.discarded = hi.intercept(hi.ResponseWriter.Header())
+	}
+	if hi.discarded {
+		return
+	}
+	hi.ResponseWriter.WriteHeader(code)
+}
+
+// Write implies a 200 status when no status was written yet
+func (hi *headerInterceptor) Write(b []byte) (int, error) {
+	if !hi.wroteHeader {
+		hi.WriteHeader(http.StatusOK)
+	}
+	if hi.discarded {
+		return len(b), nil
+	}
+	return hi.ResponseWriter.Write(b)
+}
+
+// Flush supports streaming responses
+func (hi *headerInterceptor) Flush() {
+	if !hi.wroteHeader {
+		hi.WriteHeader(http.StatusOK)
+	}
+	if hi.discarded {
+		return
+	}
+	if flusher, ok := hi.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack supports WebSocket upgrades. Headers written on a hijacked
+// connection bypass the interceptor.
+func (hi *headerInterceptor) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := hi.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	hi.hijacked = true
+	return hijacker.Hijack()
+}
+
+// finish writes the implicit 200 status if the backend never wrote a
+// response, so the interceptor still sees the headers
+func (hi *headerInterceptor) finish() {
+	if !hi.wroteHeader && !hi.hijacked {
+		hi.WriteHeader(http.StatusOK)
+	}
+}
+
+// Unwrap exposes the underlying ResponseWriter to http.ResponseController
+func (hi *headerInterceptor) Unwrap() http.ResponseWriter {
+	return hi.ResponseWriter
+}
+
+// serveBackend passes an authenticated request to the next handler, wrapping
+// the ResponseWriter when any backend-controlled response header is configured
+func (ta *TOTPAuth) serveBackend(rw http.ResponseWriter, req *http.Request) {
+	if ta.config.RevokeHeader == "" && ta.config.StepUpHeader == "" {
+		ta.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// Headers set before the backend ran, restored if its response is replaced
+	var before http.Header
+	if ta.config.StepUpHeader != "" {
+		before = rw.Header().Clone()
+	}
+
+	interceptor := &headerInterceptor{
+		ResponseWriter: rw,
+		intercept: func(header http.Header) bool {
+			if ta.config.RevokeHeader != "" {
+				ta.handleRevokeHeader(header, req)
+			}
+			return ta.config.StepUpHeader != "" && ta.handleStepUpHeader(header, req)
+		},
+	}
+	ta.next.ServeHTTP(interceptor, req)
+	interceptor.finish()
+
+	if interceptor.discarded {
+		header := rw.Header()
+		for key := range header {
+			delete(header, key)
+		}
+		for key, values := range before {
+			header[key] = values
+		}
+		ta.challengeStepUp(rw, req, "")
+	}
+}
+
+// handleRevokeHeader terminates the current session when the backend response
+// carries the revocation header. The header is always stripped.
+func (ta *TOTPAuth) handleRevokeHeader(header http.Header, req *http.Request) {
+	value := header.Get(ta.config.RevokeHeader)
+	if value == "" {
+		return
+	}
+	header.Del(ta.config.RevokeHeader)
+
+	if !isTruthy(value) {
+		return
+	}
+
+	token := ta.sessionToken(req)
+	if token == "" {
+		return
+	}
+
+	ta.sessions.Delete(hashSessionToken(token))
+	header.Add("Set-Cookie", ta.expiredCookie(ta.config.CookieName).String())
+	for _, name := range ta.config.LegacyCookieNames {
+		if _, err := req.Cookie(name); err == nil {
+			header.Add("Set-Cookie", ta.expiredCookie(name).String())
+		}
+	}
+
+	log.Printf("[%s] Session revoked by backend response header for %s", ta.name, ta.getClientIP(req))
+	ta.audit(req, auditSessionRevoked, "backend_header")
+}
+
+// isTruthy interprets common boolean header values
+func isTruthy(value string) bool {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "1", "true", "yes", "on":
+		return true
+	}
+	return false
+}
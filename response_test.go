@@ -0,0 +1,71 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRevokeHeaderOptIn checks that a backend's revocation header only ends
+// the session once revokeHeader names it
+func TestRevokeHeaderOptIn(t *testing.T) {
+	if CreateConfig().RevokeHeader != "" {
+		t.Fatal("revokeHeader enabled by default")
+	}
+	for _, revokeHeader := range []string{"", "X-TOTP-Revoke"} {
+		config := CreateConfig()
+		config.SecretKey = testSecret
+		config.SkipSelfTest = true
+		config.RevokeHeader = revokeHeader
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("X-TOTP-Revoke", "1")
+			rw.WriteHeader(http.StatusOK)
+		})
+		handler, err := New(ctx, next, config, "test")
+		if err != nil {
+			t.Fatalf("New: %v", err)
+		}
+		ta := handler.(*TOTPAuth)
+		token := newTestSession(t, ta)
+
+		rec := httptest.NewRecorder()
+		ta.ServeHTTP(rec, withSession(ta, newTestRequest(http.MethodGet, "/app"), token))
+		_, kept := ta.sessions.Get(hashSessionToken(token))
+		passed := rec.Header().Get("X-TOTP-Revoke") != ""
+
+		enabled := revokeHeader != ""
+		if kept == enabled || passed == enabled {
+			t.Errorf("revokeHeader %q: session kept %v, header passed through %v", revokeHeader, kept, passed)
+		}
+		if deleted := responseCookie(rec, ta.config.CookieName); enabled != (deleted != nil && deleted.MaxAge < 0) {
+			t.Errorf("revokeHeader %q: session cookie %v", revokeHeader, deleted)
+		}
+	}
+}
+
+// TestRevokeHeaderNeedsStoredSessions checks that revokeHeader is refused
+// with the cookie session modes, where it couldn't end the session
+func TestRevokeHeaderNeedsStoredSessions(t *testing.T) {
+	for _, mode := range []string{sessionModeMemory, sessionModeSigned, sessionModeEncrypted, sessionModeJWT} {
+		config := CreateConfig()
+		config.SessionMode = mode
+		config.SessionSigningKey = "0123456789abcdef0123456789abcdef"
+		config.SessionEncryptionKey = base64.StdEncoding.EncodeToString(make([]byte, 32))
+		config.RevokeHeader = "X-TOTP-Revoke"
+
+		err := validateSessionMode(config)
+		if mode == sessionModeMemory {
+			if err != nil {
+				t.Errorf("sessionMode %s: %v", mode, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), "revokeHeader") {
+			t.Errorf("sessionMode %s: error %v, want revokeHeader rejected", mode, err)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package traefik_totp_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// webhookSecretRotated is sent after the secret has been rotated
+const webhookSecretRotated = "secret_rotated"
+
+// secretState holds the secret codes are validated against. With secretFile
+// it is persisted and can be rotated; the previous secret keeps working
+// until previousUntil.
+type secretState struct {
+	mu            sync.RWMutex
+	path          string
+	current       string
+	previous      string
+	previousUntil time.Time
+	rotatedAt     time.Time
+}
+
+// secretFileContents is the JSON persisted in secretFile
+type secretFileContents struct {
+	Secret             string    `json:"secret"`
+	PreviousSecret     string    `json:"previousSecret,omitempty"`
+	PreviousValidUntil time.Time `json:"previousValidUntil,omitempty"`
+	RotatedAt          time.Time `json:"rotatedAt"`
+}
+
+// loadSecretState reads the persisted secret. Without a secret file, or
+// when the file does not exist yet, secretKey is used; in the latter case
+// the file is created so that the rotation schedule starts now and survives
+// restarts.
+func loadSecretState(config *Config, now time.Time) (*secretState, error) {
+	state := &secretState{path: config.SecretFile, current: config.SecretKey}
+	if config.SecretFile == "" {
+		return state, nil
+	}
+
+	contents, err := readSecretFile(config.SecretFile)
+	if os.IsNotExist(err) {
+		state.rotatedAt = now.UTC()
+		if err := writeSecretFile(state.path, state.contents()); err != nil {
+			return nil, fmt.Errorf("failed to create secret file: %w", err)
+		}
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state.apply(contents)
+	return state, nil
+}
+
+// readSecretFile reads and validates a secret file
+func readSecretFile(path string) (secretFileContents, error) {
+	var contents secretFileContents
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return contents, err
+	}
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return contents, fmt.Errorf("invalid secret file %s: %w", path, err)
+	}
+	contents.Secret = normalizeSecret(contents.Secret)
+	contents.PreviousSecret = normalizeSecret(contents.PreviousSecret)
+	if _, err := decodeSecret(contents.Secret); err != nil || contents.Secret == "" {
+		return contents, fmt.Errorf("invalid secret in %s (must be base32 encoded)", path)
+	}
+	return contents, nil
+}
+
+// apply takes over the contents of a secret file
+func (s *secretState) apply(contents secretFileContents) {
+	s.current = contents.Secret
+	s.previous = contents.PreviousSecret
+	s.previousUntil = contents.PreviousValidUntil
+	s.rotatedAt = contents.RotatedAt
+}
+
+// secrets returns the current secret and, during the overlap window, the
+// previous one
+func (s *secretState) secrets(now time.Time) (string, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.previous != "" && now.Before(s.previousUntil) {
+		return s.current, s.previous
+	}
+	return s.current, ""
+}
+
+// lastRotation returns when the current secret was set
+func (s *secretState) lastRotation() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rotatedAt
+}
+
+// contents returns the state as persisted. Callers hold the lock or have
+// exclusive access.
+func (s *secretState) contents() secretFileContents {
+	return secretFileContents{
+		Secret:             s.current,
+		PreviousSecret:     s.previous,
+		PreviousValidUntil: s.previousUntil,
+		RotatedAt:          s.rotatedAt,
+	}
+}
+
+// writeSecretFile persists contents, replacing the file atomically
+func writeSecretFile(path string, contents secretFileContents) error {
+	data, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, writeErr := tmp.Write(data)
+	closeErr := tmp.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tmp.Name(), path)
+	}
+	if writeErr != nil {
+		os.Remove(tmp.Name())
+	}
+	return writeErr
+}
+
+// rotateIfDue replaces the secret once interval has passed since the last
+// rotation. The file is read again first: when another instance sharing it
+// already rotated, its secret is adopted instead of rotating twice. It
+// reports whether the secret changed and whether this call generated it.
+func (s *secretState) rotateIfDue(interval, overlap time.Duration, now time.Time) (changed, generated bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.rotatedAt) < interval {
+		return false, false, nil
+	}
+
+	contents, err := readSecretFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, false, err
+	}
+	if err == nil && contents.RotatedAt.After(s.rotatedAt) {
+		s.apply(contents)
+		if now.Sub(s.rotatedAt) < interval {
+			return true, false, nil
+		}
+	}
+
+	secret, err := GenerateSecret(20)
+	if err != nil {
+		return false, false, err
+	}
+
+	rotated := secretFileContents{
+		Secret:             secret,
+		PreviousSecret:     s.current,
+		PreviousValidUntil: now.Add(overlap).UTC(),
+		RotatedAt:          now.UTC(),
+	}
+	if err := writeSecretFile(s.path, rotated); err != nil {
+		return false, false, err
+	}
+	s.apply(rotated)
+	return true, true, nil
+}
+
+// currentSecret returns the secret new codes are generated from
+func (ta *TOTPAuth) currentSecret() string {
+	current, _ := ta.secret.secrets(ta.clock.Now())
+	return current
+}
+
+// rotateSecretIfDue rotates the secret on the configured schedule; it is
+// called by the shared cleanup scheduler
+func (ta *TOTPAuth) rotateSecretIfDue(now time.Time) {
+	if ta.config.SecretRotationDays <= 0 {
+		return
+	}
+
+	interval := time.Duration(ta.config.SecretRotationDays) * 24 * time.Hour
+	overlap := time.Duration(ta.config.RotationOverlapDays) * 24 * time.Hour
+	changed, generated, err := ta.secret.rotateIfDue(interval, overlap, now)
+	if err != nil {
+		log.Printf("[%s] Failed to rotate secret: %v", ta.name, err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	revoked := 0
+	if ta.config.RevokeOnRotate {
+		revoked = ta.deleteSessions(func(*Session) bool { return true })
+	}
+
+	// Another instance sharing secretFile rotated first and announced it
+	if !generated {
+		log.Printf("[%s] Adopted the rotated secret from %s; %d session(s) revoked", ta.name, ta.config.SecretFile, revoked)
+		return
+	}
+
+	current, _ := ta.secret.secrets(now)
+
+	// Never log the secret: the logs usually reach more people than secretFile
+	log.Printf("[%s] Secret rotated to sha256 %s, the previous secret is accepted for %d more day(s); %d session(s) revoked. Enroll the new secret from %s",
+		ta.name, secretFingerprint(current), ta.config.RotationOverlapDays, revoked, ta.config.SecretFile)
+	if ta.auditLog != nil {
+		ta.auditLog.record(auditEvent{
+			Timestamp: now.UTC(),
+			Event:     auditAdminAction,
+			Reason:    "rotate_secret",
+			Detail:    fmt.Sprintf("revoked=%d", revoked),
+		})
+	}
+	ta.notifyWebhook(webhookSecretRotated, map[string]interface{}{
+		"rotatedAt":          now.UTC(),
+		"previousValidUntil": now.Add(overlap).UTC(),
+		"sessionsRevoked":    revoked,
+		"secretFile":         ta.config.SecretFile,
+	})
+}
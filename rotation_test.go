@@ -0,0 +1,37 @@
+package traefik_totp_plugin
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRotationLogOmitsSecret rotates the secret and checks that the log
+// names it by fingerprint only
+func TestRotationLogOmitsSecret(t *testing.T) {
+	secretFile := filepath.Join(t.TempDir(), "secret.json")
+	ta := newTestAuth(t, func(config *Config) {
+		config.SecretFile = secretFile
+		config.SecretRotationDays = 30
+	})
+
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	ta.rotateSecretIfDue(ta.clock.Now().Add(31 * 24 * time.Hour))
+	current := ta.currentSecret()
+	if current == testSecret {
+		t.Fatal("secret not rotated")
+	}
+	if strings.Contains(logged.String(), current) || strings.Contains(logged.String(), "otpauth://") {
+		t.Errorf("rotation log reveals the secret: %s", logged.String())
+	}
+	if !strings.Contains(logged.String(), "sha256 "+secretFingerprint(current)) {
+		t.Errorf("rotation log lacks the fingerprint of the new secret: %s", logged.String())
+	}
+}
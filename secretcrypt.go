@@ -0,0 +1,107 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// EncryptSecret encrypts a TOTP secret with AES-GCM for secretKeyEncrypted.
+// key is the raw master key of 16, 24 or 32 bytes; the result is the
+// base64 encoded nonce followed by the ciphertext.
+func EncryptSecret(plain string, key []byte) (string, error) {
+	gcm, err := newSecretCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plain), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret reverses EncryptSecret
+func decryptSecret(encrypted string, key []byte) (string, error) {
+	gcm, err := newSecretCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encrypted))
+	if err != nil {
+		return "", fmt.Errorf("ciphertext is not base64 encoded")
+	}
+	if len(sealed) < gcm.NonceSize()+gcm.Overhead() {
+		return "", fmt.Errorf("ciphertext is too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plain, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("wrong master key or tampered ciphertext")
+	}
+	return string(plain), nil
+}
+
+// newSecretCipher creates the AES-GCM cipher for a master key
+func newSecretCipher(key []byte) (cipher.AEAD, error) {
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return nil, fmt.Errorf("master key must be 16, 24 or 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// decryptSecretKey sets secretKey from secretKeyEncrypted, using the base64
+// master key from masterKeyFile or masterKeyEnv
+func decryptSecretKey(config *Config) error {
+	if config.SecretKeyEncrypted == "" {
+		if config.MasterKeyFile != "" || config.MasterKeyEnv != "" {
+			return fmt.Errorf("masterKeyFile and masterKeyEnv require secretKeyEncrypted")
+		}
+		return nil
+	}
+	if config.SecretKey != "" {
+		return fmt.Errorf("set either secretKey or secretKeyEncrypted, not both")
+	}
+
+	var encoded, source string
+	switch {
+	case config.MasterKeyFile != "" && config.MasterKeyEnv != "":
+		return fmt.Errorf("set either masterKeyFile or masterKeyEnv, not both")
+	case config.MasterKeyFile != "":
+		data, err := os.ReadFile(config.MasterKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to read master key: %w", err)
+		}
+		encoded, source = string(data), config.MasterKeyFile
+	case config.MasterKeyEnv != "":
+		encoded, source = os.Getenv(config.MasterKeyEnv), "environment variable "+config.MasterKeyEnv
+	default:
+		return fmt.Errorf("secretKeyEncrypted requires masterKeyFile or masterKeyEnv")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) == 0 {
+		return fmt.Errorf("master key from %s is missing or not base64 encoded", source)
+	}
+
+	plain, err := decryptSecret(config.SecretKeyEncrypted, key)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt secretKeyEncrypted: %w", err)
+	}
+	config.SecretKey = plain
+	return nil
+}
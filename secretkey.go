@@ -0,0 +1,158 @@
+package traefik_totp_plugin
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Encodings of configured secrets
+const (
+	secretEncodingBase32 = "base32"
+	secretEncodingHex    = "hex"
+)
+
+// maxCachedKeys bounds the decoded key cache; the configured secrets are far
+// fewer, so reaching it only happens after many rotations
+const maxCachedKeys = 64
+
+// normalizeSecret brings secrets exported by other tools into canonical
+// form: whitespace and dashes removed, upper case
+func normalizeSecret(secret string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\r', '-':
+			return -1
+		}
+		return r
+	}, strings.ToUpper(secret))
+}
+
+// decodeSecret decodes a base32 secret with or without "=" padding
+func decodeSecret(secret string) ([]byte, error) {
+	secret = normalizeSecret(secret)
+	key, err := base32.StdEncoding.DecodeString(secret)
+	if err == nil {
+		return key, nil
+	}
+	if unpadded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "=")); err == nil {
+		return unpadded, nil
+	}
+	return nil, err
+}
+
+// decodeSecretAs decodes a configured secret in the given encoding
+func decodeSecretAs(secret, encoding string) ([]byte, error) {
+	if encoding != secretEncodingHex {
+		return decodeSecret(secret)
+	}
+	// Hex seeds are often grouped with spaces, dashes or colons
+	return hex.DecodeString(strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\n', '\r', '-', ':':
+			return -1
+		}
+		return r
+	}, secret))
+}
+
+// validateSecretEncoding checks secretEncoding
+func validateSecretEncoding(config *Config) error {
+	config.SecretEncoding = strings.ToLower(config.SecretEncoding)
+	switch config.SecretEncoding {
+	case "":
+		config.SecretEncoding = secretEncodingBase32
+	case secretEncodingBase32, secretEncodingHex:
+	default:
+		return fmt.Errorf("invalid secretEncoding (must be %q or %q): %s", secretEncodingBase32, secretEncodingHex, config.SecretEncoding)
+	}
+	return nil
+}
+
+// convertHexSecrets rewrites hex encoded secrets as base32, the form every
+// other part of the plugin and authenticator apps work with
+func convertHexSecrets(config *Config) error {
+	if config.SecretEncoding != secretEncodingHex {
+		return nil
+	}
+
+	convert := func(field, secret string) (string, error) {
+		if secret == "" {
+			return "", nil
+		}
+		key, err := decodeSecretAs(secret, secretEncodingHex)
+		if err != nil || len(key) == 0 {
+			return "", fmt.Errorf("invalid %s (must be hex encoded)", field)
+		}
+		return base32.StdEncoding.EncodeToString(key), nil
+	}
+
+	var err error
+	if config.SecretKey, err = convert("secretKey", config.SecretKey); err != nil {
+		return err
+	}
+	if config.ReadOnlySecretKey, err = convert("readOnlySecretKey", config.ReadOnlySecretKey); err != nil {
+		return err
+	}
+	for i, secret := range config.AdditionalSecretKeys {
+		if config.AdditionalSecretKeys[i], err = convert(fmt.Sprintf("additionalSecretKeys[%d]", i), secret); err != nil {
+			return err
+		}
+	}
+	for prefix, secret := range config.PathSecrets {
+		if config.PathSecrets[prefix], err = convert("pathSecrets secret for "+prefix, secret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeSecrets rewrites every configured secret in canonical form, so
+// that comparisons between them and the keys cached for them agree
+func normalizeSecrets(config *Config) {
+	config.SecretKey = normalizeSecret(config.SecretKey)
+	config.ReadOnlySecretKey = normalizeSecret(config.ReadOnlySecretKey)
+	for i, secret := range config.AdditionalSecretKeys {
+		config.AdditionalSecretKeys[i] = normalizeSecret(secret)
+	}
+	for prefix, secret := range config.PathSecrets {
+		config.PathSecrets[prefix] = normalizeSecret(secret)
+	}
+}
+
+// keyCache holds decoded secrets, so codes are not generated from a fresh
+// base32 decode on every attempt
+type keyCache struct {
+	mu   sync.RWMutex
+	keys map[string][]byte
+}
+
+// newKeyCache creates an empty key cache
+func newKeyCache() *keyCache {
+	return &keyCache{keys: make(map[string][]byte)}
+}
+
+// get returns the decoded key of secret
+func (c *keyCache) get(secret string) ([]byte, error) {
+	c.mu.RLock()
+	key, ok := c.keys[secret]
+	c.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.keys) >= maxCachedKeys {
+		c.keys = make(map[string][]byte)
+	}
+	c.keys[secret] = key
+	c.mu.Unlock()
+	return key, nil
+}
@@ -0,0 +1,71 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// secretEnvPrefix marks a secret that is read from an environment variable,
+// e.g. "env:TOTP_SECRET"
+const secretEnvPrefix = "env:"
+
+// resolveSecretRefs replaces environment variable references in secretKey,
+// readOnlySecretKey, additionalSecretKeys and pathSecrets with the variables' values. Errors name
+// the field and the variable, never the value.
+func resolveSecretRefs(config *Config, name string) error {
+	var err error
+	if config.SecretKey, err = resolveSecretRef(name, "secretKey", config.SecretKey, config.SecretEncoding); err != nil {
+		return err
+	}
+	if config.ReadOnlySecretKey, err = resolveSecretRef(name, "readOnlySecretKey", config.ReadOnlySecretKey, config.SecretEncoding); err != nil {
+		return err
+	}
+
+	for i, secret := range config.AdditionalSecretKeys {
+		resolved, err := resolveSecretRef(name, fmt.Sprintf("additionalSecretKeys[%d]", i), secret, config.SecretEncoding)
+		if err != nil {
+			return err
+		}
+		config.AdditionalSecretKeys[i] = resolved
+	}
+
+	prefixes := make([]string, 0, len(config.PathSecrets))
+	for prefix := range config.PathSecrets {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		resolved, err := resolveSecretRef(name, "pathSecrets secret for "+prefix, config.PathSecrets[prefix], config.SecretEncoding)
+		if err != nil {
+			return err
+		}
+		config.PathSecrets[prefix] = resolved
+	}
+	return nil
+}
+
+// resolveSecretRef returns the value of the environment variable value
+// refers to, or value itself when it is not a reference
+func resolveSecretRef(name, field, value, encoding string) (string, error) {
+	if !strings.HasPrefix(value, secretEnvPrefix) {
+		return value, nil
+	}
+
+	variable := strings.TrimPrefix(value, secretEnvPrefix)
+	if variable == "" {
+		return "", fmt.Errorf("%s: %q is missing the environment variable name", field, value)
+	}
+	resolved := strings.TrimSpace(os.Getenv(variable))
+	if resolved == "" {
+		return "", fmt.Errorf("%s refers to environment variable %s, which is not set or empty", field, variable)
+	}
+	if _, err := decodeSecretAs(resolved, encoding); err != nil {
+		return "", fmt.Errorf("%s: environment variable %s is not valid %s", field, variable, encoding)
+	}
+
+	log.Printf("[%s] Using %s from environment variable %s", name, field, variable)
+	return resolved, nil
+}
@@ -0,0 +1,124 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"sort"
+)
+
+// rfc6238Seeds are the reference secrets of the RFC 6238 test vectors
+var rfc6238Seeds = map[string]string{
+	"SHA1":   "12345678901234567890",
+	"SHA256": "12345678901234567890123456789012",
+	"SHA512": "1234567890123456789012345678901234567890123456789012345678901234",
+}
+
+// rfc6238Vectors are the 8-digit reference codes of RFC 6238, appendix B,
+// for a 30 second time step
+var rfc6238Vectors = []struct {
+	time  int64
+	codes map[string]string
+}{
+	{59, map[string]string{"SHA1": "94287082", "SHA256": "46119246", "SHA512": "90693936"}},
+	{1111111109, map[string]string{"SHA1": "07081804", "SHA256": "68084774", "SHA512": "25091201"}},
+	{1111111111, map[string]string{"SHA1": "14050471", "SHA256": "67062674", "SHA512": "99943326"}},
+	{1234567890, map[string]string{"SHA1": "89005924", "SHA256": "91819424", "SHA512": "93441116"}},
+	{2000000000, map[string]string{"SHA1": "69279037", "SHA256": "90698825", "SHA512": "38618901"}},
+	{20000000000, map[string]string{"SHA1": "65353130", "SHA256": "77737706", "SHA512": "47863826"}},
+}
+
+// selfTest checks code generation before the middleware accepts logins: the
+// HMAC of every configured algorithm against the RFC 6238 vectors, the
+// digits of every area, and that every configured secret yields a code
+func (ta *TOTPAuth) selfTest() error {
+	// The default area plus every area with its own secret
+	areas := []string{""}
+	for prefix := range ta.config.PathSecrets {
+		areas = append(areas, prefix)
+	}
+	sort.Strings(areas)
+
+	for _, area := range areas {
+		params := ta.tokenParams(area)
+		if err := ta.selfTestParams(params); err != nil {
+			return fmt.Errorf("self-test failed for %s: %w (set skipSelfTest to start anyway)", areaLabel(area), err)
+		}
+
+		secret := ta.currentSecret()
+		if area != "" {
+			secret = ta.config.PathSecrets[area]
+		}
+		if err := ta.selfTestSecret(secret, params); err != nil {
+			return fmt.Errorf("self-test failed for %s: %w (set skipSelfTest to start anyway)", areaLabel(area), err)
+		}
+	}
+
+	for i, secret := range ta.config.AdditionalSecretKeys {
+		if err := ta.selfTestSecret(secret, ta.tokenParams("")); err != nil {
+			return fmt.Errorf("self-test failed for additionalSecretKeys[%d]: %w (set skipSelfTest to start anyway)", i, err)
+		}
+	}
+
+	if ta.config.ReadOnlySecretKey != "" {
+		if err := ta.selfTestSecret(ta.config.ReadOnlySecretKey, ta.tokenParams("")); err != nil {
+			return fmt.Errorf("self-test failed for readOnlySecretKey: %w (set skipSelfTest to start anyway)", err)
+		}
+	}
+	return nil
+}
+
+// selfTestParams compares codes generated with params against the RFC 6238
+// vectors
+func (ta *TOTPAuth) selfTestParams(params tokenParams) error {
+	if params.period <= 0 {
+		return fmt.Errorf("invalid period %d", params.period)
+	}
+
+	key := []byte(rfc6238Seeds[params.algorithm])
+	for _, vector := range rfc6238Vectors {
+		expected := vector.codes[params.algorithm]
+		truncated := truncatedHMAC(key, vector.time/30, params.algorithm)
+		if got := fmt.Sprintf("%08d", truncated%100000000); got != expected {
+			return fmt.Errorf("%s code for time %d is %s, RFC 6238 expects %s", params.algorithm, vector.time, got, expected)
+		}
+
+		// Shorter codes are the trailing digits of the 8-digit reference
+		code := ta.formatCode(truncated, params.digits)
+		if err := ta.checkCodeShape(code, params); err != nil {
+			return err
+		}
+		if ta.config.CodeFormat == codeFormatNumeric && params.digits <= 8 && code != expected[8-params.digits:] {
+			return fmt.Errorf("%d-digit code for time %d is %s, expected %s", params.digits, vector.time, code, expected[8-params.digits:])
+		}
+	}
+	return nil
+}
+
+// selfTestSecret generates one code from secret to confirm it decodes and
+// yields a code of the configured shape
+func (ta *TOTPAuth) selfTestSecret(secret string, params tokenParams) error {
+	code := ta.generateCodeWith(secret, ta.codeTime().Unix()/int64(params.period), params)
+	if code == "" {
+		return fmt.Errorf("the configured secret can't be decoded")
+	}
+	return ta.checkCodeShape(code, params)
+}
+
+// checkCodeShape verifies the length of a generated code
+func (ta *TOTPAuth) checkCodeShape(code string, params tokenParams) error {
+	length := params.digits
+	if ta.config.CodeFormat == codeFormatSteam {
+		length = steamCodeLength
+	}
+	if len(code) != length {
+		return fmt.Errorf("generated code %q does not have %d characters", code, length)
+	}
+	return nil
+}
+
+// areaLabel names an area in messages
+func areaLabel(area string) string {
+	if area == "" {
+		return "secretKey"
+	}
+	return "pathSecrets " + area
+}
@@ -0,0 +1,485 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Where sessions are kept
+const (
+	sessionModeMemory    = "memory"
+	sessionModeSigned    = "signed"
+	sessionModeEncrypted = "encrypted"
+	sessionModeJWT       = "jwt"
+)
+
+// minSessionSigningKeyLength is the shortest sessionSigningKey accepted
+const minSessionSigningKeyLength = 32
+
+// sessionCookieAD is the additional data encrypted session cookies are sealed
+// with, so values sealed for another purpose under the same key don't open.
+// The key ID is appended for cookies that carry one.
+var sessionCookieAD = []byte("totp-session-cookie-v1")
+
+// sessionKey is one of the keys session cookies are signed or encrypted with
+type sessionKey struct {
+	id     string      // Key ID carried by the cookie
+	key    []byte      // Signing key (signed and jwt mode)
+	cipher cipher.AEAD // Cipher (encrypted mode)
+}
+
+// sessionPayload is the content of a signed or encrypted session cookie.
+// Field names are short to keep the cookie small.
+type sessionPayload struct {
+	IssuedAt  int64    `json:"iat"`
+	ExpiresAt int64    `json:"exp"`
+	IdleExp   int64    `json:"ie,omitempty"` // Only with idleTimeout
+	IP        string   `json:"ip,omitempty"` // Only with validateIP
+	ReadOnly  bool     `json:"ro,omitempty"`
+	Areas     []string `json:"a,omitempty"`
+	Method    string   `json:"m,omitempty"`
+}
+
+// sessionJWTClaims are the claims of a JWT session cookie
+type sessionJWTClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub,omitempty"` // accountName, when set
+	IssuedAt  int64    `json:"iat"`
+	NotBefore int64    `json:"nbf"`
+	ExpiresAt int64    `json:"exp"`
+	IdleExp   int64    `json:"idle_exp,omitempty"` // Only with idleTimeout
+	Scope     string   `json:"scope"`
+	Areas     []string `json:"areas,omitempty"`
+	Method    string   `json:"method,omitempty"`
+	IP        string   `json:"ip,omitempty"` // Only with validateIP
+}
+
+// validateSessionMode checks sessionMode and its keys. Features that keep
+// state on a session can't be combined with sessions kept in the cookie.
+func validateSessionMode(config *Config) error {
+	config.SessionMode = strings.ToLower(config.SessionMode)
+	switch config.SessionMode {
+	case "":
+		config.SessionMode = sessionModeMemory
+		return nil
+	case sessionModeMemory:
+		return nil
+	case sessionModeSigned, sessionModeJWT:
+		keys := sessionSigningKeys(config)
+		if len(keys) == 0 {
+			return fmt.Errorf("sessionMode %s requires sessionSigningKey or sessionSigningKeys", config.SessionMode)
+		}
+		for i, key := range keys {
+			if len(key) < minSessionSigningKeyLength {
+				return fmt.Errorf("session signing key %d is shorter than %d characters", i+1, minSessionSigningKeyLength)
+			}
+		}
+	case sessionModeEncrypted:
+		if _, err := sessionEncryptionKeys(config); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid sessionMode (must be %q, %q, %q or %q): %s", sessionModeMemory, sessionModeSigned, sessionModeEncrypted, sessionModeJWT, config.SessionMode)
+	}
+
+	if config.StepUpHeader != "" || config.EnableDevicesPage || config.MaxIPChanges > 0 || config.SessionFile != "" || config.SingleSession || config.MaxSessions > 0 {
+		return fmt.Errorf("sessionMode %s cannot be combined with stepUpHeader, enableDevicesPage, maxIPChanges, sessionFile, singleSession or maxSessions", config.SessionMode)
+	}
+	// A cookie session can't be revoked, so the header would only pretend to
+	if config.RevokeHeader != "" {
+		return fmt.Errorf("sessionMode %s cannot be combined with revokeHeader: cookie sessions stay valid until they expire", config.SessionMode)
+	}
+	return nil
+}
+
+// sessionSigningKeys returns the configured signing keys, the issuing key
+// first
+func sessionSigningKeys(config *Config) []string {
+	if config.SessionSigningKey == "" {
+		return config.SessionSigningKeys
+	}
+	return append([]string{config.SessionSigningKey}, config.SessionSigningKeys...)
+}
+
+// sessionEncryptionKeys decodes the configured base64 encryption keys, the
+// issuing key first. Each must be 32 bytes (AES-256).
+func sessionEncryptionKeys(config *Config) ([][]byte, error) {
+	encoded := config.SessionEncryptionKeys
+	if config.SessionEncryptionKey != "" {
+		encoded = append([]string{config.SessionEncryptionKey}, encoded...)
+	}
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("sessionMode encrypted requires sessionEncryptionKey or sessionEncryptionKeys")
+	}
+
+	keys := make([][]byte, len(encoded))
+	for i, value := range encoded {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("session encryption key %d must be 32 base64 encoded bytes", i+1)
+		}
+		keys[i] = key
+	}
+	return keys, nil
+}
+
+// deriveSigningKey derives the key for purpose from a configured key, so the
+// configured value is never used directly and each use gets its own key
+func deriveSigningKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// sessionKeyID returns the ID a cookie carries to name the key it was issued
+// with. It reveals nothing about the key.
+func sessionKeyID(key []byte) string {
+	return hex.EncodeToString(deriveSigningKey(key, "totp-session-key-id")[:4])
+}
+
+// sharedFormKey returns the form key derived from formSigningKey or, with
+// sessionStore http or redis, from the credential all replicas share with
+// the store, and nil when neither applies. Forms rendered by one replica
+// must verify on the others, so a shared store without a long enough shared
+// key is an error.
+func sharedFormKey(config *Config) ([]byte, error) {
+	if config.FormSigningKey != "" {
+		if len(config.FormSigningKey) < minSessionSigningKeyLength {
+			return nil, fmt.Errorf("formSigningKey is shorter than %d characters", minSessionSigningKeyLength)
+		}
+		return deriveSigningKey([]byte(config.FormSigningKey), "totp-form-v1"), nil
+	}
+
+	var credential string
+	switch config.SessionStore {
+	case sessionStoreHTTP:
+		credential = config.SessionStoreToken
+	case sessionStoreRedis:
+		credential = config.RedisPassword
+	default:
+		return nil, nil
+	}
+	if len(credential) < minSessionSigningKeyLength {
+		return nil, fmt.Errorf("sessionStore %s requires formSigningKey, or a sessionStoreToken or redisPassword of at least %d characters, so that replicas accept each other's forms", config.SessionStore, minSessionSigningKeyLength)
+	}
+	return deriveSigningKey([]byte(credential), "totp-form-v1"), nil
+}
+
+// newSessionKeys returns the keys for sessions kept in the cookie, the
+// issuing key first, and the form key, which is derived from the issuing key
+// so replicas accept each other's forms. Both are nil in memory mode.
+func newSessionKeys(config *Config) ([]sessionKey, []byte, error) {
+	var keys []sessionKey
+	var formKey []byte
+
+	switch config.SessionMode {
+	case sessionModeSigned, sessionModeJWT:
+		for _, configured := range sessionSigningKeys(config) {
+			key := []byte(configured)
+			if config.SessionMode == sessionModeSigned {
+				key = deriveSigningKey(key, "totp-session-cookie-v1")
+			}
+			keys = append(keys, sessionKey{id: sessionKeyID([]byte(configured)), key: key})
+			if formKey == nil {
+				formKey = deriveSigningKey([]byte(configured), "totp-form-v1")
+			}
+		}
+	case sessionModeEncrypted:
+		configured, err := sessionEncryptionKeys(config)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, key := range configured {
+			aead, err := newSecretCipher(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			keys = append(keys, sessionKey{id: sessionKeyID(key), cipher: aead})
+		}
+		formKey = deriveSigningKey(configured[0], "totp-form-v1")
+	}
+
+	for i := range keys {
+		for j := 0; j < i; j++ {
+			if keys[i].id == keys[j].id {
+				return nil, nil, fmt.Errorf("session key %d is configured twice", i+1)
+			}
+		}
+	}
+	return keys, formKey, nil
+}
+
+// statelessSessions reports whether sessions are kept in the cookie instead
+// of the store
+func (ta *TOTPAuth) statelessSessions() bool {
+	return ta.config.SessionMode != sessionModeMemory
+}
+
+// sessionKeysFor returns the keys a cookie naming kid may have been issued
+// with: that key only, or every key for cookies from before key IDs were
+// added
+func (ta *TOTPAuth) sessionKeysFor(kid string) []sessionKey {
+	if kid == "" {
+		return ta.sessionKeys
+	}
+	for _, key := range ta.sessionKeys {
+		if key.id == kid {
+			return []sessionKey{key}
+		}
+	}
+	return nil
+}
+
+// encodeSession returns the cookie value carrying session, signed,
+// encrypted or as a JWT according to sessionMode, with the issuing key
+func (ta *TOTPAuth) encodeSession(session *Session) (string, error) {
+	issuing := ta.sessionKeys[0]
+	if ta.config.SessionMode == sessionModeJWT {
+		return ta.encodeSessionJWT(session, issuing)
+	}
+
+	payload := sessionPayload{
+		IssuedAt:  session.CreatedAt.Unix(),
+		ExpiresAt: session.ExpiresAt.Unix(),
+		IdleExp:   unixTime(session.IdleExpiresAt),
+		ReadOnly:  session.ReadOnly,
+		Areas:     session.Areas,
+		Method:    session.Method,
+	}
+	if ta.config.ValidateIP {
+		payload.IP = session.IP
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+
+	if ta.config.SessionMode == sessionModeEncrypted {
+		nonce := make([]byte, issuing.cipher.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		sealed := issuing.cipher.Seal(nonce, nonce, data, sessionCookieADFor(issuing.id))
+		return issuing.id + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+	}
+
+	signingInput := issuing.id + "." + base64.RawURLEncoding.EncodeToString(data)
+	return signingInput + "." + sessionSignature(issuing.key, signingInput), nil
+}
+
+// decodeSession returns the session carried by a signed, encrypted or JWT
+// cookie value. Wrong keys, tampered, truncated or otherwise malformed values
+// are rejected.
+func (ta *TOTPAuth) decodeSession(token string) (*Session, bool) {
+	if ta.config.SessionMode == sessionModeJWT {
+		return ta.decodeSessionJWT(token)
+	}
+
+	var data []byte
+	if ta.config.SessionMode == sessionModeEncrypted {
+		data = ta.openSession(token)
+	} else {
+		data = ta.verifySessionSignature(token)
+	}
+	if data == nil {
+		return nil, false
+	}
+
+	var payload sessionPayload
+	if err := json.Unmarshal(data, &payload); err != nil || payload.ExpiresAt == 0 {
+		return nil, false
+	}
+	return &Session{
+		TokenHash:     hashSessionToken(token),
+		CreatedAt:     time.Unix(payload.IssuedAt, 0),
+		ExpiresAt:     time.Unix(payload.ExpiresAt, 0),
+		IdleExpiresAt: fromUnixTime(payload.IdleExp),
+		IP:            payload.IP,
+		ReadOnly:      payload.ReadOnly,
+		Areas:         payload.Areas,
+		Method:        payload.Method,
+	}, true
+}
+
+// verifySessionSignature returns the payload of a signed cookie value
+// ("kid.payload.signature"), or nil
+func (ta *TOTPAuth) verifySessionSignature(token string) []byte {
+	idx := strings.LastIndex(token, ".")
+	if idx == -1 {
+		return nil
+	}
+	signingInput, signature := token[:idx], token[idx+1:]
+
+	kid, encoded := "", signingInput
+	if dot := strings.Index(signingInput, "."); dot != -1 {
+		kid, encoded = signingInput[:dot], signingInput[dot+1:]
+		if kid == "" {
+			return nil
+		}
+	}
+
+	for _, key := range ta.sessionKeysFor(kid) {
+		if hmac.Equal([]byte(signature), []byte(sessionSignature(key.key, signingInput))) {
+			data, err := base64.RawURLEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil
+			}
+			return data
+		}
+	}
+	return nil
+}
+
+// sessionCookieADFor returns the additional data of an encrypted cookie
+// issued with the key named kid
+func sessionCookieADFor(kid string) []byte {
+	return append(append([]byte(nil), sessionCookieAD...), kid...)
+}
+
+// sessionSignature returns the HMAC of a session cookie's signing input
+func sessionSignature(key []byte, signingInput string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// openSession returns the payload of an encrypted cookie value
+// ("kid.sealed"), or nil
+func (ta *TOTPAuth) openSession(token string) []byte {
+	kid, encoded := "", token
+	if dot := strings.Index(token, "."); dot != -1 {
+		kid, encoded = token[:dot], token[dot+1:]
+		if kid == "" {
+			return nil
+		}
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil
+	}
+	ad := sessionCookieADFor(kid)
+
+	for _, key := range ta.sessionKeysFor(kid) {
+		if len(sealed) < key.cipher.NonceSize()+key.cipher.Overhead() {
+			return nil
+		}
+		nonce, ciphertext := sealed[:key.cipher.NonceSize()], sealed[key.cipher.NonceSize():]
+		if data, err := key.cipher.Open(nil, nonce, ciphertext, ad); err == nil {
+			return data
+		}
+	}
+	return nil
+}
+
+// encodeSessionJWT returns session as an HS256 JWT signed with the
+// configured signing key itself, so backends can verify it with the same
+// key. The header names the key in kid.
+func (ta *TOTPAuth) encodeSessionJWT(session *Session, issuing sessionKey) (string, error) {
+	claims := sessionJWTClaims{
+		Issuer:    ta.name,
+		Subject:   ta.config.AccountName,
+		IssuedAt:  session.CreatedAt.Unix(),
+		NotBefore: session.CreatedAt.Unix(),
+		ExpiresAt: session.ExpiresAt.Unix(),
+		IdleExp:   unixTime(session.IdleExpiresAt),
+		Scope:     sessionScope(session),
+		Areas:     session.Areas,
+		Method:    session.Method,
+	}
+	if ta.config.ValidateIP {
+		claims.IP = session.IP
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": issuing.id})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, issuing.key)
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// decodeSessionJWT verifies a JWT session cookie like any other JWT (HMAC
+// signature, exp and nbf with leeway, issuer) with the key named by its kid
+// header, and returns its session
+func (ta *TOTPAuth) decodeSessionJWT(token string) (*Session, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, false
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, false
+	}
+	var header struct {
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, false
+	}
+
+	for _, key := range ta.sessionKeysFor(header.Kid) {
+		verifier := &jwtVerifier{hmacKey: key.key, issuer: ta.name}
+		if _, err := verifier.verify(token, ta.clock.Now()); err != nil {
+			continue
+		}
+
+		// The signature is valid, so the payload is well-formed
+		payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims sessionJWTClaims
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			return nil, false
+		}
+		return &Session{
+			TokenHash:     hashSessionToken(token),
+			CreatedAt:     time.Unix(claims.IssuedAt, 0),
+			ExpiresAt:     time.Unix(claims.ExpiresAt, 0),
+			IdleExpiresAt: fromUnixTime(claims.IdleExp),
+			IP:            claims.IP,
+			ReadOnly:      claims.Scope == "readonly",
+			Areas:         claims.Areas,
+			Method:        claims.Method,
+		}, true
+	}
+	return nil, false
+}
+
+// unixTime returns t as a unix timestamp, 0 for the zero time
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// fromUnixTime is the inverse of unixTime
+func fromUnixTime(seconds int64) time.Time {
+	if seconds == 0 {
+		return time.Time{}
+	}
+	return time.Unix(seconds, 0)
+}
+
+// lookupSession returns the session for token: decoded from the cookie value
+// when sessions are kept in the cookie, from the store otherwise
+func (ta *TOTPAuth) lookupSession(token string) (*Session, bool) {
+	if ta.statelessSessions() {
+		return ta.decodeSession(token)
+	}
+	return ta.sessions.Get(hashSessionToken(token))
+}
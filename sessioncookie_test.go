@@ -0,0 +1,247 @@
+package traefik_totp_plugin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSharedFormKey(t *testing.T) {
+	const long = "0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name    string
+		config  Config
+		shared  bool
+		wantErr string
+	}{
+		{name: "memory store keeps the random key", config: Config{SessionStore: sessionStoreMemory}},
+		{name: "formSigningKey", config: Config{SessionStore: sessionStoreMemory, FormSigningKey: long}, shared: true},
+		{name: "short formSigningKey", config: Config{FormSigningKey: "short"}, wantErr: "formSigningKey"},
+		{name: "http store token", config: Config{SessionStore: sessionStoreHTTP, SessionStoreToken: long}, shared: true},
+		{name: "redis password", config: Config{SessionStore: sessionStoreRedis, RedisPassword: long}, shared: true},
+		{name: "http store without key", config: Config{SessionStore: sessionStoreHTTP}, wantErr: "requires formSigningKey"},
+		{name: "redis with short password", config: Config{SessionStore: sessionStoreRedis, RedisPassword: "secret"}, wantErr: "requires formSigningKey"},
+		{name: "formSigningKey wins over the store credential", config: Config{SessionStore: sessionStoreRedis, FormSigningKey: long}, shared: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := sharedFormKey(&tt.config)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (key != nil) != tt.shared {
+				t.Fatalf("key = %x, want shared %v", key, tt.shared)
+			}
+		})
+	}
+}
+
+// TestFormKeySharedBetweenReplicas checks that a CSRF token issued by one
+// instance verifies on another with the same formSigningKey
+func TestFormKeySharedBetweenReplicas(t *testing.T) {
+	configure := func(config *Config) {
+		config.FormSigningKey = "0123456789abcdef0123456789abcdef"
+	}
+	first := newTestAuth(t, configure)
+	second := newTestAuth(t, configure)
+	if !bytes.Equal(first.formKey, second.formKey) {
+		t.Fatal("replicas derived different form keys")
+	}
+	token := first.csrfToken("session-token", "logout")
+	if !second.validCSRFToken("session-token", "logout", token) {
+		t.Fatal("CSRF token of one replica rejected by the other")
+	}
+
+	third := newTestAuth(t, nil)
+	if bytes.Equal(first.formKey, third.formKey) {
+		t.Fatal("instance without formSigningKey uses the shared key")
+	}
+}
+
+// TestSessionKeyRotation checks that during a key rotation cookies of both
+// the new and the old key verify, and that only the new key's do afterwards
+func TestSessionKeyRotation(t *testing.T) {
+	type keys struct {
+		issuing string
+		others  []string
+	}
+	modes := []struct {
+		mode      string
+		old, new  string
+		configure func(config *Config, k keys)
+	}{
+		{
+			mode: sessionModeSigned,
+			old:  "old-signing-key-0123456789abcdef0123",
+			new:  "new-signing-key-0123456789abcdef0123",
+			configure: func(config *Config, k keys) {
+				config.SessionSigningKey, config.SessionSigningKeys = k.issuing, k.others
+			},
+		},
+		{
+			mode: sessionModeEncrypted,
+			old:  base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)),
+			new:  base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)),
+			configure: func(config *Config, k keys) {
+				config.SessionEncryptionKey, config.SessionEncryptionKeys = k.issuing, k.others
+			},
+		},
+		{
+			mode: sessionModeJWT,
+			old:  "old-jwt-key-0123456789abcdef0123456789",
+			new:  "new-jwt-key-0123456789abcdef0123456789",
+			configure: func(config *Config, k keys) {
+				config.SessionSigningKey, config.SessionSigningKeys = k.issuing, k.others
+			},
+		},
+	}
+
+	for _, m := range modes {
+		t.Run(m.mode, func(t *testing.T) {
+			instance := func(k keys) *TOTPAuth {
+				return newTestAuth(t, func(config *Config) {
+					config.SessionMode = m.mode
+					m.configure(config, k)
+				})
+			}
+			before := instance(keys{issuing: m.old})
+			during := instance(keys{issuing: m.new, others: []string{m.old}})
+			after := instance(keys{issuing: m.new})
+
+			oldCookie := newTestSession(t, before)
+			newCookie := newTestSession(t, during)
+
+			for _, check := range []struct {
+				name   string
+				ta     *TOTPAuth
+				cookie string
+				valid  bool
+			}{
+				{"old cookie during the overlap", during, oldCookie, true},
+				{"new cookie during the overlap", during, newCookie, true},
+				{"new cookie after the overlap", after, newCookie, true},
+				{"old cookie after the overlap", after, oldCookie, false},
+				{"new cookie before the rotation", before, newCookie, false},
+			} {
+				req := withSession(check.ta, newTestRequest(http.MethodGet, "/"), check.cookie)
+				if valid := check.ta.validSession(req, check.cookie) != nil; valid != check.valid {
+					t.Errorf("%s: valid = %v, want %v", check.name, valid, check.valid)
+				}
+			}
+
+			// Forms rendered during the overlap stay valid once the old key is gone
+			if !bytes.Equal(during.formKey, after.formKey) {
+				t.Error("form key doesn't follow the issuing key")
+			}
+		})
+	}
+}
+
+// TestTamperedSessionCookies checks that cookie values that were altered,
+// cut short or name another key carry no session in every cookie mode
+func TestTamperedSessionCookies(t *testing.T) {
+	type tamperCase struct {
+		name   string
+		tamper func(value string) string
+	}
+	modes := []struct {
+		mode      string
+		configure func(config *Config)
+	}{
+		{sessionModeSigned, func(config *Config) {
+			config.SessionSigningKey = "issuing-signing-key-0123456789abcdef"
+			config.SessionSigningKeys = []string{"other-signing-key-0123456789abcdef01"}
+		}},
+		{sessionModeEncrypted, func(config *Config) {
+			config.SessionEncryptionKey = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+			config.SessionEncryptionKeys = []string{base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))}
+		}},
+		{sessionModeJWT, func(config *Config) {
+			config.SessionSigningKey = "issuing-jwt-key-0123456789abcdef0123"
+			config.SessionSigningKeys = []string{"other-jwt-key-0123456789abcdef012345"}
+		}},
+	}
+
+	// flip changes the character at i of the segment of value at index
+	// segment, never the last one, whose low bits base64 may ignore
+	flip := func(segment int, middle bool) func(value string) string {
+		return func(value string) string {
+			parts := strings.Split(value, ".")
+			i := 0
+			if middle {
+				i = len(parts[segment]) / 2
+			}
+			b := []byte(parts[segment])
+			if b[i] == 'A' {
+				b[i] = 'B'
+			} else {
+				b[i] = 'A'
+			}
+			parts[segment] = string(b)
+			return strings.Join(parts, ".")
+		}
+	}
+
+	// withKeyID replaces the key ID of value with kid
+	withKeyID := func(mode, value, kid string) string {
+		parts := strings.Split(value, ".")
+		if mode != sessionModeJWT {
+			parts[0] = kid
+			return strings.Join(parts, ".")
+		}
+		header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": kid})
+		parts[0] = base64.RawURLEncoding.EncodeToString(header)
+		return strings.Join(parts, ".")
+	}
+
+	for _, m := range modes {
+		t.Run(m.mode, func(t *testing.T) {
+			ta := newTestAuth(t, func(config *Config) {
+				config.SessionMode = m.mode
+				m.configure(config)
+			})
+			value := newTestSession(t, ta)
+			if _, ok := ta.decodeSession(value); !ok {
+				t.Fatal("untouched cookie rejected")
+			}
+			segments := strings.Count(value, ".") + 1
+
+			tests := []tamperCase{
+				{"cut by one character", func(v string) string { return v[:len(v)-1] }},
+				{"cut in half", func(v string) string { return v[:len(v)/2] }},
+				{"last segment removed", func(v string) string { return v[:strings.LastIndex(v, ".")] }},
+				{"empty", func(string) string { return "" }},
+				{"other key's ID", func(v string) string { return withKeyID(m.mode, v, ta.sessionKeys[1].id) }},
+				{"unknown key ID", func(v string) string { return withKeyID(m.mode, v, "unknown") }},
+			}
+			for segment := 0; segment < segments; segment++ {
+				tests = append(tests,
+					tamperCase{fmt.Sprintf("segment %d first byte flipped", segment), flip(segment, false)},
+					tamperCase{fmt.Sprintf("segment %d middle byte flipped", segment), flip(segment, true)},
+				)
+			}
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					tampered := tt.tamper(value)
+					if tampered == value {
+						t.Fatal("value unchanged")
+					}
+					if session, ok := ta.decodeSession(tampered); ok || session != nil {
+						t.Errorf("tampered cookie %q yields a session", tampered)
+					}
+				})
+			}
+		})
+	}
+}
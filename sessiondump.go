@@ -0,0 +1,126 @@
+package traefik_totp_plugin
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// adminSessionDumpPath is the admin API path sessions are exported from and
+// imported to, relative to adminPathPrefix
+const adminSessionDumpPath = "sessions/dump"
+
+// maxSessionDumpSize bounds the body of a session import, enough for the
+// default maxTotalSessions
+const maxSessionDumpSize = 64 << 20
+
+// handleAdminSessionDump handles /.totp/admin/sessions/dump: GET exports
+// every active session, POST imports such an export, e.g. when moving users
+// to a new deployment. Dumps have the format of sessionFile and, like it,
+// only hold token hashes, which don't work as cookies.
+func (ta *TOTPAuth) handleAdminSessionDump(rw http.ResponseWriter, req *http.Request) {
+	if ta.statelessSessions() {
+		writeJSONError(rw, http.StatusNotImplemented, "sessions are kept in the cookie, there is nothing to export or import")
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		ta.exportSessions(rw, req)
+	case http.MethodPost:
+		ta.importSessions(rw, req)
+	default:
+		rw.Header().Set("Allow", "GET, POST")
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// exportSessions responds with every session that hasn't expired yet
+func (ta *TOTPAuth) exportSessions(rw http.ResponseWriter, req *http.Request) {
+	if _, canList := ta.sessions.(SessionLister); !canList {
+		writeJSONError(rw, http.StatusNotImplemented, "the session store cannot list sessions")
+		return
+	}
+
+	now := ta.clock.Now()
+	contents := sessionFileContents{Sessions: []sessionFileEntry{}}
+	for _, session := range ta.listSessions() {
+		if now.Before(session.deadline()) {
+			contents.Sessions = append(contents.Sessions, newSessionFileEntry(session))
+		}
+	}
+
+	log.Printf("[%s] Admin exported %d session(s) (admin request from %s)", ta.name, len(contents.Sessions), ta.getClientIP(req))
+	ta.audit(req, auditAdminAction, "export_sessions", fmt.Sprintf("exported=%d", len(contents.Sessions)))
+	writeJSON(rw, http.StatusOK, contents)
+}
+
+// importSessions merges the sessions of an export into the store. Sessions
+// that expired or are already known are skipped, so importing the same dump
+// twice changes nothing.
+func (ta *TOTPAuth) importSessions(rw http.ResponseWriter, req *http.Request) {
+	var contents sessionFileContents
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxSessionDumpSize)).Decode(&contents); err != nil {
+		writeJSONError(rw, http.StatusBadRequest, "body must be a session export")
+		return
+	}
+
+	now := ta.clock.Now()
+	var sessions []*Session
+	expired, existing, invalid := 0, 0, 0
+	for _, entry := range contents.Sessions {
+		if entry.TokenHash == "" && entry.Token != "" {
+			entry.TokenHash = hashSessionToken(entry.Token)
+		}
+		if !validTokenHash(entry.TokenHash) {
+			invalid++
+			continue
+		}
+		session := entry.session()
+		if !now.Before(session.deadline()) {
+			expired++
+			continue
+		}
+		if _, exists := ta.sessions.Get(session.TokenHash); exists {
+			existing++
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+
+	imported := 0
+	if memory, ok := ta.sessions.(*memorySessionStore); ok {
+		memory.putAll(sessions)
+		imported = len(sessions)
+	} else {
+		for _, session := range sessions {
+			if err := ta.sessions.Put(session); err != nil {
+				log.Printf("[%s] Failed to import session %s: %v", ta.name, session.id(), err)
+				continue
+			}
+			imported++
+		}
+	}
+
+	log.Printf("[%s] Admin imported %d session(s), skipped %d expired, %d existing and %d invalid (admin request from %s)",
+		ta.name, imported, expired, existing, invalid, ta.getClientIP(req))
+	ta.audit(req, auditAdminAction, "import_sessions", fmt.Sprintf("imported=%d expired=%d existing=%d invalid=%d", imported, expired, existing, invalid))
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"imported": imported,
+		"expired":  expired,
+		"existing": existing,
+		"invalid":  invalid,
+		"failed":   len(sessions) - imported,
+	})
+}
+
+// validTokenHash reports whether tokenHash is a hex SHA-256
+func validTokenHash(tokenHash string) bool {
+	if len(tokenHash) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(tokenHash)
+	return err == nil
+}
@@ -0,0 +1,199 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sessionFileEntry is a session as persisted in sessionFile
+type sessionFileEntry struct {
+	TokenHash     string     `json:"tokenHash,omitempty"` // Omitted in records sent to the http and redis session stores
+	Token         string     `json:"token,omitempty"`     // Raw token, only in files written before tokens were hashed
+	CreatedAt     time.Time  `json:"createdAt"`
+	ExpiresAt     time.Time  `json:"expiresAt"`
+	IdleExpiresAt *time.Time `json:"idleExpiresAt,omitempty"` // Only with idleTimeout
+	IP            string     `json:"ip,omitempty"`
+	UserAgent     string     `json:"userAgent,omitempty"`
+	ReadOnly      bool       `json:"readOnly,omitempty"`
+	Areas         []string   `json:"areas,omitempty"`
+	Method        string     `json:"method,omitempty"`
+}
+
+// newSessionFileEntry returns the record of session
+func newSessionFileEntry(session *Session) sessionFileEntry {
+	entry := sessionFileEntry{
+		TokenHash: session.TokenHash,
+		CreatedAt: session.CreatedAt,
+		ExpiresAt: session.ExpiresAt,
+		IP:        session.IP,
+		UserAgent: session.UserAgent,
+		ReadOnly:  session.ReadOnly,
+		Areas:     session.Areas,
+		Method:    session.Method,
+	}
+	if !session.IdleExpiresAt.IsZero() {
+		idleExpiresAt := session.IdleExpiresAt
+		entry.IdleExpiresAt = &idleExpiresAt
+	}
+	return entry
+}
+
+// session returns the session a record describes
+func (e sessionFileEntry) session() *Session {
+	session := &Session{
+		TokenHash: e.TokenHash,
+		CreatedAt: e.CreatedAt,
+		ExpiresAt: e.ExpiresAt,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		ReadOnly:  e.ReadOnly,
+		Areas:     e.Areas,
+		Method:    e.Method,
+	}
+	if e.IdleExpiresAt != nil {
+		session.IdleExpiresAt = *e.IdleExpiresAt
+	}
+	return session
+}
+
+// sessionFileContents is the JSON persisted in sessionFile
+type sessionFileContents struct {
+	Sessions      []sessionFileEntry `json:"sessions"`
+	LockdownUntil *time.Time         `json:"lockdownUntil,omitempty"` // End of a lockdown started through the admin API
+}
+
+// restoreSessionFile loads the sessions in path that haven't expired yet and
+// persists every later change there. A missing file starts empty; a corrupt
+// or unreadable one is logged and ignored, so a bad file can't keep the
+// middleware from starting.
+func (s *memorySessionStore) restoreSessionFile(path, name string, now time.Time) {
+	var contents sessionFileContents
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Printf("[%s] Failed to read session file, starting without sessions: %v", name, err)
+	default:
+		if err := json.Unmarshal(data, &contents); err != nil {
+			log.Printf("[%s] Invalid session file %s, starting without sessions: %v", name, path, err)
+		}
+	}
+
+	restored := 0
+	for _, entry := range contents.Sessions {
+		if entry.TokenHash == "" && entry.Token != "" {
+			entry.TokenHash = hashSessionToken(entry.Token)
+		}
+		session := entry.session()
+		if session.TokenHash == "" || !now.Before(session.deadline()) {
+			continue
+		}
+		s.Put(session)
+		restored++
+	}
+	if restored > 0 {
+		log.Printf("[%s] Restored %d session(s) from %s", name, restored, path)
+	}
+
+	s.mu.Lock()
+	s.path = path
+	s.name = name
+	if contents.LockdownUntil != nil && now.Before(*contents.LockdownUntil) {
+		s.lockdownUntil = *contents.LockdownUntil
+	}
+	s.mu.Unlock()
+
+	// Drop expired entries and find out now whether the file is writable
+	s.persist()
+}
+
+// lockdown returns the end of the lockdown restored from or persisted to the
+// session file, or the zero time
+func (s *memorySessionStore) lockdown() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lockdownUntil
+}
+
+// setLockdown records the end of a lockdown, or the zero time when it was
+// lifted, and persists it with the sessions
+func (s *memorySessionStore) setLockdown(until time.Time) {
+	s.mu.Lock()
+	s.lockdownUntil = until
+	s.mu.Unlock()
+	s.persist()
+}
+
+// Flush writes the session file one last time, so that removals that were
+// not persisted, such as lazy cleanup batches, are. It gives up when ctx is
+// done first.
+func (s *memorySessionStore) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.persist()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// persist writes all sessions to the session file, replacing it atomically.
+// Failures are logged: sessions stay valid in memory and the next change
+// tries again. Writers are serialized and each writes a fresh snapshot, so
+// the last write always reflects the latest state.
+func (s *memorySessionStore) persist() {
+	s.mu.RLock()
+	path, name := s.path, s.name
+	s.mu.RUnlock()
+	if path == "" {
+		return
+	}
+
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	var contents sessionFileContents
+	s.mu.RLock()
+	for _, session := range s.sessions {
+		contents.Sessions = append(contents.Sessions, newSessionFileEntry(session))
+	}
+	if !s.lockdownUntil.IsZero() {
+		lockdownUntil := s.lockdownUntil
+		contents.LockdownUntil = &lockdownUntil
+	}
+	s.mu.RUnlock()
+
+	data, err := json.Marshal(contents)
+	if err != nil {
+		log.Printf("[%s] Failed to encode sessions: %v", name, err)
+		return
+	}
+
+	// CreateTemp creates the file readable by its owner only, which matters
+	// because tokens are credentials
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		log.Printf("[%s] Failed to write session file: %v", name, err)
+		return
+	}
+	_, writeErr := tmp.Write(data)
+	closeErr := tmp.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tmp.Name(), path)
+	}
+	if writeErr != nil {
+		os.Remove(tmp.Name())
+		log.Printf("[%s] Failed to write session file: %v", name, writeErr)
+	}
+}
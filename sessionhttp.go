@@ -0,0 +1,394 @@
+package traefik_totp_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session store backends
+const (
+	sessionStoreMemory = "memory"
+	sessionStoreHTTP   = "http"
+	sessionStoreRedis  = "redis"
+)
+
+// Actions taken when the session store cannot be reached or fails
+const (
+	sessionStoreOnErrorDeny  = "deny"
+	sessionStoreOnErrorAllow = "allow"
+)
+
+// maxSessionStoreCacheEntries bounds the lookups cached per instance
+const maxSessionStoreCacheEntries = 10000
+
+// httpSessionStore keeps sessions in an external service, so replicas share
+// them. Records are addressed by the token hash, so the service never learns
+// tokens that could be replayed as cookies. Lookups are cached briefly to
+// avoid a remote call on every request.
+type httpSessionStore struct {
+	endpoint string
+	token    string
+	onError  string
+	ttl      time.Duration
+	name     string
+	client   *http.Client
+	clock    Clock // Time source of the cache and of expiry checks
+
+	mu       sync.Mutex
+	cache    map[string]httpSessionCacheEntry
+	unsynced map[string]*Session // Sessions the service failed to store (sessionStoreOnError allow)
+}
+
+// httpSessionCacheEntry is a cached lookup; session is nil for tokens the
+// service doesn't know
+type httpSessionCacheEntry struct {
+	session   *Session
+	fetchedAt time.Time
+}
+
+// validateSessionStore checks sessionStore and its options
+func validateSessionStore(config *Config) error {
+	config.SessionStore = strings.ToLower(config.SessionStore)
+	switch config.SessionStore {
+	case "":
+		config.SessionStore = sessionStoreMemory
+		return nil
+	case sessionStoreMemory:
+		return nil
+	case sessionStoreHTTP, sessionStoreRedis:
+	default:
+		return fmt.Errorf("invalid sessionStore (must be %q, %q or %q): %s", sessionStoreMemory, sessionStoreHTTP, sessionStoreRedis, config.SessionStore)
+	}
+
+	if config.SessionMode != sessionModeMemory {
+		return fmt.Errorf("sessionStore %s cannot be combined with sessionMode %s", config.SessionStore, config.SessionMode)
+	}
+	if config.StepUpHeader != "" || config.EnableDevicesPage || config.MaxIPChanges > 0 || config.SessionFile != "" || config.SingleSession || config.MaxSessions > 0 {
+		return fmt.Errorf("sessionStore %s cannot be combined with stepUpHeader, enableDevicesPage, maxIPChanges, sessionFile, singleSession or maxSessions", config.SessionStore)
+	}
+
+	if config.SessionStore == sessionStoreRedis {
+		return validateRedisConfig(config)
+	}
+
+	endpoint, err := url.Parse(config.SessionStoreURL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid sessionStoreURL: %s", config.SessionStoreURL)
+	}
+	config.SessionStoreOnError = strings.ToLower(config.SessionStoreOnError)
+	if config.SessionStoreOnError == "" {
+		config.SessionStoreOnError = sessionStoreOnErrorDeny
+	}
+	if config.SessionStoreOnError != sessionStoreOnErrorDeny && config.SessionStoreOnError != sessionStoreOnErrorAllow {
+		return fmt.Errorf("invalid sessionStoreOnError (must be %q or %q): %s", sessionStoreOnErrorDeny, sessionStoreOnErrorAllow, config.SessionStoreOnError)
+	}
+	if config.SessionStoreTimeoutMs <= 0 {
+		config.SessionStoreTimeoutMs = 500
+	}
+	if config.SessionStoreCacheTTL < 0 {
+		return fmt.Errorf("sessionStoreCacheTTL must not be negative")
+	}
+	return nil
+}
+
+// newHTTPSessionStore creates a store for the service at sessionStoreURL
+func newHTTPSessionStore(config *Config, name string, clock Clock) *httpSessionStore {
+	return &httpSessionStore{
+		endpoint: strings.TrimSuffix(config.SessionStoreURL, "/"),
+		token:    config.SessionStoreToken,
+		onError:  config.SessionStoreOnError,
+		ttl:      time.Duration(config.SessionStoreCacheTTL) * time.Second,
+		name:     name,
+		client:   &http.Client{Timeout: time.Duration(config.SessionStoreTimeoutMs) * time.Millisecond},
+		cache:    make(map[string]httpSessionCacheEntry),
+		unsynced: make(map[string]*Session),
+		clock:    clock,
+	}
+}
+
+// recordURL returns the URL of the record for tokenHash
+func (s *httpSessionStore) recordURL(tokenHash string) string {
+	return s.endpoint + "/" + url.PathEscape(tokenHash)
+}
+
+// request sends a request for the record of tokenHash and returns the
+// response status and body. The body is only read for successful responses.
+func (s *httpSessionStore) request(ctx context.Context, method, tokenHash string, body []byte) (int, []byte, error) {
+	return s.send(ctx, method, s.recordURL(tokenHash), body)
+}
+
+// send sends a request to target, which is under endpoint, and returns the
+// response status and body like request
+func (s *httpSessionStore) send(ctx context.Context, method, target string, body []byte) (int, []byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, nil, nil
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, data, nil
+}
+
+// cached returns the cached lookup for tokenHash and whether it is still fresh
+func (s *httpSessionStore) cached(tokenHash string, now time.Time) (httpSessionCacheEntry, bool, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, exists := s.cache[tokenHash]
+	return entry, exists, exists && now.Sub(entry.fetchedAt) < s.ttl
+}
+
+// remember caches the lookup of tokenHash. When the cache is full, stale
+// entries are dropped first; if it is still full the lookup isn't cached.
+func (s *httpSessionStore) remember(tokenHash string, session *Session, now time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.cache[tokenHash]; !exists && len(s.cache) >= maxSessionStoreCacheEntries {
+		for key, entry := range s.cache {
+			if now.Sub(entry.fetchedAt) >= s.ttl {
+				delete(s.cache, key)
+			}
+		}
+		if len(s.cache) >= maxSessionStoreCacheEntries {
+			return
+		}
+	}
+	s.cache[tokenHash] = httpSessionCacheEntry{session: session, fetchedAt: now}
+}
+
+// Get returns the session for tokenHash from the cache or the service. When
+// the service fails, the session is unknown; with sessionStoreOnError allow
+// a session looked up before stays valid until it expires.
+func (s *httpSessionStore) Get(tokenHash string) (*Session, bool) {
+	now := s.clock.Now()
+	entry, exists, fresh := s.cached(tokenHash, now)
+	if fresh {
+		return entry.session, entry.session != nil
+	}
+
+	status, data, err := s.request(context.Background(), http.MethodGet, tokenHash, nil)
+	if err == nil && status == http.StatusNotFound {
+		s.remember(tokenHash, nil, now)
+		return nil, false
+	}
+	if err == nil && status != http.StatusOK {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+
+	var record sessionFileEntry
+	if err == nil {
+		if err = json.Unmarshal(data, &record); err != nil {
+			err = fmt.Errorf("invalid response: %w", err)
+		}
+	}
+	if err != nil {
+		if s.onError == sessionStoreOnErrorAllow && exists && entry.session != nil {
+			log.Printf("[%s] Session store lookup failed, keeping the cached session (sessionStoreOnError=allow): %v", s.name, err)
+			return entry.session, true
+		}
+		log.Printf("[%s] Session store lookup failed, treating the session as unknown: %v", s.name, err)
+		return nil, false
+	}
+
+	record.TokenHash = tokenHash
+	session := record.session()
+	s.remember(tokenHash, session, now)
+	return session, true
+}
+
+// Put stores session in the service. With sessionStoreOnError allow a
+// failure only keeps the session in this instance's cache, and Flush tries
+// again on shutdown.
+func (s *httpSessionStore) Put(session *Session) error {
+	err := s.store(context.Background(), session)
+	if err != nil {
+		if s.onError != sessionStoreOnErrorAllow {
+			return fmt.Errorf("session store failed: %w", err)
+		}
+		log.Printf("[%s] Session store failed, keeping the session on this instance only (sessionStoreOnError=allow): %v", s.name, err)
+	}
+
+	s.mu.Lock()
+	if err != nil {
+		s.unsynced[session.TokenHash] = session
+	} else {
+		delete(s.unsynced, session.TokenHash)
+	}
+	s.mu.Unlock()
+	s.remember(session.TokenHash, session, s.clock.Now())
+	return nil
+}
+
+// store PUTs the record of session to the service
+func (s *httpSessionStore) store(ctx context.Context, session *Session) error {
+	record := newSessionFileEntry(session)
+	record.TokenHash = "" // It is the record's address
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	status, _, err := s.request(ctx, http.MethodPut, session.TokenHash, body)
+	if err == nil && (status < 200 || status > 299) {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	return err
+}
+
+// Flush stores the unexpired sessions the service failed to store earlier,
+// so that they survive this instance. It stops at the first failure.
+func (s *httpSessionStore) Flush(ctx context.Context) error {
+	s.mu.Lock()
+	pending := make([]*Session, 0, len(s.unsynced))
+	for _, session := range s.unsynced {
+		pending = append(pending, session)
+	}
+	s.mu.Unlock()
+
+	now := s.clock.Now()
+	stored := 0
+	for _, session := range pending {
+		if !now.Before(session.deadline()) {
+			continue
+		}
+		if err := s.store(ctx, session); err != nil {
+			return fmt.Errorf("sessions kept on this instance only could not be stored: %w", err)
+		}
+		stored++
+		s.mu.Lock()
+		delete(s.unsynced, session.TokenHash)
+		s.mu.Unlock()
+	}
+	if stored > 0 {
+		log.Printf("[%s] Stored %d session(s) kept on this instance only in the session store", s.name, stored)
+	}
+	return nil
+}
+
+// Delete removes the session for tokenHash from the cache and the service.
+// Other instances notice within sessionStoreCacheTTL.
+func (s *httpSessionStore) Delete(tokenHash string) {
+	s.mu.Lock()
+	delete(s.cache, tokenHash)
+	delete(s.unsynced, tokenHash)
+	s.mu.Unlock()
+
+	status, _, err := s.request(context.Background(), http.MethodDelete, tokenHash, nil)
+	if err == nil && status != http.StatusNotFound && (status < 200 || status > 299) {
+		err = fmt.Errorf("unexpected status %d", status)
+	}
+	if err != nil {
+		log.Printf("[%s] Failed to delete session from the session store: %v", s.name, err)
+	}
+}
+
+// DeleteByIP asks the service to remove the sessions created from an IP in
+// network with DELETE <sessionStoreURL>?ip=<cidr>, and drops them from the
+// cache. Other instances notice within sessionStoreCacheTTL. Sessions the
+// service never stored are removed locally and counted too.
+func (s *httpSessionStore) DeleteByIP(network *net.IPNet) (int, error) {
+	revoked := 0
+	s.mu.Lock()
+	for tokenHash, entry := range s.cache {
+		if entry.session != nil && entry.session.inNetwork(network) {
+			delete(s.cache, tokenHash)
+		}
+	}
+	for tokenHash, session := range s.unsynced {
+		if session.inNetwork(network) {
+			delete(s.unsynced, tokenHash)
+			revoked++
+		}
+	}
+	s.mu.Unlock()
+
+	status, data, err := s.send(context.Background(), http.MethodDelete, s.endpoint+"?ip="+url.QueryEscape(network.String()), nil)
+	if err != nil {
+		return revoked, err
+	}
+	if status < 200 || status > 299 {
+		return revoked, fmt.Errorf("unexpected status %d", status)
+	}
+	var result struct {
+		Revoked int `json:"revoked"`
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &result); err != nil {
+			return revoked, fmt.Errorf("invalid response: %w", err)
+		}
+	}
+	return revoked + result.Revoked, nil
+}
+
+// DeleteExpired drops expired sessions and stale lookups from the cache. The
+// service expires its records itself, using the expiresAt it was given.
+func (s *httpSessionStore) DeleteExpired(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for tokenHash, session := range s.unsynced {
+		if !now.Before(session.deadline()) {
+			delete(s.unsynced, tokenHash)
+		}
+	}
+
+	removed := 0
+	for tokenHash, entry := range s.cache {
+		if entry.session != nil && !now.Before(entry.session.deadline()) {
+			delete(s.cache, tokenHash)
+			removed++
+		} else if now.Sub(entry.fetchedAt) >= s.ttl && (entry.session == nil || s.onError != sessionStoreOnErrorAllow) {
+			// With allow, stale sessions are kept to fall back on
+			delete(s.cache, tokenHash)
+		}
+	}
+	return removed
+}
+
+// Count returns the number of sessions cached by this instance; the service
+// may hold more
+func (s *httpSessionStore) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, entry := range s.cache {
+		if entry.session != nil {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,240 @@
+package traefik_totp_plugin
+
+import (
+	"container/list"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metricSessionsEvicted counts sessions evicted by maxTotalSessions
+const metricSessionsEvicted = "sessions.evicted"
+
+// sessionEvictionLogInterval is the minimum time between two log messages
+// about evicted sessions; evictions in between are summed up
+const sessionEvictionLogInterval = time.Minute
+
+// evictionLog throttles the log messages about evicted sessions
+type evictionLog struct {
+	mu       sync.Mutex
+	loggedAt time.Time
+	pending  int // Evictions since the last message
+	total    int // Evictions since startup
+}
+
+// sessionEvicted counts a session evicted from the in-memory store and logs
+// the evictions at most once per sessionEvictionLogInterval
+func (ta *TOTPAuth) sessionEvicted(session *Session) {
+	ta.incrMetric(metricSessionsEvicted)
+
+	now := ta.clock.Now()
+	ta.evictions.mu.Lock()
+	ta.evictions.pending++
+	ta.evictions.total++
+	if !ta.evictions.loggedAt.IsZero() && now.Sub(ta.evictions.loggedAt) < sessionEvictionLogInterval {
+		ta.evictions.mu.Unlock()
+		return
+	}
+	pending, total := ta.evictions.pending, ta.evictions.total
+	ta.evictions.pending = 0
+	ta.evictions.loggedAt = now
+	ta.evictions.mu.Unlock()
+
+	log.Printf("[%s] Session limit (%d) reached: evicted %d least recently used session(s), %d since startup; latest created at %s from %s",
+		ta.name, ta.config.MaxTotalSessions, pending, total, session.CreatedAt.UTC().Format(time.RFC3339), session.IP)
+}
+
+// recentTouchInterval is how long after being moved to the front of the usage
+// order a session isn't moved again. Lookups of sessions used within that
+// time only take the read lock; the order is approximate within it.
+const recentTouchInterval = time.Second
+
+// recentEntry is an element of the usage order
+type recentEntry struct {
+	tokenHash string
+	touchedAt int64 // Unix nanoseconds of the last move to the front, accessed atomically
+}
+
+// setLimit makes the store evict the least recently used sessions beyond
+// maxSessions, calling onEvict for each. Call it before the store is used.
+func (s *memorySessionStore) setLimit(maxSessions int, onEvict func(*Session)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxSessions = maxSessions
+	s.onEvict = onEvict
+	s.recent = list.New()
+	s.recentElems = make(map[string]*list.Element)
+	for tokenHash := range s.sessions {
+		s.touchLocked(tokenHash)
+	}
+}
+
+// touchLocked moves a session to the front of the usage order; s.mu must be
+// held for writing
+func (s *memorySessionStore) touchLocked(tokenHash string) {
+	if s.maxSessions <= 0 {
+		return
+	}
+	now := s.clock.Now().UnixNano()
+	if element, exists := s.recentElems[tokenHash]; exists {
+		s.recent.MoveToFront(element)
+		atomic.StoreInt64(&element.Value.(*recentEntry).touchedAt, now)
+		return
+	}
+	s.recentElems[tokenHash] = s.recent.PushFront(&recentEntry{tokenHash: tokenHash, touchedAt: now})
+}
+
+// touchRLocked moves a session that was looked up to the front of the usage
+// order, unless it was moved there within recentTouchInterval; s.mu must be
+// held for reading
+func (s *memorySessionStore) touchRLocked(tokenHash string) {
+	element, exists := s.recentElems[tokenHash]
+	if !exists {
+		return
+	}
+	entry := element.Value.(*recentEntry)
+	now := s.clock.Now().UnixNano()
+	if now-atomic.LoadInt64(&entry.touchedAt) < int64(recentTouchInterval) {
+		return
+	}
+
+	s.recentMu.Lock()
+	s.recent.MoveToFront(element)
+	s.recentMu.Unlock()
+	atomic.StoreInt64(&entry.touchedAt, now)
+}
+
+// forgetLocked drops a session from the usage order; s.mu must be held for
+// writing
+func (s *memorySessionStore) forgetLocked(tokenHash string) {
+	if element, exists := s.recentElems[tokenHash]; exists {
+		s.recent.Remove(element)
+		delete(s.recentElems, tokenHash)
+	}
+}
+
+// evictLocked removes the least recently used sessions beyond maxSessions
+// and returns them; s.mu must be held for writing
+func (s *memorySessionStore) evictLocked() []*Session {
+	if s.maxSessions <= 0 {
+		return nil
+	}
+	var evicted []*Session
+	for len(s.sessions) > s.maxSessions {
+		oldest := s.recent.Back()
+		if oldest == nil {
+			break
+		}
+		tokenHash := oldest.Value.(*recentEntry).tokenHash
+		if session, exists := s.sessions[tokenHash]; exists {
+			evicted = append(evicted, session)
+		}
+		s.removeLocked(tokenHash)
+	}
+	return evicted
+}
+
+// errTooManySessions is returned when a client already holds
+// maxSessionsPerIP sessions
+var errTooManySessions = errors.New("too many sessions from this IP")
+
+// indexIPLocked adds a session to the index by client IP; s.mu must be held
+// for writing
+func (s *memorySessionStore) indexIPLocked(session *Session) {
+	tokens := s.byIP[session.IP]
+	if tokens == nil {
+		tokens = make(map[string]struct{})
+		s.byIP[session.IP] = tokens
+	}
+	tokens[session.TokenHash] = struct{}{}
+}
+
+// unindexIPLocked removes a session from the index by client IP; s.mu must
+// be held for writing
+func (s *memorySessionStore) unindexIPLocked(session *Session) {
+	if tokens := s.byIP[session.IP]; tokens != nil {
+		delete(tokens, session.TokenHash)
+		if len(tokens) == 0 {
+			delete(s.byIP, session.IP)
+		}
+	}
+}
+
+// countByIP returns the number of sessions from ip that are still valid at
+// now. Only that IP's sessions are visited, and sessions that expired but
+// haven't been swept yet don't count.
+func (s *memorySessionStore) countByIP(ip string, now time.Time) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.countByIPLocked(ip, now)
+}
+
+// countByIPLocked is countByIP for callers holding s.mu
+func (s *memorySessionStore) countByIPLocked(ip string, now time.Time) int {
+	count := 0
+	for tokenHash := range s.byIP[ip] {
+		if session := s.sessions[tokenHash]; session != nil && now.Before(session.deadline()) {
+			count++
+		}
+	}
+	return count
+}
+
+// withinIPLimitLocked reports whether storing sessions leaves every IP with
+// at most maxPerIP valid sessions; s.mu must be held
+func (s *memorySessionStore) withinIPLimitLocked(sessions []*Session, maxPerIP int) bool {
+	added := make(map[string]int)
+	for _, session := range sessions {
+		added[session.IP]++
+		if s.countByIPLocked(session.IP, session.CreatedAt)+added[session.IP] > maxPerIP {
+			return false
+		}
+	}
+	return true
+}
+
+// sessionsPerIPLimit returns the maxSessionsPerIP that applies to sessions
+// from ip, 0 when they aren't limited
+func (ta *TOTPAuth) sessionsPerIPLimit(ip string) int {
+	if ta.isLockoutExempt(ip) {
+		return 0
+	}
+	return ta.config.MaxSessionsPerIP
+}
+
+// checkSessionsPerIP returns errTooManySessions when the client of a new
+// session already holds maxSessionsPerIP valid sessions. Clients in
+// lockoutExemptNetworks are never limited, and only the in-memory store
+// keeps the index this needs. It refuses a login before older sessions are
+// revoked; putSession repeats the check atomically when storing.
+func (ta *TOTPAuth) checkSessionsPerIP(session *Session) error {
+	memory, ok := ta.sessions.(*memorySessionStore)
+	limit := ta.sessionsPerIPLimit(session.IP)
+	if !ok || limit == 0 || memory.countByIP(session.IP, session.CreatedAt) < limit {
+		return nil
+	}
+	ta.logTooManySessions(session)
+	return errTooManySessions
+}
+
+// putSession stores a new session. In memory, maxSessionsPerIP is checked
+// again under the store's lock, so that concurrent logins from one client
+// can't all pass checkSessionsPerIP before any of them is stored.
+func (ta *TOTPAuth) putSession(session *Session) error {
+	memory, ok := ta.sessions.(*memorySessionStore)
+	if !ok {
+		return ta.sessions.Put(session)
+	}
+	err := memory.putAllLimited([]*Session{session}, ta.sessionsPerIPLimit(session.IP))
+	if errors.Is(err, errTooManySessions) {
+		ta.logTooManySessions(session)
+	}
+	return err
+}
+
+// logTooManySessions logs a session refused by maxSessionsPerIP
+func (ta *TOTPAuth) logTooManySessions(session *Session) {
+	log.Printf("[%s] Refusing new session for %s: it already holds %d session(s) (maxSessionsPerIP)", ta.name, session.IP, ta.config.MaxSessionsPerIP)
+}
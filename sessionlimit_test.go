@@ -0,0 +1,101 @@
+package traefik_totp_plugin
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newIPSession returns an unstored session from ip created now
+func newIPSession(ta *TOTPAuth, i int, ip string) *Session {
+	now := ta.clock.Now()
+	return &Session{
+		TokenHash: hashSessionToken(fmt.Sprintf("token-%d", i)),
+		CreatedAt: now,
+		ExpiresAt: now.Add(time.Hour),
+		IP:        ip,
+	}
+}
+
+// TestSessionsPerIPAtomic has more logins than maxSessionsPerIP pass the
+// early check before any is stored, as concurrent logins would, and checks
+// that storing them still keeps to the limit
+func TestSessionsPerIPAtomic(t *testing.T) {
+	const limit = 3
+	ta := newTestAuth(t, func(config *Config) {
+		config.MaxSessionsPerIP = limit
+	})
+
+	sessions := make([]*Session, 2*limit)
+	for i := range sessions {
+		sessions[i] = newIPSession(ta, i, "192.0.2.1")
+		if err := ta.checkSessionsPerIP(sessions[i]); err != nil {
+			t.Fatalf("early check: %v", err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	stored, refused := 0, 0
+	for _, session := range sessions {
+		wg.Add(1)
+		go func(session *Session) {
+			defer wg.Done()
+			err := ta.putSession(session)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				stored++
+			case errors.Is(err, errTooManySessions):
+				refused++
+			default:
+				t.Errorf("putSession: %v", err)
+			}
+		}(session)
+	}
+	wg.Wait()
+
+	if stored != limit || refused != len(sessions)-limit {
+		t.Errorf("stored %d and refused %d sessions, want %d and %d", stored, refused, limit, len(sessions)-limit)
+	}
+	if count := ta.memorySessions().countByIP("192.0.2.1", ta.clock.Now()); count != limit {
+		t.Errorf("%d sessions from the IP, want %d", count, limit)
+	}
+	if err := ta.putSession(newIPSession(ta, 100, "198.51.100.7")); err != nil {
+		t.Errorf("session from another IP: %v", err)
+	}
+}
+
+// TestSessionsPerIPDisabled checks that maxSessionsPerIP 0 means no limit,
+// and that the default still applies when the setting is left out
+func TestSessionsPerIPDisabled(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		allowed   int // Logins that succeed out of 20
+	}{
+		{"default", nil, 10},
+		{"disabled", func(config *Config) { config.MaxSessionsPerIP = 0 }, 20},
+		{"exempt network", func(config *Config) { config.LockoutExemptNetworks = []string{"192.0.2.0/24"} }, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestAuth(t, tt.configure)
+			allowed := 0
+			for i := 0; i < 20; i++ {
+				if _, err := ta.createSession(newTestRequest(http.MethodGet, "/"), methodTOTP); err == nil {
+					allowed++
+				} else if !errors.Is(err, errTooManySessions) {
+					t.Fatalf("createSession: %v", err)
+				}
+			}
+			if allowed != tt.allowed {
+				t.Errorf("%d of 20 logins allowed, want %d", allowed, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package traefik_totp_plugin
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// Session endpoints for frontends
+const (
+	sessionStatusPath = "/.totp/session"        // Reports the state of the current session as JSON
+	sessionExtendPath = "/.totp/session/extend" // Renews the idle deadline of the current session
+)
+
+// sessionExtendCSRFHeader carries the CSRF token of an extend request, as an
+// alternative to the csrf form field
+const sessionExtendCSRFHeader = "X-TOTP-CSRF"
+
+// handleSessionStatus handles /.totp/session. Checking the status doesn't
+// count as using the session, so polling it doesn't defer idleTimeout.
+func (ta *TOTPAuth) handleSessionStatus(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var session *Session
+	token := ta.sessionToken(req)
+	if token != "" {
+		session = ta.validSession(req, token)
+	}
+	if session == nil {
+		writeJSON(rw, http.StatusUnauthorized, map[string]interface{}{"authenticated": false})
+		return
+	}
+
+	now := ta.clock.Now()
+	status := map[string]interface{}{
+		"authenticated":    true,
+		"createdAt":        session.CreatedAt.UTC(),
+		"expiresAt":        session.deadline().UTC(),
+		"remainingSeconds": int(session.deadline().Sub(now) / time.Second),
+		"readOnly":         session.ReadOnly,
+	}
+	if !session.IdleExpiresAt.IsZero() {
+		// expiresAt moves as the session is used; absoluteExpiresAt doesn't
+		status["absoluteExpiresAt"] = session.ExpiresAt.UTC()
+	}
+	status["extendCSRF"] = ta.csrfToken(token, "extend")
+	writeJSON(rw, http.StatusOK, status)
+}
+
+// handleSessionExtend handles /.totp/session/extend: it resets the idle
+// timer of the current session and re-issues its cookie, for pages that stay
+// open without making requests. The session never outlives sessionExpiry.
+// The CSRF token comes from the status endpoint, so other sites can't keep
+// sessions alive.
+func (ta *TOTPAuth) handleSessionExtend(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	token := ta.sessionToken(req)
+	var session *Session
+	if token != "" {
+		session = ta.validSession(req, token)
+	}
+	if session == nil {
+		writeJSON(rw, http.StatusUnauthorized, map[string]interface{}{"authenticated": false})
+		return
+	}
+
+	csrf := req.Header.Get(sessionExtendCSRFHeader)
+	if csrf == "" {
+		csrf = req.PostFormValue("csrf")
+	}
+	if !ta.validCSRFToken(token, "extend", csrf) {
+		log.Printf("[%s] Rejected session extension with a missing or invalid CSRF token from %s", ta.name, ta.getClientIP(req))
+		writeJSONError(rw, http.StatusForbidden, "invalid CSRF token")
+		return
+	}
+
+	now := ta.clock.Now()
+	expiresAt := session.deadline()
+	extended := false
+	if ta.idleTimeout > 0 {
+		if renewed, idleExpiresAt, ok := ta.renewSession(rw, token, session, now); ok {
+			token = renewed
+			expiresAt = idleExpiresAt
+			extended = true
+		}
+	}
+
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"authenticated":     true,
+		"extended":          extended,
+		"expiresAt":         expiresAt.UTC(),
+		"absoluteExpiresAt": session.ExpiresAt.UTC(),
+		"remainingSeconds":  int(expiresAt.Sub(now) / time.Second),
+		"extendCSRF":        ta.csrfToken(token, "extend"),
+	})
+}
@@ -0,0 +1,482 @@
+package traefik_totp_plugin
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// SessionStore keeps authenticated sessions. The default keeps them in
+// memory; embedders can provide their own with SetSessionStore, e.g. backed
+// by a file, Redis or an HTTP service. Sessions are keyed by their
+// TokenHash: stores never see the tokens that work as cookies.
+type SessionStore interface {
+	// Get returns the session stored under tokenHash. Expired sessions may
+	// still be returned until DeleteExpired removes them.
+	Get(tokenHash string) (*Session, bool)
+	// Put stores a session under its TokenHash, replacing any previous one
+	Put(session *Session) error
+	// Delete removes the session stored under tokenHash, if any
+	Delete(tokenHash string)
+	// DeleteExpired removes sessions that expired before now and returns how
+	// many were removed
+	DeleteExpired(now time.Time) int
+	// Count returns the number of stored sessions
+	Count() int
+}
+
+// SessionLister is implemented by stores that can enumerate their sessions.
+// The devices page, concurrent login detection and session revocation need
+// it; without it they see no sessions.
+type SessionLister interface {
+	// List returns a snapshot of all stored sessions
+	List() []*Session
+}
+
+// SessionIPRevoker is implemented by stores that can't enumerate their
+// sessions but can remove the sessions created from a range of client IPs
+// themselves, so that the admin API can revoke them
+type SessionIPRevoker interface {
+	// DeleteByIP removes the sessions whose IP is in network and returns
+	// how many were removed
+	DeleteByIP(network *net.IPNet) (int, error)
+}
+
+// SessionFlusher is implemented by stores that hold changes not yet
+// persisted. Flush is called once when the middleware shuts down, with a
+// context that bounds how long it may take.
+type SessionFlusher interface {
+	// Flush persists pending changes
+	Flush(ctx context.Context) error
+}
+
+// sessionFlushTimeout bounds the final flush of the session store on shutdown
+const sessionFlushTimeout = 5 * time.Second
+
+// flushSessions gives the session store a last chance to persist its state
+// when ctx is done, e.g. on a configuration reload, so that sessions survive
+// into the next instance
+func (ta *TOTPAuth) flushSessions() {
+	ta.drainSessionDeletions(sessionDeletionQueueSize)
+
+	flusher, ok := ta.sessions.(SessionFlusher)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sessionFlushTimeout)
+	defer cancel()
+	if err := flusher.Flush(ctx); err != nil {
+		log.Printf("[%s] Failed to flush sessions on shutdown: %v", ta.name, err)
+	}
+}
+
+// SetSessionStore replaces the store sessions are kept in. Call it before the
+// middleware serves requests. Step-up and network change tracking keep state
+// on the in-memory sessions and are only available with the default store.
+// nil restores an empty in-memory store.
+func (ta *TOTPAuth) SetSessionStore(store SessionStore) error {
+	if store == nil {
+		memory := newMemorySessionStore(ta.clock)
+		memory.setLimit(ta.config.MaxTotalSessions, ta.sessionEvicted)
+		ta.sessions = memory
+		return nil
+	}
+	if _, isMemory := store.(*memorySessionStore); !isMemory {
+		if ta.config.StepUpHeader != "" || ta.config.MaxIPChanges > 0 {
+			return fmt.Errorf("stepUpHeader and maxIPChanges require the in-memory session store")
+		}
+		if _, canList := store.(SessionLister); !canList && (ta.config.EnableDevicesPage || ta.config.SingleSession || ta.config.MaxSessions > 0) {
+			return fmt.Errorf("enableDevicesPage, singleSession and maxSessions require a session store that implements SessionLister")
+		}
+	}
+	ta.sessions = store
+	return nil
+}
+
+// memorySessions returns the in-memory store. Only features SetSessionStore
+// refuses for other stores use it.
+func (ta *TOTPAuth) memorySessions() *memorySessionStore {
+	return ta.sessions.(*memorySessionStore)
+}
+
+// listSessions returns a snapshot of all stored sessions, or nil when the
+// store can't enumerate them
+func (ta *TOTPAuth) listSessions() []*Session {
+	if lister, ok := ta.sessions.(SessionLister); ok {
+		return lister.List()
+	}
+	return nil
+}
+
+// hashSessionToken returns the TokenHash of a session token
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// deleteSessions removes all sessions for which match returns true and
+// returns the number of sessions removed
+func (ta *TOTPAuth) deleteSessions(match func(*Session) bool) int {
+	removed := 0
+	for _, session := range ta.listSessions() {
+		if match(session) {
+			ta.sessions.Delete(session.TokenHash)
+			removed++
+		}
+	}
+	return removed
+}
+
+// inNetwork reports whether the session was created from an IP in network
+func (s *Session) inNetwork(network *net.IPNet) bool {
+	ip := net.ParseIP(s.IP)
+	return ip != nil && network.Contains(ip)
+}
+
+// sessionDeletionQueueSize bounds the invalidated sessions waiting to be
+// removed in the background
+const sessionDeletionQueueSize = 256
+
+// deleteSessionLater removes a session off the request path, so that
+// rejecting it doesn't take the store's write lock. The queue is drained by
+// the cleanup; when it is full the session is removed right away.
+func (ta *TOTPAuth) deleteSessionLater(tokenHash string) {
+	select {
+	case ta.deletions <- tokenHash:
+	default:
+		ta.sessions.Delete(tokenHash)
+	}
+}
+
+// drainSessionDeletions removes up to max sessions queued by
+// deleteSessionLater without waiting for more
+func (ta *TOTPAuth) drainSessionDeletions(max int) {
+	for i := 0; i < max; i++ {
+		select {
+		case tokenHash := <-ta.deletions:
+			ta.sessions.Delete(tokenHash)
+		default:
+			return
+		}
+	}
+}
+
+// memorySessionStore is the default SessionStore. Besides the map of token
+// hashes it groups them by expiry minute, so that cleanup only visits
+// buckets that have elapsed instead of scanning every session, and with a
+// limit it keeps them in order of use, so that the least recently used
+// session is evicted without a scan.
+type memorySessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+	expiries map[int64]map[string]struct{} // Token hashes by expiry minute (unix seconds / 60)
+	swept    int64                         // First expiry minute not yet swept
+
+	maxSessions int                      // Sessions kept before the least recently used is evicted (unlimited when 0)
+	onEvict     func(*Session)           // Called for every evicted session, outside the lock
+	recentMu    sync.Mutex               // Guards the links of recent for readers holding mu for reading
+	recent      *list.List               // recentEntry values, most recently used first
+	recentElems map[string]*list.Element // Elements of recent by token hash
+
+	byIP map[string]map[string]struct{} // Token hashes by client IP
+
+	peak int // Most sessions held since the maps were last rebuilt
+
+	lockdownUntil time.Time // End of the lockdown persisted with the sessions, zero without one
+
+	clock Clock // Time source of the usage order
+
+	path      string     // sessionFile every change is persisted to, if any
+	name      string     // Middleware name for log messages about path
+	persistMu sync.Mutex // Serializes writes to path
+}
+
+// newMemorySessionStore creates an empty in-memory session store
+func newMemorySessionStore(clock Clock) *memorySessionStore {
+	return &memorySessionStore{
+		sessions: make(map[string]*Session),
+		expiries: make(map[int64]map[string]struct{}),
+		swept:    expiryBucket(clock.Now()),
+		byIP:     make(map[string]map[string]struct{}),
+		clock:    clock,
+	}
+}
+
+// rebase re-buckets every session for a clock that now reads now, so that
+// sweeps neither walk every minute the clock jumped over nor skip buckets
+// behind it. Sessions that expired by now are swept with the next pass.
+func (s *memorySessionStore) rebase(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.swept = expiryBucket(now)
+	s.expiries = make(map[int64]map[string]struct{})
+	for _, session := range s.sessions {
+		s.bucketLocked(session)
+	}
+}
+
+// expiryBucket returns the expiry bucket a point in time falls into
+func expiryBucket(t time.Time) int64 {
+	return t.Unix() / 60
+}
+
+// Get returns a copy of the session stored under tokenHash. Stored sessions
+// only change under s.mu, e.g. through update, so the copy can be
+// read without the lock while another request renews the session.
+func (s *memorySessionStore) Get(tokenHash string) (*Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, exists := s.sessions[tokenHash]
+	if !exists {
+		return nil, false
+	}
+	if s.maxSessions > 0 {
+		s.touchRLocked(tokenHash)
+	}
+	snapshot := *session
+	return &snapshot, true
+}
+
+// Put stores a session
+func (s *memorySessionStore) Put(session *Session) error {
+	return s.putAll([]*Session{session})
+}
+
+// putAll stores several sessions and persists them with a single write
+func (s *memorySessionStore) putAll(sessions []*Session) error {
+	return s.putAllLimited(sessions, 0)
+}
+
+// putAllLimited is putAll refusing all sessions with errTooManySessions when
+// an IP would hold more than maxPerIP valid sessions (no limit when 0). The
+// sessions are counted under the lock they are stored with.
+func (s *memorySessionStore) putAllLimited(sessions []*Session, maxPerIP int) error {
+	s.mu.Lock()
+	if maxPerIP > 0 && !s.withinIPLimitLocked(sessions, maxPerIP) {
+		s.mu.Unlock()
+		return errTooManySessions
+	}
+	for _, session := range sessions {
+		if previous, exists := s.sessions[session.TokenHash]; exists {
+			s.unbucketLocked(previous)
+			s.unindexIPLocked(previous)
+		}
+		s.sessions[session.TokenHash] = session
+		s.bucketLocked(session)
+		s.indexIPLocked(session)
+		s.touchLocked(session.TokenHash)
+	}
+	if len(s.sessions) > s.peak {
+		s.peak = len(s.sessions)
+	}
+	evicted := s.evictLocked()
+	s.mu.Unlock()
+
+	s.persist()
+	if s.onEvict != nil {
+		for _, old := range evicted {
+			s.onEvict(old)
+		}
+	}
+	return nil
+}
+
+// update applies change to a stored session, moving it to the bucket of its
+// new deadline. change returns false to leave the session as it is. update
+// returns false when the session no longer exists or wasn't changed.
+func (s *memorySessionStore) update(tokenHash string, change func(*Session) bool) bool {
+	s.mu.Lock()
+	session, exists := s.sessions[tokenHash]
+	if !exists {
+		s.mu.Unlock()
+		return false
+	}
+	s.unbucketLocked(session)
+	changed := change(session)
+	s.bucketLocked(session)
+	if changed {
+		s.touchLocked(tokenHash)
+	}
+	s.mu.Unlock()
+
+	if changed {
+		s.persist()
+	}
+	return changed
+}
+
+// DeleteExpired removes the sessions in every bucket that has fully elapsed and
+// returns how many were removed. Sessions expiring within the current minute
+// are left to the next sweep (validSession rejects them in the meantime).
+// Maps left mostly empty are rebuilt afterwards.
+func (s *memorySessionStore) DeleteExpired(now time.Time) int {
+	s.mu.Lock()
+	removed := s.sweepLocked(expiryBucket(now), -1)
+	s.compactLocked()
+	s.mu.Unlock()
+
+	if removed > 0 {
+		s.persist()
+	}
+	return removed
+}
+
+// deleteExpiredBatch removes at most limit sessions from elapsed buckets and
+// returns how many were removed. The write lock is only taken when a bucket
+// has elapsed. The session file isn't rewritten: expired sessions in it are
+// skipped on restore, and the next change drops them.
+func (s *memorySessionStore) deleteExpiredBatch(now time.Time, limit int) int {
+	current := expiryBucket(now)
+	s.mu.RLock()
+	pending := s.swept < current
+	s.mu.RUnlock()
+	if !pending {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sweepLocked(current, limit)
+}
+
+// Maps keyed by token hash are rebuilt once they hold fewer than
+// 1/compactRatio of their peak, and only after holding compactMinPeak
+const (
+	compactRatio   = 4
+	compactMinPeak = 1024
+)
+
+// compactLocked rebuilds the maps keyed by token hash when most of the
+// sessions they held have gone. Go maps never shrink, so after a burst of
+// sessions expires this is the only way to release their memory. s.mu must
+// be held for writing.
+func (s *memorySessionStore) compactLocked() {
+	if s.peak < compactMinPeak || len(s.sessions)*compactRatio >= s.peak {
+		return
+	}
+
+	sessions := make(map[string]*Session, len(s.sessions))
+	for tokenHash, session := range s.sessions {
+		sessions[tokenHash] = session
+	}
+	s.sessions = sessions
+
+	if s.recentElems != nil {
+		recentElems := make(map[string]*list.Element, len(s.recentElems))
+		for tokenHash, element := range s.recentElems {
+			recentElems[tokenHash] = element
+		}
+		s.recentElems = recentElems
+	}
+
+	byIP := make(map[string]map[string]struct{}, len(s.byIP))
+	for ip, tokens := range s.byIP {
+		byIP[ip] = tokens
+	}
+	s.byIP = byIP
+
+	s.peak = len(s.sessions)
+}
+
+// sweepLocked removes the sessions in buckets before current, at most limit
+// unless it is negative, and returns how many were removed; s.mu must be held
+func (s *memorySessionStore) sweepLocked(current int64, limit int) int {
+	removed := 0
+	for s.swept < current {
+		tokens := s.expiries[s.swept]
+		for tokenHash := range tokens {
+			if limit >= 0 && removed >= limit {
+				return removed
+			}
+			if session, exists := s.sessions[tokenHash]; exists {
+				s.unindexIPLocked(session)
+			}
+			delete(s.sessions, tokenHash)
+			s.forgetLocked(tokenHash)
+			delete(tokens, tokenHash)
+			removed++
+		}
+		delete(s.expiries, s.swept)
+		s.swept++
+	}
+	return removed
+}
+
+// bucketLocked adds a session to its expiry bucket; s.mu must be held
+func (s *memorySessionStore) bucketLocked(session *Session) {
+	bucket := expiryBucket(session.deadline())
+	if bucket < s.swept {
+		// Already elapsed: sweep it with the next pass
+		bucket = s.swept
+	}
+	tokens := s.expiries[bucket]
+	if tokens == nil {
+		tokens = make(map[string]struct{})
+		s.expiries[bucket] = tokens
+	}
+	tokens[session.TokenHash] = struct{}{}
+}
+
+// unbucketLocked removes a session from its expiry bucket; s.mu must be held
+func (s *memorySessionStore) unbucketLocked(session *Session) {
+	bucket := expiryBucket(session.deadline())
+	if bucket < s.swept {
+		bucket = s.swept
+	}
+	if tokens := s.expiries[bucket]; tokens != nil {
+		delete(tokens, session.TokenHash)
+		if len(tokens) == 0 {
+			delete(s.expiries, bucket)
+		}
+	}
+}
+
+// removeLocked deletes a session, its bucket and IP entries and its place in
+// the usage order; s.mu must be held
+func (s *memorySessionStore) removeLocked(tokenHash string) {
+	if session, exists := s.sessions[tokenHash]; exists {
+		s.unbucketLocked(session)
+		s.unindexIPLocked(session)
+		delete(s.sessions, tokenHash)
+	}
+	s.forgetLocked(tokenHash)
+}
+
+// Count returns the number of stored sessions
+func (s *memorySessionStore) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.sessions)
+}
+
+// List returns copies of all stored sessions
+func (s *memorySessionStore) List() []*Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		snapshot := *session
+		sessions = append(sessions, &snapshot)
+	}
+	return sessions
+}
+
+// Delete removes a single session
+func (s *memorySessionStore) Delete(tokenHash string) {
+	s.mu.Lock()
+	_, exists := s.sessions[tokenHash]
+	s.removeLocked(tokenHash)
+	s.mu.Unlock()
+
+	if exists {
+		s.persist()
+	}
+}
@@ -0,0 +1,273 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestInvalidatedSessionRemovedByCleanup checks that a session rejected for
+// an IP mismatch is queued and removed by the cleanup, not by the request
+func TestInvalidatedSessionRemovedByCleanup(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.ValidateIP = true
+	})
+	token := newTestSession(t, ta)
+
+	req := withSession(ta, newTestRequest(http.MethodGet, "/"), token)
+	req.RemoteAddr = "198.51.100.7:1234"
+	if ta.validSession(req, token) != nil {
+		t.Fatal("session accepted from another IP")
+	}
+	if _, ok := ta.sessions.Get(hashSessionToken(token)); !ok {
+		t.Fatal("session removed on the request path")
+	}
+
+	ta.cleanupExpiredSessions(ta.clock.Now())
+	if _, ok := ta.sessions.Get(hashSessionToken(token)); ok {
+		t.Error("invalidated session survived the cleanup")
+	}
+}
+
+// BenchmarkValidSessionMixed checks cookies in parallel, half of them for
+// sessions that already expired, to show that rejecting expired sessions
+// doesn't serialize the read path
+func BenchmarkValidSessionMixed(b *testing.B) {
+	const sessions = 1000
+	ta := newTestAuth(b, func(config *Config) {
+		config.MaxSessionsPerIP = sessions
+	})
+
+	tokens := make([]string, sessions)
+	for i := range tokens {
+		tokens[i] = newTestSession(b, ta)
+		if i%2 == 1 {
+			session, _ := ta.sessions.Get(hashSessionToken(tokens[i]))
+			session.ExpiresAt = ta.clock.Now().Add(-time.Minute)
+			if err := ta.sessions.Put(session); err != nil {
+				b.Fatalf("Put: %v", err)
+			}
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		req := newTestRequest(http.MethodGet, "/")
+		i := 0
+		for pb.Next() {
+			token := tokens[i%sessions]
+			if valid := ta.validSession(req, token) != nil; valid != (i%sessions%2 == 0) {
+				panic(fmt.Sprintf("session %d: valid = %v", i%sessions, valid))
+			}
+			i++
+		}
+	})
+}
+
+// deleteExpiredFullScan is the cleanup before sessions were bucketed by
+// expiry minute, kept as the baseline of BenchmarkDeleteExpired: it visits
+// every session under the write lock
+func deleteExpiredFullScan(s *memorySessionStore, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for tokenHash, session := range s.sessions {
+		if !now.Before(session.deadline()) {
+			s.removeLocked(tokenHash)
+			removed++
+		}
+	}
+	return removed
+}
+
+// BenchmarkDeleteExpired measures one cleanup pass over stores of live
+// sessions in which 1% expired since the previous pass, with the bucketed
+// sweep and with the full scan it replaced
+func BenchmarkDeleteExpired(b *testing.B) {
+	sweeps := []struct {
+		name  string
+		sweep func(*memorySessionStore, time.Time) int
+	}{
+		{"buckets", (*memorySessionStore).DeleteExpired},
+		{"fullscan", deleteExpiredFullScan},
+	}
+	for _, size := range []int{10000, 100000, 500000} {
+		for _, sweep := range sweeps {
+			b.Run(sweep.name+"/"+strconv.Itoa(size), func(b *testing.B) {
+				benchmarkDeleteExpired(b, size, sweep.sweep)
+			})
+		}
+	}
+}
+
+func benchmarkDeleteExpired(b *testing.B, size int, sweep func(*memorySessionStore, time.Time) int) {
+	clock := newFakeClock(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	store := newMemorySessionStore(clock)
+
+	next := 0
+	newSessions := func(count int, expiresAt time.Time) []*Session {
+		sessions := make([]*Session, count)
+		for i := range sessions {
+			next++
+			sessions[i] = &Session{
+				TokenHash: fmt.Sprintf("%064x", next),
+				CreatedAt: clock.Now(),
+				ExpiresAt: expiresAt,
+				IP:        fmt.Sprintf("10.%d.%d.%d", next>>16&0xff, next>>8&0xff, next&0xff),
+			}
+		}
+		return sessions
+	}
+	if err := store.putAll(newSessions(size, clock.Now().AddDate(1, 0, 0))); err != nil {
+		b.Fatalf("putAll: %v", err)
+	}
+
+	expiring := size / 100
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		if err := store.putAll(newSessions(expiring, clock.Now().Add(time.Minute))); err != nil {
+			b.Fatalf("putAll: %v", err)
+		}
+		clock.advance(defaultCleanupInterval)
+		b.StartTimer()
+
+		if removed := sweep(store, clock.Now()); removed != expiring {
+			b.Fatalf("removed %d sessions, want %d", removed, expiring)
+		}
+	}
+}
+
+// TestHashedSessionTokens checks that the store only knows token hashes and
+// that expiry and IP validation still apply to sessions looked up by cookie
+func TestHashedSessionTokens(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.ValidateIP = true
+		config.SessionExpiry = "1h"
+	})
+	clock := newFakeClock(time.Date(2026, 7, 8, 9, 10, 11, 0, time.UTC))
+	ta.SetClock(clock)
+	token := newTestSession(t, ta)
+
+	if _, ok := ta.sessions.Get(token); ok {
+		t.Fatal("session stored under its plaintext token")
+	}
+	for _, session := range ta.memorySessions().List() {
+		if session.TokenHash != hashSessionToken(token) {
+			t.Fatalf("stored session hash %s, want %s", session.TokenHash, hashSessionToken(token))
+		}
+	}
+
+	check := func(name, remoteAddr string, want bool) {
+		t.Helper()
+		req := withSession(ta, newTestRequest(http.MethodGet, "/"), token)
+		req.RemoteAddr = remoteAddr
+		if valid := ta.validSession(req, token) != nil; valid != want {
+			t.Errorf("%s: valid = %v, want %v", name, valid, want)
+		}
+	}
+	check("same IP", "192.0.2.1:1234", true)
+	check("other IP", "198.51.100.7:1234", false)
+
+	// The mismatch queued the session for deletion; start over
+	token = newTestSession(t, ta)
+	clock.advance(59 * time.Minute)
+	check("before expiry", "192.0.2.1:1234", true)
+	clock.advance(2 * time.Minute)
+	check("after expiry", "192.0.2.1:1234", false)
+	if ta.validSession(withSession(ta, newTestRequest(http.MethodGet, "/"), hashSessionToken(token)), hashSessionToken(token)) != nil {
+		t.Error("the token hash works as a cookie")
+	}
+}
+
+// TestCompactKeepsLiveSessions expires most sessions of stores of several
+// sizes and checks that the maps are rebuilt exactly when fewer than
+// 1/compactRatio of a peak of at least compactMinPeak are left, and that
+// every live session stays reachable through all of them
+func TestCompactKeepsLiveSessions(t *testing.T) {
+	tests := []struct {
+		name        string
+		live, total int
+		compact     bool
+	}{
+		{"mostly expired", compactMinPeak / 8, 2 * compactMinPeak, true},
+		{"at the ratio", 2 * compactMinPeak / compactRatio, 2 * compactMinPeak, false},
+		{"below the minimum peak", 10, compactMinPeak - 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock(time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC))
+			store := newMemorySessionStore(clock)
+			store.setLimit(4*compactMinPeak, nil)
+
+			newSession := func(i int, expiresAt time.Time) *Session {
+				return &Session{
+					TokenHash: fmt.Sprintf("%064x", i),
+					CreatedAt: clock.Now(),
+					ExpiresAt: expiresAt,
+					IP:        fmt.Sprintf("10.0.%d.%d", i>>8&0xff, i&0xff),
+				}
+			}
+			var sessions []*Session
+			for i := 0; i < tt.total; i++ {
+				expiresAt := clock.Now().Add(time.Minute)
+				if i < tt.live {
+					expiresAt = clock.Now().Add(time.Hour)
+				}
+				sessions = append(sessions, newSession(i, expiresAt))
+			}
+			if err := store.putAll(sessions); err != nil {
+				t.Fatalf("putAll: %v", err)
+			}
+			if store.peak != tt.total {
+				t.Fatalf("peak %d, want %d", store.peak, tt.total)
+			}
+
+			before := fmt.Sprintf("%p %p %p", store.sessions, store.recentElems, store.byIP)
+			clock.advance(2 * time.Minute)
+			if removed := store.DeleteExpired(clock.Now()); removed != tt.total-tt.live {
+				t.Fatalf("removed %d sessions, want %d", removed, tt.total-tt.live)
+			}
+			after := fmt.Sprintf("%p %p %p", store.sessions, store.recentElems, store.byIP)
+
+			if rebuilt := before != after; rebuilt != tt.compact {
+				t.Errorf("maps rebuilt = %v, want %v", rebuilt, tt.compact)
+			}
+			wantPeak := tt.total
+			if tt.compact {
+				wantPeak = tt.live
+			}
+			if store.peak != wantPeak {
+				t.Errorf("peak %d, want %d", store.peak, wantPeak)
+			}
+
+			if count := store.Count(); count != tt.live {
+				t.Fatalf("%d sessions left, want %d", count, tt.live)
+			}
+			if len(store.recentElems) != tt.live || store.recent.Len() != tt.live {
+				t.Errorf("usage order holds %d/%d sessions, want %d", len(store.recentElems), store.recent.Len(), tt.live)
+			}
+			for i := 0; i < tt.live; i++ {
+				session := newSession(i, time.Time{})
+				if _, ok := store.Get(session.TokenHash); !ok {
+					t.Fatalf("live session %d lost", i)
+				}
+				if store.countByIP(session.IP, clock.Now()) != 1 {
+					t.Fatalf("live session %d missing from the IP index", i)
+				}
+			}
+
+			// The expiry buckets were kept too: the live sessions still expire
+			clock.advance(time.Hour)
+			if removed := store.DeleteExpired(clock.Now()); removed != tt.live {
+				t.Errorf("removed %d live sessions after they expired, want %d", removed, tt.live)
+			}
+			if len(store.byIP) != 0 || len(store.recentElems) != 0 {
+				t.Errorf("indexes hold %d IPs and %d sessions after the last expiry", len(store.byIP), len(store.recentElems))
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSignedRequests checks which signature headers reach the backend and
+// that every rejected one gets the same plain 401
+func TestSignedRequests(t *testing.T) {
+	const secret = "signing-secret-0123456789abcdef"
+	ta := newTestAuth(t, func(config *Config) {
+		config.SigningSecret = secret
+		config.SignatureMaxAge = 300
+	})
+	clock := newFakeClock(time.Date(2026, 9, 10, 11, 12, 13, 0, time.UTC))
+	ta.SetClock(clock)
+
+	// header signs method and path with the timestamp offset from now
+	header := func(offset time.Duration, method, path string) string {
+		timestamp := strconv.FormatInt(clock.Now().Add(offset).Unix(), 10)
+		return "t=" + timestamp + ",v1=" + signRequest([]byte(secret), timestamp, method, path)
+	}
+	now := strconv.FormatInt(clock.Now().Unix(), 10)
+	wrong := signRequest([]byte("another-secret"), now, http.MethodPost, "/api/jobs")
+	valid := signRequest([]byte(secret), now, http.MethodPost, "/api/jobs")
+
+	tests := []struct {
+		name   string
+		header string
+		valid  bool
+	}{
+		{"valid", header(0, http.MethodPost, "/api/jobs"), true},
+		{"upper-case signature", "t=" + now + ",v1=" + strings.ToUpper(valid), true},
+		{"spaces around entries", "t=" + now + ", v1=" + valid, true},
+		{"old within signatureMaxAge", header(-299*time.Second, http.MethodPost, "/api/jobs"), true},
+		{"ahead within signatureMaxAge", header(299*time.Second, http.MethodPost, "/api/jobs"), true},
+		{"stale timestamp", header(-301*time.Second, http.MethodPost, "/api/jobs"), false},
+		{"future timestamp", header(301*time.Second, http.MethodPost, "/api/jobs"), false},
+		{"bad signature", "t=" + now + ",v1=" + wrong, false},
+		{"signature for another path", header(0, http.MethodPost, "/api/other"), false},
+		{"signature for another method", header(0, http.MethodGet, "/api/jobs"), false},
+		{"several v1 entries, the second valid", "t=" + now + ",v1=" + wrong + ",v1=" + valid, true},
+		{"several v1 entries, none valid", "t=" + now + ",v1=" + wrong + ",v1=" + strings.Repeat("0", 64), false},
+		{"missing timestamp", "v1=" + valid, false},
+		{"missing signature", "t=" + now, false},
+		{"malformed timestamp", "t=yesterday,v1=" + valid, false},
+		{"timestamp in milliseconds", "t=" + now + "000,v1=" + valid, false},
+	}
+
+	var rejection *httptest.ResponseRecorder
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "https://app.example/api/jobs", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			req.Header.Set(signatureHeader, tt.header)
+			rec := httptest.NewRecorder()
+			ta.ServeHTTP(rec, req)
+
+			if tt.valid {
+				if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+					t.Errorf("status %d, body %q; want the backend's response", rec.Code, rec.Body.String())
+				}
+				return
+			}
+			if rec.Code != http.StatusUnauthorized {
+				t.Fatalf("status %d, want %d", rec.Code, http.StatusUnauthorized)
+			}
+			// Every rejection looks the same, whatever the reason
+			if rejection == nil {
+				rejection = rec
+				return
+			}
+			if rec.Body.String() != rejection.Body.String() {
+				t.Errorf("body %q differs from %q", rec.Body.String(), rejection.Body.String())
+			}
+			for _, name := range []string{"Content-Type", "WWW-Authenticate", "Set-Cookie", "Location"} {
+				if got, want := rec.Header().Values(name), rejection.Header().Values(name); strings.Join(got, "\n") != strings.Join(want, "\n") {
+					t.Errorf("%s %q differs from %q", name, got, want)
+				}
+			}
+		})
+	}
+	if rejection != nil && strings.Contains(rejection.Body.String(), "signature") {
+		t.Errorf("rejection reveals the reason: %q", rejection.Body.String())
+	}
+}
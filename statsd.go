@@ -0,0 +1,115 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metric names
+const (
+	metricAuthSuccess     = "auth.success"
+	metricAuthFailure     = "auth.failure"
+	metricSessionsCreated = "sessions.created"
+	metricSessionsActive  = "sessions.active"
+)
+
+// statsdMaxPacketSize keeps datagrams below common network MTUs
+const statsdMaxPacketSize = 1432
+
+// statsdEmitter aggregates counters and periodically sends them, together with
+// gauges, as StatsD datagrams over UDP. Counters are handed over through a
+// buffered channel so request handling never waits on the network.
+type statsdEmitter struct {
+	address  string
+	prefix   string
+	interval time.Duration
+	events   chan string
+	gauges   func() map[string]int64
+}
+
+// newStatsdEmitter creates an emitter; gauges is called on every flush
+func newStatsdEmitter(config *Config, gauges func() map[string]int64) *statsdEmitter {
+	prefix := strings.Trim(config.StatsdPrefix, ".")
+	if prefix != "" {
+		prefix += "."
+	}
+
+	return &statsdEmitter{
+		address:  config.StatsdAddress,
+		prefix:   prefix,
+		interval: time.Duration(config.StatsdFlushInterval) * time.Second,
+		events:   make(chan string, 1024),
+		gauges:   gauges,
+	}
+}
+
+// incr counts one occurrence of a metric, dropping it when the buffer is full
+func (se *statsdEmitter) incr(name string) {
+	select {
+	case se.events <- name:
+	default:
+	}
+}
+
+// run aggregates counters and flushes them every interval until ctx is done
+func (se *statsdEmitter) run(ctx context.Context) {
+	ticker := time.NewTicker(se.interval)
+	defer ticker.Stop()
+
+	counters := make(map[string]int64)
+	for {
+		select {
+		case <-ctx.Done():
+			se.flush(counters)
+			return
+		case name := <-se.events:
+			counters[name]++
+		case <-ticker.C:
+			se.flush(counters)
+			counters = make(map[string]int64)
+		}
+	}
+}
+
+// flush sends counters and current gauges; socket errors are ignored
+func (se *statsdEmitter) flush(counters map[string]int64) {
+	var lines []string
+	for name, value := range counters {
+		lines = append(lines, se.prefix+name+":"+strconv.FormatInt(value, 10)+"|c")
+	}
+	for name, value := range se.gauges() {
+		lines = append(lines, se.prefix+name+":"+strconv.FormatInt(value, 10)+"|g")
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	conn, err := net.DialTimeout("udp", se.address, time.Second)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var packet []byte
+	for _, line := range lines {
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacketSize {
+			_, _ = conn.Write(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	_, _ = conn.Write(packet)
+}
+
+// incrMetric counts one occurrence of a metric
+func (ta *TOTPAuth) incrMetric(name string) {
+	if ta.statsd != nil {
+		ta.statsd.incr(name)
+	}
+}
@@ -0,0 +1,68 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// enrollmentState records when a code from the authenticator was first
+// verified, which confirms that the secret has been enrolled correctly
+type enrollmentState struct {
+	mu          sync.Mutex
+	confirmedAt time.Time
+}
+
+// confirm records the first successful verification
+func (e *enrollmentState) confirm(now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.confirmedAt.IsZero() {
+		e.confirmedAt = now.UTC()
+	}
+}
+
+// reset forgets the confirmation, so the next login confirms enrollment again
+func (e *enrollmentState) reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.confirmedAt = time.Time{}
+}
+
+// confirmed returns when enrollment was confirmed, or the zero time
+func (e *enrollmentState) confirmed() time.Time {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.confirmedAt
+}
+
+// handleAdminStatus reports the provisioning state of this instance for
+// automation. The secret itself is never included.
+func (ta *TOTPAuth) handleAdminStatus(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		rw.Header().Set("Allow", http.MethodGet)
+		writeJSONError(rw, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// The secret can only come from the plugin configuration, there are no
+	// setup endpoints and every session belongs to the single configured user
+	status := map[string]interface{}{
+		"secretConfigured":      ta.config.SecretKey != "",
+		"secretSource":          "config",
+		"enrollmentConfirmed":   false,
+		"setupTokenConfigured":  false,
+		"setupEndpointsEnabled": false,
+		"mode":                  "single-user",
+	}
+	if ta.config.SecretFile != "" {
+		status["secretSource"] = "file"
+		status["secretRotatedAt"] = ta.secret.lastRotation()
+	}
+	if confirmedAt := ta.enrollment.confirmed(); !confirmedAt.IsZero() {
+		status["enrollmentConfirmed"] = true
+		status["enrollmentConfirmedAt"] = confirmedAt
+	}
+
+	writeJSON(rw, http.StatusOK, status)
+}
@@ -0,0 +1,59 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Code formats
+const (
+	codeFormatNumeric = "numeric"
+	codeFormatSteam   = "steam"
+)
+
+// steamAlphabet is the character set of Steam Guard codes; it leaves out
+// vowels and characters that are easily confused
+const steamAlphabet = "23456789BCDFGHJKMNPQRTVWXY"
+
+// steamCodeLength is the fixed length of Steam Guard codes
+const steamCodeLength = 5
+
+// validateCodeFormat checks codeFormat. Steam codes always have five
+// characters, so codeDigits is set accordingly.
+func validateCodeFormat(config *Config) error {
+	config.CodeFormat = strings.ToLower(config.CodeFormat)
+	switch config.CodeFormat {
+	case "", codeFormatNumeric:
+		config.CodeFormat = codeFormatNumeric
+		return nil
+	case codeFormatSteam:
+	default:
+		return fmt.Errorf("invalid codeFormat (must be %q or %q): %s", codeFormatNumeric, codeFormatSteam, config.CodeFormat)
+	}
+
+	if config.ShowKeypad {
+		return fmt.Errorf("showKeypad only supports numeric codes, not codeFormat steam")
+	}
+	config.CodeDigits = steamCodeLength
+	return nil
+}
+
+// steamCode formats the truncated HMAC value as a Steam Guard code
+func steamCode(truncated uint32) string {
+	code := make([]byte, steamCodeLength)
+	base := uint32(len(steamAlphabet))
+	for i := range code {
+		code[i] = steamAlphabet[truncated%base]
+		truncated /= base
+	}
+	return string(code)
+}
+
+// normalizeCode prepares a submitted code for comparison: Steam codes are
+// accepted in either case
+func (ta *TOTPAuth) normalizeCode(code string) string {
+	if ta.config.CodeFormat == codeFormatSteam {
+		return strings.ToUpper(code)
+	}
+	return code
+}
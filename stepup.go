@@ -0,0 +1,148 @@
+package traefik_totp_plugin
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requireStepUp marks the session with tokenHash as needing a fresh code. It
+// returns false when the session no longer exists.
+func (s *memorySessionStore) requireStepUp(tokenHash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, exists := s.sessions[tokenHash]
+	if !exists {
+		return false
+	}
+	session.stepUp = true
+	return true
+}
+
+// completeStepUp clears the step-up mark after a fresh code was entered
+func (s *memorySessionStore) completeStepUp(tokenHash string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, exists := s.sessions[tokenHash]; exists {
+		session.stepUp = false
+		session.verifiedAt = now
+	}
+}
+
+// stepUpState returns whether the session with tokenHash needs a fresh code
+// and when a code was last entered for it
+func (s *memorySessionStore) stepUpState(tokenHash string) (bool, time.Time) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, exists := s.sessions[tokenHash]
+	if !exists {
+		return false, time.Time{}
+	}
+	return session.stepUp, session.verifiedAt
+}
+
+// handleStepUpHeader marks the current session for re-verification when the
+// backend response carries the step-up header, unless a code was entered
+// within stepUpMaxAge. It returns true when the backend's response must be
+// replaced by the challenge. The header is always stripped.
+func (ta *TOTPAuth) handleStepUpHeader(header http.Header, req *http.Request) bool {
+	value := header.Get(ta.config.StepUpHeader)
+	if value == "" {
+		return false
+	}
+	header.Del(ta.config.StepUpHeader)
+
+	if !isTruthy(value) {
+		return false
+	}
+
+	token := ta.sessionToken(req)
+	session, exists := ta.sessions.Get(hashSessionToken(token))
+	if token == "" || !exists {
+		return false
+	}
+
+	// The retried request right after re-verification gets the same demand
+	_, verifiedAt := ta.memorySessions().stepUpState(session.TokenHash)
+	if ta.clock.Now().Sub(verifiedAt) < time.Duration(ta.config.StepUpMaxAge)*time.Second {
+		return false
+	}
+	if !ta.memorySessions().requireStepUp(session.TokenHash) {
+		return false
+	}
+
+	log.Printf("[%s] Backend requested step-up verification for %s %s from %s", ta.name, req.Method, req.URL.Path, ta.getClientIP(req))
+	ta.audit(req, auditAccessDenied, "step_up_required", req.Method+" "+req.URL.Path)
+	return true
+}
+
+// handleStepUp handles a code submitted to the login path by a session that
+// must re-verify: a valid code clears the mark, anything else gets the
+// challenge again
+func (ta *TOTPAuth) handleStepUp(rw http.ResponseWriter, req *http.Request, session *Session) {
+	if err := req.ParseForm(); err != nil || req.PostFormValue("totp_code") == "" {
+		ta.challengeStepUp(rw, req, "")
+		return
+	}
+	if !ta.checkSubmissionOrigin(req) {
+		ta.audit(req, auditAuthFailure, "origin_check")
+		ta.challengeStepUp(rw, req, "Invalid request")
+		return
+	}
+	if !ta.validLoginCSRF(req) {
+		ta.audit(req, auditAuthFailure, "csrf_check")
+		ta.challengeStepUp(rw, req, "Your sign-in form has expired. Please enter a new code.")
+		return
+	}
+	if problem := ta.submissionTimingProblem(req, ta.clock.Now()); problem != "" {
+		ta.audit(req, auditAuthFailure, "submission_timing", problem)
+		ta.challengeStepUp(rw, req, "Something went wrong. Please enter the code again.")
+		return
+	}
+	release, ok := ta.reserveAttempt(rw, req)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Codes from the read-only authenticator only re-verify read-only sessions
+	code := strings.TrimSpace(req.PostFormValue("totp_code"))
+	result, valid := ta.runValidators(req, code, ta.validators)
+	if valid && result.ReadOnly && !session.ReadOnly {
+		valid = false
+	}
+	if !valid {
+		log.Printf("[%s] Invalid step-up code from %s", ta.name, ta.getClientIP(req))
+		ta.incrMetric(metricAuthFailure)
+		ta.audit(req, auditAuthFailure, "step_up_invalid_code")
+		if ta.recordFailedCode(rw, req) {
+			return
+		}
+		ta.delayFailedSubmission(req)
+		ta.challengeStepUp(rw, req, "Invalid TOTP code. Please try again.")
+		return
+	}
+
+	ta.recordSuccessfulCode(req)
+	ta.memorySessions().completeStepUp(session.TokenHash, ta.clock.Now())
+	log.Printf("[%s] Successful step-up verification from %s", ta.name, ta.getClientIP(req))
+	ta.incrMetric(metricAuthSuccess)
+	ta.audit(req, auditAuthSuccess, "step_up")
+	ta.completeSubmission(rw, req, session.ReadOnly)
+}
+
+// challengeStepUp asks for a fresh code: browsers get the challenge page,
+// which submits to the login path, API clients a JSON 401
+func (ta *TOTPAuth) challengeStepUp(rw http.ResponseWriter, req *http.Request, errorMsg string) {
+	if !acceptsHTML(req) {
+		writeJSONError(rw, http.StatusUnauthorized, "step-up verification required")
+		return
+	}
+	if errorMsg == "" {
+		errorMsg = "Please confirm with a fresh code to continue."
+	}
+	ta.showTOTPPage(rw, req, errorMsg)
+}
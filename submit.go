@@ -0,0 +1,187 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// submissionTTL is how long a used form nonce is remembered
+	submissionTTL = 2 * time.Minute
+	// maxSubmissions bounds the number of remembered form nonces
+	maxSubmissions = 10000
+	// submissionWait is how long a duplicate waits for the original to finish
+	submissionWait = 5 * time.Second
+)
+
+// formSubmission is the outcome of the first submission of a challenge form.
+// The session token is only kept sealed with a key derived from the
+// browser's login CSRF cookie, so the cache alone never yields a cookie.
+type formSubmission struct {
+	ip          string
+	codeHash    []byte
+	expires     time.Time
+	done        chan struct{} // closed once tokenHash is set
+	tokenHash   string        // hash of the session created by the submission, empty if it failed
+	sealedToken []byte        // the session token, sealed with submissionCipher
+}
+
+// submissionCache remembers recently submitted form nonces so that a
+// double-click or a retried POST reuses the session of the first submission
+// instead of validating the code again
+type submissionCache struct {
+	mu      sync.Mutex
+	entries map[string]*formSubmission
+}
+
+// newSubmissionCache creates an empty submission cache
+func newSubmissionCache() *submissionCache {
+	return &submissionCache{entries: make(map[string]*formSubmission)}
+}
+
+// newFormNonce returns a random nonce for a rendered challenge form, or an
+// empty string if none could be generated
+func newFormNonce() string {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(nonce)
+}
+
+// begin records the first submission of nonce and returns it with first set.
+// For a repeated nonce the earlier submission is returned instead. Missing or
+// malformed nonces, and nonces that don't fit into the cache, are not tracked.
+func (c *submissionCache) begin(nonce, ip string, codeHash []byte, now time.Time) (*formSubmission, bool) {
+	if len(nonce) != 32 {
+		return nil, false
+	}
+	if _, err := hex.DecodeString(nonce); err != nil {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, ok := c.entries[nonce]; ok && now.Before(existing.expires) {
+		return existing, false
+	}
+	if len(c.entries) >= maxSubmissions {
+		return nil, false
+	}
+
+	submission := &formSubmission{
+		ip:       ip,
+		codeHash: codeHash,
+		expires:  now.Add(submissionTTL),
+		done:     make(chan struct{}),
+	}
+	c.entries[nonce] = submission
+	return submission, true
+}
+
+// finish stores the outcome of a submission started with begin. Failed
+// submissions are forgotten so that a retry is validated normally.
+func (c *submissionCache) finish(nonce string, submission *formSubmission, tokenHash string, sealedToken []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	submission.tokenHash = tokenHash
+	submission.sealedToken = sealedToken
+	close(submission.done)
+	if tokenHash == "" && c.entries[nonce] == submission {
+		delete(c.entries, nonce)
+	}
+}
+
+// cleanup removes expired nonces
+func (c *submissionCache) cleanup(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for nonce, submission := range c.entries {
+		if now.After(submission.expires) {
+			delete(c.entries, nonce)
+		}
+	}
+}
+
+// submissionCodeHash hashes a submitted code so it can be compared with a
+// duplicate without keeping the code itself around
+func (ta *TOTPAuth) submissionCodeHash(code string) []byte {
+	mac := hmac.New(sha256.New, ta.formKey)
+	mac.Write([]byte("submission:" + code))
+	return mac.Sum(nil)
+}
+
+// submissionCipher returns the cipher sealing the session token of the
+// submission of nonce made with req. Its key depends on the browser's login
+// CSRF cookie, which only the browser holds, and is used for that one token.
+func (ta *TOTPAuth) submissionCipher(req *http.Request, nonce string) (cipher.AEAD, error) {
+	cookie, err := req.Cookie(ta.loginCSRFCookieName())
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, ta.formKey)
+	mac.Write([]byte("submission-token:" + nonce + ":" + cookie.Value))
+	return newSecretCipher(mac.Sum(nil))
+}
+
+// finishSubmission records the session token created by the submission of
+// nonce, or its failure when token is empty
+func (ta *TOTPAuth) finishSubmission(req *http.Request, nonce string, submission *formSubmission, token string) {
+	var tokenHash string
+	var sealed []byte
+	if token != "" {
+		if aead, err := ta.submissionCipher(req, nonce); err == nil {
+			tokenHash = hashSessionToken(token)
+			// Each key seals a single token, so a fixed nonce is safe
+			sealed = aead.Seal(nil, make([]byte, aead.NonceSize()), []byte(token), nil)
+		}
+	}
+	ta.submissions.finish(nonce, submission, tokenHash, sealed)
+}
+
+// replaySubmission answers a duplicate of an earlier submission with the
+// session that submission created. It returns false when the duplicate has
+// to be validated normally: the original failed, came from another client,
+// browser or code, or its session is gone.
+func (ta *TOTPAuth) replaySubmission(rw http.ResponseWriter, req *http.Request, original *formSubmission, codeHash []byte) bool {
+	select {
+	case <-original.done:
+	case <-time.After(submissionWait):
+		return false
+	case <-req.Context().Done():
+		return false
+	}
+
+	if original.tokenHash == "" || original.ip != ta.getClientIP(req) || !hmac.Equal(original.codeHash, codeHash) {
+		return false
+	}
+	aead, err := ta.submissionCipher(req, req.PostFormValue("submission"))
+	if err != nil {
+		return false
+	}
+	plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), original.sealedToken, nil)
+	if err != nil {
+		return false
+	}
+	token := string(plain)
+	session := ta.validSession(req, token)
+	if session == nil {
+		return false
+	}
+
+	log.Printf("[%s] Duplicate TOTP submission from %s, reusing its session", ta.name, session.IP)
+	http.SetCookie(rw, ta.sessionCookie(token, ta.sessionCookieMaxAge()))
+	ta.markVerified(rw, req)
+	ta.completeSubmission(rw, req, session.ReadOnly)
+	return true
+}
@@ -0,0 +1,94 @@
+package traefik_totp_plugin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestDuplicateSubmissionsReachTarget checks that a double-clicked or
+// retried challenge form lands both POSTs on the target URL with the same
+// session, whether the second arrives during or after the first
+func TestDuplicateSubmissionsReachTarget(t *testing.T) {
+	for _, concurrent := range []bool{true, false} {
+		name := "sequential"
+		if concurrent {
+			name = "concurrent"
+		}
+		t.Run(name, func(t *testing.T) {
+			ta := newTestAuth(t, nil)
+			form, csrf := loginForm(ta, currentCode(ta))
+
+			recs := []*httptest.ResponseRecorder{httptest.NewRecorder(), httptest.NewRecorder()}
+			submit := func(rec *httptest.ResponseRecorder) {
+				ta.ServeHTTP(rec, newTestLogin(ta, "/app/page?x=1", form, csrf))
+			}
+			if concurrent {
+				var wg sync.WaitGroup
+				for _, rec := range recs {
+					wg.Add(1)
+					go func(rec *httptest.ResponseRecorder) {
+						defer wg.Done()
+						submit(rec)
+					}(rec)
+				}
+				wg.Wait()
+			} else {
+				for _, rec := range recs {
+					submit(rec)
+				}
+			}
+
+			var tokens []string
+			for i, rec := range recs {
+				if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/app/page?x=1" {
+					t.Fatalf("submission %d: status %d to %q, want %d to /app/page?x=1", i+1, rec.Code, rec.Header().Get("Location"), http.StatusSeeOther)
+				}
+				cookie := responseCookie(rec, ta.config.CookieName)
+				if cookie == nil || cookie.Value == "" {
+					t.Fatalf("submission %d set no session cookie", i+1)
+				}
+				tokens = append(tokens, cookie.Value)
+			}
+			if tokens[0] != tokens[1] {
+				t.Error("duplicate submission created a second session")
+			}
+			if count := ta.sessions.Count(); count != 1 {
+				t.Errorf("%d sessions stored, want 1", count)
+			}
+		})
+	}
+}
+
+// TestSubmissionCacheSealsToken checks that the submission cache only holds
+// the session token sealed to the submitting browser, which another browser
+// replaying the form can't open
+func TestSubmissionCacheSealsToken(t *testing.T) {
+	ta := newTestAuth(t, nil)
+	form, csrf := loginForm(ta, currentCode(ta))
+
+	rec := httptest.NewRecorder()
+	ta.ServeHTTP(rec, newTestLogin(ta, "/app", form, csrf))
+	token := responseCookie(rec, ta.config.CookieName).Value
+
+	ta.submissions.mu.Lock()
+	entry := ta.submissions.entries[form.Get("submission")]
+	ta.submissions.mu.Unlock()
+	if entry == nil || entry.tokenHash != hashSessionToken(token) {
+		t.Fatalf("submission entry = %+v, want the hash of the session token", entry)
+	}
+	if strings.Contains(string(entry.sealedToken), token) {
+		t.Fatal("submission entry holds the plaintext token")
+	}
+
+	// Another browser posting the same form can't take over the session
+	other := &http.Cookie{Name: csrf.Name, Value: newFormNonce()}
+	form.Set("csrf", ta.csrfToken(other.Value, "login"))
+	rec = httptest.NewRecorder()
+	ta.ServeHTTP(rec, newTestLogin(ta, "/app", form, other))
+	if cookie := responseCookie(rec, ta.config.CookieName); cookie != nil && cookie.Value == token {
+		t.Fatal("another browser received the session of the first submission")
+	}
+}
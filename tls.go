@@ -0,0 +1,26 @@
+package traefik_totp_plugin
+
+import (
+	"log"
+	"net/http"
+)
+
+// enforceTLS keeps the challenge off plain HTTP: page requests are redirected
+// to the https:// equivalent and code submissions are refused, since the code
+// would travel in cleartext and a Secure cookie would not be stored anyway.
+// It returns true when the request has been handled.
+func (ta *TOTPAuth) enforceTLS(rw http.ResponseWriter, req *http.Request) bool {
+	if ta.config.RequireTLS == nil || !*ta.config.RequireTLS || ta.requestScheme(req) != "http" {
+		return false
+	}
+
+	if req.Method == http.MethodPost {
+		log.Printf("[%s] Refused code submission over plain HTTP from %s", ta.name, ta.getClientIP(req))
+		ta.audit(req, auditAuthFailure, "plain_http")
+		ta.showMessagePage(rw, http.StatusForbidden, "Secure Connection Required", "Codes can only be submitted over HTTPS.")
+		return true
+	}
+
+	http.Redirect(rw, req, "https://"+ta.requestHost(req)+req.URL.RequestURI(), http.StatusFound)
+	return true
+}
@@ -0,0 +1,92 @@
+package traefik_totp_plugin
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// TokenSettings overrides the code parameters for the token enrolled for a
+// pathSecrets prefix. Unset fields fall back to the plugin-level values.
+type TokenSettings struct {
+	Digits    int    `json:"digits,omitempty"`    // Number of digits in codes (default: codeDigits)
+	Period    int    `json:"period,omitempty"`    // Time step in seconds (default: timeStep)
+	Algorithm string `json:"algorithm,omitempty"` // HMAC algorithm: SHA1, SHA256 or SHA512 (default: algorithm)
+}
+
+// tokenParams are the resolved parameters codes are generated with
+type tokenParams struct {
+	digits    int
+	period    int
+	algorithm string
+}
+
+// maxCodeDigits is the most digits the 31-bit truncated HMAC can fill
+const maxCodeDigits = 9
+
+// hashes maps the supported algorithm names to their hash functions
+var hashes = map[string]func() hash.Hash{
+	"SHA1":   sha1.New,
+	"SHA256": sha256.New,
+	"SHA512": sha512.New,
+}
+
+// validateTokenSettings checks the plugin-level code parameters and the
+// per-prefix overrides
+func validateTokenSettings(config *Config) error {
+	config.Algorithm = strings.ToUpper(config.Algorithm)
+	if config.Algorithm == "" {
+		config.Algorithm = "SHA1"
+	}
+	if _, ok := hashes[config.Algorithm]; !ok {
+		return fmt.Errorf("invalid algorithm (must be SHA1, SHA256 or SHA512): %s", config.Algorithm)
+	}
+
+	for prefix, settings := range config.PathTokenSettings {
+		if _, ok := config.PathSecrets[prefix]; !ok {
+			return fmt.Errorf("pathTokenSettings prefix %s has no pathSecrets entry", prefix)
+		}
+		if settings.Digits < 0 || settings.Digits > maxCodeDigits {
+			return fmt.Errorf("pathTokenSettings digits for %s must be between 1 and %d: %d", prefix, maxCodeDigits, settings.Digits)
+		}
+		if settings.Digits > 0 && config.CodeFormat == codeFormatSteam {
+			return fmt.Errorf("pathTokenSettings digits for %s can't be combined with codeFormat steam", prefix)
+		}
+		if settings.Period < 0 {
+			return fmt.Errorf("pathTokenSettings period for %s must not be negative: %d", prefix, settings.Period)
+		}
+		settings.Algorithm = strings.ToUpper(settings.Algorithm)
+		if _, ok := hashes[settings.Algorithm]; !ok && settings.Algorithm != "" {
+			return fmt.Errorf("invalid pathTokenSettings algorithm for %s (must be SHA1, SHA256 or SHA512): %s", prefix, settings.Algorithm)
+		}
+		config.PathTokenSettings[prefix] = settings
+	}
+	return nil
+}
+
+// tokenParams returns the code parameters of area, "" being the default area
+func (ta *TOTPAuth) tokenParams(area string) tokenParams {
+	params := tokenParams{
+		digits:    ta.config.CodeDigits,
+		period:    ta.timeStep,
+		algorithm: ta.config.Algorithm,
+	}
+
+	settings, ok := ta.config.PathTokenSettings[area]
+	if !ok {
+		return params
+	}
+	if settings.Digits > 0 {
+		params.digits = settings.Digits
+	}
+	if settings.Period > 0 {
+		params.period = settings.Period
+	}
+	if settings.Algorithm != "" {
+		params.algorithm = settings.Algorithm
+	}
+	return params
+}
@@ -5,141 +5,1016 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha1"
-	"encoding/base32"
+	"crypto/subtle"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"html/template"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
-	"sync"
 	"time"
 )
 
 // Config holds the plugin configuration
 type Config struct {
 	SecretKey       string `json:"secretKey,omitempty"`       // Base32 encoded TOTP secret
-	SessionExpiry   int    `json:"sessionExpiry,omitempty"`   // Session expiry in seconds (default: 3600)
+	SessionExpiry   string `json:"sessionExpiry,omitempty"`   // Session expiry in seconds or as a duration like "12h" (default: 3600)
+	IdleTimeout     string `json:"idleTimeout,omitempty"`     // Sessions unused for this long expire before sessionExpiry, in seconds or as a duration like "30m" (default: 0, disabled)
 	CookieName      string `json:"cookieName,omitempty"`      // Name of the session cookie
 	CookieDomain    string `json:"cookieDomain,omitempty"`    // Cookie domain
 	CookieSecure    bool   `json:"cookieSecure,omitempty"`    // Use secure cookies
 	Issuer          string `json:"issuer,omitempty"`          // TOTP issuer name
 	AccountName     string `json:"accountName,omitempty"`     // TOTP account name
-	TimeStep        int    `json:"timeStep,omitempty"`        // Time step in seconds (default: 30)
+	TimeStep        string `json:"timeStep,omitempty"`        // Time step in seconds or as a duration like "30s" (default: 30)
 	CodeDigits      int    `json:"codeDigits,omitempty"`      // Number of digits in code (default: 6)
 	AllowedSkew     int    `json:"allowedSkew,omitempty"`     // Number of time steps to allow for clock skew (default: 1)
 	PageTitle       string   `json:"pageTitle,omitempty"`       // Custom page title
 	PageDescription string   `json:"pageDescription,omitempty"` // Custom page description
 	ValidateIP      bool     `json:"validateIP,omitempty"`      // Validate IP address for sessions (default: false)
-	TrustedProxies  []string `json:"trustedProxies,omitempty"`  // CIDR ranges of trusted proxies (e.g., ["10.0.0.0/8", "172.16.0.0/12"])
+	TrustedProxies  []string `json:"trustedProxies,omitempty"`  // CIDR ranges, IPs or hostnames of trusted proxies (e.g., ["10.0.0.0/8", "proxy.internal.lan"])
+	WebOTP          bool     `json:"webOTP,omitempty"`          // Enable the WebOTP API to auto-fill codes delivered by SMS (default: false)
+	ShowKeypad      bool     `json:"showKeypad,omitempty"`      // Show an on-screen numeric keypad for touch kiosks (default: false)
+	AdminToken      string   `json:"adminToken,omitempty"`      // Bearer token for the admin API under /.totp/admin/ (disabled when empty)
+	RevokeHeader    string   `json:"revokeHeader,omitempty"`    // Backend response header that revokes the current session, e.g. "X-TOTP-Revoke"; needs sessionMode memory (disabled when empty)
+
+	LegacyCookieNames []string `json:"legacyCookieNames,omitempty"` // Previous cookie names still accepted and migrated to cookieName
+
+	LockoutExemptNetworks []string `json:"lockoutExemptNetworks,omitempty"` // CIDR ranges never delayed or locked out by brute-force protections
+
+	PostLogoutRedirectURL string   `json:"postLogoutRedirectURL,omitempty"` // Where to send users after logout (default: built-in confirmation page)
+	AllowedRedirectHosts  []string `json:"allowedRedirectHosts,omitempty"`  // Hosts that absolute redirect URLs may point at
+
+	ReputationURL            string `json:"reputationURL,omitempty"`            // IP reputation service queried as GET <url>?ip=<client ip> (disabled when empty)
+	ReputationTimeoutMs      int    `json:"reputationTimeoutMs,omitempty"`      // Reputation lookup timeout in milliseconds (default: 500)
+	ReputationDefaultVerdict string `json:"reputationDefaultVerdict,omitempty"` // Verdict used when the lookup fails: "challenge" or "deny" (default: challenge)
+	ReputationCacheTTL       int    `json:"reputationCacheTTL,omitempty"`       // Seconds to cache a verdict per IP (default: 300)
+	ReputationCacheSize      int    `json:"reputationCacheSize,omitempty"`      // Maximum number of cached verdicts (default: 10000)
+
+	StatsdAddress       string `json:"statsdAddress,omitempty"`       // StatsD server (host:port) to send metrics to over UDP (disabled when empty)
+	StatsdPrefix        string `json:"statsdPrefix,omitempty"`        // Prefix prepended to metric names (default: "totp")
+	StatsdFlushInterval int    `json:"statsdFlushInterval,omitempty"` // Seconds between metric flushes (default: 10)
+
+	ClockCheckURL      string `json:"clockCheckURL,omitempty"`      // HTTPS endpoint whose Date header is compared with the local clock (disabled when empty)
+	ClockCheckInterval int    `json:"clockCheckInterval,omitempty"` // Seconds between clock checks (default: 3600)
+
+	TrustedProxiesRefreshInterval int `json:"trustedProxiesRefreshInterval,omitempty"` // Seconds between re-resolving hostnames in trustedProxies (default: 300)
+
+	StrictOriginCheck string `json:"strictOriginCheck,omitempty"` // Origin/Sec-Fetch-Site validation of code submissions: "off", "log" or "enforce" (default: off)
+
+	EnableDevicesPage bool `json:"enableDevicesPage,omitempty"` // Let authenticated users list and revoke sessions at /.totp/devices (default: false)
+
+	AuditFile          string `json:"auditFile,omitempty"`          // Path of the JSON lines audit file (disabled when empty)
+	AuditMaxSizeMB     int    `json:"auditMaxSizeMB,omitempty"`     // Rotate the audit file when it exceeds this size (default: 100)
+	AuditMaxFiles      int    `json:"auditMaxFiles,omitempty"`      // Number of rotated audit files to keep (default: 5)
+	AuditFlushInterval int    `json:"auditFlushInterval,omitempty"` // Seconds between audit file flushes (default: 5)
+	AuditIPMode        string `json:"auditIPMode,omitempty"`        // How client IPs are recorded in the audit file: "full", "truncated" (/24 for IPv4, /48 for IPv6) or "hashed" (default: full)
+
+	IdentityHeader string `json:"identityHeader,omitempty"` // Header carrying the authenticated identity to the backend; stripped from incoming requests (default: X-TOTP-User)
+
+	JWTSecret    string `json:"jwtSecret,omitempty"`    // HMAC secret for JWTs that bypass the TOTP challenge (HS256/384/512)
+	JWTPublicKey string `json:"jwtPublicKey,omitempty"` // PEM encoded RSA/ECDSA public key or certificate for JWTs (RS*/ES*)
+	JWTIssuer    string `json:"jwtIssuer,omitempty"`    // Expected iss claim (not checked when empty)
+	JWTAudience  string `json:"jwtAudience,omitempty"`  // Expected aud claim (not checked when empty)
+	JWTHeader    string `json:"jwtHeader,omitempty"`    // Request header carrying the JWT, optionally with a Bearer prefix (default: Authorization)
+
+	SigningSecret   string `json:"signingSecret,omitempty"`   // Shared secret for HMAC-signed machine-to-machine requests (disabled when empty)
+	SignatureMaxAge int    `json:"signatureMaxAge,omitempty"` // Maximum age in seconds of a request signature timestamp (default: 300)
+
+	WebhookURL string `json:"webhookURL,omitempty"` // URL receiving JSON notifications about security events (disabled when empty)
+
+	MaxIPChanges     int `json:"maxIPChanges,omitempty"`     // Invalidate a session that changes source network more often than this within ipChangeWindow (disabled when 0)
+	IPChangeWindow   int `json:"ipChangeWindow,omitempty"`   // Window in seconds for counting network changes (default: 3600)
+	IPChangePrefixV4 int `json:"ipChangePrefixV4,omitempty"` // IPv4 prefix length defining a "network" (default: 16)
+	IPChangePrefixV6 int `json:"ipChangePrefixV6,omitempty"` // IPv6 prefix length defining a "network" (default: 48)
+
+	PortalURL         string `json:"portalURL,omitempty"`         // Central login portal that unauthenticated users are redirected to (disabled when empty)
+	PortalSigningKey  string `json:"portalSigningKey,omitempty"`  // Key shared with the portal for signing login assertions
+	PortalTokenMaxAge int    `json:"portalTokenMaxAge,omitempty"` // Lifetime of a portal login assertion in seconds (default: 60)
+
+	StaticTestCode        string `json:"staticTestCode,omitempty"`        // Fixed code accepted in addition to TOTP codes, for end-to-end tests only
+	AllowInsecureTestCode bool   `json:"allowInsecureTestCode,omitempty"` // Must be true for staticTestCode to be accepted (default: false)
+
+	RedirectLoopThreshold int `json:"redirectLoopThreshold,omitempty"` // Challenges right after a successful verification before a diagnostic page is shown (default: 3)
+
+	DriftFile         string `json:"driftFile,omitempty"`         // File persisting the calibrated clock drift of the authenticator (in memory only when empty)
+	CalibrationWindow int    `json:"calibrationWindow,omitempty"` // Time steps searched either side of now during drift calibration (default: 10)
+	ConfirmEnrollment bool   `json:"confirmEnrollment,omitempty"` // Ask for two consecutive codes at the first login to confirm enrollment and calibrate the drift (default: false)
+
+	EnablePairing bool `json:"enablePairing,omitempty"` // Let signed-in users approve another device via a pairing code (default: false)
+	PairingTTL    int  `json:"pairingTTL,omitempty"`    // Lifetime of a pairing code in seconds (default: 120)
+
+	RequireTLS *bool `json:"requireTLS,omitempty"` // Redirect the challenge to HTTPS and refuse codes over plain HTTP (default: same as cookieSecure)
+
+	NoticeFile string `json:"noticeFile,omitempty"` // File whose contents are shown as a banner on the challenge page (no banner when absent or empty)
+	NoticeHTML bool   `json:"noticeHTML,omitempty"` // Render the notice file as trusted HTML instead of plain text (default: false)
+
+	ReadOnlySecretKey string `json:"readOnlySecretKey,omitempty"` // Base32 secret whose codes create read-only (GET/HEAD) sessions (disabled when empty)
+	ScopeHeader       string `json:"scopeHeader,omitempty"`       // Header telling the backend the session scope, "full" or "readonly"; stripped from incoming requests (default: X-TOTP-Scope)
+
+	AssertionHeader     string   `json:"assertionHeader,omitempty"`     // Header carrying a signed JWT for the backend's own session system; stripped from incoming requests (disabled when empty)
+	AssertionSigningKey string   `json:"assertionSigningKey,omitempty"` // HMAC-SHA256 key shared with the backend for signing assertions
+	AssertionTTL        int      `json:"assertionTTL,omitempty"`        // Assertion lifetime in seconds (default: 60)
+	AssertionClaims     []string `json:"assertionClaims,omitempty"`     // Claims added to iat and exp: sub, scope, sid, ip, iss (default: sub, scope)
+
+	VerifierURL       string `json:"verifierURL,omitempty"`       // External service that validates codes instead of the local secret (disabled when empty)
+	VerifierToken     string `json:"verifierToken,omitempty"`     // Bearer token sent to the verifier
+	VerifierTimeoutMs int    `json:"verifierTimeoutMs,omitempty"` // Verifier request timeout in milliseconds (default: 2000)
+	VerifierOnError   string `json:"verifierOnError,omitempty"`   // What to do when the verifier fails: "deny", "local" or "allow" (default: deny)
+
+	EmbedAllowedOrigins []string `json:"embedAllowedOrigins,omitempty"` // Origins allowed to frame the challenge with ?embedded=1 (embedding disabled when empty)
+	EmbedTargetOrigin   string   `json:"embedTargetOrigin,omitempty"`   // Origin the completion message is posted to (default: first of embedAllowedOrigins)
+
+	PathSecrets map[string]string `json:"pathSecrets,omitempty"` // Separate base32 secrets per path prefix; the longest matching prefix wins and other paths use secretKey
+
+	RequireApproval bool `json:"requireApproval,omitempty"` // Hold logins from unknown devices until approved through a link sent to webhookURL (default: false)
+	ApprovalTimeout int  `json:"approvalTimeout,omitempty"` // Seconds a login waits for approval (default: 300)
+
+	StepUpHeader string `json:"stepUpHeader,omitempty"` // Backend response header demanding a fresh code for the current session, e.g. "X-TOTP-StepUp" (disabled when empty)
+	StepUpMaxAge int    `json:"stepUpMaxAge,omitempty"` // Step-up demands are ignored this many seconds after a code was entered (default: 60)
+
+	SecretFile          string `json:"secretFile,omitempty"`          // JSON file holding the current secret and rotation state; takes precedence over secretKey once it exists
+	SecretRotationDays  int    `json:"secretRotationDays,omitempty"`  // Generate a new secret this often, requires secretFile (disabled when 0)
+	RotationOverlapDays int    `json:"rotationOverlapDays,omitempty"` // Days the previous secret is still accepted after a rotation (default: 7)
+	RevokeOnRotate      bool   `json:"revokeOnRotate,omitempty"`      // Revoke all sessions when the secret is rotated (default: false)
+
+	Mode            string `json:"mode,omitempty"`            // Code generation: "totp" (time-based) or "hotp" (counter-based hardware tokens) (default: totp)
+	InitialCounter  int64  `json:"initialCounter,omitempty"`  // HOTP counter of the token's first code, used until hotpCounterFile exists (default: 0)
+	HOTPLookAhead   int    `json:"hotpLookAhead,omitempty"`   // Counter values past the expected one that are tried, for button presses that were never submitted (default: 10)
+	HOTPCounterFile string `json:"hotpCounterFile,omitempty"` // JSON file persisting the next expected HOTP counter, required in hotp mode
+
+	CodeFormat string `json:"codeFormat,omitempty"` // Code format: "numeric" or "steam" (5 characters from the Steam Guard alphabet) (default: numeric)
+
+	Algorithm         string                   `json:"algorithm,omitempty"`         // HMAC algorithm of codes: SHA1, SHA256 or SHA512 (default: SHA1)
+	PathTokenSettings map[string]TokenSettings `json:"pathTokenSettings,omitempty"` // Digits, period and algorithm of the tokens enrolled for pathSecrets prefixes; unset values use the plugin-level ones
+
+	TimeOffsetSeconds int `json:"timeOffsetSeconds,omitempty"` // Seconds added to the host clock before computing time steps, to compensate known drift (-300 to 300, default: 0)
+
+	SkipSelfTest bool `json:"skipSelfTest,omitempty"` // Skip the startup check of code generation against the RFC 6238 test vectors and the configured secrets (default: false)
+
+	AdditionalSecretKeys []string `json:"additionalSecretKeys,omitempty"` // Further base32 secrets whose codes are accepted like secretKey's, e.g. the old secret during a manual rotation
+
+	SecretEncoding string `json:"secretEncoding,omitempty"` // Encoding of the configured secrets: "base32" or "hex" (default: base32)
+
+	SecretKeyEncrypted string `json:"secretKeyEncrypted,omitempty"` // secretKey encrypted with EncryptSecret (base64 AES-GCM), used instead of secretKey
+	MasterKeyFile      string `json:"masterKeyFile,omitempty"`      // File holding the base64 master key that decrypts secretKeyEncrypted
+	MasterKeyEnv       string `json:"masterKeyEnv,omitempty"`       // Environment variable holding the base64 master key that decrypts secretKeyEncrypted
+
+	LoginPath             string `json:"loginPath,omitempty"`             // Path the challenge form submits codes to; only POSTs to this path are code submissions (default: /.totp/login)
+	UnauthenticatedWrites string `json:"unauthenticatedWrites,omitempty"` // Answer to browsers POSTing, PUTting or PATCHing without a session: "challenge" (page with a warning that the data was not saved) or "reject" (401 page) (default: challenge)
+
+	RedirectStatus int `json:"redirectStatus,omitempty"` // Status of the redirect to the original URL after a successful login: 302, 303 or 307 (default: 303)
+
+	SubmitMinDelayMs int `json:"submitMinDelayMs,omitempty"` // Reject code submissions arriving sooner than this many milliseconds after the form was rendered (default: 0, disabled)
+	SubmitMaxAge     int `json:"submitMaxAge,omitempty"`     // Reject code submissions from forms rendered more than this many seconds ago (default: 0, no limit)
+
+	SessionMode          string `json:"sessionMode,omitempty"`          // Where sessions are kept: "memory" (server-side store), "signed" (HMAC-signed cookie), "encrypted" (AES-GCM sealed cookie) or "jwt" (HS256 JWT cookie); cookie modes survive restarts and work across replicas (default: memory)
+	SessionSigningKey    string `json:"sessionSigningKey,omitempty"`    // Key signed and JWT session cookies are signed with, at least 32 characters; must be the same on all replicas
+	SessionEncryptionKey string `json:"sessionEncryptionKey,omitempty"` // Base64 encoded 32-byte key encrypted session cookies are sealed with; must be the same on all replicas
+
+	SessionSigningKeys    []string `json:"sessionSigningKeys,omitempty"`    // Further signing keys, accepted for verification during a key rotation; without sessionSigningKey the first one issues cookies
+	SessionEncryptionKeys []string `json:"sessionEncryptionKeys,omitempty"` // Further encryption keys, accepted for decryption during a key rotation; without sessionEncryptionKey the first one issues cookies
+	FormSigningKey        string   `json:"formSigningKey,omitempty"`        // Key CSRF tokens, signed form fields and approval links are signed with, at least 32 characters; must be the same on all replicas (default: derived from the session keys, sessionStoreToken or redisPassword, otherwise random per instance)
+
+	SessionFile string `json:"sessionFile,omitempty"` // JSON file sessions are persisted to, so they survive restarts (in memory only when empty)
+
+	SessionStore          string `json:"sessionStore,omitempty"`          // Where server-side sessions are kept: "memory" or "http" (default: memory)
+	SessionStoreURL       string `json:"sessionStoreURL,omitempty"`       // Base URL of the session service, required with sessionStore http
+	SessionStoreToken     string `json:"sessionStoreToken,omitempty"`     // Bearer token sent to the session service
+	SessionStoreTimeoutMs int    `json:"sessionStoreTimeoutMs,omitempty"` // Session service request timeout in milliseconds (default: 500)
+	SessionStoreCacheTTL  int    `json:"sessionStoreCacheTTL,omitempty"`  // Seconds a session lookup is cached per instance, 0 disables the cache (default: 5)
+	SessionStoreOnError   string `json:"sessionStoreOnError,omitempty"`   // What to do when the session service fails: "deny" or "allow" (default: deny)
+
+	RedisAddress       string `json:"redisAddress,omitempty"`       // host:port of the redis server, required with sessionStore redis
+	RedisPassword      string `json:"redisPassword,omitempty"`      // Password sent with AUTH (none when empty)
+	RedisDB            int    `json:"redisDB,omitempty"`            // Redis database index (default: 0)
+	RedisKeyPrefix     string `json:"redisKeyPrefix,omitempty"`     // Prefix of the session keys (default: totp:session:)
+	RedisDialTimeoutMs int    `json:"redisDialTimeoutMs,omitempty"` // Redis connect timeout in milliseconds (default: 500)
+	RedisReadTimeoutMs int    `json:"redisReadTimeoutMs,omitempty"` // Redis command timeout in milliseconds (default: 500)
+
+	IdleRenewThreshold int `json:"idleRenewThreshold,omitempty"` // Renew a session's idle deadline and cookie once less than this percentage of idleTimeout remains, 100 renews on every request (default: 50)
+
+	SingleSession bool `json:"singleSession,omitempty"` // Revoke all other sessions whenever a new one is created, so only the latest login stays signed in (default: false)
+	MaxSessions   int  `json:"maxSessions,omitempty"`   // Maximum number of active sessions; a new login beyond it evicts the oldest (unlimited when 0)
+
+	MaxTotalSessions int `json:"maxTotalSessions,omitempty"` // Maximum number of sessions kept in memory; beyond it the least recently used one is evicted (default: 100000)
+	MaxSessionsPerIP int `json:"maxSessionsPerIP,omitempty"` // Refuse new sessions for a client IP that already holds this many, except in lockoutExemptNetworks; 0 disables the limit (default: 10)
+
+	CleanupMode     string `json:"cleanupMode,omitempty"`     // "background" sweeps on a shared timer, "lazy" prunes during request handling without background goroutines (default: background)
+	CleanupInterval string `json:"cleanupInterval,omitempty"` // Time between sweeps of expired sessions and caches, in seconds or as a duration like "1m" (default: 300)
+
+	LogoutPath string `json:"logoutPath,omitempty"` // Path that ends the current session: GET asks for confirmation, POST signs out (default: /.totp/logout)
+
+	LockdownDuration string `json:"lockdownDuration,omitempty"` // How long a lockdown started through the admin API lasts, in seconds or as a duration like "30m" (default: 3600)
+	LockdownMessage  string `json:"lockdownMessage,omitempty"`  // Message shown with a 503 to every request during a lockdown (default: "This service is temporarily unavailable. Please try again later.")
+
+	MaxFailedAttempts   int    `json:"maxFailedAttempts,omitempty"`   // Invalid codes from one client IP within failedAttemptWindow that lock it out, except in lockoutExemptNetworks (default: 5)
+	FailedAttemptWindow string `json:"failedAttemptWindow,omitempty"` // Window over which failed codes are counted, in seconds or as a duration like "5m" (default: 300)
+	LockoutDuration     string `json:"lockoutDuration,omitempty"`     // How long a client that reached maxFailedAttempts can't submit codes, in seconds or as a duration like "15m" (default: 900)
+	MaxFailureDelay     string `json:"maxFailureDelay,omitempty"`     // Longest delay of the answer to consecutive wrong or malformed codes, which doubles from 2 seconds with each one, in seconds or as a duration like "30s" (default: 30)
+	DisableFailureDelay bool   `json:"disableFailureDelay,omitempty"` // Answer failed codes right away instead of with a growing delay (default: false)
+	LockoutScope        string `json:"lockoutScope,omitempty"`        // What maxFailedAttempts locks out: "ip" (the client IP) or "identity" (the secret, for every client) (default: ip)
+	GlobalFailureRate   int    `json:"globalFailureRate,omitempty"`   // Failed codes per minute across all clients; beyond it and globalFailureBurst, codes are refused until the budget refills (default: 0, disabled)
+	GlobalFailureBurst  int    `json:"globalFailureBurst,omitempty"`  // Failed codes across all clients allowed at once before globalFailureRate applies (default: same as globalFailureRate)
 }
 
 // CreateConfig creates the default plugin configuration
 func CreateConfig() *Config {
 	return &Config{
-		SessionExpiry:   3600, // 1 hour
+		SessionExpiry:   "1h",
 		CookieName:      "totp_session",
 		CookieSecure:    true,
-		TimeStep:        30,
+		TimeStep:        "30s",
 		CodeDigits:      6,
 		AllowedSkew:     1,
 		PageTitle:       "TOTP Authentication Required",
 		PageDescription: "Please enter your TOTP code to continue",
 		ValidateIP:      false, // Disabled by default for better compatibility
+
+		ReputationTimeoutMs:      500,
+		ReputationDefaultVerdict: verdictChallenge,
+		ReputationCacheTTL:       300,
+		ReputationCacheSize:      10000,
+
+		StatsdPrefix:        "totp",
+		StatsdFlushInterval: 10,
+
+		ClockCheckInterval: 3600,
+
+		TrustedProxiesRefreshInterval: 300,
+
+		StrictOriginCheck: originCheckOff,
+
+		AuditMaxSizeMB:     100,
+		AuditMaxFiles:      5,
+		AuditFlushInterval: 5,
+		AuditIPMode:        auditIPFull,
+
+		IdentityHeader: "X-TOTP-User",
+		JWTHeader:      "Authorization",
+
+		SignatureMaxAge: 300,
+
+		IPChangeWindow:   3600,
+		IPChangePrefixV4: 16,
+		IPChangePrefixV6: 48,
+
+		PortalTokenMaxAge: 60,
+
+		RedirectLoopThreshold: 3,
+
+		CalibrationWindow: 10,
+
+		PairingTTL: 120,
+
+		ScopeHeader: "X-TOTP-Scope",
+
+		AssertionTTL:    60,
+		AssertionClaims: []string{"sub", "scope"},
+
+		VerifierTimeoutMs: 2000,
+		VerifierOnError:   verifierOnErrorDeny,
+
+		ApprovalTimeout: 300,
+
+		StepUpMaxAge: 60,
+
+		RotationOverlapDays: 7,
+
+		LoginPath:             defaultLoginPath,
+		UnauthenticatedWrites: unauthenticatedWritesChallenge,
+
+		RedirectStatus: http.StatusSeeOther,
+
+		SessionStore:          sessionStoreMemory,
+		SessionStoreTimeoutMs: 500,
+		SessionStoreCacheTTL:  5,
+		SessionStoreOnError:   sessionStoreOnErrorDeny,
+
+		RedisKeyPrefix:     "totp:session:",
+		RedisDialTimeoutMs: 500,
+		RedisReadTimeoutMs: 500,
+
+		IdleRenewThreshold: 50,
+
+		MaxTotalSessions: 100000,
+		MaxSessionsPerIP: 10,
+
+		CleanupMode:     cleanupModeBackground,
+		CleanupInterval: "5m",
+
+		LogoutPath: defaultLogoutPath,
+
+		LockdownDuration: "1h",
+		LockdownMessage:  defaultLockdownMessage,
+
+		MaxFailedAttempts:   5,
+		FailedAttemptWindow: "5m",
+		LockoutDuration:     "15m",
+		MaxFailureDelay:     "30s",
+		LockoutScope:        lockoutScopeIP,
 	}
 }
 
 // TOTPAuth is the plugin structure
 type TOTPAuth struct {
-	next           http.Handler
-	name           string
-	config         *Config
-	sessions       *sessionStore
-	trustedNetworks []*net.IPNet // Parsed CIDR networks for trusted proxies
+	next             http.Handler
+	name             string
+	config           *Config
+	sessionExpiry    int             // Parsed sessionExpiry in seconds
+	idleTimeout      int             // Parsed idleTimeout in seconds, 0 when disabled
+	timeStep         int             // Parsed timeStep in seconds
+	cleanupInterval  int             // Parsed cleanupInterval in seconds
+	lastCleanup      int64           // Unix nanoseconds of the last sweep in lazy cleanup mode, accessed atomically
+	cleanupTask      uint64          // ID of the background cleanup task, 0 in lazy cleanup mode
+	lockdownDuration int             // Parsed lockdownDuration in seconds
+	lockdownUntil    int64           // Unix nanoseconds at which the lockdown ends, 0 without one, accessed atomically
+	maxFailureDelay  int             // Parsed maxFailureDelay in seconds, 0 with disableFailureDelay
+	done             <-chan struct{} // Closed when the plugin shuts down, e.g. on a configuration reload
+	sessions         SessionStore
+	trustedProxies   *trustedProxySet // Trusted proxy networks (CIDRs, IPs and resolved hostnames)
+	exemptNetworks   []*net.IPNet     // Parsed CIDR networks exempt from lockouts
+	reputation       *reputationChecker
+	statsd           *statsdEmitter
+	auditLog         *auditLogger
+	jwt              *jwtVerifier
+	verifier         *codeVerifier
+	webhook          *webhookNotifier
+	portalReplay     *replayCache // Portal assertion nonces already used
+	usedCodes        *replayCache // Replay keys of accepted codes, e.g. verifier nonces
+	validators       []validator  // Validator chain codes are checked against, in order
+	drift            *driftState  // Calibrated clock drift of the authenticator
+	keys             *keyCache    // Decoded secrets
+	clock            *pluginClock // Time source of sessions, cleanup and time steps
+	hotp             *hotpState   // Next expected counter in hotp mode, nil otherwise
+	secret           *secretState // Current and, after a rotation, previous secret
+	pairings         *pairingStore
+	submissions      *submissionCache // Recently submitted challenge forms
+	failures         *failureTracker  // Failed codes per client, for lockouts
+	globalFailures   *globalLimiter   // Failed codes across all clients (nil without globalFailureRate)
+	approvals        *approvalStore   // Logins waiting for approval (nil unless requireApproval)
+	notice           *noticeBanner
+	enrollment       *enrollmentState
+	formKey          []byte       // Key for signed form fields and CSRF tokens, random per instance unless shared through formSigningKey, the session keys or the session store credential
+	sessionKeys      []sessionKey // Keys of sessions kept in the cookie, the issuing key first
+	evictions        evictionLog  // Sessions evicted by maxTotalSessions
+	deletions        chan string  // Token hashes of invalidated sessions, removed by the cleanup
+	pages            *pageTemplates // Page templates, parsed once in New
 }
 
 // Session represents an authenticated session
 type Session struct {
-	Token     string
-	CreatedAt time.Time
-	ExpiresAt time.Time
-	IP        string
-}
-
-// sessionStore manages active sessions
-type sessionStore struct {
-	mu       sync.RWMutex
-	sessions map[string]*Session
+	TokenHash     string // Hex SHA-256 of the session token; the token itself is never stored
+	CreatedAt     time.Time
+	ExpiresAt     time.Time // Absolute expiry
+	IdleExpiresAt time.Time // Expiry when unused, pushed back as the session is used (zero without idleTimeout)
+	IP            string
+	UserAgent     string
+	ReadOnly      bool     // Created from readOnlySecretKey: only safe methods are allowed
+	Areas         []string // pathSecrets prefixes the session has been unlocked for ("" is the default area)
+	Method        string   // How the session was established, e.g. "totp", "verifier", "pairing" or "portal"
+
+	networks   []networkObservation // Recent distinct source networks, guarded by the store lock
+	verifiedAt time.Time            // Last time a code was entered for the session, guarded by the store lock
+	stepUp     bool                 // The backend demanded a fresh code, guarded by the store lock
 }
 
 // New creates a new TOTPAuth plugin
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
+	splitListFields(config)
+	if err := validateConfig(config, name); err != nil {
+		return nil, err
+	}
+
+	if err := validateSecretEncoding(config); err != nil {
+		return nil, err
+	}
+	if err := resolveSecretRefs(config, name); err != nil {
+		return nil, err
+	}
+	if err := decryptSecretKey(config); err != nil {
+		return nil, err
+	}
+	if err := convertHexSecrets(config); err != nil {
+		return nil, err
+	}
+	normalizeSecrets(config)
+
 	if config.SecretKey == "" {
 		return nil, fmt.Errorf("secretKey is required")
 	}
 
-	// Validate secret key is valid base32
-	_, err := base32.StdEncoding.DecodeString(strings.ToUpper(config.SecretKey))
-	if err != nil {
-		return nil, fmt.Errorf("invalid secret key (must be base32 encoded): %w", err)
+	// Validate secret key is valid base32
+	_, err := decodeSecret(config.SecretKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key (must be base32 encoded): %w", err)
+	}
+
+	if config.ReadOnlySecretKey != "" {
+		if _, err := decodeSecret(config.ReadOnlySecretKey); err != nil {
+			return nil, fmt.Errorf("invalid readOnlySecretKey (must be base32 encoded): %w", err)
+		}
+		if strings.EqualFold(config.ReadOnlySecretKey, config.SecretKey) {
+			return nil, fmt.Errorf("readOnlySecretKey must differ from secretKey")
+		}
+	}
+
+	if err := validatePathSecrets(config); err != nil {
+		return nil, err
+	}
+	if err := validateAdditionalSecrets(config); err != nil {
+		return nil, err
+	}
+
+	sessionExpiry, err := parseSeconds("sessionExpiry", config.SessionExpiry, 3600)
+	if err != nil {
+		return nil, err
+	}
+	idleTimeout, err := parseSeconds("idleTimeout", config.IdleTimeout, 0)
+	if err != nil {
+		return nil, err
+	}
+	if config.IdleRenewThreshold <= 0 {
+		config.IdleRenewThreshold = 50
+	}
+	if config.MaxTotalSessions <= 0 {
+		config.MaxTotalSessions = 100000
+	}
+	timeStep, err := parseSeconds("timeStep", config.TimeStep, 30)
+	if err != nil {
+		return nil, err
+	}
+	cleanupInterval, err := parseSeconds("cleanupInterval", config.CleanupInterval, int(defaultCleanupInterval/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	lockdownDuration, err := parseSeconds("lockdownDuration", config.LockdownDuration, 3600)
+	if err != nil {
+		return nil, err
+	}
+	if config.LockdownMessage == "" {
+		config.LockdownMessage = defaultLockdownMessage
+	}
+	if config.MaxFailedAttempts <= 0 {
+		config.MaxFailedAttempts = 5
+	}
+	failedAttemptWindow, err := parseSeconds("failedAttemptWindow", config.FailedAttemptWindow, 300)
+	if err != nil {
+		return nil, err
+	}
+	lockoutDuration, err := parseSeconds("lockoutDuration", config.LockoutDuration, 900)
+	if err != nil {
+		return nil, err
+	}
+	maxFailureDelay, err := parseSeconds("maxFailureDelay", config.MaxFailureDelay, 30)
+	if err != nil {
+		return nil, err
+	}
+	if config.DisableFailureDelay {
+		maxFailureDelay = 0
+	}
+
+	if config.CodeDigits <= 0 {
+		config.CodeDigits = 6
+	}
+	if err := validateCodeFormat(config); err != nil {
+		return nil, err
+	}
+	if err := validateTokenSettings(config); err != nil {
+		return nil, err
+	}
+
+	for _, name := range config.LegacyCookieNames {
+		if name == config.CookieName {
+			return nil, fmt.Errorf("legacyCookieNames must not contain the current cookieName (%s)", name)
+		}
+	}
+
+	if config.PostLogoutRedirectURL != "" && !isAllowedRedirect(config.PostLogoutRedirectURL, config.AllowedRedirectHosts) {
+		return nil, fmt.Errorf("postLogoutRedirectURL must be a relative path or use a host from allowedRedirectHosts: %s", config.PostLogoutRedirectURL)
+	}
+
+	switch config.StrictOriginCheck {
+	case "":
+		config.StrictOriginCheck = originCheckOff
+	case originCheckOff, originCheckLog, originCheckEnforce:
+	default:
+		return nil, fmt.Errorf("invalid strictOriginCheck (must be %q, %q or %q): %s", originCheckOff, originCheckLog, originCheckEnforce, config.StrictOriginCheck)
+	}
+
+	// Parse trusted proxy CIDR ranges, IPs and hostnames
+	trustedProxies, err := newTrustedProxySet(ctx, config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse lockout exemption CIDR ranges
+	var exemptNetworks []*net.IPNet
+	for _, cidr := range config.LockoutExemptNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR in lockoutExemptNetworks (%s): %w", cidr, err)
+		}
+		exemptNetworks = append(exemptNetworks, network)
+	}
+
+	var reputation *reputationChecker
+	if config.ReputationURL != "" {
+		if config.ReputationTimeoutMs <= 0 {
+			config.ReputationTimeoutMs = 500
+		}
+		if config.ReputationDefaultVerdict == "" {
+			config.ReputationDefaultVerdict = verdictChallenge
+		}
+		if config.ReputationCacheTTL <= 0 {
+			config.ReputationCacheTTL = 300
+		}
+		if config.ReputationCacheSize <= 0 {
+			config.ReputationCacheSize = 10000
+		}
+		reputation, err = newReputationChecker(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var jwt *jwtVerifier
+	if config.JWTSecret != "" || config.JWTPublicKey != "" {
+		if config.JWTHeader == "" {
+			config.JWTHeader = "Authorization"
+		}
+		jwt, err = newJWTVerifier(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.SignatureMaxAge <= 0 {
+		config.SignatureMaxAge = 300
+	}
+
+	if config.MaxIPChanges > 0 {
+		if config.IPChangeWindow <= 0 {
+			config.IPChangeWindow = 3600
+		}
+		if config.IPChangePrefixV4 <= 0 || config.IPChangePrefixV4 > 32 {
+			return nil, fmt.Errorf("ipChangePrefixV4 must be between 1 and 32: %d", config.IPChangePrefixV4)
+		}
+		if config.IPChangePrefixV6 <= 0 || config.IPChangePrefixV6 > 128 {
+			return nil, fmt.Errorf("ipChangePrefixV6 must be between 1 and 128: %d", config.IPChangePrefixV6)
+		}
+	}
+
+	if config.PortalURL != "" {
+		if len(config.PathSecrets) > 0 {
+			return nil, fmt.Errorf("pathSecrets cannot be combined with portalURL")
+		}
+		parsed, err := url.Parse(config.PortalURL)
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			return nil, fmt.Errorf("portalURL must be an absolute http(s) URL: %s", config.PortalURL)
+		}
+		if config.PortalSigningKey == "" {
+			return nil, fmt.Errorf("portalSigningKey is required when portalURL is set")
+		}
+	}
+	if config.PortalSigningKey != "" && len(config.PortalSigningKey) < 32 {
+		return nil, fmt.Errorf("portalSigningKey must be at least 32 characters")
+	}
+	if config.PortalTokenMaxAge <= 0 {
+		config.PortalTokenMaxAge = 60
+	}
+
+	if config.RedirectLoopThreshold <= 0 {
+		config.RedirectLoopThreshold = 3
+	}
+
+	if config.CalibrationWindow <= 0 {
+		config.CalibrationWindow = 10
+	}
+	drift, err := loadDriftState(config.DriftFile)
+	if err != nil {
+		return nil, err
+	}
+	if steps := drift.get(); steps != 0 {
+		log.Printf("[%s] Applying calibrated clock drift of %d time step(s)", name, steps)
+	}
+
+	if config.RequireTLS == nil {
+		requireTLS := config.CookieSecure
+		config.RequireTLS = &requireTLS
+	}
+
+	var verifier *codeVerifier
+	if config.VerifierURL != "" {
+		if config.VerifierTimeoutMs <= 0 {
+			config.VerifierTimeoutMs = 2000
+		}
+		if config.VerifierOnError == "" {
+			config.VerifierOnError = verifierOnErrorDeny
+		}
+		verifier, err = newCodeVerifier(config)
+		if err != nil {
+			return nil, err
+		}
+		if verifier.onError == verifierOnErrorAllow {
+			log.Printf("[%s] WARNING: verifierOnError is allow - any code is accepted while the verifier is unavailable", name)
+		}
+	}
+
+	if err := validateEmbedConfig(config); err != nil {
+		return nil, err
+	}
+
+	if err := validateAssertionConfig(config); err != nil {
+		return nil, err
+	}
+	if config.AssertionTTL <= 0 {
+		config.AssertionTTL = 60
+	}
+
+	if config.PairingTTL <= 0 {
+		config.PairingTTL = 120
+	}
+
+	if config.StaticTestCode != "" {
+		if !config.AllowInsecureTestCode {
+			return nil, fmt.Errorf("staticTestCode requires allowInsecureTestCode: true")
+		}
+		log.Printf("[%s] WARNING: staticTestCode is enabled - anyone knowing it can log in; never use this in production", name)
+	}
+
+	if config.RequireApproval && config.WebhookURL == "" {
+		return nil, fmt.Errorf("requireApproval needs webhookURL to deliver approval links")
+	}
+	if config.ApprovalTimeout <= 0 {
+		config.ApprovalTimeout = 300
+	}
+	if config.StepUpMaxAge <= 0 {
+		config.StepUpMaxAge = 60
+	}
+
+	if config.SecretRotationDays > 0 && config.SecretFile == "" {
+		return nil, fmt.Errorf("secretRotationDays requires secretFile to persist rotated secrets")
+	}
+	clock := newPluginClock()
+	secret, err := loadSecretState(config, clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	if current, _ := secret.secrets(clock.Now()); current != config.SecretKey {
+		log.Printf("[%s] Using the secret from %s instead of secretKey", name, config.SecretFile)
+	}
+
+	if err := validateModeConfig(config); err != nil {
+		return nil, err
+	}
+	if err := validateConfirmEnrollment(config); err != nil {
+		return nil, err
+	}
+	if err := validateSessionMode(config); err != nil {
+		return nil, err
+	}
+	if err := validateSessionStore(config); err != nil {
+		return nil, err
+	}
+
+	var hotp *hotpState
+	if config.Mode == modeHOTP {
+		hotp, err = loadHOTPState(config.HOTPCounterFile, config.InitialCounter)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[%s] Using counter-based HOTP codes, next expected counter %d", name, hotp.next())
+	}
+
+	sessionKeys, formKey, err := newSessionKeys(config)
+	if err != nil {
+		return nil, err
+	}
+	sharedKey, err := sharedFormKey(config)
+	if err != nil {
+		return nil, err
+	}
+	if sharedKey != nil {
+		formKey = sharedKey
+	}
+	if formKey == nil {
+		formKey = make([]byte, 32)
+		if _, err := rand.Read(formKey); err != nil {
+			return nil, fmt.Errorf("failed to generate form key: %w", err)
+		}
+	}
+
+	pages, err := parsePageTemplates()
+	if err != nil {
+		return nil, err
+	}
+
+	plugin := &TOTPAuth{
+		next:             next,
+		name:             name,
+		config:           config,
+		sessionExpiry:    sessionExpiry,
+		idleTimeout:      idleTimeout,
+		timeStep:         timeStep,
+		cleanupInterval:  cleanupInterval,
+		lockdownDuration: lockdownDuration,
+		maxFailureDelay:  maxFailureDelay,
+		done:             ctx.Done(),
+		sessions:         newMemorySessionStore(clock),
+		trustedProxies:   trustedProxies,
+		exemptNetworks:   exemptNetworks,
+		reputation:       reputation,
+		formKey:          formKey,
+		sessionKeys:      sessionKeys,
+		jwt:              jwt,
+		verifier:         verifier,
+		drift:            drift,
+		clock:            clock,
+		keys:             newKeyCache(),
+		hotp:             hotp,
+		secret:           secret,
+		pairings:         newPairingStore(),
+		submissions:      newSubmissionCache(),
+		failures:         newFailureTracker(config.MaxFailedAttempts, time.Duration(failedAttemptWindow)*time.Second, time.Duration(lockoutDuration)*time.Second),
+		enrollment:       &enrollmentState{},
+		portalReplay: &replayCache{
+			seen: make(map[string]time.Time),
+		},
+		usedCodes: &replayCache{
+			seen: make(map[string]time.Time),
+		},
+		deletions: make(chan string, sessionDeletionQueueSize),
+		pages:     pages,
+	}
+	plugin.validators = plugin.buildValidators()
+	// A calibration persisted in driftFile was made when enrollment was confirmed
+	if _, calibratedAt := drift.snapshot(); !calibratedAt.IsZero() {
+		plugin.enrollment.confirm(calibratedAt)
+	}
+	plugin.memorySessions().setLimit(config.MaxTotalSessions, plugin.sessionEvicted)
+
+	if config.SessionFile != "" {
+		plugin.memorySessions().restoreSessionFile(config.SessionFile, name, plugin.clock.Now())
+		if until := plugin.memorySessions().lockdown(); until.After(plugin.clock.Now()) {
+			plugin.lockdownUntil = until.UnixNano()
+			log.Printf("[%s] Lockdown restored from %s: refusing all requests until %s", name, config.SessionFile, until.UTC().Format(time.RFC3339))
+		}
+	}
+	switch config.SessionStore {
+	case sessionStoreHTTP:
+		plugin.sessions = newHTTPSessionStore(config, name, clock)
+		if config.SessionStoreOnError == sessionStoreOnErrorAllow {
+			log.Printf("[%s] WARNING: sessionStoreOnError is allow - cached sessions stay valid and new ones are kept locally while the session store is unavailable", name)
+		}
+	case sessionStoreRedis:
+		plugin.sessions = newRedisSessionStore(config, name, clock)
+	}
+
+	if !config.SkipSelfTest {
+		if err := plugin.selfTest(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.StatsdAddress != "" {
+		if config.StatsdFlushInterval <= 0 {
+			config.StatsdFlushInterval = 10
+		}
+		plugin.statsd = newStatsdEmitter(config, func() map[string]int64 {
+			if _, ok := plugin.sessions.(*redisSessionStore); ok {
+				return nil // Counting redis keys needs a full SCAN
+			}
+			return map[string]int64{metricSessionsActive: int64(plugin.sessions.Count())}
+		})
+		go plugin.statsd.run(ctx)
+	}
+
+	if len(trustedProxies.hosts) > 0 {
+		if config.TrustedProxiesRefreshInterval <= 0 {
+			config.TrustedProxiesRefreshInterval = 300
+		}
+		go trustedProxies.runRefresh(ctx, name, time.Duration(config.TrustedProxiesRefreshInterval)*time.Second)
+	}
+
+	if config.AuditFile != "" {
+		if config.AuditMaxSizeMB <= 0 {
+			config.AuditMaxSizeMB = 100
+		}
+		if config.AuditMaxFiles <= 0 {
+			config.AuditMaxFiles = 5
+		}
+		if config.AuditFlushInterval <= 0 {
+			config.AuditFlushInterval = 5
+		}
+		plugin.auditLog = newAuditLogger(config, name)
+		go plugin.auditLog.run(ctx, time.Duration(config.AuditFlushInterval)*time.Second)
+	}
+
+	if config.RequireApproval {
+		plugin.approvals = newApprovalStore()
+	}
+
+	if config.GlobalFailureRate > 0 {
+		if config.GlobalFailureBurst <= 0 {
+			config.GlobalFailureBurst = config.GlobalFailureRate
+		}
+		plugin.globalFailures = newGlobalLimiter(config.GlobalFailureRate, config.GlobalFailureBurst, plugin.clock.Now())
+	}
+
+	if config.WebhookURL != "" {
+		plugin.webhook = newWebhookNotifier(config, name)
+		go plugin.webhook.run(ctx)
+	}
+
+	if config.NoticeFile != "" {
+		plugin.notice = newNoticeBanner(config, name)
+	}
+
+	if config.ClockCheckURL != "" {
+		if config.ClockCheckInterval <= 0 {
+			config.ClockCheckInterval = 3600
+		}
+		go plugin.runClockCheck(ctx)
+	}
+
+	if config.CleanupMode == cleanupModeLazy {
+		// Requests do the cleanup, nothing runs in the background
+		plugin.lastCleanup = plugin.clock.Now().UnixNano()
+	} else {
+		plugin.cleanupTask = sharedCleanup.register(ctx, time.Duration(cleanupInterval)*time.Second, func(time.Time) {
+			plugin.cleanupExpiredSessions(plugin.clock.Now())
+		})
+	}
+	context.AfterFunc(ctx, plugin.flushSessions)
+
+	return plugin, nil
+}
+
+// ServeHTTP handles the HTTP request
+func (ta *TOTPAuth) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if ta.config.CleanupMode == cleanupModeLazy {
+		ta.cleanupOnRequest()
+	}
+
+	// Never let clients supply the identity forwarded to the backend
+	if ta.config.IdentityHeader != "" {
+		req.Header.Del(ta.config.IdentityHeader)
+	}
+	if ta.config.ScopeHeader != "" {
+		req.Header.Del(ta.config.ScopeHeader)
+	}
+	if ta.config.AssertionHeader != "" {
+		req.Header.Del(ta.config.AssertionHeader)
+	}
+
+	// Admin API is authenticated by its own token, never by the session cookie
+	if ta.isAdminRequest(req) {
+		ta.handleAdmin(rw, req)
+		return
+	}
+
+	// During a lockdown nothing but the admin API is served
+	if until, locked := ta.lockdownEnd(ta.clock.Now()); locked {
+		ta.serveLockdown(rw, until)
+		return
+	}
+
+	if req.URL.Path == ta.config.LogoutPath {
+		ta.handleLogout(rw, req)
+		return
+	}
+
+	switch req.URL.Path {
+	case sessionStatusPath:
+		ta.handleSessionStatus(rw, req)
+		return
+	case sessionExtendPath:
+		ta.handleSessionExtend(rw, req)
+		return
+	}
+
+	// Devices waiting for pairing poll without a session
+	if ta.config.EnablePairing && req.URL.Path == pairPollPath {
+		ta.handlePairPoll(rw, req)
+		return
+	}
+
+	// Approval links and browsers waiting for approval have no session
+	if ta.approvals != nil {
+		switch req.URL.Path {
+		case approvePath:
+			ta.handleApprove(rw, req)
+			return
+		case approvalPollPath:
+			ta.handleApprovalPoll(rw, req)
+			return
+		}
+	}
+
+	// Assertions from the login portal are converted into a local session
+	if ta.handlePortalAssertion(rw, req) {
+		return
+	}
+
+	// Codes are only accepted on the login path
+	if req.URL.Path == ta.config.LoginPath {
+		ta.handleLogin(rw, req)
+		return
+	}
+
+	// Check if user has a valid session for the area being accessed
+	area, _ := ta.areaFor(req.URL.Path)
+	if session := ta.sessionFromCookies(rw, req); session != nil && session.coversArea(area) {
+		ta.clearLoopMarker(rw, req)
+
+		// Read-only sessions may only read, including on the plugin's own pages
+		if session.ReadOnly && req.Method != http.MethodGet && req.Method != http.MethodHead {
+			log.Printf("[%s] Rejected %s %s from read-only session at %s", ta.name, req.Method, req.URL.Path, ta.getClientIP(req))
+			ta.audit(req, auditAccessDenied, "read_only", req.Method+" "+req.URL.Path)
+			ta.showMessagePage(rw, http.StatusForbidden, "Read-Only Access", "Your session only allows viewing. Changes are not permitted.")
+			return
+		}
+
+		// The backend demanded a fresh code before this session may continue
+		if ta.config.StepUpHeader != "" {
+			if required, _ := ta.memorySessions().stepUpState(session.TokenHash); required {
+				ta.challengeStepUp(rw, req, "")
+				return
+			}
+		}
+
+		// On the login portal, send already signed-in users straight back
+		if ta.redirectToPortalReturn(rw, req, session.ReadOnly) {
+			return
+		}
+		if ta.config.EnableDevicesPage && req.URL.Path == devicesPath {
+			ta.handleDevices(rw, req)
+			return
+		}
+		if ta.config.EnablePairing && req.URL.Path == pairPath {
+			ta.handlePair(rw, req, session)
+			return
+		}
+		if ta.config.ScopeHeader != "" {
+			req.Header.Set(ta.config.ScopeHeader, sessionScope(session))
+		}
+		ta.setAppAssertion(req, ta.config.AccountName, sessionScope(session), session.id())
+		ta.serveBackend(rw, req)
+		return
+	}
+
+	// Machine-to-machine calls authenticate with a request signature
+	if ta.handleSignedRequest(rw, req) {
+		return
 	}
 
-	if config.SessionExpiry <= 0 {
-		config.SessionExpiry = 3600
+	// Clients carrying a valid JWT from the identity provider skip the challenge
+	if ta.hasValidJWT(req) {
+		ta.serveBackend(rw, req)
+		return
 	}
 
-	if config.TimeStep <= 0 {
-		config.TimeStep = 30
+	// Consult the reputation service before challenging or accepting a code
+	if ta.isDeniedByReputation(req) {
+		ta.audit(req, auditAccessDenied, "reputation")
+		ta.showMessagePage(rw, http.StatusForbidden, "Access Denied", "Access from your network is not permitted.")
+		return
 	}
 
-	if config.CodeDigits <= 0 {
-		config.CodeDigits = 6
+	// In portal mode the challenge is shown by the central login portal
+	if ta.config.PortalURL != "" {
+		ta.redirectToPortal(rw, req)
+		return
 	}
 
-	if config.AllowedSkew < 0 {
-		config.AllowedSkew = 1
+	// Never show the form or accept codes over plain HTTP
+	if ta.enforceTLS(rw, req) {
+		return
 	}
 
-	// Parse trusted proxy CIDR ranges
-	var trustedNetworks []*net.IPNet
-	for _, cidr := range config.TrustedProxies {
-		_, network, err := net.ParseCIDR(cidr)
-		if err != nil {
-			return nil, fmt.Errorf("invalid CIDR in trustedProxies (%s): %w", cidr, err)
-		}
-		trustedNetworks = append(trustedNetworks, network)
+	// The body of an unauthenticated write is never passed on
+	if isWriteMethod(req.Method) {
+		ta.handleUnauthenticatedWrite(rw, req)
+		return
 	}
 
-	plugin := &TOTPAuth{
-		next:            next,
-		name:            name,
-		config:          config,
-		sessions:        &sessionStore{
-			sessions: make(map[string]*Session),
-		},
-		trustedNetworks: trustedNetworks,
+	// API clients can't fill in the challenge form
+	if !acceptsHTML(req) {
+		writeJSONError(rw, http.StatusUnauthorized, "authentication required")
+		return
 	}
 
-	// Start cleanup goroutine
-	go plugin.cleanupExpiredSessions(ctx)
-
-	return plugin, nil
-}
-
-// ServeHTTP handles the HTTP request
-func (ta *TOTPAuth) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
-	// Check if user has valid session
-	if ta.hasValidSession(req) {
-		ta.next.ServeHTTP(rw, req)
+	// Explain instead of challenging again when sessions keep getting lost
+	if ta.detectRedirectLoop(rw, req) {
 		return
 	}
 
-	// Check if this is a TOTP submission
-	if req.Method == http.MethodPost && req.URL.Path == req.URL.Path {
-		ta.handleTOTPSubmission(rw, req)
+	// Locked out clients get a neutral message instead of the form
+	if until, reason := ta.lockedOutUntil(req); reason != "" {
+		ta.showLockout(rw, req, until)
 		return
 	}
 
@@ -147,27 +1022,71 @@ func (ta *TOTPAuth) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	ta.showTOTPPage(rw, req, "")
 }
 
-// hasValidSession checks if the request has a valid session cookie
-func (ta *TOTPAuth) hasValidSession(req *http.Request) bool {
-	cookie, err := req.Cookie(ta.config.CookieName)
-	if err != nil {
-		return false
+// sessionFromCookies returns the valid session carried by the request's
+// cookies, or nil. Sessions found under a legacy cookie name are re-issued
+// under the current name. Cookies of expired or unknown sessions are
+// cleared, so the browser stops sending them.
+func (ta *TOTPAuth) sessionFromCookies(rw http.ResponseWriter, req *http.Request) *Session {
+	var stale []string
+	if cookie, err := req.Cookie(ta.config.CookieName); err == nil {
+		if session := ta.validSession(req, cookie.Value); session != nil {
+			ta.touchSession(rw, cookie.Value, session)
+			ta.expireLegacyCookies(rw, req)
+			return session
+		}
+		stale = append(stale, cookie.Name)
+	}
+
+	for _, name := range ta.config.LegacyCookieNames {
+		cookie, err := req.Cookie(name)
+		if err != nil {
+			continue
+		}
+
+		session := ta.validSession(req, cookie.Value)
+		if session == nil {
+			stale = append(stale, name)
+			continue
+		}
+
+		// Move the session to the current cookie name
+		maxAge := int(session.deadline().Sub(ta.clock.Now()).Seconds())
+		http.SetCookie(rw, ta.sessionCookie(cookie.Value, maxAge))
+		ta.expireLegacyCookies(rw, req)
+		log.Printf("[%s] Migrated session from legacy cookie %s to %s", ta.name, name, ta.config.CookieName)
+		return session
+	}
+
+	for _, name := range stale {
+		http.SetCookie(rw, ta.expiredCookie(name))
+	}
+	if len(stale) > 0 {
+		log.Printf("[%s] Cleared expired or unknown session cookie from %s", ta.name, ta.getClientIP(req))
 	}
+	return nil
+}
 
-	ta.sessions.mu.RLock()
-	session, exists := ta.sessions.sessions[cookie.Value]
-	ta.sessions.mu.RUnlock()
+// sessionScope returns the scope reported to the backend for a session
+func sessionScope(session *Session) string {
+	if session.ReadOnly {
+		return "readonly"
+	}
+	return "full"
+}
 
+// validSession returns the session for token if it exists, has not expired
+// and (when enabled) matches the client IP. Only the read lock is taken:
+// expired sessions are left to the cleanup and invalidated sessions are
+// removed in the background.
+func (ta *TOTPAuth) validSession(req *http.Request, token string) *Session {
+	session, exists := ta.lookupSession(token)
 	if !exists {
-		return false
+		return nil
 	}
 
 	// Check if session has expired
-	if time.Now().After(session.ExpiresAt) {
-		ta.sessions.mu.Lock()
-		delete(ta.sessions.sessions, cookie.Value)
-		ta.sessions.mu.Unlock()
-		return false
+	if ta.clock.Now().After(session.deadline()) {
+		return nil
 	}
 
 	// Verify IP address if enabled (optional security check)
@@ -175,39 +1094,141 @@ func (ta *TOTPAuth) hasValidSession(req *http.Request) bool {
 		clientIP := ta.getClientIP(req)
 		if session.IP != clientIP {
 			log.Printf("[%s] Session IP mismatch: expected %s, got %s", ta.name, session.IP, clientIP)
-			ta.sessions.mu.Lock()
-			delete(ta.sessions.sessions, cookie.Value)
-			ta.sessions.mu.Unlock()
-			return false
+			ta.deleteSessionLater(session.TokenHash)
+			return nil
 		}
 	}
 
-	return true
+	// Invalidate sessions that hop between networks too often
+	if ta.isAnomalousNetworkChange(req, session) {
+		ta.deleteSessionLater(session.TokenHash)
+		return nil
+	}
+
+	return session
 }
 
 // handleTOTPSubmission processes TOTP code submission
 func (ta *TOTPAuth) handleTOTPSubmission(rw http.ResponseWriter, req *http.Request) {
+	if !ta.checkSubmissionOrigin(req) {
+		ta.audit(req, auditAuthFailure, "origin_check")
+		ta.showTOTPPage(rw, req, "Invalid request")
+		return
+	}
+
 	err := req.ParseForm()
 	if err != nil {
 		ta.showTOTPPage(rw, req, "Invalid request")
 		return
 	}
 
+	// A browser that already holds a full session for this area (double
+	// click, refreshed POST) goes straight to the destination. Read-only
+	// sessions may still sign in with full access.
+	area, _ := ta.areaFor(req.URL.Path)
+	previousToken := ta.sessionToken(req)
+	previous := ta.validSession(req, previousToken)
+	if previous != nil && !previous.ReadOnly && previous.coversArea(area) {
+		log.Printf("[%s] Code submitted by already signed-in client %s, skipping validation", ta.name, ta.getClientIP(req))
+		ta.completeSubmission(rw, req, false)
+		return
+	}
+
+	// Only forms rendered for this browser may submit codes
+	if !ta.validLoginCSRF(req) {
+		log.Printf("[%s] Rejected code submission with a missing or invalid CSRF token from %s", ta.name, ta.getClientIP(req))
+		ta.audit(req, auditAuthFailure, "csrf_check")
+		ta.showTOTPPage(rw, req, "Your sign-in form has expired. Please enter a new code.")
+		return
+	}
+	if problem := ta.submissionTimingProblem(req, ta.clock.Now()); problem != "" {
+		log.Printf("[%s] Rejected code submission from %s: %s", ta.name, ta.getClientIP(req), problem)
+		ta.audit(req, auditAuthFailure, "submission_timing", problem)
+		ta.showTOTPPage(rw, req, "Something went wrong. Please enter the code again.")
+		return
+	}
+	release, ok := ta.reserveAttempt(rw, req)
+	if !ok {
+		return
+	}
+	defer release()
+
 	code := strings.TrimSpace(req.FormValue("totp_code"))
 	if code == "" {
+		ta.audit(req, auditAuthFailure, "missing_code")
+		ta.delayFailedSubmission(req)
 		ta.showTOTPPage(rw, req, "Please enter a TOTP code")
 		return
 	}
 
-	// Validate TOTP code
-	if !ta.validateTOTP(code) {
-		log.Printf("[%s] Invalid TOTP code attempt from %s", ta.name, ta.getClientIP(req))
-		ta.showTOTPPage(rw, req, "Invalid TOTP code. Please try again.")
+	// A repeated submission of the same form reuses the session it created.
+	// Forms without a nonce (e.g. cached pages) are validated as usual.
+	var sessionToken string
+	nonce := req.PostFormValue("submission")
+	codeHash := ta.submissionCodeHash(code)
+	submission, first := ta.submissions.begin(nonce, ta.getClientIP(req), codeHash, ta.clock.Now())
+	if first {
+		defer func() { ta.finishSubmission(req, nonce, submission, sessionToken) }()
+	} else if submission != nil && ta.replaySubmission(rw, req, submission, codeHash) {
 		return
 	}
 
-	// Create new session
-	sessionToken, err := ta.createSession(req)
+	// Validate the code with the validator chain
+	// Each pathSecrets area is validated with its own secret only
+	var result validationResult
+	valid := false
+	chain := ta.validators
+	if ta.awaitingEnrollment(area) {
+		// Only the primary authenticator can confirm enrollment
+		result, valid = ta.confirmEnrollment(req, code)
+		chain = chain[1:]
+	}
+	if !valid {
+		result, valid = ta.runValidators(req, code, chain)
+	}
+	readOnly := result.ReadOnly
+	if !valid {
+		clientIP := ta.getClientIP(req)
+		if ta.isLockoutExempt(clientIP) {
+			log.Printf("[%s] Invalid TOTP code attempt from %s (lockout-exempt)", ta.name, clientIP)
+		} else {
+			log.Printf("[%s] Invalid TOTP code attempt from %s", ta.name, clientIP)
+		}
+		ta.incrMetric(metricAuthFailure)
+		ta.audit(req, auditAuthFailure, "invalid_code")
+		if ta.recordFailedCode(rw, req) {
+			return
+		}
+		ta.delayFailedSubmission(req)
+		// The read-only session is still good; say so instead of challenging
+		if previous != nil && previous.coversArea(area) {
+			ta.showLinkPage(rw, http.StatusOK, "Already Signed In", "The code was not accepted, but you are still signed in with read-only access.", req.URL.String(), "Continue")
+			return
+		}
+		ta.showTOTPPage(rw, req, "Invalid TOTP code. Please try again.")
+		return
+	}
+	ta.recordSuccessfulCode(req)
+
+	// Create new session. Areas unlocked earlier by this browser carry over
+	// into the new session, which replaces the previous one.
+	areas := []string{area}
+	if previous != nil && previous.ReadOnly == readOnly {
+		for _, unlocked := range previous.Areas {
+			if unlocked != area {
+				areas = append(areas, unlocked)
+			}
+		}
+	}
+	// Logins from devices that were never approved wait for an out-of-band approval
+	if ta.approvals != nil && !ta.isKnownDevice(req) {
+		ta.requestApproval(rw, req, result, areas)
+		return
+	}
+	// Never keep a token the browser brought along. Remove previous sessions
+	// first so the replacement is not reported as a concurrent login.
+	ta.discardIncomingSessions(rw, req)
+	sessionToken, err = ta.createScopedSession(req, readOnly, areas, result.Method)
 	if err != nil {
 		log.Printf("[%s] Failed to create session: %v", ta.name, err)
 		ta.showTOTPPage(rw, req, "Authentication failed. Please try again.")
@@ -215,70 +1236,131 @@ func (ta *TOTPAuth) handleTOTPSubmission(rw http.ResponseWriter, req *http.Reque
 	}
 
 	// Set session cookie
-	http.SetCookie(rw, &http.Cookie{
-		Name:     ta.config.CookieName,
-		Value:    sessionToken,
-		Path:     "/",
-		Domain:   ta.config.CookieDomain,
-		MaxAge:   ta.config.SessionExpiry,
-		Secure:   ta.config.CookieSecure,
-		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-	})
+	http.SetCookie(rw, ta.sessionCookie(sessionToken, ta.sessionCookieMaxAge()))
+	ta.markVerified(rw, req)
+
+	matchedSecret := ""
+	if result.Secret != "" {
+		matchedSecret = ", secret=" + result.Secret
+	}
+	log.Printf("[%s] Successful TOTP authentication from %s (method=%s, skew=%d%s, challenge_duration=%s)", ta.name, ta.getClientIP(req), result.Method, result.Skew, matchedSecret, ta.recordChallengeDuration(req))
+	ta.incrMetric(metricAuthSuccess)
+	ta.audit(req, auditAuthSuccess, result.Reason)
+	if result.Reason == "valid_code" {
+		ta.enrollment.confirm(ta.clock.Now())
+	}
 
-	log.Printf("[%s] Successful TOTP authentication from %s", ta.name, ta.getClientIP(req))
+	ta.completeSubmission(rw, req, readOnly)
+}
+
+// completeSubmission sends the response to a successful code submission
+func (ta *TOTPAuth) completeSubmission(rw http.ResponseWriter, req *http.Request, readOnly bool) {
+	// On the login portal, return to the service the user came from
+	if ta.redirectToPortalReturn(rw, req, readOnly) {
+		return
+	}
+
+	// In an iframe, signal the parent page instead of navigating the frame
+	if ta.isEmbedded(req) {
+		ta.showEmbeddedSuccess(rw)
+		return
+	}
 
 	// Redirect to original URL
-	http.Redirect(rw, req, req.URL.String(), http.StatusSeeOther)
+	http.Redirect(rw, req, req.URL.String(), ta.config.RedirectStatus)
 }
 
-// validateTOTP validates a TOTP code
-func (ta *TOTPAuth) validateTOTP(code string) bool {
-	// Get current time step
-	currentTimeStep := time.Now().Unix() / int64(ta.config.TimeStep)
+// matchCode validates a code against secret with the given parameters,
+// shifted by drift time steps, and returns the skew of the matching time step
+func (ta *TOTPAuth) matchCode(secret, code string, drift int64, params tokenParams) (int, bool) {
+	code = ta.normalizeCode(code)
 
-	// Check current time step and allow for skew
-	for skew := -ta.config.AllowedSkew; skew <= ta.config.AllowedSkew; skew++ {
-		timeStep := currentTimeStep + int64(skew)
-		expectedCode := ta.generateTOTP(timeStep)
-		if code == expectedCode {
-			return true
-		}
+	// Get current time step, corrected by the calibrated drift
+	currentTimeStep := ta.codeTime().Unix()/int64(params.period) + drift
+
+	return matchSteps(code, currentTimeStep, ta.config.AllowedSkew, func(timeStep int64) string {
+		return ta.generateCodeWith(secret, timeStep, params)
+	})
+}
+
+// matchSteps compares code with the code generate returns for every time step
+// within allowedSkew of current and returns the skew of the first match.
+// Every step is compared in constant time, even after a match, so the
+// response time does not reveal which step matched.
+func matchSteps(code string, current int64, allowedSkew int, generate func(timeStep int64) string) (int, bool) {
+	matched, found := 0, 0
+	submitted := []byte(code)
+	for skew := -allowedSkew; skew <= allowedSkew; skew++ {
+		expectedCode := generate(current + int64(skew))
+		equal := subtle.ConstantTimeCompare(submitted, []byte(expectedCode))
+		matched = subtle.ConstantTimeSelect(equal&^found, skew, matched)
+		found |= equal
 	}
 
-	return false
+	return matched, found == 1
 }
 
 // generateTOTP generates a TOTP code for a given time step
 func (ta *TOTPAuth) generateTOTP(timeStep int64) string {
+	return ta.generateCode(ta.currentSecret(), timeStep)
+}
+
+// generateCode generates a code from secret for a given time step with the
+// plugin-level parameters
+func (ta *TOTPAuth) generateCode(secret string, timeStep int64) string {
+	return ta.generateCodeWith(secret, timeStep, ta.tokenParams(""))
+}
+
+// generateCodeWith generates a code from secret for a given time step
+func (ta *TOTPAuth) generateCodeWith(secret string, timeStep int64, params tokenParams) string {
 	// Decode secret key
-	key, err := base32.StdEncoding.DecodeString(strings.ToUpper(ta.config.SecretKey))
+	key, err := ta.keys.get(secret)
 	if err != nil {
 		log.Printf("[%s] Failed to decode secret key: %v", ta.name, err)
 		return ""
 	}
 
+	return ta.formatCode(truncatedHMAC(key, timeStep, params.algorithm), params.digits)
+}
+
+// truncatedHMAC computes the HMAC of the time step (or counter) and applies
+// the dynamic truncation of RFC 4226
+func truncatedHMAC(key []byte, timeStep int64, algorithm string) uint32 {
 	// Convert time step to bytes
 	buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(buf, uint64(timeStep))
 
-	// Generate HMAC-SHA1
-	h := hmac.New(sha1.New, key)
+	// Generate the HMAC
+	h := hmac.New(hashes[algorithm], key)
 	h.Write(buf)
 	hash := h.Sum(nil)
 
 	// Dynamic truncation
 	offset := hash[len(hash)-1] & 0x0f
-	truncated := binary.BigEndian.Uint32(hash[offset:offset+4]) & 0x7fffffff
+	return binary.BigEndian.Uint32(hash[offset:offset+4]) & 0x7fffffff
+}
+
+// formatCode turns a truncated HMAC into a code of the configured format
+func (ta *TOTPAuth) formatCode(truncated uint32, digits int) string {
+	if ta.config.CodeFormat == codeFormatSteam {
+		return steamCode(truncated)
+	}
 
 	// Generate code
-	code := truncated % uint32(pow10(ta.config.CodeDigits))
-	format := fmt.Sprintf("%%0%dd", ta.config.CodeDigits)
+	code := truncated % uint32(pow10(digits))
+	format := fmt.Sprintf("%%0%dd", digits)
 	return fmt.Sprintf(format, code)
 }
 
 // createSession creates a new session and returns the session token
-func (ta *TOTPAuth) createSession(req *http.Request) (string, error) {
+func (ta *TOTPAuth) createSession(req *http.Request, method string) (string, error) {
+	area, _ := ta.areaFor(req.URL.Path)
+	return ta.createScopedSession(req, false, []string{area}, method)
+}
+
+// createScopedSession creates a new, optionally read-only, session unlocked
+// for the given areas and returns the session token
+func (ta *TOTPAuth) createScopedSession(req *http.Request, readOnly bool, areas []string, method string) (string, error) {
 	// Generate random session token
 	tokenBytes := make([]byte, 32)
 	_, err := rand.Read(tokenBytes)
@@ -288,51 +1370,153 @@ func (ta *TOTPAuth) createSession(req *http.Request) (string, error) {
 	token := hex.EncodeToString(tokenBytes)
 
 	// Create session
-	now := time.Now()
+	now := ta.clock.Now()
 	session := &Session{
-		Token:     token,
+		TokenHash: hashSessionToken(token),
 		CreatedAt: now,
-		ExpiresAt: now.Add(time.Duration(ta.config.SessionExpiry) * time.Second),
+		ExpiresAt: now.Add(time.Duration(ta.sessionExpiry) * time.Second),
 		IP:        ta.getClientIP(req),
+		UserAgent: truncate(req.UserAgent(), 256),
+		ReadOnly:  readOnly,
+		Areas:     areas,
+		Method:    method,
+
+		verifiedAt: now,
+	}
+	session.IdleExpiresAt = ta.idleDeadline(now, session.ExpiresAt)
+	if ta.config.MaxIPChanges > 0 {
+		session.networks = []networkObservation{{network: ta.sourceNetwork(session.IP), seenAt: now}}
+	}
+
+	// Signed and encrypted sessions live in the cookie only
+	if ta.statelessSessions() {
+		ta.incrMetric(metricSessionsCreated)
+		return ta.encodeSession(session)
+	}
+
+	// Checked before older sessions are revoked, so a refused login has no effect
+	if err := ta.checkSessionsPerIP(session); err != nil {
+		return "", err
+	}
+	if ta.config.SingleSession {
+		ta.revokeOtherSessions(session)
+	} else {
+		if ta.config.MaxSessions > 0 {
+			ta.evictOldestSessions(session)
+		}
+		ta.detectConcurrentLogin(session)
 	}
 
 	// Store session
-	ta.sessions.mu.Lock()
-	ta.sessions.sessions[token] = session
-	ta.sessions.mu.Unlock()
+	if err := ta.putSession(session); err != nil {
+		return "", fmt.Errorf("failed to store session: %w", err)
+	}
+
+	ta.incrMetric(metricSessionsCreated)
 
 	return token, nil
 }
 
-// cleanupExpiredSessions periodically removes expired sessions
-func (ta *TOTPAuth) cleanupExpiredSessions(ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Minute)
-	defer ticker.Stop()
+// maxConcurrentLoginDetails limits how many existing sessions are described
+// in a concurrent_login notification
+const maxConcurrentLoginDetails = 10
+
+// detectConcurrentLogin logs and notifies when a new session is created while
+// other unexpired sessions exist. With a single shared secret every session
+// belongs to the same identity.
+func (ta *TOTPAuth) detectConcurrentLogin(session *Session) {
+	active := 0
+	var existing []map[string]interface{}
+	for _, other := range ta.listSessions() {
+		if other.TokenHash == session.TokenHash || session.CreatedAt.After(other.deadline()) {
+			continue
+		}
+		active++
+		if len(existing) >= maxConcurrentLoginDetails {
+			continue
+		}
+		existing = append(existing, map[string]interface{}{
+			"ip":        other.IP,
+			"userAgent": other.UserAgent,
+			"createdAt": other.CreatedAt.UTC(),
+		})
+	}
+	if active == 0 {
+		return
+	}
+
+	log.Printf("[%s] Concurrent login: new session from %s while %d other session(s) are active", ta.name, session.IP, active)
+	ta.notifyWebhook(webhookConcurrentLogin, map[string]interface{}{
+		"new": map[string]interface{}{
+			"ip":        session.IP,
+			"userAgent": session.UserAgent,
+			"createdAt": session.CreatedAt.UTC(),
+		},
+		"activeSessions": active,
+		"existing":       existing,
+	})
+}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			now := time.Now()
-			ta.sessions.mu.Lock()
-			for token, session := range ta.sessions.sessions {
-				if now.After(session.ExpiresAt) {
-					delete(ta.sessions.sessions, token)
-				}
-			}
-			ta.sessions.mu.Unlock()
+// revokeOtherSessions removes every session but the new one. With a single
+// shared secret every session belongs to the same identity.
+func (ta *TOTPAuth) revokeOtherSessions(session *Session) {
+	revoked := ta.deleteSessions(func(other *Session) bool {
+		return other.TokenHash != session.TokenHash
+	})
+	if revoked > 0 {
+		log.Printf("[%s] Single session: revoked %d older session(s) for new session from %s", ta.name, revoked, session.IP)
+	}
+}
+
+// evictOldestSessions removes the oldest active sessions so that, with the
+// new one, no more than maxSessions remain. With a single shared secret every
+// session belongs to the same identity, so all sessions count.
+func (ta *TOTPAuth) evictOldestSessions(session *Session) {
+	var active []*Session
+	for _, other := range ta.listSessions() {
+		if other.TokenHash != session.TokenHash && session.CreatedAt.Before(other.deadline()) {
+			active = append(active, other)
 		}
 	}
+	excess := len(active) - (ta.config.MaxSessions - 1)
+	if excess <= 0 {
+		return
+	}
+
+	sort.Slice(active, func(i, j int) bool {
+		return active[i].CreatedAt.Before(active[j].CreatedAt)
+	})
+	for _, evicted := range active[:excess] {
+		ta.sessions.Delete(evicted.TokenHash)
+		log.Printf("[%s] Max sessions (%d) reached: evicted session %s created at %s from %s for new session from %s", ta.name, ta.config.MaxSessions, evicted.id(), evicted.CreatedAt.UTC().Format(time.RFC3339), evicted.IP, session.IP)
+	}
+}
+
+// cleanupExpiredSessions removes expired sessions and cache entries; it is
+// called by the shared cleanup scheduler
+func (ta *TOTPAuth) cleanupExpiredSessions(now time.Time) {
+	ta.sessions.DeleteExpired(now)
+	ta.drainSessionDeletions(sessionDeletionQueueSize)
+
+	if ta.reputation != nil {
+		ta.reputation.cleanup(now)
+	}
+	ta.portalReplay.cleanup(now)
+	ta.usedCodes.cleanup(now)
+	ta.pairings.cleanup(time.Duration(ta.config.PairingTTL)*time.Second, now)
+	ta.submissions.cleanup(now)
+	ta.failures.cleanup(now)
+	ta.globalLimitUntil(now)
+	ta.rotateSecretIfDue(now)
+	if ta.approvals != nil {
+		ta.approvals.cleanup(now)
+	}
 }
 
 // getClientIP extracts the client IP address from the request
 func (ta *TOTPAuth) getClientIP(req *http.Request) string {
 	// Extract the remote address (direct connection IP)
-	remoteIP := req.RemoteAddr
-	if idx := strings.LastIndex(remoteIP, ":"); idx != -1 {
-		remoteIP = remoteIP[:idx]
-	}
+	remoteIP := remoteHost(req)
 
 	// Parse the remote IP
 	ip := net.ParseIP(remoteIP)
@@ -341,17 +1525,8 @@ func (ta *TOTPAuth) getClientIP(req *http.Request) string {
 		return remoteIP
 	}
 
-	// Check if the request is from a trusted proxy
-	isTrustedProxy := false
-	for _, network := range ta.trustedNetworks {
-		if network.Contains(ip) {
-			isTrustedProxy = true
-			break
-		}
-	}
-
 	// If request is from a trusted proxy, check forwarded headers
-	if isTrustedProxy {
+	if ta.isTrustedProxyIP(ip) {
 		// Check X-Forwarded-For header (standard)
 		if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
 			ips := strings.Split(xff, ",")
@@ -371,23 +1546,97 @@ func (ta *TOTPAuth) getClientIP(req *http.Request) string {
 	return remoteIP
 }
 
+// remoteHost returns the host part of the request's remote address
+func remoteHost(req *http.Request) string {
+	remoteIP := req.RemoteAddr
+	if idx := strings.LastIndex(remoteIP, ":"); idx != -1 {
+		remoteIP = remoteIP[:idx]
+	}
+	return remoteIP
+}
+
+// isTrustedProxyIP reports whether ip belongs to a trusted proxy network
+func (ta *TOTPAuth) isTrustedProxyIP(ip net.IP) bool {
+	return ta.trustedProxies.contains(ip)
+}
+
+// requestHost returns the host the client addressed, honoring
+// X-Forwarded-Host when the request comes from a trusted proxy
+func (ta *TOTPAuth) requestHost(req *http.Request) string {
+	if ip := net.ParseIP(remoteHost(req)); ip != nil && ta.isTrustedProxyIP(ip) {
+		if xfh := req.Header.Get("X-Forwarded-Host"); xfh != "" {
+			return strings.TrimSpace(strings.Split(xfh, ",")[0])
+		}
+	}
+	return req.Host
+}
+
+// isLockoutExempt reports whether the client IP (as resolved by getClientIP)
+// is exempt from brute-force delays and lockouts
+func (ta *TOTPAuth) isLockoutExempt(clientIP string) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, network := range ta.exemptNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // showTOTPPage displays the TOTP input page
 func (ta *TOTPAuth) showTOTPPage(rw http.ResponseWriter, req *http.Request, errorMsg string) {
-	tmpl := template.Must(template.New("totp").Parse(totpPageTemplate))
+	ta.renderTOTPPage(rw, req, http.StatusUnauthorized, errorMsg)
+}
+
+// renderTOTPPage renders the TOTP input page with status
+func (ta *TOTPAuth) renderTOTPPage(rw http.ResponseWriter, req *http.Request, status int, errorMsg string) {
+	embedded := ta.isEmbedded(req)
+	area, _ := ta.areaFor(req.URL.Path)
+	params := ta.tokenParams(area)
 
 	data := map[string]interface{}{
 		"Title":       ta.config.PageTitle,
 		"Description": ta.config.PageDescription,
 		"Error":       errorMsg,
-		"Action":      req.URL.String(),
+		"Action":      ta.loginAction(req),
+		"Digits":      params.digits,
+		"Period":      params.period,
+		"WebOTP":      ta.config.WebOTP,
+		"ShowKeypad":  ta.config.ShowKeypad,
+		"Steam":       ta.config.CodeFormat == codeFormatSteam,
+		"Rendered":    ta.renderTimestamp(ta.clock.Now()),
+		"Submission":  newFormNonce(),
+		"CSRF":        ta.loginCSRFToken(rw, req),
+		"Embedded":    embedded,
+		"Area":        area,
+		"PairingURL":  ta.requestScheme(req) + "://" + ta.requestHost(req) + pairPath,
+		"PollURL":     pairPollPath,
+		"Notice":      ta.noticeHTML(),
+		"Enrollment":  ta.awaitingEnrollment(area),
+	}
+	if embedded {
+		ta.setEmbedHeaders(rw)
+	} else {
+		if code := ta.pairingForPage(rw, req); code != "" {
+			data["PairingCode"] = formatPairingCode(code)
+			qr, size := ta.pairingQR(req, code)
+			data["PairingQR"] = qr
+			data["PairingQRSize"] = size
+		}
 	}
 
-	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
-	rw.WriteHeader(http.StatusUnauthorized)
-	
-	if err := tmpl.Execute(rw, data); err != nil {
-		log.Printf("[%s] Failed to render TOTP page: %v", ta.name, err)
+	ta.renderPage(rw, status, ta.pages.totp, data)
+}
+
+// truncate shortens s to at most n bytes
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
 	}
+	return s
 }
 
 // pow10 calculates 10^n
@@ -444,6 +1693,20 @@ const totpPageTemplate = `<!DOCTYPE html>
             }
         }
 
+        body.embedded {
+            background: transparent;
+            min-height: 0;
+            padding: 0;
+        }
+
+        body.embedded .container {
+            max-width: none;
+            border-radius: 0;
+            box-shadow: none;
+            padding: 24px;
+            animation: none;
+        }
+
         .lock-icon {
             width: 80px;
             height: 80px;
@@ -543,6 +1806,80 @@ const totpPageTemplate = `<!DOCTYPE html>
             transform: translateY(0);
         }
 
+        .pairing {
+            margin-top: 20px;
+            padding-top: 20px;
+            border-top: 1px solid #e2e8f0;
+            color: #718096;
+            font-size: 13px;
+            text-align: center;
+            line-height: 1.6;
+        }
+
+        .pairing-code {
+            display: block;
+            margin: 8px 0;
+            color: #2d3748;
+            font-size: 24px;
+            font-weight: 700;
+            letter-spacing: 4px;
+            font-family: 'Courier New', monospace;
+        }
+
+        .pairing-qr {
+            display: block;
+            width: 160px;
+            height: 160px;
+            margin: 8px auto 0;
+        }
+
+        .area {
+            color: #4a5568;
+            font-size: 14px;
+            text-align: center;
+            margin: -16px 0 24px;
+        }
+
+        .notice {
+            background: #fefcbf;
+            color: #744210;
+            padding: 12px 16px;
+            border-radius: 8px;
+            margin-bottom: 20px;
+            font-size: 14px;
+            line-height: 1.5;
+            white-space: pre-line;
+        }
+
+        {{if .ShowKeypad}}
+        .keypad {
+            display: grid;
+            grid-template-columns: repeat(3, 1fr);
+            gap: 10px;
+            margin-bottom: 20px;
+        }
+
+        .keypad button {
+            height: 64px;
+            padding: 0;
+            background: #edf2f7;
+            color: #2d3748;
+            font-size: 28px;
+            text-transform: none;
+            letter-spacing: 0;
+            touch-action: manipulation;
+        }
+
+        .keypad button:hover {
+            transform: none;
+            box-shadow: none;
+        }
+
+        .keypad button:active {
+            background: #cbd5e0;
+        }
+        {{end}}
+
         .info-text {
             margin-top: 20px;
             padding-top: 20px;
@@ -554,53 +1891,226 @@ const totpPageTemplate = `<!DOCTYPE html>
         }
     </style>
 </head>
-<body>
+<body{{if .Embedded}} class="embedded"{{end}}>
     <div class="container">
+        {{if not .Embedded}}
         <div class="lock-icon">🔒</div>
+        {{end}}
         <h1>{{.Title}}</h1>
         <p class="description">{{.Description}}</p>
+        {{if .Area}}
+        <p class="area">Unlocking <strong>{{.Area}}</strong></p>
+        {{end}}
+
+        {{if .Notice}}
+        <div class="notice" role="status">{{.Notice}}</div>
+        {{end}}
         
         {{if .Error}}
         <div class="error">{{.Error}}</div>
         {{end}}
         
         <form method="POST" action="{{.Action}}">
+            <input type="hidden" name="rendered" value="{{.Rendered}}">
+            {{if .Submission}}<input type="hidden" name="submission" value="{{.Submission}}">{{end}}
+            <input type="hidden" name="csrf" value="{{.CSRF}}">
             <div class="form-group">
                 <label for="totp_code">Authentication Code</label>
                 <input 
                     type="text" 
                     id="totp_code" 
                     name="totp_code" 
-                    maxlength="6" 
+                    maxlength="{{.Digits}}" 
+                    {{if .Steam}}
+                    pattern="[2-9BCDFGHJKMNPQRTVWXYbcdfghjkmnpqrtvwxy]*"
+                    autocapitalize="characters"
+                    spellcheck="false"
+                    placeholder="XXXXX"
+                    {{else}}
                     pattern="[0-9]*"
-                    inputmode="numeric"
+                    inputmode="{{if .ShowKeypad}}none{{else}}numeric{{end}}"
                     placeholder="000000"
+                    {{end}}
                     autofocus 
                     required
+                    autocomplete="one-time-code"
+                >
+            </div>
+            {{if .Enrollment}}
+            <div class="form-group">
+                <label for="totp_next_code">Next Code</label>
+                <input 
+                    type="text" 
+                    id="totp_next_code" 
+                    name="totp_next_code" 
+                    maxlength="{{.Digits}}" 
+                    {{if .Steam}}
+                    pattern="[2-9BCDFGHJKMNPQRTVWXYbcdfghjkmnpqrtvwxy]*"
+                    autocapitalize="characters"
+                    spellcheck="false"
+                    placeholder="XXXXX"
+                    {{else}}
+                    pattern="[0-9]*"
+                    inputmode="{{if .ShowKeypad}}none{{else}}numeric{{end}}"
+                    placeholder="000000"
+                    {{end}}
+                    required
                     autocomplete="off"
                 >
             </div>
+            {{end}}
+            {{if .ShowKeypad}}
+            <div class="keypad">
+                <button type="button" data-key="1">1</button>
+                <button type="button" data-key="2">2</button>
+                <button type="button" data-key="3">3</button>
+                <button type="button" data-key="4">4</button>
+                <button type="button" data-key="5">5</button>
+                <button type="button" data-key="6">6</button>
+                <button type="button" data-key="7">7</button>
+                <button type="button" data-key="8">8</button>
+                <button type="button" data-key="9">9</button>
+                <button type="button" data-key="clear" aria-label="Clear">C</button>
+                <button type="button" data-key="0">0</button>
+                <button type="button" data-key="back" aria-label="Backspace">&#9003;</button>
+            </div>
+            {{end}}
             <button type="submit">Verify & Continue</button>
         </form>
         
+        {{if .Enrollment}}
+        <div class="info-text">
+            To confirm your authenticator, enter its current code, wait for
+            the code to change and enter the next one as well.
+        </div>
+        {{else if not .Embedded}}
         <div class="info-text">
-            Enter the 6-digit code from your authenticator app.<br>
-            Codes refresh every 30 seconds.
+            Enter the {{.Digits}}-{{if .Steam}}character{{else}}digit{{end}} code from your authenticator app.<br>
+            Codes refresh every {{.Period}} seconds.
         </div>
+        {{end}}
+        {{if .PairingCode}}
+        <div class="pairing">
+            Or sign in from a device where you are already signed in:
+            open <strong>{{.PairingURL}}</strong> and enter
+            <span class="pairing-code">{{.PairingCode}}</span>
+            {{if .PairingQR}}or scan
+            <svg class="pairing-qr" viewBox="0 0 {{.PairingQRSize}} {{.PairingQRSize}}" role="img" aria-label="QR code of the pairing link">
+                <rect width="100%" height="100%" fill="#fff"/>
+                <path d="{{.PairingQR}}" fill="#000"/>
+            </svg>{{end}}
+        </div>
+        {{end}}
     </div>
 
     <script>
-        document.getElementById('totp_code').focus();
+        var codeInput = document.getElementById('totp_code');
+        var nextInput = document.getElementById('totp_next_code');
+        var codeDigits = {{.Digits}};
+        var submitTimer = null;
+        {{if .Steam}}
+        var invalidChars = /[^23456789BCDFGHJKMNPQRTVWXY]/g;
+        {{else}}
+        var invalidChars = /[^0-9]/g;
+        {{end}}
+
+        codeInput.focus();
         
-        document.getElementById('totp_code').addEventListener('input', function(e) {
-            this.value = this.value.replace(/[^0-9]/g, '');
+        codeInput.addEventListener('input', function(e) {
+            this.value = this.value.toUpperCase().replace(invalidChars, '');
+            if (nextInput && this.value.length === codeDigits) {
+                nextInput.focus();
+            }
         });
+        if (nextInput) {
+            nextInput.addEventListener('input', function(e) {
+                this.value = this.value.toUpperCase().replace(invalidChars, '');
+            });
+        }
         
-        document.getElementById('totp_code').addEventListener('input', function(e) {
-            if (this.value.length === 6) {
-                this.form.submit();
+        // Auto-fill (password managers, WebOTP) may write the value in several
+        // steps, so only submit once the code is complete and stopped changing.
+        function enteredCodes() {
+            return codeInput.value + (nextInput ? ' ' + nextInput.value : '');
+        }
+
+        function scheduleSubmit() {
+            clearTimeout(submitTimer);
+            if (codeInput.value.length !== codeDigits || (nextInput && nextInput.value.length !== codeDigits)) {
+                return;
             }
+            var value = enteredCodes();
+            submitTimer = setTimeout(function() {
+                // requestSubmit fires the submit event, which aborts a
+                // pending WebOTP request; submit() would skip it. Browsers
+                // without requestSubmit have no WebOTP either.
+                if (enteredCodes() === value) {
+                    if (codeInput.form.requestSubmit) {
+                        codeInput.form.requestSubmit();
+                    } else {
+                        codeInput.form.submit();
+                    }
+                }
+            }, 100);
+        }
+
+        codeInput.addEventListener('input', scheduleSubmit);
+        if (nextInput) {
+            nextInput.addEventListener('input', scheduleSubmit);
+        }
+        {{if .ShowKeypad}}
+        Array.prototype.forEach.call(document.querySelectorAll('.keypad button'), function(key) {
+            key.addEventListener('click', function() {
+                // With two fields, keys go to the next code once the first is complete
+                var input = codeInput;
+                if (nextInput && (nextInput.value !== '' || (codeInput.value.length === codeDigits && key.dataset.key !== 'back'))) {
+                    input = nextInput;
+                }
+                var value = input.value;
+                if (key.dataset.key === 'back') {
+                    input.value = value.slice(0, -1);
+                } else if (key.dataset.key === 'clear') {
+                    codeInput.value = '';
+                    if (nextInput) {
+                        nextInput.value = '';
+                    }
+                } else if (value.length < codeDigits) {
+                    input.value = value + key.dataset.key;
+                }
+                scheduleSubmit();
+            });
         });
+        {{end}}
+        {{if .WebOTP}}
+        if ('OTPCredential' in window) {
+            var otpAbort = new AbortController();
+            codeInput.form.addEventListener('submit', function() {
+                otpAbort.abort();
+            });
+            navigator.credentials.get({
+                otp: { transport: ['sms'] },
+                signal: otpAbort.signal
+            }).then(function(otp) {
+                if (otp && otp.code) {
+                    codeInput.value = otp.code.toUpperCase().replace(invalidChars, '');
+                    scheduleSubmit();
+                }
+            }).catch(function() {});
+        }
+        {{end}}
+        {{if .PairingCode}}
+        var pairingPoll = setInterval(function() {
+            fetch({{.PollURL}}, { credentials: 'same-origin', cache: 'no-store' })
+                .then(function(response) { return response.json(); })
+                .then(function(result) {
+                    if (result.status === 'approved' || result.status === 'expired') {
+                        clearInterval(pairingPoll);
+                        window.location.reload();
+                    }
+                })
+                .catch(function() {});
+        }, 2000);
+        {{end}}
     </script>
 </body>
 </html>`
\ No newline at end of file
@@ -0,0 +1,66 @@
+package traefik_totp_plugin
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestMatchStepsComparesEveryStep checks that the steps after a match are
+// still generated and compared, and that the first matching step wins
+func TestMatchStepsComparesEveryStep(t *testing.T) {
+	const current, allowedSkew = 1000, 2
+
+	for skew := -allowedSkew; skew <= allowedSkew; skew++ {
+		t.Run(strconv.Itoa(skew), func(t *testing.T) {
+			var generated []int64
+			generate := func(timeStep int64) string {
+				generated = append(generated, timeStep)
+				if timeStep >= current+int64(skew) {
+					return "123456" // Later steps match too
+				}
+				return "000000"
+			}
+
+			matched, ok := matchSteps("123456", current, allowedSkew, generate)
+			if !ok || matched != skew {
+				t.Errorf("matchSteps = %d, %v, want %d, true", matched, ok, skew)
+			}
+			if len(generated) != 2*allowedSkew+1 {
+				t.Fatalf("generated %d codes, want %d", len(generated), 2*allowedSkew+1)
+			}
+			for i, timeStep := range generated {
+				if want := int64(current - allowedSkew + i); timeStep != want {
+					t.Errorf("code %d generated for step %d, want %d", i, timeStep, want)
+				}
+			}
+		})
+	}
+
+	var calls int
+	if _, ok := matchSteps("123456", current, allowedSkew, func(int64) string { calls++; return "000000" }); ok || calls != 2*allowedSkew+1 {
+		t.Errorf("no match: ok = %v after %d codes, want false after %d", ok, calls, 2*allowedSkew+1)
+	}
+}
+
+// TestMatchCodeSkewWindow checks that codes are accepted within allowedSkew
+// steps of the clock and rejected beyond
+func TestMatchCodeSkewWindow(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.AllowedSkew = 2
+	})
+	clock := newFakeClock(time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC))
+	ta.SetClock(clock)
+
+	params := ta.tokenParams("")
+	current := clock.Now().Unix() / int64(params.period)
+	for skew := -3; skew <= 3; skew++ {
+		code := ta.generateCodeWith(testSecret, current+int64(skew), params)
+		matched, ok := ta.matchCode(testSecret, code, 0, params)
+		if want := skew >= -2 && skew <= 2; ok != want {
+			t.Errorf("skew %d: accepted = %v, want %v", skew, ok, want)
+		} else if ok && matched != skew {
+			t.Errorf("skew %d: matched step %d", skew, matched)
+		}
+	}
+}
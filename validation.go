@@ -0,0 +1,181 @@
+package traefik_totp_plugin
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Bounds of the core code settings
+const (
+	minTimeStep       = 5
+	maxTimeStep       = 300
+	maxAllowedSkew    = 10
+	warnAllowedSkew   = 2
+	defaultCookieName = "totp_session"
+)
+
+// validateConfig checks the settings that don't depend on each other up
+// front and reports every violation at once. Unset values are defaulted
+// later; explicitly set values outside their bounds are errors, never
+// clamped.
+func validateConfig(config *Config, name string) error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if config.CodeDigits < 0 || config.CodeDigits > maxCodeDigits {
+		add("codeDigits must be between 1 and %d, got %d", maxCodeDigits, config.CodeDigits)
+	}
+
+	if timeStep, err := parseSeconds("timeStep", config.TimeStep, 30); err != nil {
+		add("%v", err)
+	} else if timeStep < minTimeStep || timeStep > maxTimeStep {
+		add("timeStep must be between %ds and %ds, got %ds", minTimeStep, maxTimeStep, timeStep)
+	}
+	if _, err := parseSeconds("sessionExpiry", config.SessionExpiry, 3600); err != nil {
+		add("%v", err)
+	}
+	if _, err := parseSeconds("idleTimeout", config.IdleTimeout, 0); err != nil {
+		add("%v", err)
+	}
+	if _, err := parseSeconds("cleanupInterval", config.CleanupInterval, 300); err != nil {
+		add("%v", err)
+	}
+	if _, err := parseSeconds("lockdownDuration", config.LockdownDuration, 3600); err != nil {
+		add("%v", err)
+	}
+	if _, err := parseSeconds("failedAttemptWindow", config.FailedAttemptWindow, 300); err != nil {
+		add("%v", err)
+	}
+	if _, err := parseSeconds("lockoutDuration", config.LockoutDuration, 900); err != nil {
+		add("%v", err)
+	}
+	if _, err := parseSeconds("maxFailureDelay", config.MaxFailureDelay, 30); err != nil {
+		add("%v", err)
+	}
+	if err := validateCleanupMode(config); err != nil {
+		add("%v", err)
+	}
+	if err := validateLockoutScope(config); err != nil {
+		add("%v", err)
+	}
+	if err := validateAuditIPMode(config); err != nil {
+		add("%v", err)
+	}
+
+	if config.AllowedSkew < 0 || config.AllowedSkew > maxAllowedSkew {
+		add("allowedSkew must be between 0 and %d, got %d", maxAllowedSkew, config.AllowedSkew)
+	} else if config.AllowedSkew > warnAllowedSkew {
+		log.Printf("[%s] WARNING: allowedSkew %d accepts codes from %d time steps; consider calibrating drift or timeOffsetSeconds instead", name, config.AllowedSkew, 2*config.AllowedSkew+1)
+	}
+
+	if config.TimeOffsetSeconds < -maxTimeOffset || config.TimeOffsetSeconds > maxTimeOffset {
+		add("timeOffsetSeconds must be between -%d and %d, got %d", maxTimeOffset, maxTimeOffset, config.TimeOffsetSeconds)
+	}
+
+	if config.CookieName == "" {
+		config.CookieName = defaultCookieName
+	}
+	if !isCookieToken(config.CookieName) {
+		add("cookieName %q is not a valid cookie name", config.CookieName)
+	}
+	for _, legacy := range config.LegacyCookieNames {
+		if !isCookieToken(legacy) {
+			add("legacyCookieNames entry %q is not a valid cookie name", legacy)
+		}
+	}
+
+	if err := validateLogoutPath(config); err != nil {
+		add("%v", err)
+	}
+	if err := validateLoginPath(config); err != nil {
+		add("%v", err)
+	}
+	if err := validateUnauthenticatedWrites(config); err != nil {
+		add("%v", err)
+	}
+
+	switch config.RedirectStatus {
+	case 0:
+		config.RedirectStatus = http.StatusSeeOther
+	case http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+	default:
+		add("redirectStatus must be 302, 303 or 307, got %d", config.RedirectStatus)
+	}
+
+	// Zero selects the default of these; negative values are mistakes
+	for _, setting := range []struct {
+		name  string
+		value int
+	}{
+		{"reputationTimeoutMs", config.ReputationTimeoutMs},
+		{"reputationCacheTTL", config.ReputationCacheTTL},
+		{"reputationCacheSize", config.ReputationCacheSize},
+		{"signatureMaxAge", config.SignatureMaxAge},
+		{"maxIPChanges", config.MaxIPChanges},
+		{"ipChangeWindow", config.IPChangeWindow},
+		{"portalTokenMaxAge", config.PortalTokenMaxAge},
+		{"redirectLoopThreshold", config.RedirectLoopThreshold},
+		{"calibrationWindow", config.CalibrationWindow},
+		{"verifierTimeoutMs", config.VerifierTimeoutMs},
+		{"assertionTTL", config.AssertionTTL},
+		{"pairingTTL", config.PairingTTL},
+		{"approvalTimeout", config.ApprovalTimeout},
+		{"stepUpMaxAge", config.StepUpMaxAge},
+		{"secretRotationDays", config.SecretRotationDays},
+		{"rotationOverlapDays", config.RotationOverlapDays},
+		{"hotpLookAhead", config.HOTPLookAhead},
+		{"statsdFlushInterval", config.StatsdFlushInterval},
+		{"trustedProxiesRefreshInterval", config.TrustedProxiesRefreshInterval},
+		{"auditMaxSizeMB", config.AuditMaxSizeMB},
+		{"auditMaxFiles", config.AuditMaxFiles},
+		{"auditFlushInterval", config.AuditFlushInterval},
+		{"clockCheckInterval", config.ClockCheckInterval},
+		{"submitMinDelayMs", config.SubmitMinDelayMs},
+		{"submitMaxAge", config.SubmitMaxAge},
+		{"maxSessions", config.MaxSessions},
+		{"maxTotalSessions", config.MaxTotalSessions},
+		{"maxSessionsPerIP", config.MaxSessionsPerIP},
+		{"maxFailedAttempts", config.MaxFailedAttempts},
+		{"globalFailureRate", config.GlobalFailureRate},
+		{"globalFailureBurst", config.GlobalFailureBurst},
+	} {
+		if setting.value < 0 {
+			add("%s must not be negative, got %d", setting.name, setting.value)
+		}
+	}
+
+	if config.IdleRenewThreshold < 0 || config.IdleRenewThreshold > 100 {
+		add("idleRenewThreshold must be between 1 and 100, got %d", config.IdleRenewThreshold)
+	}
+
+	if config.SingleSession && config.MaxSessions > 0 {
+		add("singleSession and maxSessions cannot be combined (singleSession is maxSessions 1)")
+	}
+
+	if config.SubmitMinDelayMs > 0 && config.SubmitMaxAge > 0 && config.SubmitMinDelayMs >= config.SubmitMaxAge*1000 {
+		add("submitMinDelayMs (%dms) must be shorter than submitMaxAge (%ds)", config.SubmitMinDelayMs, config.SubmitMaxAge)
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+}
+
+// isCookieToken reports whether name is a valid cookie name (an RFC 7230
+// token)
+func isCookieToken(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r <= ' ' || r >= 0x7f || strings.ContainsRune("\"(),/:;<=>?@[\\]{}", r) {
+			return false
+		}
+	}
+	return true
+}
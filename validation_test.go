@@ -0,0 +1,55 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRedirectStatusKeepsLocation checks that redirectStatus only changes
+// the status of the redirect after a login, never its Location
+func TestRedirectStatusKeepsLocation(t *testing.T) {
+	targets := []struct {
+		next     string
+		location string
+	}{
+		{"/app", "/app"},
+		{"/app/page?x=1&y=%2F#frag", "/app/page?x=1&y=%2F#frag"},
+		{"/caf%C3%A9/", "/caf%C3%A9/"},
+		{"https://wiki.example/start?q=1", "https://wiki.example/start?q=1"},
+		{"//evil.example", "/"},
+	}
+
+	for _, status := range []int{http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect} {
+		ta := newTestAuth(t, func(config *Config) {
+			config.RedirectStatus = status
+			config.AllowedRedirectHosts = []string{"wiki.example"}
+			config.MaxSessionsPerIP = 100
+		})
+		for _, target := range targets {
+			form, csrf := loginForm(ta, currentCode(ta))
+			rec := httptest.NewRecorder()
+			ta.ServeHTTP(rec, newTestLogin(ta, target.next, form, csrf))
+
+			if rec.Code != status {
+				t.Errorf("redirectStatus %d, %s: status %d", status, target.next, rec.Code)
+			}
+			if location := rec.Header().Get("Location"); location != target.location {
+				t.Errorf("redirectStatus %d, %s: Location %q, want %q", status, target.next, location, target.location)
+			}
+		}
+	}
+}
+
+func TestRedirectStatusValidation(t *testing.T) {
+	for _, status := range []int{http.StatusMovedPermanently, http.StatusPermanentRedirect, http.StatusOK} {
+		config := CreateConfig()
+		config.SecretKey = testSecret
+		config.SkipSelfTest = true
+		config.RedirectStatus = status
+		if _, err := New(context.Background(), http.NotFoundHandler(), config, "test"); err == nil {
+			t.Errorf("redirectStatus %d accepted", status)
+		}
+	}
+}
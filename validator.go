@@ -0,0 +1,161 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Validation methods, recorded in sessions, logs and metrics
+const (
+	methodTOTP     = "totp"
+	methodVerifier = "verifier"
+	methodReadOnly = "read_only"
+	methodTestCode = "test_code"
+)
+
+// metricAuthMethodPrefix counts successful validations per method
+const metricAuthMethodPrefix = "auth.method."
+
+// validationIdentity describes what a code is validated for
+type validationIdentity struct {
+	account string
+	ip      string
+	area    string // pathSecrets prefix of the request, "" for the default area
+	secret  string // Secret of the area
+}
+
+// validationResult is the outcome of a single validator
+type validationResult struct {
+	Valid    bool
+	Method   string // Validation method, one of the method constants
+	Reason   string // Audit reason recorded for a successful login
+	ReadOnly bool   // The code only grants read-only access
+	Skew     int    // Time steps between the matched code and the current (drift-corrected) step
+	Secret   string // Which configured secret the code matched, for the logs ("" when not applicable)
+
+	// ReplayKey, when set, is marked as used until ReplayUntil before the
+	// result is accepted; a key that was already used rejects the code
+	ReplayKey   string
+	ReplayUntil time.Time
+}
+
+// validator checks a submitted code. Validators return an invalid result
+// for codes they don't recognize and an error only when they could not
+// decide; the chain then moves on to the next validator.
+type validator interface {
+	Validate(ctx context.Context, identity validationIdentity, code string) (validationResult, error)
+}
+
+// validatorFunc adapts a function to the validator interface
+type validatorFunc func(ctx context.Context, identity validationIdentity, code string) (validationResult, error)
+
+// Validate calls f
+func (f validatorFunc) Validate(ctx context.Context, identity validationIdentity, code string) (validationResult, error) {
+	return f(ctx, identity, code)
+}
+
+// buildValidators assembles the validator chain from the configuration. The
+// primary validator (local TOTP, HOTP or the external verifier) always comes
+// first.
+func (ta *TOTPAuth) buildValidators() []validator {
+	chain := []validator{validatorFunc(ta.validateTOTPCode)}
+	if ta.verifier != nil {
+		chain[0] = validatorFunc(ta.validateWithVerifier)
+	}
+	if ta.hotp != nil {
+		chain[0] = validatorFunc(ta.validateHOTPCode)
+	}
+	if ta.config.ReadOnlySecretKey != "" {
+		chain = append(chain, validatorFunc(ta.validateReadOnlyCode))
+	}
+	if ta.config.StaticTestCode != "" {
+		chain = append(chain, validatorFunc(ta.validateTestCode))
+	}
+	return chain
+}
+
+// validationIdentityFor returns the identity a code submitted with req is
+// validated for
+func (ta *TOTPAuth) validationIdentityFor(req *http.Request) validationIdentity {
+	area, secret := ta.areaFor(req.URL.Path)
+	return validationIdentity{
+		account: ta.config.AccountName,
+		ip:      ta.getClientIP(req),
+		area:    area,
+		secret:  secret,
+	}
+}
+
+// runValidators returns the first valid result of chain for code. Errors are
+// logged and the next validator is tried; a valid result whose replay key
+// was already used rejects the code.
+func (ta *TOTPAuth) runValidators(req *http.Request, code string, chain []validator) (validationResult, bool) {
+	identity := ta.validationIdentityFor(req)
+	for _, v := range chain {
+		result, err := v.Validate(req.Context(), identity, code)
+		if err != nil {
+			log.Printf("[%s] Code validation failed for %s: %v", ta.name, identity.ip, err)
+			continue
+		}
+		if !result.Valid {
+			continue
+		}
+
+		if result.ReplayKey != "" && !ta.usedCodes.use(result.ReplayKey, result.ReplayUntil) {
+			log.Printf("[%s] Replayed %s code from %s", ta.name, result.Method, identity.ip)
+			return validationResult{}, false
+		}
+		ta.incrMetric(metricAuthMethodPrefix + result.Method)
+		return result, true
+	}
+	return validationResult{}, false
+}
+
+// namedSecret is a secret codes are checked against, labelled for the logs
+type namedSecret struct {
+	label  string
+	secret string
+}
+
+// validateTOTPCode validates a code locally: pathSecrets areas against their
+// own secret, the default area against the current secret, during the
+// overlap after a rotation the previous one, and additionalSecretKeys, all
+// shifted by the calibrated drift
+func (ta *TOTPAuth) validateTOTPCode(ctx context.Context, identity validationIdentity, code string) (validationResult, error) {
+	if identity.area != "" {
+		skew, ok := ta.matchCode(identity.secret, code, 0, ta.tokenParams(identity.area))
+		return validationResult{Valid: ok, Method: methodTOTP, Reason: "valid_code", Skew: skew, Secret: "pathSecrets " + identity.area}, nil
+	}
+
+	current, previous := ta.secret.secrets(ta.clock.Now())
+	candidates := []namedSecret{{"secretKey", current}}
+	if previous != "" {
+		candidates = append(candidates, namedSecret{"previous secret", previous})
+	}
+	for i, secret := range ta.config.AdditionalSecretKeys {
+		candidates = append(candidates, namedSecret{fmt.Sprintf("additionalSecretKeys[%d]", i), secret})
+	}
+
+	drift := ta.drift.get()
+	params := ta.tokenParams("")
+	for _, candidate := range candidates {
+		if skew, ok := ta.matchCode(candidate.secret, code, drift, params); ok {
+			return validationResult{Valid: true, Method: methodTOTP, Reason: "valid_code", Skew: skew, Secret: candidate.label}, nil
+		}
+	}
+	return validationResult{}, nil
+}
+
+// validateReadOnlyCode validates a code from the read-only authenticator in
+// the default area. The calibrated drift belongs to the primary
+// authenticator and is not applied.
+func (ta *TOTPAuth) validateReadOnlyCode(ctx context.Context, identity validationIdentity, code string) (validationResult, error) {
+	if identity.area != "" {
+		return validationResult{}, nil
+	}
+	skew, ok := ta.matchCode(ta.config.ReadOnlySecretKey, code, 0, ta.tokenParams(""))
+	return validationResult{Valid: ok, Method: methodReadOnly, Reason: "read_only_code", ReadOnly: true, Skew: skew}, nil
+}
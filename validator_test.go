@@ -0,0 +1,153 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// fakeValidator returns a validator answering with result and err and
+// counting its calls in *calls
+func fakeValidator(result validationResult, err error, calls *int) validator {
+	return validatorFunc(func(ctx context.Context, identity validationIdentity, code string) (validationResult, error) {
+		*calls++
+		return result, err
+	})
+}
+
+func TestRunValidators(t *testing.T) {
+	invalid := validationResult{}
+	totp := validationResult{Valid: true, Method: methodTOTP, Reason: "valid_code"}
+	readOnly := validationResult{Valid: true, Method: methodReadOnly, Reason: "read_only_code", ReadOnly: true}
+	replayed := validationResult{Valid: true, Method: methodVerifier, ReplayKey: "nonce-1", ReplayUntil: time.Now().Add(time.Minute)}
+	failure := errors.New("verifier unreachable")
+
+	type step struct {
+		result validationResult
+		err    error
+	}
+	tests := []struct {
+		name       string
+		chain      []step
+		usedKeys   []string // Replay keys already used before the chain runs
+		wantValid  bool
+		wantMethod string
+		wantCalls  []int // Calls per validator
+		wantMetric string
+	}{
+		{
+			name:       "first match wins",
+			chain:      []step{{result: totp}, {result: readOnly}},
+			wantValid:  true,
+			wantMethod: methodTOTP,
+			wantCalls:  []int{1, 0},
+			wantMetric: metricAuthMethodPrefix + methodTOTP,
+		},
+		{
+			name:       "falls through invalid results",
+			chain:      []step{{result: invalid}, {result: readOnly}},
+			wantValid:  true,
+			wantMethod: methodReadOnly,
+			wantCalls:  []int{1, 1},
+			wantMetric: metricAuthMethodPrefix + methodReadOnly,
+		},
+		{
+			name:       "errors move on to the next validator",
+			chain:      []step{{err: failure}, {result: totp}},
+			wantValid:  true,
+			wantMethod: methodTOTP,
+			wantCalls:  []int{1, 1},
+			wantMetric: metricAuthMethodPrefix + methodTOTP,
+		},
+		{
+			name:      "an error with a valid result is not trusted",
+			chain:     []step{{result: totp, err: failure}, {result: invalid}},
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:      "nothing matches",
+			chain:     []step{{result: invalid}, {err: failure}},
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:       "fresh replay key is accepted",
+			chain:      []step{{result: replayed}},
+			wantValid:  true,
+			wantMethod: methodVerifier,
+			wantCalls:  []int{1},
+			wantMetric: metricAuthMethodPrefix + methodVerifier,
+		},
+		{
+			name:      "used replay key rejects the code",
+			chain:     []step{{result: replayed}, {result: totp}},
+			usedKeys:  []string{"nonce-1"},
+			wantCalls: []int{1, 0},
+		},
+		{
+			name:      "empty chain",
+			wantCalls: []int{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ta := newTestAuth(t, nil)
+			ta.statsd = &statsdEmitter{events: make(chan string, 16)}
+			for _, key := range tt.usedKeys {
+				ta.usedCodes.use(key, time.Now().Add(time.Minute))
+			}
+
+			calls := make([]int, len(tt.chain))
+			chain := make([]validator, len(tt.chain))
+			for i, s := range tt.chain {
+				chain[i] = fakeValidator(s.result, s.err, &calls[i])
+			}
+
+			result, valid := ta.runValidators(newTestRequest(http.MethodPost, "/"), "123456", chain)
+			if valid != tt.wantValid {
+				t.Fatalf("valid = %v, want %v", valid, tt.wantValid)
+			}
+			if result.Method != tt.wantMethod {
+				t.Errorf("method = %q, want %q", result.Method, tt.wantMethod)
+			}
+			for i, want := range tt.wantCalls {
+				if calls[i] != want {
+					t.Errorf("validator %d called %d times, want %d", i, calls[i], want)
+				}
+			}
+
+			var metrics []string
+			for len(ta.statsd.events) > 0 {
+				metrics = append(metrics, <-ta.statsd.events)
+			}
+			if tt.wantMetric == "" && len(metrics) > 0 {
+				t.Errorf("metrics = %v, want none", metrics)
+			}
+			if tt.wantMetric != "" && (len(metrics) != 1 || metrics[0] != tt.wantMetric) {
+				t.Errorf("metrics = %v, want [%s]", metrics, tt.wantMetric)
+			}
+		})
+	}
+}
+
+// TestRunValidatorsIdentity checks the identity handed to the validators
+func TestRunValidatorsIdentity(t *testing.T) {
+	ta := newTestAuth(t, func(config *Config) {
+		config.AccountName = "alice"
+		config.PathSecrets = map[string]string{"/admin": "GEZDGNBVGY3TQOJQ"}
+	})
+
+	var got validationIdentity
+	chain := []validator{validatorFunc(func(ctx context.Context, identity validationIdentity, code string) (validationResult, error) {
+		got = identity
+		return validationResult{}, nil
+	})}
+	ta.runValidators(newTestRequest(http.MethodPost, "/admin/users"), "123456", chain)
+
+	want := validationIdentity{account: "alice", ip: "192.0.2.1", area: "/admin", secret: "GEZDGNBVGY3TQOJQ"}
+	if got != want {
+		t.Fatalf("identity = %+v, want %+v", got, want)
+	}
+}
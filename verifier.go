@@ -0,0 +1,153 @@
+package traefik_totp_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Actions taken when the external verifier cannot be reached or fails
+const (
+	verifierOnErrorDeny  = "deny"
+	verifierOnErrorLocal = "local"
+	verifierOnErrorAllow = "allow"
+)
+
+// verifierNonceTTL is how long verifier nonces are remembered for replay checks
+const verifierNonceTTL = 10 * time.Minute
+
+// codeVerifier delegates code validation to an external service
+type codeVerifier struct {
+	endpoint string
+	token    string
+	onError  string
+	client   *http.Client
+}
+
+// verifierRequest is the JSON body sent to the verifier
+type verifierRequest struct {
+	Username string `json:"username"`
+	Code     string `json:"code"`
+	IP       string `json:"ip"`
+}
+
+// verifierResponse is the JSON answer expected from the verifier
+type verifierResponse struct {
+	Valid bool   `json:"valid"`
+	Nonce string `json:"nonce"`
+}
+
+// verifierStatusError is a non-200 answer from the verifier
+type verifierStatusError struct {
+	status int
+}
+
+func (e *verifierStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", e.status)
+}
+
+// definitive reports whether the verifier decided on the code, as opposed to
+// being unavailable: 4xx answers reject the code, 5xx answers are failures
+func (e *verifierStatusError) definitive() bool {
+	return e.status >= 400 && e.status < 500
+}
+
+// newCodeVerifier creates a verifier from the plugin configuration
+func newCodeVerifier(config *Config) (*codeVerifier, error) {
+	endpoint, err := url.Parse(config.VerifierURL)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid verifierURL: %s", config.VerifierURL)
+	}
+
+	onError := strings.ToLower(config.VerifierOnError)
+	if onError != verifierOnErrorDeny && onError != verifierOnErrorLocal && onError != verifierOnErrorAllow {
+		return nil, fmt.Errorf("invalid verifierOnError (must be %q, %q or %q): %s", verifierOnErrorDeny, verifierOnErrorLocal, verifierOnErrorAllow, config.VerifierOnError)
+	}
+
+	return &codeVerifier{
+		endpoint: config.VerifierURL,
+		token:    config.VerifierToken,
+		onError:  onError,
+		client:   &http.Client{Timeout: time.Duration(config.VerifierTimeoutMs) * time.Millisecond},
+	}, nil
+}
+
+// verify asks the verifier whether code is valid for username
+func (cv *codeVerifier) verify(ctx context.Context, username, code, ip string) (verifierResponse, error) {
+	var result verifierResponse
+
+	body, err := json.Marshal(verifierRequest{Username: username, Code: code, IP: ip})
+	if err != nil {
+		return result, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cv.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if cv.token != "" {
+		req.Header.Set("Authorization", "Bearer "+cv.token)
+	}
+
+	resp, err := cv.client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return result, &verifierStatusError{status: resp.StatusCode}
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&result); err != nil {
+		return result, fmt.Errorf("invalid response: %w", err)
+	}
+	return result, nil
+}
+
+// validateWithVerifier validates a default-area code with the external
+// verifier; pathSecrets areas are always validated locally
+func (ta *TOTPAuth) validateWithVerifier(ctx context.Context, identity validationIdentity, code string) (validationResult, error) {
+	if identity.area != "" {
+		return ta.validateTOTPCode(ctx, identity, code)
+	}
+
+	response, err := ta.verifier.verify(ctx, identity.account, code, identity.ip)
+	var statusErr *verifierStatusError
+	if errors.As(err, &statusErr) && statusErr.definitive() {
+		// A 4xx is the verifier's answer, never a reason to fail open
+		if statusErr.status == http.StatusUnauthorized || statusErr.status == http.StatusForbidden {
+			log.Printf("[%s] Verifier refused our credentials (status %d), check verifierToken; rejecting code", ta.name, statusErr.status)
+		}
+		return validationResult{Method: methodVerifier, Reason: "invalid_code"}, nil
+	}
+	if err != nil {
+		switch ta.verifier.onError {
+		case verifierOnErrorAllow:
+			log.Printf("[%s] Verifier failed for %s, accepting code (verifierOnError=allow): %v", ta.name, identity.ip, err)
+			return validationResult{Valid: true, Method: methodVerifier, Reason: "valid_code"}, nil
+		case verifierOnErrorLocal:
+			log.Printf("[%s] Verifier failed for %s, validating locally: %v", ta.name, identity.ip, err)
+			return ta.validateTOTPCode(ctx, identity, code)
+		default:
+			return validationResult{}, fmt.Errorf("verifier failed, rejecting code: %w", err)
+		}
+	}
+
+	result := validationResult{Valid: response.Valid, Method: methodVerifier, Reason: "valid_code"}
+	// The verifier's nonce identifies the accepted code; seeing it twice is a replay
+	if response.Nonce != "" {
+		result.ReplayKey = "verifier:" + response.Nonce
+		result.ReplayUntil = ta.clock.Now().Add(verifierNonceTTL)
+	}
+	return result, nil
+}
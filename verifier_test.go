@@ -0,0 +1,59 @@
+package traefik_totp_plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestVerifierStatusHandling checks that verifierOnError only applies when
+// the verifier is unavailable, and that 4xx answers always reject the code
+func TestVerifierStatusHandling(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int // 0 closes the connection without an answer
+		onError   string
+		wantValid bool
+	}{
+		{name: "400 with allow", status: http.StatusBadRequest, onError: verifierOnErrorAllow},
+		{name: "401 with allow", status: http.StatusUnauthorized, onError: verifierOnErrorAllow},
+		{name: "403 with local", status: http.StatusForbidden, onError: verifierOnErrorLocal},
+		{name: "404 with local", status: http.StatusNotFound, onError: verifierOnErrorLocal},
+		{name: "429 with allow", status: http.StatusTooManyRequests, onError: verifierOnErrorAllow},
+		{name: "500 with deny", status: http.StatusInternalServerError, onError: verifierOnErrorDeny},
+		{name: "500 with allow", status: http.StatusInternalServerError, onError: verifierOnErrorAllow, wantValid: true},
+		{name: "503 with local", status: http.StatusServiceUnavailable, onError: verifierOnErrorLocal, wantValid: true},
+		{name: "unreachable with local", onError: verifierOnErrorLocal, wantValid: true},
+		{name: "unreachable with deny", onError: verifierOnErrorDeny},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if tt.status == 0 {
+					conn, _, err := rw.(http.Hijacker).Hijack()
+					if err == nil {
+						conn.Close()
+					}
+					return
+				}
+				rw.WriteHeader(tt.status)
+			}))
+			defer verifier.Close()
+
+			ta := newTestAuth(t, func(config *Config) {
+				config.VerifierURL = verifier.URL
+				config.VerifierOnError = tt.onError
+			})
+
+			// The local code is valid, so fall-backs to local validation succeed
+			code := currentCode(ta)
+			identity := validationIdentity{account: ta.config.AccountName, ip: "192.0.2.1"}
+			result, err := ta.validateWithVerifier(context.Background(), identity, code)
+			if result.Valid != tt.wantValid {
+				t.Fatalf("valid = %v (err %v), want %v", result.Valid, err, tt.wantValid)
+			}
+		})
+	}
+}
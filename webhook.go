@@ -0,0 +1,96 @@
+package traefik_totp_plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Webhook event names
+const (
+	webhookConcurrentLogin = "concurrent_login"
+)
+
+// webhookEvent is the JSON payload POSTed to the webhook URL
+type webhookEvent struct {
+	Event     string      `json:"event"`
+	Plugin    string      `json:"plugin"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data,omitempty"`
+}
+
+// webhookNotifier delivers events to the configured webhook off the request
+// path; events are dropped when the queue is full
+type webhookNotifier struct {
+	name   string
+	url    string
+	client *http.Client
+	events chan webhookEvent
+}
+
+// newWebhookNotifier creates a notifier for the configured webhook URL
+func newWebhookNotifier(config *Config, name string) *webhookNotifier {
+	return &webhookNotifier{
+		name:   name,
+		url:    config.WebhookURL,
+		client: &http.Client{Timeout: 5 * time.Second},
+		events: make(chan webhookEvent, 100),
+	}
+}
+
+// notify queues an event for delivery
+func (wn *webhookNotifier) notify(event string, data interface{}) {
+	select {
+	case wn.events <- webhookEvent{Event: event, Plugin: wn.name, Timestamp: time.Now().UTC(), Data: data}:
+	default:
+		log.Printf("[%s] Webhook queue full, dropping %s event", wn.name, event)
+	}
+}
+
+// run delivers queued events until ctx is done
+func (wn *webhookNotifier) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-wn.events:
+			wn.deliver(ctx, event)
+		}
+	}
+}
+
+// deliver POSTs a single event, logging failures
+func (wn *webhookNotifier) deliver(ctx context.Context, event webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[%s] Failed to create webhook request: %v", wn.name, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		log.Printf("[%s] Failed to deliver %s webhook: %v", wn.name, event.Event, err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		log.Printf("[%s] Webhook for %s returned status %d", wn.name, event.Event, resp.StatusCode)
+	}
+}
+
+// notifyWebhook sends an event to the webhook when one is configured
+func (ta *TOTPAuth) notifyWebhook(event string, data interface{}) {
+	if ta.webhook != nil {
+		ta.webhook.notify(event, data)
+	}
+}